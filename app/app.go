@@ -0,0 +1,249 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/config"
+	"gateway/proxy/auth"
+	"gateway/proxy/auth/apikey"
+	"gateway/proxy/auth/signature"
+	"gateway/proxy/clientip"
+	"gateway/proxy/fault"
+	"gateway/proxy/tcp_proxy/server"
+	"gateway/proxy/upgrade"
+	"gateway/proxy/waf"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// App 按配置组装并运行整个网关：HTTP反向代理、TCP代理、WebSocket代理和正向代理
+// cmd/gateway的各个子命令都是先得到一个config.Config，再交给App运行
+
+// App 一个网关进程
+type App struct {
+	Config *config.Config
+	//Listen 取得监听，为nil时按监听选项直接创建，见server.ListenConfig.Inherit
+	//cmd/gateway run传入upgrade.Upgrader.ListenWith，这样热升级时监听socket可以交给新进程
+	Listen func(network, addr string, create func(network, addr string) (net.Listener, error)) (net.Listener, error)
+	//Logger 为nil时使用log包默认的Logger
+	Logger *log.Logger
+
+	faults *fault.Injector
+	//jwt 按名字索引的JWT认证提供方
+	jwt map[string]*auth.JWTAuth
+	//oidc、introspection 按名字索引的OIDC依赖方和令牌自省
+	oidc          map[string]*auth.RelyingParty
+	introspection map[string]*auth.IntrospectionAuth
+	//apikeys API密钥校验，没有配置时为nil
+	apikeys *apikey.Auth
+	//hmac、resign 按名字索引的签名校验和转发给上游时的重新签名
+	hmac   map[string]*signature.Auth
+	resign map[string]*signature.Signer
+	//clientIP 真实客户端IP的解析，没有配置时为nil
+	clientIP *clientip.Resolver
+	//waf 请求检查引擎，没有配置时为nil
+	waf *waf.Engine
+	//background 后台任务，比如写回API密钥的用量、重新加载IP规则文件，Start时启动
+	background []func(stop <-chan struct{})
+	//stop Shutdown时关闭，通知后台任务退出
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	services []*service
+	started  bool
+	closing  int32
+}
+
+// service 一个监听及其上面的服务
+type service struct {
+	name     string
+	addr     string
+	listen   server.ListenConfig
+	nagle    bool //关闭TCP_NODELAY
+	serve    func(ln net.Listener) error
+	shutdown func(ctx context.Context) error
+	//lns 开启reuse_port时有多个，每个都有自己的Accept循环
+	lns []net.Listener
+}
+
+// New 检查配置并创建所有的处理器，还不会监听端口
+func New(cfg *config.Config) (*App, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	a := &App{Config: cfg, faults: fault.NewInjector(), stop: make(chan struct{})}
+	a.faults.LabMode = cfg.LabMode
+	if c := cfg.ClientIP; c != nil {
+		res, err := clientip.NewResolver(c.TrustedProxies, c.Header)
+		if err != nil {
+			return nil, fmt.Errorf("client_ip: %w", err)
+		}
+		a.clientIP = res
+	}
+	if err := a.buildAuth(cfg.Auth); err != nil {
+		return nil, err
+	}
+	if err := a.buildWAF(cfg.WAF); err != nil {
+		return nil, err
+	}
+	for _, l := range cfg.HTTP {
+		s, err := a.buildHTTP(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.Name, err)
+		}
+		a.services = append(a.services, s)
+	}
+	for _, l := range cfg.TCP {
+		s, err := a.buildTCP(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.Name, err)
+		}
+		a.services = append(a.services, s)
+	}
+	for _, l := range cfg.WebSocket {
+		s, err := a.buildWebSocket(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", l.Name, err)
+		}
+		a.services = append(a.services, s)
+	}
+	for _, l := range cfg.Forward {
+		a.services = append(a.services, a.buildForward(l))
+	}
+	//管理接口放在最后，这时所有的路由和监听都已经在故障注入中注册过
+	if cfg.Admin != nil {
+		a.services = append(a.services, a.buildAdmin(*cfg.Admin))
+	}
+	return a, nil
+}
+
+// APIKeys 返回API密钥的存储，没有配置auth.api_keys时返回nil
+func (a *App) APIKeys() *apikey.Store {
+	if a.apikeys == nil {
+		return nil
+	}
+	return a.apikeys.Store
+}
+
+// Faults 返回故障注入的注册表，没有开启管理接口时也可以用它修改故障
+func (a *App) Faults() *fault.Injector {
+	return a.faults
+}
+
+func (a *App) logger() *log.Logger {
+	if a.Logger != nil {
+		return a.Logger
+	}
+	return log.Default()
+}
+
+// Start 监听所有地址并在后台提供服务，任何一个监听失败时关闭已经打开的监听并返回错误
+func (a *App) Start() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.started {
+		return errors.New("app: already started")
+	}
+	for i, s := range a.services {
+		lc := s.listen
+		lc.Inherit = a.Listen
+		lns, err := lc.Listen(s.addr)
+		if err != nil {
+			for _, opened := range a.services[:i] {
+				for _, ln := range opened.lns {
+					ln.Close()
+				}
+			}
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+		if s.nagle {
+			for j, ln := range lns {
+				lns[j] = server.NagleListener(ln)
+			}
+		}
+		s.lns = lns
+	}
+	for _, s := range a.services {
+		for _, ln := range s.lns {
+			go func(s *service, ln net.Listener) {
+				err := s.serve(ln)
+				//关闭时Serve返回的错误是预期的，热升级时监听会被提前关闭
+				if err != nil && atomic.LoadInt32(&a.closing) == 0 &&
+					!errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+					a.logger().Printf("gateway: %s stopped: %v", s.name, err)
+				}
+			}(s, ln)
+		}
+	}
+	for _, run := range a.background {
+		go run(a.stop)
+	}
+	a.started = true
+	return nil
+}
+
+// Addr 返回监听的实际地址，配置中端口写0时可以用它拿到随机端口，没有这个名字时返回nil
+func (a *App) Addr(name string) net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range a.services {
+		if s.name == name && len(s.lns) > 0 {
+			return s.lns[0].Addr()
+		}
+	}
+	return nil
+}
+
+// Listeners 返回所有监听名和实际地址
+func (a *App) Listeners() map[string]net.Addr {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	addrs := make(map[string]net.Addr, len(a.services))
+	for _, s := range a.services {
+		if len(s.lns) > 0 {
+			addrs[s.name] = s.lns[0].Addr()
+		}
+	}
+	return addrs
+}
+
+// Shutdown 同时关闭所有服务：停止接收新连接，等已有的连接处理完，ctx到期后返回
+func (a *App) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&a.closing, 1)
+	a.mu.Lock()
+	services := append([]*service(nil), a.services...)
+	a.mu.Unlock()
+
+	errs := make([]error, len(services))
+	var wg sync.WaitGroup
+	for i, s := range services {
+		wg.Add(1)
+		go func(i int, s *service) {
+			defer wg.Done()
+			if err := s.shutdown(ctx); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", s.name, err)
+			}
+		}(i, s)
+	}
+	wg.Wait()
+
+	//所有请求处理完之后再写一次用量，后台任务收到stop也会写，没有新用量时不会重复写文件
+	a.stopOnce.Do(func() { close(a.stop) })
+	if a.apikeys != nil {
+		if err := a.apikeys.Store.Flush(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// httpServer 创建http.Server，关闭函数见upgrade.GracefulShutdown
+func httpServer(handler http.Handler) (*http.Server, func(ctx context.Context) error) {
+	srv := &http.Server{Handler: handler}
+	return srv, upgrade.GracefulShutdown(srv)
+}
@@ -0,0 +1,555 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"gateway/config"
+	"gateway/proxy/auth"
+	"gateway/proxy/auth/apikey"
+	"gateway/proxy/auth/signature"
+	"gateway/proxy/clientip"
+	"gateway/proxy/http_proxy/forwardproxy"
+	"gateway/proxy/http_proxy/reverseproxy"
+	"gateway/proxy/http_proxy/wsproxy"
+	"gateway/proxy/proxyproto"
+	"gateway/proxy/ratelimit"
+	"gateway/proxy/tcp_proxy/proxy"
+	"gateway/proxy/tcp_proxy/server"
+	"gateway/proxy/waf"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"time"
+)
+
+// 把配置转换成各个代理的结构体，配置已经在New中检查过，这里的解析不会出错，出错也只是兜底
+
+func (a *App) buildHTTP(l config.HTTPListener) (*service, error) {
+	router := reverseproxy.NewRouter()
+	for _, rc := range l.Routes {
+		route, err := buildRoute(rc)
+		if err != nil {
+			return nil, err
+		}
+		if rc.Auth != nil && rc.Auth.HMAC != "" {
+			if signer := a.resign[rc.Auth.HMAC]; signer != nil {
+				route.Transport = signer.Transport(reverseproxy.Transport)
+			}
+		}
+		//请求的处理顺序：客户端IP → IP过滤（先监听器、后路由）→ 请求检查 → 认证 → 故障注入 → 反向代理
+		//前面拒绝的请求不会触发登录跳转、消耗API密钥的配额或触发故障，中止的请求不会到达上游
+		key := l.Name + "/" + rc.Name
+		al, err := a.accessList(rc.IPFilter, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%s: ip_filter: %w", rc.Name, err)
+		}
+		h := a.withAuth(key, rc.Auth, a.faults.HTTP(key, reverseproxy.NewRouteProxy(route)))
+		if rc.WAF != "" {
+			set := a.waf.Sets[rc.WAF]
+			if set == nil {
+				return nil, fmt.Errorf("%s: unknown waf rule set %q in %s", rc.Name, rc.WAF, a.Config.WAF.RulesFile)
+			}
+			h = a.waf.Middleware(key, set, h)
+		}
+		router.Handle(route, withAccessList(al, h))
+		if rc.Fault != nil {
+			if err := a.faults.SetHTTP(key, rc.Fault); err != nil {
+				return nil, err
+			}
+		}
+	}
+	al, err := a.accessList(l.IPFilter, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ip_filter: %w", err)
+	}
+	pp, err := proxyProtocolConfig(l.ProxyProtocol, l.ProxyProtocolTrustedCIDRs, l.ProxyProtocolRequired, l.ProxyProtocolHeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	srv, shutdown := httpServer(a.withClientIP(withAccessList(al, router)))
+	srv.ErrorLog = a.Logger
+	return &service{
+		name:   l.Name,
+		addr:   l.Addr,
+		listen: listenConfig(l.ListenOptions),
+		nagle:  l.DisableNoDelay,
+		serve: func(ln net.Listener) error {
+			if pp != nil {
+				ln = &proxyproto.Listener{Listener: ln, Config: pp}
+			}
+			return srv.Serve(ln)
+		},
+		shutdown: shutdown,
+	}, nil
+}
+
+// proxyProtocolConfig 没有开启PROXY协议时返回nil
+func proxyProtocolConfig(on bool, trusted []string, required bool, timeout config.Duration) (*proxyproto.Config, error) {
+	if !on {
+		return nil, nil
+	}
+	nets, err := proxyproto.ParseCIDRs(trusted)
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol_trusted_cidrs: %w", err)
+	}
+	return &proxyproto.Config{TrustedCIDRs: nets, Required: required, HeaderTimeout: time.Duration(timeout)}, nil
+}
+
+func buildRoute(rc config.Route) (*reverseproxy.Route, error) {
+	route := &reverseproxy.Route{
+		Name:        rc.Name,
+		PathPrefix:  rc.PathPrefix,
+		StripPrefix: rc.StripPrefix,
+		HostPolicy:  rc.HostPolicy,
+	}
+	for _, t := range rc.Targets {
+		u, err := url.Parse(t)
+		if err != nil {
+			return nil, err
+		}
+		route.Targets = append(route.Targets, u)
+	}
+	if len(route.Targets) == 1 {
+		route.Target, route.Targets = route.Targets[0], nil
+	}
+	//改写的顺序见config.Route
+	if p := rc.PathRewrite; p != nil {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		route.RequestTransformers = append(route.RequestTransformers, &reverseproxy.PathRewrite{Pattern: re, Replacement: p.Replacement})
+	}
+	if q := rc.RequestQuery; q != nil {
+		route.RequestTransformers = append(route.RequestTransformers,
+			&reverseproxy.QueryTransformer{Set: q.Set, Add: q.Add, Remove: q.Remove})
+	}
+	if m := rc.MethodOverride; m != nil {
+		route.RequestTransformers = append(route.RequestTransformers,
+			&reverseproxy.MethodOverride{Method: m.Method, Header: m.Header, Allowed: m.Allowed})
+	}
+	if h := rc.RequestHeaders; h != nil {
+		route.RequestTransformers = append(route.RequestTransformers,
+			&reverseproxy.RequestHeaderTransformer{Set: h.Set, Add: h.Add, Remove: h.Remove})
+	}
+	if j := rc.RequestJSON; j != nil {
+		route.RequestTransformers = append(route.RequestTransformers,
+			&reverseproxy.JSONBodyFields{Add: j.Add, MaxBodySize: j.MaxBodySize})
+	}
+
+	if len(rc.StatusRemap) > 0 {
+		route.ResponseTransformers = append(route.ResponseTransformers, reverseproxy.StatusRemap(rc.StatusRemap))
+	}
+	if h := rc.ResponseHeaders; h != nil {
+		route.ResponseTransformers = append(route.ResponseTransformers,
+			&reverseproxy.HeaderTransformer{Set: h.Set, Add: h.Add, Remove: h.Remove})
+	}
+	for _, b := range rc.BodyReplace {
+		re, err := regexp.Compile(b.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		route.ResponseTransformers = append(route.ResponseTransformers, &reverseproxy.RegexReplace{
+			Pattern: re, Replacement: b.Replacement, ContentTypes: b.ContentTypes, MaxBodySize: b.MaxBodySize})
+	}
+	if j := rc.ResponseJSON; j != nil {
+		route.ResponseTransformers = append(route.ResponseTransformers, &reverseproxy.JSONFields{
+			Add: j.Add, Remove: j.Remove, Mask: j.Mask, MaskWith: j.MaskWith, MaxBodySize: j.MaxBodySize})
+	}
+	if h := rc.HTMLInject; h != nil {
+		route.ResponseTransformers = append(route.ResponseTransformers, &reverseproxy.HTMLInject{Before: h.Before, Content: h.Content})
+	}
+	if r := rc.Retry; r != nil {
+		route.Retry = &reverseproxy.RetryPolicy{
+			Attempts:           r.Attempts,
+			RetryOn:            r.RetryOn,
+			RetryNonIdempotent: r.RetryNonIdempotent,
+			BackoffBase:        time.Duration(r.BackoffBase),
+			BackoffMax:         time.Duration(r.BackoffMax),
+		}
+	}
+	return route, nil
+}
+
+func (a *App) buildTCP(l config.TCPListener) (*service, error) {
+	py := proxy.NewMultiTCPReverseProxy(l.Upstreams)
+	if l.DialTimeout > 0 {
+		py.DialTimeout = time.Duration(l.DialTimeout)
+	}
+	if l.ConnectBudget > 0 {
+		py.ConnectBudget = time.Duration(l.ConnectBudget)
+	}
+	py.IdleTimeout = time.Duration(l.IdleTimeout)
+	py.MaxConnectionAge = time.Duration(l.MaxConnectionAge)
+	py.ProxyProtocolVersion = l.ProxyProtocolVersion
+	name := l.Name
+	py.OnError = func(ctx context.Context, src net.Conn, err *proxy.ProxyError) {
+		a.logger().Printf("gateway: %s: %v from %v", name, err, src.RemoteAddr())
+	}
+
+	//IP过滤由TCPServer在交给处理器之前完成，被拒绝的连接不会经过下面的中间件
+	//中间件：panic兜底在最外层，然后是日志、限流，最里面是故障注入
+	al, err := a.accessList(l.IPFilter, l.Allow, l.Deny)
+	if err != nil {
+		return nil, err
+	}
+	middlewares := []server.Middleware{server.Recover()}
+	if l.LogConnections {
+		middlewares = append(middlewares, server.Logging(a.Logger))
+	}
+	if l.ConnRate > 0 {
+		burst := l.ConnBurst
+		if burst <= 0 {
+			burst = int(l.ConnRate)
+		}
+		middlewares = append(middlewares, server.RateLimit(ratelimit.NewLimiter(l.ConnRate, burst)))
+	}
+	middlewares = append(middlewares, a.faults.TCP(l.Name))
+	if l.Fault != nil {
+		if err := a.faults.SetTCP(l.Name, l.Fault); err != nil {
+			return nil, err
+		}
+	}
+
+	pp, err := proxyProtocolConfig(l.ProxyProtocol, l.ProxyProtocolTrustedCIDRs, l.ProxyProtocolRequired, l.ProxyProtocolHeaderTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ts := &server.TCPServer{
+		Handler:             server.Chain(py, middlewares...),
+		IdleTimeout:         time.Duration(l.IdleTimeout),
+		MaxConnectionAge:    time.Duration(l.MaxConnectionAge),
+		ProxyProtocol:       pp != nil,
+		ProxyProtocolConfig: pp,
+		AccessList:          al,
+	}
+	return &service{name: l.Name, addr: l.Addr, listen: listenConfig(l.ListenOptions), nagle: l.DisableNoDelay,
+		serve: ts.Serve, shutdown: ts.Shutdown}, nil
+}
+
+func (a *App) buildWebSocket(l config.WebSocketListener) (*service, error) {
+	target, err := url.Parse(l.Target)
+	if err != nil {
+		return nil, err
+	}
+	wp := wsproxy.NewWebSocketProxy(target)
+	wp.MaxMessageSize = l.MaxMessageSize
+	wp.MessageRate = l.MessageRate
+	wp.MessageBurst = l.MessageBurst
+	wp.IdleTimeout = time.Duration(l.IdleTimeout)
+	wp.PingInterval = time.Duration(l.PingInterval)
+	wp.DrainTimeout = time.Duration(l.DrainTimeout)
+	wp.LogMessages = l.LogMessages
+	wp.ErrorLog = a.Logger
+	if len(l.AllowedOrigins) > 0 || len(l.Subprotocols) > 0 || len(l.Tokens) > 0 || l.MaxSessionsPerUser > 0 {
+		wp.Policy = &wsproxy.Policy{
+			AllowedOrigins:     l.AllowedOrigins,
+			AllowMissingOrigin: l.AllowMissingOrigin,
+			Subprotocols:       l.Subprotocols,
+			MaxSessionsPerUser: l.MaxSessionsPerUser,
+		}
+		if len(l.Tokens) > 0 {
+			wp.Policy.Auth = &wsproxy.TokenAuth{Header: "Authorization", Query: "token", Cookie: "token", Tokens: l.Tokens}
+		}
+	}
+	//JWT和令牌自省在握手之前由中间件完成，会话数按令牌中的sub计数，只用API密钥时按密钥ID计数
+	if l.Auth != nil && (l.Auth.JWT != "" || l.Auth.Introspection != "") && wp.Policy != nil {
+		wp.Policy.Auth = wsproxy.AuthenticatorFunc(func(r *http.Request) (string, error) {
+			return auth.ClaimsFromContext(r.Context()).Subject(), nil
+		})
+	} else if l.Auth != nil && l.Auth.APIKey && wp.Policy != nil {
+		wp.Policy.Auth = wsproxy.AuthenticatorFunc(func(r *http.Request) (string, error) {
+			return apikey.KeyIDFromContext(r.Context()), nil
+		})
+	}
+
+	al, err := a.accessList(l.IPFilter, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ip_filter: %w", err)
+	}
+	srv, shutdown := httpServer(a.withClientIP(withAccessList(al, a.withAuth(l.Name, l.Auth, wp))))
+	srv.ErrorLog = a.Logger
+	return &service{
+		name:   l.Name,
+		addr:   l.Addr,
+		listen: listenConfig(l.ListenOptions),
+		nagle:  l.DisableNoDelay,
+		serve:  srv.Serve,
+		//http.Server.Shutdown不管被劫持的连接，WebSocket会话由代理自己发送1001关闭
+		shutdown: func(ctx context.Context) error {
+			err := shutdown(ctx)
+			wp.Shutdown(ctx)
+			return err
+		},
+	}, nil
+}
+
+func (a *App) buildForward(l config.ForwardListener) *service {
+	fp := &forwardproxy.Proxy{}
+	if l.LogRequests {
+		fp.Logger = a.logger()
+	}
+	srv, shutdown := httpServer(fp)
+	srv.ErrorLog = a.Logger
+	return &service{name: l.Name, addr: l.Addr, listen: listenConfig(l.ListenOptions), nagle: l.DisableNoDelay,
+		serve: srv.Serve, shutdown: shutdown}
+}
+
+// listenConfig 转换监听选项，unix_socket_mode已经在Validate中检查过
+func listenConfig(o config.ListenOptions) server.ListenConfig {
+	mode, _ := o.FileMode()
+	return server.ListenConfig{
+		Network:        o.Network,
+		IPv6Only:       o.IPv6Only,
+		ReusePort:      o.ReusePort,
+		Backlog:        o.Backlog,
+		UnixSocketMode: mode,
+	}
+}
+
+// buildAdmin 管理接口：/listeners列出监听的实际地址，/faults修改故障注入，/apikeys管理API密钥
+func (a *App) buildAdmin(l config.AdminListener) *service {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/listeners", func(w http.ResponseWriter, r *http.Request) {
+		addrs := make(map[string]string)
+		for name, addr := range a.Listeners() {
+			addrs[name] = addr.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(addrs)
+	})
+	mux.Handle("/faults", http.StripPrefix("/faults", a.faults))
+	mux.Handle("/faults/", http.StripPrefix("/faults", a.faults))
+	if a.apikeys != nil {
+		mux.Handle("/apikeys", http.StripPrefix("/apikeys", a.apikeys.Store))
+		mux.Handle("/apikeys/", http.StripPrefix("/apikeys", a.apikeys.Store))
+	}
+
+	var h http.Handler = mux
+	if l.Token != "" {
+		h = adminAuth(l.Token, mux)
+	}
+	srv, shutdown := httpServer(h)
+	srv.ErrorLog = a.Logger
+	return &service{name: l.Name, addr: l.Addr, serve: srv.Serve, shutdown: shutdown}
+}
+
+// adminAuth 管理接口的所有请求都要带正确的Bearer令牌
+func adminAuth(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// buildAuth 创建认证提供方，PEM文件和API密钥文件在这里读取
+func (a *App) buildAuth(ac *config.AuthConfig) error {
+	a.jwt = make(map[string]*auth.JWTAuth)
+	if ac == nil {
+		return nil
+	}
+	if k := ac.APIKeys; k != nil {
+		store, err := apikey.Open(k.File)
+		if err != nil {
+			return fmt.Errorf("auth.api_keys: %w", err)
+		}
+		store.FlushInterval = time.Duration(k.FlushInterval)
+		a.apikeys = &apikey.Auth{Store: store, Header: k.Header, Query: k.Query, IDHeader: k.IDHeader}
+		//用量定期写回文件
+		a.background = append(a.background, store.Run)
+	}
+	a.oidc = make(map[string]*auth.RelyingParty)
+	for _, p := range ac.OIDC {
+		a.oidc[p.Name] = &auth.RelyingParty{
+			Issuer:                p.Issuer,
+			ClientID:              p.ClientID,
+			ClientSecret:          p.ClientSecret,
+			RedirectURL:           p.RedirectURL,
+			Scopes:                p.Scopes,
+			LogoutPath:            p.LogoutPath,
+			PostLogoutRedirectURL: p.PostLogoutRedirectURL,
+			CookieName:            p.CookieName,
+			SessionTTL:            time.Duration(p.SessionTTL),
+			ClaimHeaders:          p.ClaimHeaders,
+			ForwardAccessToken:    p.ForwardAccessToken,
+		}
+	}
+	a.introspection = make(map[string]*auth.IntrospectionAuth)
+	for _, p := range ac.Introspection {
+		a.introspection[p.Name] = &auth.IntrospectionAuth{
+			Introspector: &auth.Introspector{
+				URL:              p.URL,
+				ClientID:         p.ClientID,
+				ClientSecret:     p.ClientSecret,
+				CacheTTL:         time.Duration(p.CacheTTL),
+				NegativeCacheTTL: time.Duration(p.NegativeCacheTTL),
+			},
+			Scopes:       p.Scopes,
+			Cookie:       p.Cookie,
+			Query:        p.Query,
+			ClaimHeaders: p.ClaimHeaders,
+		}
+	}
+	a.hmac = make(map[string]*signature.Auth)
+	a.resign = make(map[string]*signature.Signer)
+	for _, p := range ac.HMAC {
+		v := &signature.Verifier{
+			Headers:     p.SignedHeaders,
+			Window:      time.Duration(p.Window),
+			MaxBodySize: p.MaxBodySize,
+		}
+		for _, s := range p.Secrets {
+			v.Secrets = append(v.Secrets, signature.Secret{ID: s.ID, Key: []byte(s.Secret)})
+		}
+		a.hmac[p.Name] = &signature.Auth{Verifier: v, Logger: a.Logger}
+		if r := p.Resign; r != nil {
+			a.resign[p.Name] = &signature.Signer{
+				Secret:      signature.Secret{ID: r.ID, Key: []byte(r.Secret)},
+				Headers:     r.SignedHeaders,
+				MaxBodySize: p.MaxBodySize,
+			}
+		}
+	}
+	for _, p := range ac.JWT {
+		var sources auth.KeySources
+		if p.JWKSURL != "" {
+			jwks := auth.NewJWKS(p.JWKSURL)
+			jwks.RefreshInterval = time.Duration(p.JWKSRefresh)
+			sources = append(sources, jwks)
+		}
+		var static auth.StaticKeys
+		for _, f := range p.PublicKeyFiles {
+			key, err := auth.LoadPublicKeyPEM(f)
+			if err != nil {
+				return fmt.Errorf("auth.jwt %s: %w", p.Name, err)
+			}
+			static = append(static, auth.Key{Key: key})
+		}
+		if p.HMACSecret != "" {
+			static = append(static, auth.Key{Key: []byte(p.HMACSecret)})
+		}
+		if len(static) > 0 {
+			sources = append(sources, static)
+		}
+		a.jwt[p.Name] = &auth.JWTAuth{
+			Verifier: &auth.Verifier{
+				Keys:       sources,
+				Algorithms: p.Algorithms,
+				Issuer:     p.Issuer,
+				Audience:   p.Audience,
+				ClockSkew:  time.Duration(p.ClockSkew),
+				RequireExp: p.RequireExp,
+			},
+			Cookie:       p.Cookie,
+			Query:        p.Query,
+			ClaimHeaders: p.ClaimHeaders,
+		}
+	}
+	return nil
+}
+
+// buildWAF 读取请求检查的规则文件和拦截页面
+func (a *App) buildWAF(wc *config.WAFConfig) error {
+	if wc == nil {
+		return nil
+	}
+	sets, err := waf.LoadRules(wc.RulesFile)
+	if err != nil {
+		return fmt.Errorf("waf: %w", err)
+	}
+	a.waf = waf.NewEngine(sets)
+	a.waf.MaxBodySize = wc.MaxBodySize
+	a.waf.Logger = a.Logger
+	if p := wc.ErrorPage; p != nil {
+		a.waf.ErrorPage = waf.ErrorPage{Status: p.Status, ContentType: p.ContentType, Body: p.Body}
+		if p.File != "" {
+			body, err := os.ReadFile(p.File)
+			if err != nil {
+				return fmt.Errorf("waf: error_page: %w", err)
+			}
+			a.waf.ErrorPage.Body = string(body)
+		}
+	}
+	return nil
+}
+
+// accessList 按配置创建访问列表，没有任何规则时返回nil
+// 有规则文件时登记一个后台任务，文件修改后自动重新加载
+func (a *App) accessList(f *config.IPFilter, allow, deny []string) (*clientip.AccessList, error) {
+	var file string
+	var interval time.Duration
+	if f != nil {
+		allow = append(append([]string(nil), allow...), f.Allow...)
+		deny = append(append([]string(nil), deny...), f.Deny...)
+		file, interval = f.File, time.Duration(f.ReloadInterval)
+	}
+	if len(allow) == 0 && len(deny) == 0 && file == "" {
+		return nil, nil
+	}
+	al, err := clientip.NewAccessList(allow, deny, file)
+	if err != nil {
+		return nil, err
+	}
+	if file != "" {
+		al.ReloadInterval = interval
+		a.background = append(a.background, al.Run)
+	}
+	return al, nil
+}
+
+func withAccessList(al *clientip.AccessList, h http.Handler) http.Handler {
+	if al == nil {
+		return h
+	}
+	return al.Middleware(h)
+}
+
+// withClientIP 在最外层解析真实客户端IP，之后的IP过滤、日志和WebSocket会话计数都用它
+func (a *App) withClientIP(h http.Handler) http.Handler {
+	if a.clientIP == nil {
+		return h
+	}
+	return a.clientIP.Middleware(h)
+}
+
+// withAuth 按路由的认证要求包装处理器，key是API密钥检查路由权限时用的“监听名/路由名”
+// 校验顺序是身份（JWT、OIDC会话或令牌自省）、签名、API密钥，身份不对和重放的请求不消耗密钥的配额
+func (a *App) withAuth(key string, ra *config.RouteAuth, h http.Handler) http.Handler {
+	if ra == nil {
+		return h
+	}
+	if ra.APIKey {
+		h = a.apikeys.Middleware(key, h)
+	}
+	if ra.HMAC != "" {
+		h = a.hmac[ra.HMAC].Middleware(h)
+	}
+	if ra.JWT != "" {
+		//Optional是路由级别的设置，同一个提供方在不同路由上可以不同
+		ja := *a.jwt[ra.JWT]
+		ja.Optional = ra.Optional
+		h = ja.Middleware(h)
+	}
+	if ra.Introspection != "" {
+		ia := *a.introspection[ra.Introspection]
+		ia.Optional = ra.Optional
+		h = ia.Middleware(h)
+	}
+	if ra.OIDC != "" {
+		if ra.Optional {
+			h = a.oidc[ra.OIDC].OptionalMiddleware(h)
+		} else {
+			h = a.oidc[ra.OIDC].Middleware(h)
+		}
+	}
+	return h
+}
@@ -16,14 +16,15 @@ func main() {
 	client := &http.Client{}
 	// 2、发起请求
 	resp, err := client.Get("http://127.0.0.1:9527/hello")
-	// 4、关闭客户端
-	defer resp.Body.Close()
 	if err != nil {
 		panic(err)
 	}
+	// 4、关闭客户端
+	defer resp.Body.Close()
 	// 3、处理响应
 	bds, _ := ioutil.ReadAll(resp.Body)
 	fmt.Println(string(bds))
 }
 
 //q:以上代码运行后为什么会报错？
+//a:原来先defer resp.Body.Close()再检查err，请求失败时resp为nil，关闭时空指针panic，所以要先检查err
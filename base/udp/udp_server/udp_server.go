@@ -20,7 +20,7 @@ func main() {
 		Port: 8080,
 	})
 	if err != nil {
-		fmt.Println("conn failed, err:%v\n", err)
+		fmt.Printf("conn failed, err:%v\n", err)
 	}
 
 	// 2、读取客户端数据
@@ -29,7 +29,7 @@ func main() {
 	var data [1024]byte                             //其实byte是uint8的别名
 	n, clientAddr, err := conn.ReadFromUDP(data[:]) //n为读取到的字节数，clientaddr为客户端地址
 	if err != nil {
-		fmt.Println("read error, clientAddr: %v, err: %v\n", clientAddr, err)
+		fmt.Printf("read error, clientAddr: %v, err: %v\n", clientAddr, err)
 	}
 	fmt.Printf("clientAddr: %v data: %v count: %v\n", clientAddr, string(data[:n]), n)
 
@@ -0,0 +1,174 @@
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"gateway/app"
+	"gateway/config"
+	"gateway/proxy/http_proxy/realserver"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 对比压测：在进程内启动测试后端和一个只有一个监听的网关，用同样的参数先直连后端、再经过网关各压一次
+// 两次压测使用同一个后端，差别就是网关带来的开销。压测客户端和网关在同一个进程中，
+// 结果适合发布前和上一个版本对比，不代表独立部署时的绝对性能
+
+// Mode 压测的协议
+type Mode string
+
+const (
+	ModeHTTP      Mode = "http"
+	ModeHTTPNew   Mode = "http-new" //每个请求新建连接
+	ModeTCP       Mode = "tcp"
+	ModeWebSocket Mode = "ws"
+)
+
+// Comparison 对比压测的两次结果
+type Comparison struct {
+	Direct, Gateway *Result
+}
+
+// Compare 启动测试后端和网关，按mode分别直连和经过网关压测，size是响应体或者消息的字节数
+// backend是后端的行为，可以注入延迟模拟真实的服务，只对HTTP有效
+func Compare(ctx context.Context, mode Mode, size int, backend realserver.Behavior, opt Options) (*Comparison, error) {
+	if size <= 0 {
+		size = 64
+	}
+	var (
+		cfg    = &config.Config{}
+		direct Scenario
+		via    func(a *app.App) Scenario
+		stop   func()
+	)
+
+	switch mode {
+	case ModeHTTP, ModeHTTPNew:
+		backend.ResponseSize = size
+		rs := realserver.NewRealServer("127.0.0.1:0", backend)
+		if err := rs.Start(); err != nil {
+			return nil, err
+		}
+		stop = func() { rs.Shutdown(context.Background()) }
+		cfg.HTTP = []config.HTTPListener{{Name: "bench", Addr: "127.0.0.1:0", Routes: []config.Route{
+			{Name: "backend", PathPrefix: "/", Targets: []string{"http://" + rs.ListenAddr()}},
+		}}}
+		newConn := mode == ModeHTTPNew
+		direct = &HTTP{URL: "http://" + rs.ListenAddr() + "/bench", NewConnections: newConn}
+		via = func(a *app.App) Scenario {
+			return &HTTP{URL: "http://" + a.Addr("bench").String() + "/bench", NewConnections: newConn}
+		}
+
+	case ModeTCP:
+		ln, err := tcpEchoServer()
+		if err != nil {
+			return nil, err
+		}
+		stop = func() { ln.Close() }
+		cfg.TCP = []config.TCPListener{{Name: "bench", Addr: "127.0.0.1:0", Upstreams: []string{ln.Addr().String()}}}
+		direct = &TCPEcho{Addr: ln.Addr().String(), Size: size}
+		via = func(a *app.App) Scenario {
+			return &TCPEcho{Addr: a.Addr("bench").String(), Size: size}
+		}
+
+	case ModeWebSocket:
+		srv, addr, err := wsEchoServer()
+		if err != nil {
+			return nil, err
+		}
+		stop = func() { srv.Close() }
+		cfg.WebSocket = []config.WebSocketListener{{Name: "bench", Addr: "127.0.0.1:0", Target: "http://" + addr}}
+		direct = &WebSocket{URL: "ws://" + addr + "/bench", Size: size}
+		via = func(a *app.App) Scenario {
+			return &WebSocket{URL: "ws://" + a.Addr("bench").String() + "/bench", Size: size}
+		}
+
+	default:
+		return nil, fmt.Errorf("benchmark: unknown mode %q", mode)
+	}
+	defer stop()
+
+	a, err := app.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Start(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		a.Shutdown(sctx)
+	}()
+
+	c := &Comparison{}
+	if c.Direct, err = Run(ctx, direct, opt); err != nil {
+		return nil, err
+	}
+	if c.Gateway, err = Run(ctx, via(a), opt); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Print 输出两次压测的报告和对比
+func (c *Comparison) Print(w io.Writer) {
+	fmt.Fprintln(w, "== direct to backend")
+	c.Direct.Print(w)
+	fmt.Fprintln(w, "\n== through gateway")
+	c.Gateway.Print(w)
+	fmt.Fprintln(w, "\n== comparison")
+	PrintComparison(w, c.Direct, c.Gateway)
+}
+
+// tcpEchoServer 在随机端口上启动TCP回显服务
+func tcpEchoServer() (net.Listener, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return ln, nil
+}
+
+// wsEchoServer 在随机端口上启动WebSocket回显服务，原样返回消息
+func wsEchoServer() (*http.Server, string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	upgrader := websocket.Upgrader{}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	})}
+	go srv.Serve(ln)
+	return srv, ln.Addr().String(), nil
+}
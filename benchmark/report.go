@@ -0,0 +1,100 @@
+package benchmark
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// percentiles 报告中输出的分位数
+var percentiles = []float64{50, 90, 99, 99.9}
+
+// Print 输出一次压测的报告
+func (r *Result) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "scenario\t%s\n", r.Name)
+	mode := fmt.Sprintf("concurrency %d", r.Options.Concurrency)
+	if r.Options.Rate > 0 {
+		mode += fmt.Sprintf(", rate %.0f/s", r.Options.Rate)
+	}
+	fmt.Fprintf(tw, "load\t%s\n", mode)
+	fmt.Fprintf(tw, "operations\t%d ok, %d errors in %v\n", len(r.Latencies), r.ErrorCount(), r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(tw, "throughput\t%.1f ops/s, %s/s\n", r.Throughput(), formatBytes(float64(r.Bytes)/r.Elapsed.Seconds()))
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(tw, "latency\tmin %v", formatDuration(r.Latencies[0]))
+		for _, p := range percentiles {
+			fmt.Fprintf(tw, "  p%g %v", p, formatDuration(r.Percentile(p)))
+		}
+		fmt.Fprintf(tw, "  max %v\n", formatDuration(r.Latencies[len(r.Latencies)-1]))
+	}
+	label := "errors"
+	for _, k := range r.errorKinds() {
+		fmt.Fprintf(tw, "%s\t%s: %d\n", label, k, r.Errors[k])
+		label = ""
+	}
+	tw.Flush()
+}
+
+// errorKinds 按次数从多到少排序的错误类型
+func (r *Result) errorKinds() []string {
+	kinds := make([]string, 0, len(r.Errors))
+	for k := range r.Errors {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if r.Errors[kinds[i]] != r.Errors[kinds[j]] {
+			return r.Errors[kinds[i]] > r.Errors[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	return kinds
+}
+
+// PrintComparison 对比直连后端和经过网关的结果，输出网关带来的额外延迟和吞吐量变化
+func PrintComparison(w io.Writer, direct, gateway *Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\tdirect\tgateway\toverhead\t\n")
+	fmt.Fprintf(tw, "throughput (ops/s)\t%.1f\t%.1f\t%s\t\n",
+		direct.Throughput(), gateway.Throughput(), percentChange(direct.Throughput(), gateway.Throughput()))
+	for _, p := range percentiles {
+		d, g := direct.Percentile(p), gateway.Percentile(p)
+		fmt.Fprintf(tw, "p%g\t%v\t%v\t%+v\t\n", p, formatDuration(d), formatDuration(g), formatDuration(g-d))
+	}
+	fmt.Fprintf(tw, "errors\t%d\t%d\t\t\n", direct.ErrorCount(), gateway.ErrorCount())
+	tw.Flush()
+}
+
+func percentChange(base, v float64) string {
+	if base == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (v-base)/base*100)
+}
+
+// formatDuration 保留三位有效数字左右，方便在表格中对齐阅读
+func formatDuration(d time.Duration) time.Duration {
+	switch abs := d; {
+	case abs < 0:
+		return -formatDuration(-d)
+	case abs >= time.Second:
+		return d.Round(time.Millisecond)
+	case abs >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(100 * time.Nanosecond)
+}
+
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	div, exp := float64(unit), 0
+	for v := n / unit; v >= unit && exp < 3; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", n/div, "KMGT"[exp])
+}
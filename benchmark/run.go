@@ -0,0 +1,273 @@
+// Package benchmark 网关的压测工具：按固定并发或者固定速率对目标施加HTTP、TCP回显或WebSocket消息的负载，
+// 统计延迟分位数、错误分类和吞吐量，并且可以在进程内启动测试后端，自动对比直连后端和经过网关的差别
+// cmd/gateway benchmark是它的命令行入口
+package benchmark
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Worker 一个压测协程持有的客户端，比如一条TCP连接或者一个HTTP连接池
+type Worker interface {
+	//Do 执行一次操作，返回收到的字节数
+	//出错之后连接可能已经不能再用，下一次Do需要自己重新连接
+	Do(ctx context.Context) (int64, error)
+	Close() error
+}
+
+// Scenario 压测场景，每个并发协程调用一次NewWorker
+type Scenario interface {
+	Name() string
+	NewWorker() (Worker, error)
+}
+
+// Options 压测参数
+type Options struct {
+	//Concurrency 并发协程数，默认1
+	Concurrency int
+	//Rate 每秒发起的操作数，0表示每个协程做完一次马上做下一次（闭环压测）
+	//固定速率时延迟从计划发起的时间开始算，协程都忙时排队的时间也计入延迟，避免协调遗漏
+	Rate float64
+	//Duration 压测时长，Requests也为0时默认10秒
+	Duration time.Duration
+	//Requests 总操作数，达到后停止，0表示只受Duration限制
+	Requests int
+	//Timeout 单次操作的超时时间，默认10秒
+	Timeout time.Duration
+}
+
+func (o *Options) defaults() {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.Duration <= 0 && o.Requests <= 0 {
+		o.Duration = 10 * time.Second
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 10 * time.Second
+	}
+}
+
+// Result 一次压测的结果
+type Result struct {
+	Name    string
+	Options Options
+	//Elapsed 实际的压测时间
+	Elapsed time.Duration
+	//Latencies 成功操作的延迟，从小到大排序
+	Latencies []time.Duration
+	//Errors 按错误类型统计的次数，类型见Classify
+	Errors map[string]int
+	//Bytes 成功操作收到的字节数
+	Bytes int64
+}
+
+// sample 每个协程自己记录，结束后再合并，避免加锁
+type sample struct {
+	latencies []time.Duration
+	errors    map[string]int
+	bytes     int64
+}
+
+// Run 执行压测，ctx取消时提前结束并返回已经完成的部分
+func Run(ctx context.Context, s Scenario, opt Options) (*Result, error) {
+	opt.defaults()
+
+	//先建立所有的客户端，连接失败时不开始压测
+	workers := make([]Worker, 0, opt.Concurrency)
+	defer func() {
+		for _, w := range workers {
+			w.Close()
+		}
+	}()
+	for i := 0; i < opt.Concurrency; i++ {
+		w, err := s.NewWorker()
+		if err != nil {
+			return nil, fmt.Errorf("benchmark: %s: %w", s.Name(), err)
+		}
+		workers = append(workers, w)
+	}
+
+	var end time.Time
+	if opt.Duration > 0 {
+		var cancel context.CancelFunc
+		end = time.Now().Add(opt.Duration)
+		ctx, cancel = context.WithDeadline(ctx, end)
+		defer cancel()
+	}
+	//连接的超时和ctx的定时器不是同时触发的，按时间判断压测是否已经结束
+	over := func() bool {
+		return ctx.Err() != nil || (!end.IsZero() && !time.Now().Before(end))
+	}
+
+	//固定速率时由pacer按计划的时间发放令牌
+	var schedule chan time.Time
+	if opt.Rate > 0 {
+		schedule = make(chan time.Time, opt.Concurrency)
+		go pace(ctx, schedule, opt.Rate, opt.Requests)
+	}
+
+	var issued int64
+	samples := make([]sample, len(workers))
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i, w := range workers {
+		wg.Add(1)
+		go func(s *sample, w Worker) {
+			defer wg.Done()
+			s.errors = make(map[string]int)
+			for {
+				var begin time.Time
+				if schedule != nil {
+					t, ok := <-schedule
+					if !ok {
+						return
+					}
+					begin = t
+				} else {
+					if over() || (opt.Requests > 0 && atomic.AddInt64(&issued, 1) > int64(opt.Requests)) {
+						return
+					}
+					begin = time.Now()
+				}
+
+				opCtx, cancel := context.WithTimeout(ctx, opt.Timeout)
+				n, err := w.Do(opCtx)
+				cancel()
+				//压测时间到了被中断的操作不算错误
+				if err != nil && over() {
+					return
+				}
+				if err != nil {
+					s.errors[Classify(err)]++
+					continue
+				}
+				s.latencies = append(s.latencies, time.Since(begin))
+				s.bytes += n
+			}
+		}(&samples[i], w)
+	}
+	wg.Wait()
+
+	r := &Result{Name: s.Name(), Options: opt, Elapsed: time.Since(start), Errors: make(map[string]int)}
+	for _, s := range samples {
+		r.Latencies = append(r.Latencies, s.latencies...)
+		r.Bytes += s.bytes
+		for k, v := range s.errors {
+			r.Errors[k] += v
+		}
+	}
+	sort.Slice(r.Latencies, func(i, j int) bool { return r.Latencies[i] < r.Latencies[j] })
+	return r, nil
+}
+
+// pace 按固定间隔把计划的发起时间放进schedule，结束时关闭schedule
+func pace(ctx context.Context, schedule chan<- time.Time, rate float64, requests int) {
+	defer close(schedule)
+	interval := time.Duration(float64(time.Second) / rate)
+	next := time.Now()
+	for i := 0; requests <= 0 || i < requests; i++ {
+		if d := time.Until(next); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+		select {
+		case schedule <- next:
+		case <-ctx.Done():
+			return
+		}
+		next = next.Add(interval)
+	}
+}
+
+// StatusError 上游返回了错误的状态码
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d", e.Code)
+}
+
+// ErrMismatch 回显的内容和发送的不一致
+var ErrMismatch = errors.New("echo mismatch")
+
+// Classify 把错误归类，报告中按类别统计次数
+func Classify(err error) string {
+	var se *StatusError
+	var ne net.Error
+	switch {
+	case errors.As(err, &se):
+		return se.Error()
+	case errors.Is(err, ErrMismatch):
+		return "echo mismatch"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.Is(err, syscall.EPIPE):
+		return "broken pipe"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "unexpected EOF"
+	}
+	//其它错误去掉地址等变化的部分，只保留最后一段
+	msg := err.Error()
+	if i := strings.LastIndex(msg, ": "); i >= 0 {
+		msg = msg[i+2:]
+	}
+	return "other: " + msg
+}
+
+// Count 成功和失败的操作总数
+func (r *Result) Count() int {
+	n := len(r.Latencies)
+	for _, v := range r.Errors {
+		n += v
+	}
+	return n
+}
+
+// ErrorCount 失败的操作数
+func (r *Result) ErrorCount() int {
+	return r.Count() - len(r.Latencies)
+}
+
+// Throughput 每秒成功的操作数
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(len(r.Latencies)) / r.Elapsed.Seconds()
+}
+
+// Percentile 成功操作延迟的分位数，p在0到100之间，没有成功的操作时返回0
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies)-1) * p / 100)
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
@@ -0,0 +1,277 @@
+package benchmark
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HTTP HTTP请求的压测场景
+type HTTP struct {
+	URL    string
+	Method string //默认GET
+	Body   []byte
+	Header http.Header
+	//NewConnections 为true时每个请求都新建连接，否则每个协程复用一条长连接
+	NewConnections bool
+}
+
+// Name 场景名
+func (h *HTTP) Name() string {
+	method := h.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	conn := "keep-alive"
+	if h.NewConnections {
+		conn = "new connection per request"
+	}
+	return fmt.Sprintf("http %s %s (%s)", method, h.URL, conn)
+}
+
+// NewWorker 每个协程有自己的Transport，长连接模式下只保留一条空闲连接
+func (h *HTTP) NewWorker() (Worker, error) {
+	tr := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		DisableKeepAlives:   h.NewConnections,
+		MaxIdleConnsPerHost: 1,
+		DisableCompression:  true,
+	}
+	return &httpWorker{h: h, client: &http.Client{
+		Transport: tr,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}, nil
+}
+
+type httpWorker struct {
+	h      *HTTP
+	client *http.Client
+}
+
+func (w *httpWorker) Do(ctx context.Context) (int64, error) {
+	method := w.h.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if w.h.Body != nil {
+		body = bytes.NewReader(w.h.Body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, w.h.URL, body)
+	if err != nil {
+		return 0, err
+	}
+	for k, vs := range w.h.Header {
+		req.Header[k] = vs
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	//读完响应体连接才能复用，延迟也包括读取响应体的时间
+	n, err := io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if err != nil {
+		return n, err
+	}
+	if res.StatusCode >= 400 {
+		return n, &StatusError{Code: res.StatusCode}
+	}
+	return n, nil
+}
+
+func (w *httpWorker) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// TCPEcho TCP回显的压测场景：写入Size字节，等待读回相同的内容
+type TCPEcho struct {
+	Addr string
+	Size int //每次写入的字节数，默认64
+	//NewConnections 为true时每次操作都新建连接
+	NewConnections bool
+}
+
+// Name 场景名
+func (t *TCPEcho) Name() string {
+	mode := "persistent connection"
+	if t.NewConnections {
+		mode = "new connection per echo"
+	}
+	return fmt.Sprintf("tcp echo %s, %d bytes (%s)", t.Addr, t.size(), mode)
+}
+
+func (t *TCPEcho) size() int {
+	if t.Size <= 0 {
+		return 64
+	}
+	return t.Size
+}
+
+// NewWorker 长连接模式下每个协程先建立一条连接
+func (t *TCPEcho) NewWorker() (Worker, error) {
+	w := &tcpWorker{t: t, payload: payload(t.size()), buf: make([]byte, t.size())}
+	if !t.NewConnections {
+		conn, err := net.DialTimeout("tcp", t.Addr, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		w.conn = conn
+	}
+	return w, nil
+}
+
+type tcpWorker struct {
+	t       *TCPEcho
+	conn    net.Conn
+	payload []byte
+	buf     []byte
+}
+
+func (w *tcpWorker) Do(ctx context.Context) (int64, error) {
+	conn := w.conn
+	if conn == nil {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", w.t.Addr)
+		if err != nil {
+			return 0, err
+		}
+		conn = c
+	}
+	n, err := w.echo(ctx, conn)
+	//每次新建连接的模式用完就关闭；长连接出错后数据已经错位，关闭后下一次重新连接
+	if w.t.NewConnections || err != nil {
+		conn.Close()
+		conn = nil
+	}
+	if !w.t.NewConnections {
+		w.conn = conn
+	}
+	return n, err
+}
+
+func (w *tcpWorker) echo(ctx context.Context, conn net.Conn) (int64, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(w.payload); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(conn, w.buf)
+	if err != nil {
+		return int64(n), err
+	}
+	if !bytes.Equal(w.buf, w.payload) {
+		return int64(n), ErrMismatch
+	}
+	return int64(n), nil
+}
+
+func (w *tcpWorker) Close() error {
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
+
+// WebSocket WebSocket消息的压测场景：发送一条Size字节的二进制消息，等待回显
+// 回显的消息只检查前缀，兼容websocket_server.go中在消息后面加后缀的wsHandler
+type WebSocket struct {
+	URL  string //ws://或wss://地址
+	Size int    //消息的字节数，默认64
+}
+
+// Name 场景名
+func (ws *WebSocket) Name() string {
+	return fmt.Sprintf("websocket echo %s, %d bytes", ws.URL, ws.size())
+}
+
+func (ws *WebSocket) size() int {
+	if ws.Size <= 0 {
+		return 64
+	}
+	return ws.Size
+}
+
+// NewWorker 每个协程一个WebSocket会话
+func (ws *WebSocket) NewWorker() (Worker, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(ws.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsWorker{ws: ws, conn: conn, payload: payload(ws.size())}, nil
+}
+
+type wsWorker struct {
+	ws      *WebSocket
+	conn    *websocket.Conn
+	payload []byte
+}
+
+func (w *wsWorker) Do(ctx context.Context) (int64, error) {
+	if w.conn == nil {
+		conn, _, err := websocket.DefaultDialer.DialContext(ctx, w.ws.URL, nil)
+		if err != nil {
+			return 0, err
+		}
+		w.conn = conn
+	}
+	n, err := w.echo(ctx)
+	//超时之后gorilla/websocket的连接不能再用，关闭后下一次重新握手
+	if err != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	return n, err
+}
+
+func (w *wsWorker) echo(ctx context.Context) (int64, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		w.conn.SetWriteDeadline(deadline)
+		w.conn.SetReadDeadline(deadline)
+	}
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, w.payload); err != nil {
+		return 0, err
+	}
+	//发送的是二进制消息，回显也是二进制消息；跳过上游主动推送的文本消息，比如wsHandler的心跳
+	for {
+		mt, msg, err := w.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		if !bytes.HasPrefix(msg, w.payload) {
+			return int64(len(msg)), ErrMismatch
+		}
+		return int64(len(msg)), nil
+	}
+}
+
+func (w *wsWorker) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	w.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return w.conn.Close()
+}
+
+// payload 生成指定大小的内容
+func payload(size int) []byte {
+	p := make([]byte, size)
+	for i := range p {
+		p[i] = byte('a' + i%26)
+	}
+	return p
+}
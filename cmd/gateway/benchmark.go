@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gateway/benchmark"
+	"gateway/proxy/http_proxy/realserver"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// benchmarkCmd 压测：--target指定目标时压测目标；--compare时在进程内启动测试后端和网关，对比直连和经过网关
+func benchmarkCmd(args []string) error {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	mode := fs.String("mode", "http", "协议：http（长连接）、http-new（每个请求新建连接）、tcp（回显）、ws（WebSocket回显）")
+	target := fs.String("target", "", "压测目标：http模式是URL，tcp模式是host:port，ws模式是ws://地址")
+	compare := fs.Bool("compare", false, "不使用target，启动测试后端并对比直连和经过网关")
+	concurrency := fs.Int("concurrency", 10, "并发数")
+	rate := fs.Float64("rate", 0, "每秒发起的操作数，0表示按并发数尽快发起")
+	duration := fs.Duration("duration", 10e9, "压测时长")
+	requests := fs.Int("requests", 0, "总操作数，0表示只受duration限制")
+	timeout := fs.Duration("timeout", 10e9, "单次操作的超时时间")
+	size := fs.Int("size", 64, "TCP、WebSocket消息的字节数；compare模式下也是HTTP响应体的字节数")
+	method := fs.String("method", "GET", "HTTP方法")
+	body := fs.String("body", "", "HTTP请求体")
+	var headers headerFlag
+	fs.Var(&headers, "header", "HTTP请求头，Name: value，可以重复")
+	latency := fs.String("backend-latency", "", "compare模式下测试后端的延迟，写法见test-backend --latency")
+	fs.Parse(args)
+
+	opt := benchmark.Options{
+		Concurrency: *concurrency,
+		Rate:        *rate,
+		Duration:    *duration,
+		Requests:    *requests,
+		Timeout:     *timeout,
+	}
+	if *requests > 0 && !isFlagSet(fs, "duration") {
+		opt.Duration = 0
+	}
+
+	//Ctrl+C提前结束，已经完成的部分照常输出
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *compare {
+		lat, err := realserver.ParseLatency(*latency)
+		if err != nil {
+			return err
+		}
+		c, err := benchmark.Compare(ctx, benchmark.Mode(*mode), *size, realserver.Behavior{Latency: lat}, opt)
+		if err != nil {
+			return err
+		}
+		c.Print(os.Stdout)
+		return nil
+	}
+
+	if *target == "" {
+		return fmt.Errorf("benchmark: --target or --compare is required")
+	}
+	var s benchmark.Scenario
+	switch benchmark.Mode(*mode) {
+	case benchmark.ModeHTTP, benchmark.ModeHTTPNew:
+		h := &benchmark.HTTP{
+			URL:            *target,
+			Method:         *method,
+			Header:         http.Header(headers),
+			NewConnections: benchmark.Mode(*mode) == benchmark.ModeHTTPNew,
+		}
+		if *body != "" {
+			h.Body = []byte(*body)
+		}
+		s = h
+	case benchmark.ModeTCP:
+		s = &benchmark.TCPEcho{Addr: *target, Size: *size}
+	case benchmark.ModeWebSocket:
+		s = &benchmark.WebSocket{URL: *target, Size: *size}
+	default:
+		return fmt.Errorf("benchmark: unknown mode %q", *mode)
+	}
+	r, err := benchmark.Run(ctx, s, opt)
+	if err != nil {
+		return err
+	}
+	r.Print(os.Stdout)
+	return nil
+}
+
+// headerFlag 可以重复的--header参数
+type headerFlag http.Header
+
+func (h *headerFlag) String() string {
+	return fmt.Sprint(http.Header(*h))
+}
+
+func (h *headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("header %q must be Name: value", s)
+	}
+	if *h == nil {
+		*h = headerFlag{}
+	}
+	http.Header(*h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gateway/config"
+	"gateway/proxy/http_proxy/realserver"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// 单一用途的子命令：把命令行参数转换成只有一个监听的配置，再和run一样运行
+// 地址的默认值和原来各个main程序中写死的端口一致
+
+func forwardProxyCmd(args []string) error {
+	fs := flag.NewFlagSet("forward-proxy", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "监听地址")
+	logRequests := fs.Bool("log", true, "记录每个请求")
+	fs.Parse(args)
+
+	return serveConfig(&config.Config{
+		Forward: []config.ForwardListener{{Name: "forward", Addr: *addr, LogRequests: *logRequests}},
+	})
+}
+
+func tcpProxyCmd(args []string) error {
+	fs := flag.NewFlagSet("tcp-proxy", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8083", "监听地址")
+	upstreams := fs.String("upstream", "", "上游地址，多个用逗号分隔，拨号失败时依次尝试（必填）")
+	dialTimeout := fs.Duration("dial-timeout", 10*time.Second, "每次拨号的超时时间")
+	idleTimeout := fs.Duration("idle-timeout", 0, "空闲超时，0表示不限制")
+	maxAge := fs.Duration("max-connection-age", 0, "连接的最长存活时间，0表示不限制")
+	proxyProtocol := fs.Bool("proxy-protocol", false, "解析客户端一侧的PROXY协议头部")
+	proxyTrusted := fs.String("proxy-protocol-trusted", "127.0.0.1,::1", "只解析来自这些网段的PROXY协议头部，多个用逗号分隔")
+	sendProxyProtocol := fs.Uint("send-proxy-protocol", 0, "向上游写入PROXY协议头部的版本，0表示不写")
+	logConns := fs.Bool("log", true, "记录每个连接")
+	fs.Parse(args)
+
+	l := config.TCPListener{
+		Name:                 "tcp",
+		Addr:                 *addr,
+		Upstreams:            splitList(*upstreams),
+		DialTimeout:          config.Duration(*dialTimeout),
+		IdleTimeout:          config.Duration(*idleTimeout),
+		MaxConnectionAge:     config.Duration(*maxAge),
+		ProxyProtocolVersion: byte(*sendProxyProtocol),
+		LogConnections:       *logConns,
+	}
+	if *proxyProtocol {
+		l.ProxyProtocol = true
+		l.ProxyProtocolTrustedCIDRs = splitList(*proxyTrusted)
+	}
+	return serveConfig(&config.Config{TCP: []config.TCPListener{l}})
+}
+
+func wsProxyCmd(args []string) error {
+	fs := flag.NewFlagSet("ws-proxy", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8082", "监听地址")
+	target := fs.String("target", "http://127.0.0.1:8002", "上游WebSocket服务地址")
+	tokens := fs.String("tokens", "", "握手令牌，格式token=user，多个用逗号分隔，为空时不认证")
+	maxMessageSize := fs.Int64("max-message-size", 64<<10, "单条消息的最大字节数")
+	messageRate := fs.Float64("message-rate", 0, "每个会话每秒最多转发的消息数，0表示不限制")
+	idleTimeout := fs.Duration("idle-timeout", 0, "多久收不到任何帧就断开，0表示不限制")
+	logMessages := fs.Bool("log", false, "记录每条消息")
+	fs.Parse(args)
+
+	l := config.WebSocketListener{
+		Name:           "websocket",
+		Addr:           *addr,
+		Target:         *target,
+		MaxMessageSize: *maxMessageSize,
+		MessageRate:    *messageRate,
+		IdleTimeout:    config.Duration(*idleTimeout),
+		LogMessages:    *logMessages,
+	}
+	if *messageRate > 0 {
+		l.MessageBurst = int(*messageRate)
+	}
+	for _, kv := range splitList(*tokens) {
+		token, user, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("ws-proxy: invalid token %q, want token=user", kv)
+		}
+		if l.Tokens == nil {
+			l.Tokens = make(map[string]string)
+		}
+		l.Tokens[token] = user
+	}
+	if len(l.Tokens) > 0 {
+		l.AllowMissingOrigin = true
+	}
+	return serveConfig(&config.Config{WebSocket: []config.WebSocketListener{l}})
+}
+
+func testBackendCmd(args []string) error {
+	fs := flag.NewFlagSet("test-backend", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8001", "第一个实例的监听地址，之后的实例端口依次加1")
+	instances := fs.Int("instances", 1, "实例数量")
+	latency := fs.String("latency", "", "延迟：50ms、10ms-100ms、normal:50ms:10ms、exp:50ms")
+	errorRate := fs.Float64("error-rate", 0, "返回错误的概率，0到1")
+	errorCodes := fs.String("error-codes", "", "返回错误时使用的状态码，逗号分隔，默认500")
+	responseSize := fs.Int("response-size", 0, "响应体的字节数")
+	chunkSize := fs.Int("chunk-size", 0, "慢速响应每块的字节数，默认1024")
+	chunkInterval := fs.Duration("chunk-interval", 0, "慢速响应每块之间的间隔，0表示不分块")
+	dropRate := fs.Float64("drop-rate", 0, "直接断开连接的概率，0到1")
+	dropReset := fs.Bool("drop-reset", false, "断开时发送RST")
+	behaviorFile := fs.String("behavior", "", "JSON行为文件，可以是一个对象，也可以是每个实例一个对象的数组，会覆盖上面的参数")
+	unhealthy := fs.Bool("unhealthy", false, "启动时健康检查返回503")
+	writeTimeout := fs.Duration("write-timeout", 0, "写响应超时，0表示不限制")
+	fs.Parse(args)
+
+	b := realserver.Behavior{
+		ErrorRate:     *errorRate,
+		ResponseSize:  *responseSize,
+		ChunkSize:     *chunkSize,
+		ChunkInterval: *chunkInterval,
+		DropRate:      *dropRate,
+		DropReset:     *dropReset,
+	}
+	var err error
+	if b.Latency, err = realserver.ParseLatency(*latency); err != nil {
+		return err
+	}
+	for _, c := range splitList(*errorCodes) {
+		code, err := strconv.Atoi(c)
+		if err != nil {
+			return fmt.Errorf("invalid error code %q", c)
+		}
+		b.ErrorCodes = append(b.ErrorCodes, code)
+	}
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	behaviors := []realserver.Behavior{b}
+	if *behaviorFile != "" {
+		if behaviors, err = loadBehaviors(*behaviorFile); err != nil {
+			return err
+		}
+	}
+
+	cluster, err := realserver.NewCluster(*addr, *instances, behaviors)
+	if err != nil {
+		return err
+	}
+	for _, rs := range cluster.Servers {
+		rs.WriteTimeout = *writeTimeout
+		rs.SetHealthy(!*unhealthy)
+	}
+	if err := cluster.Start(); err != nil {
+		return err
+	}
+	for _, rs := range cluster.Servers {
+		log.Printf("test-backend: listening on %s", rs.ListenAddr())
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return cluster.Shutdown(ctx)
+}
+
+// loadBehaviors 读取行为文件，支持单个对象或者数组
+func loadBehaviors(path string) ([]realserver.Behavior, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var list []realserver.Behavior
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return list, nil
+	}
+	var b realserver.Behavior
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return []realserver.Behavior{b}, nil
+}
+
+// serveConfig 检查由命令行参数生成的配置后运行
+func serveConfig(cfg *config.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	return serve(cfg, "", 30*time.Second)
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
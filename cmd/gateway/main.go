@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// gateway 网关的唯一入口，原来分散在各个目录下的main程序对应这里的子命令：
+//
+//	gateway run --config gateway.json      按配置文件启动，可以同时运行多种代理
+//	gateway validate --config gateway.json 只检查配置文件
+//	gateway forward-proxy                  http/forward_proxy/forward_proxy.go
+//	gateway tcp-proxy --upstream ...       tcp_proxy/tcp_man.go
+//	gateway ws-proxy --target ...          websocket/websocket_proxy/websocket_proxy.go
+//	gateway test-backend                   downsteam_real_server.go
+//	gateway benchmark --target ...         压测目标，或者--compare对比直连和经过网关
+//	gateway version
+//
+// 版本号在构建时写入：go build -ldflags "-X main.version=v1.2.3" ./cmd/gateway
+
+var version = "dev"
+
+const usage = `Usage: gateway <command> [flags]
+
+Commands:
+  run            start the gateway from a config file
+  validate       check a config file and exit
+  forward-proxy  run an HTTP forward proxy
+  tcp-proxy      run a TCP reverse proxy
+  ws-proxy       run a message-level WebSocket proxy
+  test-backend   run a test backend HTTP server
+  benchmark      generate load and report latency and throughput
+  version        print version information
+
+Run "gateway <command> -h" for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+	var err error
+	switch cmd {
+	case "run":
+		err = runCmd(args)
+	case "validate":
+		err = validateCmd(args)
+	case "forward-proxy":
+		err = forwardProxyCmd(args)
+	case "tcp-proxy":
+		err = tcpProxyCmd(args)
+	case "ws-proxy":
+		err = wsProxyCmd(args)
+	case "test-backend":
+		err = testBackendCmd(args)
+	case "benchmark":
+		err = benchmarkCmd(args)
+	case "version":
+		printVersion()
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "gateway: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gateway:", err)
+		os.Exit(1)
+	}
+}
+
+func printVersion() {
+	fmt.Printf("gateway %s %s %s/%s\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	//go build会把VCS信息写进二进制，有的话一并输出
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				fmt.Printf("%s=%s\n", s.Key, s.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"gateway/app"
+	"gateway/config"
+	"gateway/proxy/upgrade"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+func runCmd(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	path := fs.String("config", "", "配置文件路径（必填）")
+	pidFile := fs.String("pidfile", "", "就绪后写入pid的文件，热升级后会更新为新进程的pid")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 30*time.Second, "退出时等待连接处理完的最长时间")
+	fs.Parse(args)
+	if *path == "" {
+		return errors.New("run: --config is required")
+	}
+	cfg, err := config.Load(*path)
+	if err != nil {
+		return err
+	}
+	return serve(cfg, *pidFile, *shutdownTimeout)
+}
+
+func validateCmd(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := fs.String("config", "", "配置文件路径（必填）")
+	fs.Parse(args)
+	if *path == "" {
+		return errors.New("validate: --config is required")
+	}
+	cfg, err := config.Load(*path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: ok, %d http, %d tcp, %d websocket, %d forward listeners\n",
+		*path, len(cfg.HTTP), len(cfg.TCP), len(cfg.WebSocket), len(cfg.Forward))
+	return nil
+}
+
+// serve 运行网关直到收到退出信号
+// SIGINT、SIGTERM优雅退出；支持的平台上SIGUSR2热升级，监听socket交给新进程后当前进程退出
+func serve(cfg *config.Config, pidFile string, shutdownTimeout time.Duration) error {
+	upg, err := upgrade.New()
+	if err != nil {
+		return err
+	}
+	upg.PIDFile = pidFile
+
+	a, err := app.New(cfg)
+	if err != nil {
+		return err
+	}
+	a.Listen = upg.ListenWith
+	if err := a.Start(); err != nil {
+		return err
+	}
+	addrs := a.Listeners()
+	names := make([]string, 0, len(addrs))
+	for name := range addrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("gateway: %s listening on %s", name, addrs[name])
+	}
+	if err := upg.Ready(); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append(upgradeSignals, syscall.SIGINT, syscall.SIGTERM)...)
+wait:
+	for {
+		select {
+		case s := <-sig:
+			if !isUpgradeSignal(s) {
+				log.Printf("gateway: received %v, shutting down", s)
+				break wait
+			}
+			log.Printf("gateway: received %v, upgrading", s)
+			if err := upg.Upgrade(); err != nil {
+				log.Printf("gateway: upgrade failed: %v", err)
+			}
+		case <-upg.Exit():
+			log.Printf("gateway: upgraded, draining connections")
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return a.Shutdown(ctx)
+}
+
+func isUpgradeSignal(s os.Signal) bool {
+	for _, u := range upgradeSignals {
+		if s == u {
+			return true
+		}
+	}
+	return false
+}
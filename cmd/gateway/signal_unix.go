@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals 触发热升级的信号
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
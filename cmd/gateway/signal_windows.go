@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// upgradeSignals Windows没有SIGUSR2，也不能通过ExtraFiles传递socket，不支持热升级
+var upgradeSignals []os.Signal
@@ -0,0 +1,460 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/proxy/fault"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 网关的配置文件，JSON格式，cmd/gateway run和validate读取它
+// 每一类监听是一个数组，一个进程可以同时提供HTTP反向代理、TCP代理、WebSocket代理和正向代理
+// 示例见example.json
+
+// Config 网关配置
+type Config struct {
+	HTTP      []HTTPListener      `json:"http,omitempty"`
+	TCP       []TCPListener       `json:"tcp,omitempty"`
+	WebSocket []WebSocketListener `json:"websocket,omitempty"`
+	Forward   []ForwardListener   `json:"forward,omitempty"`
+	//Admin 管理接口的监听，为nil时不开启
+	Admin *AdminListener `json:"admin,omitempty"`
+	//LabMode 实验室模式，允许TCP故障注入篡改字节，生产环境不要开启
+	LabMode bool `json:"lab_mode,omitempty"`
+	//Auth 认证提供方，路由和WebSocket监听按名字引用
+	Auth *AuthConfig `json:"auth,omitempty"`
+	//ClientIP 真实客户端IP的解析，HTTP和WebSocket监听共用，为nil时使用连接的地址
+	ClientIP *ClientIPConfig `json:"client_ip,omitempty"`
+	//WAF 请求检查的规则文件，路由用waf按名字引用其中的规则集
+	WAF *WAFConfig `json:"waf,omitempty"`
+}
+
+// WAFConfig 对应waf.Engine
+type WAFConfig struct {
+	//RulesFile 规则文件，rule_sets中按名字定义规则集
+	RulesFile string `json:"rules_file"`
+	//MaxBodySize 检查的请求体大小，默认64KB，超出的部分不检查但原样转发
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	//ErrorPage 拦截时返回的页面，为nil时返回默认的403页面
+	ErrorPage *WAFErrorPage `json:"error_page,omitempty"`
+}
+
+// WAFErrorPage 拦截页面，Body和File只能设置一个，内容中的{{rule_id}}替换成命中的规则ID
+type WAFErrorPage struct {
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body,omitempty"`
+	File        string `json:"file,omitempty"`
+}
+
+// ClientIPConfig 对应clientip.Resolver
+type ClientIPConfig struct {
+	//TrustedProxies 受信任的代理网段，只有来自这些地址的请求才采用转发头中的客户端IP
+	TrustedProxies []string `json:"trusted_proxies"`
+	//Header 受信任的代理写入客户端地址的请求头，默认X-Forwarded-For，也可以是Forwarded或X-Real-IP
+	//只看这一个头，不会退回到别的头
+	Header string `json:"header,omitempty"`
+}
+
+// IPFilter 客户端IP的访问列表，对应clientip.AccessList，先检查deny再检查allow，allow为空表示允许所有
+type IPFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	//File 规则文件，每行“allow 网段”或“deny 网段”，修改后自动重新加载
+	File string `json:"file,omitempty"`
+	//ReloadInterval 检查规则文件的间隔，默认10秒
+	ReloadInterval Duration `json:"reload_interval,omitempty"`
+}
+
+// AuthConfig 认证提供方
+type AuthConfig struct {
+	JWT []JWTProvider `json:"jwt,omitempty"`
+	//APIKeys API密钥的存储，路由用auth.api_key开启校验
+	APIKeys *APIKeyStore `json:"api_keys,omitempty"`
+	//HMAC 请求签名的校验方，路由用auth.hmac按名字引用
+	HMAC []HMACProvider `json:"hmac,omitempty"`
+	//OIDC 浏览器登录用的OpenID Connect依赖方，路由用auth.oidc按名字引用
+	OIDC []OIDCProvider `json:"oidc,omitempty"`
+	//Introspection 令牌自省，路由用auth.introspection按名字引用
+	Introspection []IntrospectionProvider `json:"introspection,omitempty"`
+}
+
+// OIDCProvider 一个OpenID Connect依赖方，对应auth.RelyingParty
+type OIDCProvider struct {
+	Name         string `json:"name"`
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	//RedirectURL 回调地址，路径必须落在引用这个依赖方的某条路由下，只写路径时按请求的Host拼成完整地址
+	RedirectURL           string            `json:"redirect_url"`
+	Scopes                []string          `json:"scopes,omitempty"`
+	LogoutPath            string            `json:"logout_path,omitempty"`
+	PostLogoutRedirectURL string            `json:"post_logout_redirect_url,omitempty"`
+	CookieName            string            `json:"cookie_name,omitempty"`
+	SessionTTL            Duration          `json:"session_ttl,omitempty"`
+	ClaimHeaders          map[string]string `json:"claim_headers,omitempty"`
+	ForwardAccessToken    bool              `json:"forward_access_token,omitempty"`
+}
+
+// IntrospectionProvider 一个令牌自省接口，对应auth.IntrospectionAuth
+type IntrospectionProvider struct {
+	Name             string            `json:"name"`
+	URL              string            `json:"url"`
+	ClientID         string            `json:"client_id"`
+	ClientSecret     string            `json:"client_secret,omitempty"`
+	CacheTTL         Duration          `json:"cache_ttl,omitempty"`
+	NegativeCacheTTL Duration          `json:"negative_cache_ttl,omitempty"`
+	Scopes           []string          `json:"scopes,omitempty"`
+	Cookie           string            `json:"cookie,omitempty"`
+	Query            string            `json:"query,omitempty"`
+	ClaimHeaders     map[string]string `json:"claim_headers,omitempty"`
+}
+
+// HMACProvider 一组签名密钥，对应signature.Verifier
+type HMACProvider struct {
+	Name string `json:"name"`
+	//Secrets 可以接受的密钥，轮换时同时配置新旧两个
+	Secrets []HMACSecret `json:"secrets"`
+	//SignedHeaders 参与签名的请求头，必须和调用方一致
+	SignedHeaders []string `json:"signed_headers,omitempty"`
+	//Window 时间戳允许的偏差，默认5分钟
+	Window Duration `json:"window,omitempty"`
+	//MaxBodySize 校验时缓冲请求体的上限，默认1MB
+	MaxBodySize int64 `json:"max_body_size,omitempty"`
+	//Resign 不为nil时用网关的密钥重新签名后转发给上游
+	Resign *HMACResign `json:"resign,omitempty"`
+}
+
+// HMACSecret 一个签名密钥，请求头X-Signature-Key-Id指定ID时只用这个密钥校验
+type HMACSecret struct {
+	ID     string `json:"id,omitempty"`
+	Secret string `json:"secret"`
+}
+
+// HMACResign 转发给上游时使用的签名
+type HMACResign struct {
+	HMACSecret
+	SignedHeaders []string `json:"signed_headers,omitempty"`
+}
+
+// APIKeyStore API密钥文件，对应apikey.Store，密钥通过管理接口的/apikeys创建和修改
+type APIKeyStore struct {
+	//File 保存密钥摘要和用量的JSON文件，不存在时自动创建
+	File string `json:"file"`
+	//Header、Query 密钥所在的请求头和查询参数，默认X-API-Key，查询参数为空时不查找
+	Header string `json:"header,omitempty"`
+	Query  string `json:"query,omitempty"`
+	//IDHeader 把密钥ID转发给上游的请求头，为空时不转发
+	IDHeader string `json:"id_header,omitempty"`
+	//FlushInterval 用量写回文件的间隔，默认10秒
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+}
+
+// JWTProvider 一个JWT签发方，对应auth.JWTAuth
+// 密钥可以来自JWKS地址、PEM公钥文件或者HMAC密钥，至少配置一种
+type JWTProvider struct {
+	Name           string            `json:"name"`
+	JWKSURL        string            `json:"jwks_url,omitempty"`
+	JWKSRefresh    Duration          `json:"jwks_refresh,omitempty"`
+	PublicKeyFiles []string          `json:"public_key_files,omitempty"`
+	HMACSecret     string            `json:"hmac_secret,omitempty"`
+	Algorithms     []string          `json:"algorithms,omitempty"`
+	Issuer         string            `json:"issuer,omitempty"`
+	Audience       []string          `json:"audience,omitempty"`
+	ClockSkew      Duration          `json:"clock_skew,omitempty"`
+	RequireExp     bool              `json:"require_exp,omitempty"`
+	Cookie         string            `json:"cookie,omitempty"`
+	Query          string            `json:"query,omitempty"`
+	ClaimHeaders   map[string]string `json:"claim_headers,omitempty"`
+}
+
+// RouteAuth 路由或WebSocket监听的认证要求，为nil时不认证
+type RouteAuth struct {
+	//JWT 引用auth.jwt中的提供方名字
+	JWT string `json:"jwt,omitempty"`
+	//APIKey 请求必须带有效的API密钥，和JWT同时配置时两个都要通过
+	APIKey bool `json:"api_key,omitempty"`
+	//HMAC 引用auth.hmac中的名字，请求必须带正确的签名，只能用于HTTP路由
+	HMAC string `json:"hmac,omitempty"`
+	//OIDC 引用auth.oidc中的名字，没有会话时跳转登录，只能用于HTTP路由
+	OIDC string `json:"oidc,omitempty"`
+	//Introspection 引用auth.introspection中的名字，令牌交给授权服务器校验
+	//jwt、oidc、introspection三者只能选一个
+	Introspection string `json:"introspection,omitempty"`
+	//Optional 没有JWT、会话或令牌的请求也放行，凭证无效时仍然拒绝，对API密钥和签名不起作用
+	Optional bool `json:"optional,omitempty"`
+}
+
+// AdminListener 管理接口，故障注入、API密钥等运行时开关通过它修改
+type AdminListener struct {
+	Name string `json:"name,omitempty"`
+	Addr string `json:"addr"`
+	//Token 设置后每个请求都要带Authorization: Bearer <token>
+	//监听在回环地址以外时必须设置，否则能访问这个端口的人都可以注入故障、创建API密钥
+	Token string `json:"token,omitempty"`
+}
+
+// ListenOptions 监听选项，对应server.ListenConfig，嵌在各类代理的监听中
+type ListenOptions struct {
+	//Network tcp（默认）、tcp4、tcp6、unix，unix时addr是socket文件路径
+	Network string `json:"network,omitempty"`
+	//IPv6Only 只接收IPv6连接，默认监听[::]时同时接收IPv4连接
+	IPv6Only bool `json:"ipv6_only,omitempty"`
+	//ReusePort 大于0时开启SO_REUSEPORT，在同一个地址上打开这么多个监听，只支持Linux
+	ReusePort int `json:"reuse_port,omitempty"`
+	//Backlog 全连接队列的长度，0表示使用系统默认值，只支持Linux
+	Backlog int `json:"backlog,omitempty"`
+	//DisableNoDelay 关闭TCP_NODELAY，启用Nagle算法合并小包
+	DisableNoDelay bool `json:"disable_no_delay,omitempty"`
+	//UnixSocketMode unix socket文件的权限，八进制字符串，比如"0660"
+	UnixSocketMode string `json:"unix_socket_mode,omitempty"`
+}
+
+// FileMode 解析unix_socket_mode，为空时返回0，表示不修改权限
+func (o ListenOptions) FileMode() (os.FileMode, error) {
+	if o.UnixSocketMode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(o.UnixSocketMode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid unix_socket_mode %q", o.UnixSocketMode)
+	}
+	return os.FileMode(m), nil
+}
+
+// HTTPListener HTTP反向代理的监听，按路径前缀把请求分给不同的路由
+type HTTPListener struct {
+	Name string `json:"name,omitempty"`
+	Addr string `json:"addr"`
+	ListenOptions
+	//ProxyProtocol 解析四层负载均衡写入的PROXY协议头部，必须同时设置受信任的网段
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+	//ProxyProtocolTrustedCIDRs 只解析来自这些网段（负载均衡）的头部，其它连接的头部原样透传
+	ProxyProtocolTrustedCIDRs []string `json:"proxy_protocol_trusted_cidrs,omitempty"`
+	//ProxyProtocolRequired 受信任的连接必须带头部
+	ProxyProtocolRequired bool `json:"proxy_protocol_required,omitempty"`
+	//ProxyProtocolHeaderTimeout 读取头部的超时时间，默认5秒
+	ProxyProtocolHeaderTimeout Duration `json:"proxy_protocol_header_timeout,omitempty"`
+	//IPFilter 整个监听的访问列表，在路由之前检查
+	IPFilter *IPFilter `json:"ip_filter,omitempty"`
+	Routes   []Route   `json:"routes"`
+}
+
+// Route 一条HTTP路由，对应reverseproxy.Route
+type Route struct {
+	Name        string   `json:"name,omitempty"`
+	PathPrefix  string   `json:"path_prefix"`
+	StripPrefix bool     `json:"strip_prefix,omitempty"`
+	Targets     []string `json:"targets"`
+	//HostPolicy preserve（默认）、upstream，或者一个固定的Host
+	HostPolicy      string       `json:"host_policy,omitempty"`
+	RequestHeaders  *HeaderRules `json:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules `json:"response_headers,omitempty"`
+	Retry           *RetryPolicy `json:"retry,omitempty"`
+	//Fault 故障注入，启动时就开启，之后可以通过管理接口修改
+	Fault *fault.HTTPFault `json:"fault,omitempty"`
+	//Auth 这条路由是否需要认证
+	Auth *RouteAuth `json:"auth,omitempty"`
+	//IPFilter 这条路由的访问列表，在认证之前检查
+	IPFilter *IPFilter `json:"ip_filter,omitempty"`
+	//WAF 检查请求用的规则集名字，在IP过滤之后、认证之前检查
+	WAF string `json:"waf,omitempty"`
+
+	//请求改写按path_rewrite、request_query、method_override、request_headers、request_json的顺序执行
+	PathRewrite    *PathRewrite    `json:"path_rewrite,omitempty"`
+	RequestQuery   *HeaderRules    `json:"request_query,omitempty"`
+	MethodOverride *MethodOverride `json:"method_override,omitempty"`
+	RequestJSON    *RequestJSON    `json:"request_json,omitempty"`
+	//响应改写按status_remap、response_headers、body_replace、response_json、html_inject的顺序执行
+	//StatusRemap 上游状态码到返回给客户端的状态码，比如{"500": 502}
+	StatusRemap  map[int]int   `json:"status_remap,omitempty"`
+	BodyReplace  []BodyReplace `json:"body_replace,omitempty"`
+	ResponseJSON *ResponseJSON `json:"response_json,omitempty"`
+	HTMLInject   *HTMLInject   `json:"html_inject,omitempty"`
+}
+
+// HeaderRules 设置、追加、删除头部，request_query中是查询参数
+type HeaderRules struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// PathRewrite 对应reverseproxy.PathRewrite，replacement中可以用$1、${name}引用分组
+type PathRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// MethodOverride 对应reverseproxy.MethodOverride，method和header只能设置一个
+type MethodOverride struct {
+	Method string `json:"method,omitempty"`
+	Header string `json:"header,omitempty"`
+	//Allowed 请求头中允许改成的方法，默认GET、POST、PUT、PATCH、DELETE
+	Allowed []string `json:"allowed,omitempty"`
+}
+
+// RequestJSON 对应reverseproxy.JSONBodyFields，字段路径用"."分隔
+type RequestJSON struct {
+	Add         map[string]interface{} `json:"add"`
+	MaxBodySize int64                  `json:"max_body_size,omitempty"`
+}
+
+// BodyReplace 对应reverseproxy.RegexReplace
+type BodyReplace struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+	//ContentTypes 只改写这些类型，为空时改写文本、JSON和XML
+	ContentTypes []string `json:"content_types,omitempty"`
+	MaxBodySize  int64    `json:"max_body_size,omitempty"`
+}
+
+// ResponseJSON 对应reverseproxy.JSONFields，字段路径用"."分隔
+type ResponseJSON struct {
+	Add         map[string]interface{} `json:"add,omitempty"`
+	Remove      []string               `json:"remove,omitempty"`
+	Mask        []string               `json:"mask,omitempty"`
+	MaskWith    string                 `json:"mask_with,omitempty"`
+	MaxBodySize int64                  `json:"max_body_size,omitempty"`
+}
+
+// HTMLInject 对应reverseproxy.HTMLInject
+type HTMLInject struct {
+	//Before 在这个标签之前注入，默认"</body>"
+	Before  string `json:"before,omitempty"`
+	Content string `json:"content"`
+}
+
+// RetryPolicy 对应reverseproxy.RetryPolicy
+type RetryPolicy struct {
+	Attempts           int      `json:"attempts"`
+	RetryOn            []int    `json:"retry_on,omitempty"`
+	RetryNonIdempotent bool     `json:"retry_non_idempotent,omitempty"`
+	BackoffBase        Duration `json:"backoff_base,omitempty"`
+	BackoffMax         Duration `json:"backoff_max,omitempty"`
+}
+
+// TCPListener TCP代理的监听
+type TCPListener struct {
+	Name string `json:"name,omitempty"`
+	Addr string `json:"addr"`
+	ListenOptions
+	Upstreams []string `json:"upstreams"`
+
+	DialTimeout      Duration `json:"dial_timeout,omitempty"`
+	ConnectBudget    Duration `json:"connect_budget,omitempty"`
+	IdleTimeout      Duration `json:"idle_timeout,omitempty"`
+	MaxConnectionAge Duration `json:"max_connection_age,omitempty"`
+	//ProxyProtocol 解析客户端一侧的PROXY协议头部，必须同时设置受信任的网段
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+	//ProxyProtocolTrustedCIDRs、ProxyProtocolRequired、ProxyProtocolHeaderTimeout 和HTTPListener中的相同
+	ProxyProtocolTrustedCIDRs  []string `json:"proxy_protocol_trusted_cidrs,omitempty"`
+	ProxyProtocolRequired      bool     `json:"proxy_protocol_required,omitempty"`
+	ProxyProtocolHeaderTimeout Duration `json:"proxy_protocol_header_timeout,omitempty"`
+	//ProxyProtocolVersion 向上游写入PROXY协议头部的版本，0表示不写
+	ProxyProtocolVersion byte `json:"proxy_protocol_version,omitempty"`
+
+	//Allow、Deny 客户端IP的网段，写法见proxyproto.ParseCIDRs，和ip_filter中的网段合并
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	//IPFilter 访问列表，可以从文件加载，在TCPServer把连接交给处理器之前检查
+	IPFilter *IPFilter `json:"ip_filter,omitempty"`
+	//ConnRate、ConnBurst 每秒新连接数的限制，0表示不限制
+	ConnRate  float64 `json:"conn_rate,omitempty"`
+	ConnBurst int     `json:"conn_burst,omitempty"`
+	//LogConnections 记录每个连接的建立和关闭
+	LogConnections bool `json:"log_connections,omitempty"`
+	//Fault 故障注入，corrupt_rate需要开启lab_mode
+	Fault *fault.TCPFault `json:"fault,omitempty"`
+}
+
+// WebSocketListener 消息级别的WebSocket代理，对应wsproxy.WebSocketProxy
+type WebSocketListener struct {
+	Name string `json:"name,omitempty"`
+	Addr string `json:"addr"`
+	ListenOptions
+	Target string `json:"target"`
+	//IPFilter 握手请求的访问列表
+	IPFilter *IPFilter `json:"ip_filter,omitempty"`
+
+	MaxMessageSize int64    `json:"max_message_size,omitempty"`
+	MessageRate    float64  `json:"message_rate,omitempty"`
+	MessageBurst   int      `json:"message_burst,omitempty"`
+	IdleTimeout    Duration `json:"idle_timeout,omitempty"`
+	PingInterval   Duration `json:"ping_interval,omitempty"`
+	DrainTimeout   Duration `json:"drain_timeout,omitempty"`
+	LogMessages    bool     `json:"log_messages,omitempty"`
+
+	AllowedOrigins     []string `json:"allowed_origins,omitempty"`
+	AllowMissingOrigin bool     `json:"allow_missing_origin,omitempty"`
+	Subprotocols       []string `json:"subprotocols,omitempty"`
+	//Tokens 令牌到用户名，不为空时握手必须带令牌（Authorization头、token参数或cookie）
+	Tokens             map[string]string `json:"tokens,omitempty"`
+	MaxSessionsPerUser int               `json:"max_sessions_per_user,omitempty"`
+	//Auth 握手请求的认证，不能和tokens同时使用
+	Auth *RouteAuth `json:"auth,omitempty"`
+}
+
+// ForwardListener 正向代理的监听
+type ForwardListener struct {
+	Name string `json:"name,omitempty"`
+	Addr string `json:"addr"`
+	ListenOptions
+	LogRequests bool `json:"log_requests,omitempty"`
+}
+
+// Duration 配置文件中的时间，写成字符串，比如"500ms"、"30s"、"1m"
+type Duration time.Duration
+
+// UnmarshalJSON 解析"30s"这样的字符串
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\", got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON 输出成字符串
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Parse 解析配置，不认识的字段当作错误，避免拼错的配置项被悄悄忽略
+func Parse(data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Load 读取并解析配置文件
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ErrEmpty 配置中没有任何监听
+var ErrEmpty = errors.New("config: no listeners configured")
@@ -0,0 +1,467 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gateway/proxy/auth"
+	"gateway/proxy/fault"
+	"gateway/proxy/proxyproto"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Validate 检查配置，返回所有的问题，而不是遇到第一个就停下
+// 没有名字的监听按类型和序号补上名字，比如tcp[0]
+func (c *Config) Validate() error {
+	v := &validator{names: make(map[string]bool), addrs: make(map[string]string)}
+	if len(c.HTTP)+len(c.TCP)+len(c.WebSocket)+len(c.Forward) == 0 {
+		return ErrEmpty
+	}
+
+	jwt := make(map[string]bool)
+	hmac := make(map[string]bool)
+	oidc := make(map[string]*oidcUse)
+	introspection := make(map[string]bool)
+	if c.Auth != nil {
+		for i, p := range c.Auth.JWT {
+			where := fmt.Sprintf("auth.jwt[%d]", i)
+			if p.Name == "" {
+				v.errorf("%s: name is required", where)
+			} else if jwt[p.Name] {
+				v.errorf("%s: duplicate provider name %q", where, p.Name)
+			}
+			jwt[p.Name] = true
+			if p.JWKSURL == "" && len(p.PublicKeyFiles) == 0 && p.HMACSecret == "" {
+				v.errorf("%s: one of jwks_url, public_key_files or hmac_secret is required", where)
+			}
+			if p.JWKSURL != "" {
+				v.httpURL(where, p.JWKSURL)
+			}
+			for _, alg := range p.Algorithms {
+				if alg != auth.HS256 && alg != auth.RS256 && alg != auth.ES256 {
+					v.errorf("%s: unsupported algorithm %q", where, alg)
+				}
+			}
+		}
+		if c.Auth.APIKeys != nil && c.Auth.APIKeys.File == "" {
+			v.errorf("auth.api_keys: file is required")
+		}
+		for i, p := range c.Auth.HMAC {
+			where := fmt.Sprintf("auth.hmac[%d]", i)
+			if p.Name == "" {
+				v.errorf("%s: name is required", where)
+			} else if hmac[p.Name] {
+				v.errorf("%s: duplicate name %q", where, p.Name)
+			}
+			hmac[p.Name] = true
+			if len(p.Secrets) == 0 {
+				v.errorf("%s: no secrets", where)
+			}
+			ids := make(map[string]bool)
+			for j, s := range p.Secrets {
+				if s.Secret == "" {
+					v.errorf("%s.secrets[%d]: secret is required", where, j)
+				}
+				if ids[s.ID] {
+					v.errorf("%s.secrets[%d]: duplicate id %q", where, j, s.ID)
+				}
+				ids[s.ID] = true
+			}
+			if p.Window < 0 || p.MaxBodySize < 0 {
+				v.errorf("%s: window and max_body_size must not be negative", where)
+			}
+			if p.Resign != nil && p.Resign.Secret == "" {
+				v.errorf("%s: resign.secret is required", where)
+			}
+		}
+		for i, p := range c.Auth.OIDC {
+			where := fmt.Sprintf("auth.oidc[%d]", i)
+			if p.Name == "" {
+				v.errorf("%s: name is required", where)
+			} else if oidc[p.Name] != nil {
+				v.errorf("%s: duplicate name %q", where, p.Name)
+			}
+			oidc[p.Name] = &oidcUse{where: where}
+			v.httpURL(where, p.Issuer)
+			if p.ClientID == "" {
+				v.errorf("%s: client_id is required", where)
+			}
+			if u, err := url.Parse(p.RedirectURL); err != nil || !(strings.HasPrefix(p.RedirectURL, "/") ||
+				(u.Scheme == "http" || u.Scheme == "https") && u.Host != "") {
+				v.errorf("%s: redirect_url %q must be a path or an absolute http or https URL", where, p.RedirectURL)
+			} else {
+				oidc[p.Name].callback = u.Path
+			}
+		}
+		for i, p := range c.Auth.Introspection {
+			where := fmt.Sprintf("auth.introspection[%d]", i)
+			if p.Name == "" {
+				v.errorf("%s: name is required", where)
+			} else if introspection[p.Name] {
+				v.errorf("%s: duplicate name %q", where, p.Name)
+			}
+			introspection[p.Name] = true
+			v.httpURL(where, p.URL)
+			if p.ClientID == "" {
+				v.errorf("%s: client_id is required", where)
+			}
+		}
+	}
+	checkAuth := func(where string, a *RouteAuth) {
+		if a != nil && a.JWT != "" && !jwt[a.JWT] {
+			v.errorf("%s: unknown jwt provider %q", where, a.JWT)
+		}
+		if a != nil && a.APIKey && (c.Auth == nil || c.Auth.APIKeys == nil) {
+			v.errorf("%s: api_key requires auth.api_keys", where)
+		}
+		if a != nil && a.HMAC != "" && !hmac[a.HMAC] {
+			v.errorf("%s: unknown hmac provider %q", where, a.HMAC)
+		}
+		if a != nil && a.OIDC != "" && oidc[a.OIDC] == nil {
+			v.errorf("%s: unknown oidc provider %q", where, a.OIDC)
+		}
+		if a != nil && a.Introspection != "" && !introspection[a.Introspection] {
+			v.errorf("%s: unknown introspection provider %q", where, a.Introspection)
+		}
+		if a != nil && countNonEmpty(a.JWT, a.OIDC, a.Introspection) > 1 {
+			v.errorf("%s: only one of jwt, oidc and introspection can be used", where)
+		}
+	}
+
+	for i := range c.HTTP {
+		l := &c.HTTP[i]
+		v.listener("http", i, &l.Name, l.Addr, l.ListenOptions)
+		v.proxyProtocol(l.Name, l.ProxyProtocol, l.ProxyProtocolTrustedCIDRs, l.ProxyProtocolRequired, l.ProxyProtocolHeaderTimeout)
+		v.ipFilter(l.Name, l.IPFilter)
+		if len(l.Routes) == 0 {
+			v.errorf("%s: no routes", l.Name)
+		}
+		routeNames := make(map[string]bool)
+		for j := range l.Routes {
+			r := &l.Routes[j]
+			where := fmt.Sprintf("%s.routes[%d]", l.Name, j)
+			//路由名在监听内唯一，故障注入等按“监听名/路由名”找到路由
+			if r.Name == "" {
+				r.Name = fmt.Sprintf("route[%d]", j)
+			}
+			if routeNames[r.Name] {
+				v.errorf("%s: duplicate route name %q", where, r.Name)
+			}
+			routeNames[r.Name] = true
+			if !strings.HasPrefix(r.PathPrefix, "/") {
+				v.errorf("%s: path_prefix %q must start with /", where, r.PathPrefix)
+			}
+			if len(r.Targets) == 0 {
+				v.errorf("%s: no targets", where)
+			}
+			for _, t := range r.Targets {
+				v.httpURL(where, t)
+			}
+			if r.Retry != nil && r.Retry.Attempts < 0 {
+				v.errorf("%s: retry.attempts must not be negative", where)
+			}
+			v.transformers(where, r)
+			checkAuth(where, r.Auth)
+			v.ipFilter(where, r.IPFilter)
+			if r.WAF != "" && c.WAF == nil {
+				v.errorf("%s: waf requires the top-level waf config", where)
+			}
+			if r.Auth != nil && oidc[r.Auth.OIDC] != nil {
+				oidc[r.Auth.OIDC].prefixes = append(oidc[r.Auth.OIDC].prefixes, r.PathPrefix)
+			}
+		}
+	}
+	if w := c.WAF; w != nil {
+		if w.RulesFile == "" {
+			v.errorf("waf: rules_file is required")
+		}
+		if w.MaxBodySize < 0 {
+			v.errorf("waf: max_body_size must not be negative")
+		}
+		if p := w.ErrorPage; p != nil {
+			if p.Status != 0 && (p.Status < 400 || p.Status > 599) {
+				v.errorf("waf: error_page.status %d must be between 400 and 599", p.Status)
+			}
+			if p.Body != "" && p.File != "" {
+				v.errorf("waf: only one of error_page.body and error_page.file can be set")
+			}
+		}
+	}
+	//回调地址要由使用这个依赖方的路由处理，否则登录回来会落到别的路由上
+	if c.Auth != nil {
+		for _, p := range c.Auth.OIDC {
+			use := oidc[p.Name]
+			if use != nil && use.callback != "" && len(use.prefixes) > 0 && !underAny(use.callback, use.prefixes) {
+				v.errorf("%s: redirect_url path %q is not under any route using oidc %q", use.where, use.callback, p.Name)
+			}
+		}
+	}
+
+	for i := range c.TCP {
+		l := &c.TCP[i]
+		v.listener("tcp", i, &l.Name, l.Addr, l.ListenOptions)
+		if len(l.Upstreams) == 0 {
+			v.errorf("%s: no upstreams", l.Name)
+		}
+		for _, u := range l.Upstreams {
+			if _, _, err := net.SplitHostPort(u); err != nil {
+				v.errorf("%s: upstream %q: %v", l.Name, u, err)
+			}
+		}
+		v.proxyProtocol(l.Name, l.ProxyProtocol, l.ProxyProtocolTrustedCIDRs, l.ProxyProtocolRequired, l.ProxyProtocolHeaderTimeout)
+		if l.ProxyProtocolVersion > 2 {
+			v.errorf("%s: proxy_protocol_version must be 0, 1 or 2", l.Name)
+		}
+		if _, err := proxyproto.ParseCIDRs(l.Allow); err != nil {
+			v.errorf("%s: allow: %v", l.Name, err)
+		}
+		if _, err := proxyproto.ParseCIDRs(l.Deny); err != nil {
+			v.errorf("%s: deny: %v", l.Name, err)
+		}
+		v.ipFilter(l.Name, l.IPFilter)
+		if l.ConnRate < 0 {
+			v.errorf("%s: conn_rate must not be negative", l.Name)
+		}
+		if l.Fault != nil && l.Fault.CorruptRate > 0 && !c.LabMode {
+			v.errorf("%s: %v", l.Name, fault.ErrLabMode)
+		}
+	}
+
+	for i := range c.WebSocket {
+		l := &c.WebSocket[i]
+		v.listener("websocket", i, &l.Name, l.Addr, l.ListenOptions)
+		v.ipFilter(l.Name, l.IPFilter)
+		v.httpURL(l.Name, l.Target)
+		checkAuth(l.Name, l.Auth)
+		//浏览器发起的WebSocket握手没办法签名，也不能跟着跳转去登录
+		if l.Auth != nil && (l.Auth.HMAC != "" || l.Auth.OIDC != "") {
+			v.errorf("%s: hmac and oidc are only supported on http routes", l.Name)
+		}
+		if l.Auth != nil && len(l.Tokens) > 0 {
+			v.errorf("%s: tokens and auth cannot be used together", l.Name)
+		}
+	}
+
+	for i := range c.Forward {
+		l := &c.Forward[i]
+		v.listener("forward", i, &l.Name, l.Addr, l.ListenOptions)
+	}
+
+	if c.ClientIP != nil {
+		if _, err := proxyproto.ParseCIDRs(c.ClientIP.TrustedProxies); err != nil {
+			v.errorf("client_ip.trusted_proxies: %v", err)
+		}
+	}
+
+	if c.Admin != nil {
+		if c.Admin.Name == "" {
+			c.Admin.Name = "admin"
+		}
+		v.listener("admin", 0, &c.Admin.Name, c.Admin.Addr, ListenOptions{})
+		if c.Admin.Token == "" && !loopback(c.Admin.Addr) {
+			v.errorf("%s: token is required when addr %q is not a loopback address", c.Admin.Name, c.Admin.Addr)
+		}
+	}
+	return errors.Join(v.errs...)
+}
+
+// ipFilter 检查访问列表中的网段，规则文件在启动时读取，这里不检查
+func (v *validator) ipFilter(where string, f *IPFilter) {
+	if f == nil {
+		return
+	}
+	if _, err := proxyproto.ParseCIDRs(f.Allow); err != nil {
+		v.errorf("%s: ip_filter.allow: %v", where, err)
+	}
+	if _, err := proxyproto.ParseCIDRs(f.Deny); err != nil {
+		v.errorf("%s: ip_filter.deny: %v", where, err)
+	}
+	if f.ReloadInterval < 0 {
+		v.errorf("%s: ip_filter.reload_interval must not be negative", where)
+	}
+}
+
+// proxyProtocol 开启PROXY协议时必须指定受信任的网段，否则任何直连的客户端都可以伪造自己的地址
+func (v *validator) proxyProtocol(where string, on bool, trusted []string, required bool, timeout Duration) {
+	if on && len(trusted) == 0 {
+		v.errorf("%s: proxy_protocol requires proxy_protocol_trusted_cidrs", where)
+	}
+	if !on && (len(trusted) > 0 || required || timeout != 0) {
+		v.errorf("%s: proxy_protocol_* settings require proxy_protocol", where)
+	}
+	if _, err := proxyproto.ParseCIDRs(trusted); err != nil {
+		v.errorf("%s: proxy_protocol_trusted_cidrs: %v", where, err)
+	}
+	if timeout < 0 {
+		v.errorf("%s: proxy_protocol_header_timeout must not be negative", where)
+	}
+}
+
+// loopback 判断监听地址是否只在本机可以访问，主机名为空表示所有网卡
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// oidcUse 一个OIDC依赖方的回调路径和引用它的路由前缀
+type oidcUse struct {
+	where    string
+	callback string
+	prefixes []string
+}
+
+func underAny(path string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func countNonEmpty(list ...string) int {
+	n := 0
+	for _, s := range list {
+		if s != "" {
+			n++
+		}
+	}
+	return n
+}
+
+type validator struct {
+	errs  []error
+	names map[string]bool
+	addrs map[string]string //地址到监听名，检查重复的地址
+}
+
+func (v *validator) errorf(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("config: "+format, args...))
+}
+
+// listener 检查名字、地址和监听选项，名字为空时补上默认名
+func (v *validator) listener(kind string, i int, name *string, addr string, o ListenOptions) {
+	if *name == "" {
+		*name = fmt.Sprintf("%s[%d]", kind, i)
+	}
+	if v.names[*name] {
+		v.errorf("%s: duplicate listener name", *name)
+	}
+	v.names[*name] = true
+
+	switch o.Network {
+	case "", "tcp", "tcp4", "tcp6", "unix":
+	default:
+		v.errorf("%s: network %q must be tcp, tcp4, tcp6 or unix", *name, o.Network)
+	}
+	if o.ReusePort < 0 || o.Backlog < 0 {
+		v.errorf("%s: reuse_port and backlog must not be negative", *name)
+	}
+	if o.IPv6Only && o.Network != "" && o.Network != "tcp" && o.Network != "tcp6" {
+		v.errorf("%s: ipv6_only requires network tcp or tcp6", *name)
+	}
+	if o.UnixSocketMode != "" {
+		if _, err := o.FileMode(); err != nil {
+			v.errorf("%s: unix_socket_mode %q must be an octal permission like \"0660\"", *name, o.UnixSocketMode)
+		}
+	}
+	if o.Network == "unix" {
+		if addr == "" {
+			v.errorf("%s: addr must be a socket path when network is unix", *name)
+		}
+		if o.ReusePort > 0 {
+			v.errorf("%s: reuse_port is not supported on unix sockets", *name)
+		}
+		if other, ok := v.addrs["unix:"+addr]; ok {
+			v.errorf("%s: addr %s already used by %s", *name, addr, other)
+		}
+		v.addrs["unix:"+addr] = *name
+		return
+	}
+	if o.UnixSocketMode != "" {
+		v.errorf("%s: unix_socket_mode requires network unix", *name)
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.errorf("%s: addr %q: %v", *name, addr, err)
+		return
+	}
+	//端口为0时每次监听都是随机端口，不算重复
+	if port != "0" {
+		if other, ok := v.addrs[addr]; ok {
+			v.errorf("%s: addr %s already used by %s", *name, addr, other)
+		}
+		v.addrs[addr] = *name
+	}
+}
+
+// transformers 检查路由的请求和响应改写，正则在这里编译一次，buildRoute中不会再出错
+func (v *validator) transformers(where string, r *Route) {
+	if p := r.PathRewrite; p != nil {
+		if _, err := regexp.Compile(p.Pattern); err != nil {
+			v.errorf("%s: path_rewrite.pattern: %v", where, err)
+		}
+	}
+	if m := r.MethodOverride; m != nil {
+		if (m.Method == "") == (m.Header == "") {
+			v.errorf("%s: method_override requires exactly one of method and header", where)
+		}
+		if m.Method != "" && !validMethod(m.Method) {
+			v.errorf("%s: method_override.method %q is not a valid method", where, m.Method)
+		}
+	}
+	if j := r.RequestJSON; j != nil && (len(j.Add) == 0 || j.MaxBodySize < 0) {
+		v.errorf("%s: request_json needs fields to add and a non-negative max_body_size", where)
+	}
+	for from, to := range r.StatusRemap {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			v.errorf("%s: status_remap %d -> %d: status codes must be between 100 and 599", where, from, to)
+		}
+	}
+	for i, b := range r.BodyReplace {
+		if _, err := regexp.Compile(b.Pattern); err != nil {
+			v.errorf("%s: body_replace[%d].pattern: %v", where, i, err)
+		}
+		if b.MaxBodySize < 0 {
+			v.errorf("%s: body_replace[%d].max_body_size must not be negative", where, i)
+		}
+	}
+	if j := r.ResponseJSON; j != nil && j.MaxBodySize < 0 {
+		v.errorf("%s: response_json.max_body_size must not be negative", where)
+	}
+	if h := r.HTMLInject; h != nil && h.Content == "" {
+		v.errorf("%s: html_inject.content is required", where)
+	}
+}
+
+// validMethod 方法名只能由token字符组成，改写后的方法要能原样写进请求行
+func validMethod(m string) bool {
+	for _, c := range m {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return m != ""
+}
+
+// httpURL 检查上游地址是否是http或https的绝对地址
+func (v *validator) httpURL(where, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.errorf("%s: target %q: %v", where, raw, err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf("%s: target %q must be an absolute http or https URL", where, raw)
+	}
+}
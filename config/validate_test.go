@@ -0,0 +1,57 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTransformersAndListenOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		//listener、route 拼进一个HTTP监听里的JSON片段
+		listener string
+		route    string
+		//want 为空表示配置合法
+		want string
+	}{
+		{name: "valid", listener: `"network": "tcp6", "ipv6_only": true, "reuse_port": 2, "backlog": 128`,
+			route: `"path_rewrite": {"pattern": "^/a/(\\d+)$", "replacement": "/b/$1"},
+				"method_override": {"header": "X-HTTP-Method-Override"},
+				"status_remap": {"500": 502}, "body_replace": [{"pattern": "x+", "replacement": "y"}],
+				"html_inject": {"content": "<p>"}`},
+		{name: "bad path pattern", route: `"path_rewrite": {"pattern": "(", "replacement": ""}`, want: "path_rewrite.pattern"},
+		{name: "bad body pattern", route: `"body_replace": [{"pattern": "[", "replacement": ""}]`, want: "body_replace[0].pattern"},
+		{name: "method and header", route: `"method_override": {"method": "POST", "header": "X-M"}`, want: "exactly one of method and header"},
+		{name: "invalid method", route: `"method_override": {"method": "GET /"}`, want: "not a valid method"},
+		{name: "status out of range", route: `"status_remap": {"500": 700}`, want: "status_remap 500 -> 700"},
+		{name: "empty html inject", route: `"html_inject": {"before": "</head>"}`, want: "html_inject.content"},
+		{name: "empty request json", route: `"request_json": {"add": {}}`, want: "request_json"},
+		{name: "unknown network", listener: `"network": "udp"`, want: `network "udp"`},
+		{name: "ipv6_only on tcp4", listener: `"network": "tcp4", "ipv6_only": true`, want: "ipv6_only requires"},
+		{name: "reuse_port on unix", listener: `"network": "unix", "reuse_port": 2`, want: "reuse_port is not supported on unix"},
+		{name: "mode without unix", listener: `"unix_socket_mode": "0600"`, want: "unix_socket_mode requires network unix"},
+		{name: "bad mode", listener: `"network": "unix", "unix_socket_mode": "rw"`, want: "octal permission"},
+	}
+	for _, c := range cases {
+		addr := "127.0.0.1:8080"
+		if strings.Contains(c.listener, `"unix"`) {
+			addr = "/run/gateway.sock"
+		}
+		listener := c.listener
+		if listener != "" {
+			listener += ", "
+		}
+		route := c.route
+		if route != "" {
+			route = ", " + route
+		}
+		_, err := Parse([]byte(`{"http": [{"addr": "` + addr + `", ` + listener +
+			`"routes": [{"path_prefix": "/", "targets": ["http://127.0.0.1:9000"]` + route + `}]}]}`))
+		switch {
+		case c.want == "" && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+			t.Errorf("%s: got error %v, want one containing %q", c.name, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package gatewaytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 断言函数：失败时调用t.Fatalf，错误信息中带上期望值和实际值
+
+// ReadBody 读出响应体
+func ReadBody(t testing.TB, res *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("gatewaytest: read body: %v", err)
+	}
+	res.Body.Close()
+	return string(b)
+}
+
+// AssertStatus 检查状态码
+func AssertStatus(t testing.TB, res *http.Response, want int) {
+	t.Helper()
+	if res.StatusCode != want {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		t.Fatalf("status = %d, want %d; body: %q", res.StatusCode, want, body)
+	}
+}
+
+// AssertHeader 检查头部的值，want为空时检查头部不存在
+func AssertHeader(t testing.TB, h http.Header, key, want string) {
+	t.Helper()
+	got, ok := h[http.CanonicalHeaderKey(key)]
+	switch {
+	case want == "" && ok:
+		t.Fatalf("header %s = %q, want absent", key, got)
+	case want != "" && h.Get(key) != want:
+		t.Fatalf("header %s = %q, want %q", key, got, want)
+	}
+}
+
+// AssertRoutedTo 检查响应来自哪个上游
+func AssertRoutedTo(t testing.TB, res *http.Response, up *HTTPUpstream) {
+	t.Helper()
+	if got := res.Header.Get(HeaderUpstream); got != up.Name {
+		t.Fatalf("routed to upstream %q, want %q", got, up.Name)
+	}
+}
+
+// EchoAssert 对上游回显的请求做断言，方法可以链式调用
+type EchoAssert struct {
+	t testing.TB
+	Echo
+}
+
+// AssertEcho 解析HTTPUpstream默认处理器返回的Echo
+func AssertEcho(t testing.TB, res *http.Response) *EchoAssert {
+	t.Helper()
+	var e Echo
+	body := ReadBody(t, res)
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		t.Fatalf("gatewaytest: response is not an echo: %v; body: %q", err, body)
+	}
+	return &EchoAssert{t: t, Echo: e}
+}
+
+// Path 检查上游收到的路径
+func (a *EchoAssert) Path(want string) *EchoAssert {
+	a.t.Helper()
+	if a.Echo.Path != want {
+		a.t.Fatalf("upstream path = %q, want %q", a.Echo.Path, want)
+	}
+	return a
+}
+
+// Query 检查上游收到的查询参数
+func (a *EchoAssert) Query(want string) *EchoAssert {
+	a.t.Helper()
+	if a.RawQuery != want {
+		a.t.Fatalf("upstream query = %q, want %q", a.RawQuery, want)
+	}
+	return a
+}
+
+// Host 检查上游收到的Host
+func (a *EchoAssert) Host(want string) *EchoAssert {
+	a.t.Helper()
+	if a.Echo.Host != want {
+		a.t.Fatalf("upstream host = %q, want %q", a.Echo.Host, want)
+	}
+	return a
+}
+
+// Header 检查上游收到的头部，want为空时检查头部不存在
+func (a *EchoAssert) Header(key, want string) *EchoAssert {
+	a.t.Helper()
+	AssertHeader(a.t, a.Echo.Header, key, want)
+	return a
+}
+
+// Body 检查上游收到的请求体
+func (a *EchoAssert) Body(want string) *EchoAssert {
+	a.t.Helper()
+	if a.Echo.Body != want {
+		a.t.Fatalf("upstream body = %q, want %q", a.Echo.Body, want)
+	}
+	return a
+}
+
+// AssertRoundTrip 写入payload，检查读回的字节完全相同，适用于经过代理的回显上游
+func AssertRoundTrip(t testing.TB, conn net.Conn, payload []byte) {
+	t.Helper()
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("gatewaytest: write: %v", err)
+	}
+	got := ReadN(t, conn, len(payload))
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("read back %q, want %q", abbrev(got), abbrev(payload))
+	}
+}
+
+// ReadN 读取恰好n个字节，5秒内读不完时让测试失败
+func ReadN(t testing.TB, conn net.Conn, n int) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, n)
+	if m, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("gatewaytest: read %d bytes, got %d: %v", n, m, err)
+	}
+	return buf
+}
+
+// AssertClosed 检查对方已经关闭连接：5秒内读到EOF或者连接被重置
+func AssertClosed(t testing.TB, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	var buf [1]byte
+	n, err := conn.Read(buf[:])
+	if n > 0 {
+		t.Fatalf("connection still open: read %q", buf[:n])
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("connection still open after 5s")
+	}
+}
+
+func abbrev(b []byte) []byte {
+	if len(b) > 64 {
+		return append(b[:64:64], "..."...)
+	}
+	return b
+}
@@ -0,0 +1,210 @@
+package gatewaytest
+
+import (
+	"context"
+	"encoding/json"
+	"gateway/app"
+	"gateway/config"
+	"gateway/proxy/tcp_proxy/server"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Gateway 在测试进程中运行的网关
+type Gateway struct {
+	App *app.App
+	//Client 请求网关用的客户端，不跟随重定向，方便断言3xx响应
+	Client *http.Client
+}
+
+// Start 用内存中的配置启动网关，测试结束时自动关闭
+// 没有写addr的监听使用127.0.0.1:0，实际地址通过Addr、URL按监听名获取
+func Start(t testing.TB, cfg *config.Config) *Gateway {
+	t.Helper()
+	ephemeral(cfg)
+	a, err := app.New(cfg)
+	if err != nil {
+		t.Fatalf("gatewaytest: %v", err)
+	}
+	a.Logger = log.New(testWriter{t}, "", 0)
+	if err := a.Start(); err != nil {
+		t.Fatalf("gatewaytest: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := a.Shutdown(ctx); err != nil {
+			t.Logf("gatewaytest: shutdown: %v", err)
+		}
+	})
+	return &Gateway{
+		App: a,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// StartJSON 解析JSON配置后启动网关，可以省略addr
+func StartJSON(t testing.TB, js string) *Gateway {
+	t.Helper()
+	cfg := &config.Config{}
+	//先不检查，补上地址之后由app.New检查
+	if err := strictDecode(js, cfg); err != nil {
+		t.Fatalf("gatewaytest: config: %v", err)
+	}
+	return Start(t, cfg)
+}
+
+// ephemeral 给没有地址的监听补上随机端口
+func ephemeral(cfg *config.Config) {
+	set := func(addr *string) {
+		if *addr == "" {
+			*addr = "127.0.0.1:0"
+		}
+	}
+	for i := range cfg.HTTP {
+		set(&cfg.HTTP[i].Addr)
+	}
+	for i := range cfg.TCP {
+		set(&cfg.TCP[i].Addr)
+	}
+	for i := range cfg.WebSocket {
+		set(&cfg.WebSocket[i].Addr)
+	}
+	for i := range cfg.Forward {
+		set(&cfg.Forward[i].Addr)
+	}
+	if cfg.Admin != nil {
+		set(&cfg.Admin.Addr)
+	}
+}
+
+// Addr 监听的实际地址，没有这个监听时让测试失败
+func (g *Gateway) Addr(t testing.TB, name string) string {
+	t.Helper()
+	addr := g.App.Addr(name)
+	if addr == nil {
+		t.Fatalf("gatewaytest: no listener named %q, have %v", name, g.App.Listeners())
+	}
+	return addr.String()
+}
+
+// URL 监听的http地址加上路径
+func (g *Gateway) URL(t testing.TB, name, path string) string {
+	t.Helper()
+	return "http://" + g.Addr(t, name) + path
+}
+
+// Do 发送请求，出错时让测试失败；响应体在测试结束时关闭
+func (g *Gateway) Do(t testing.TB, req *http.Request) *http.Response {
+	t.Helper()
+	res, err := g.Client.Do(req)
+	if err != nil {
+		t.Fatalf("gatewaytest: %s %s: %v", req.Method, req.URL, err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+// Get 向监听发送GET请求
+func (g *Gateway) Get(t testing.TB, name, path string) *http.Response {
+	t.Helper()
+	return g.Request(t, http.MethodGet, name, path, "", nil)
+}
+
+// Request 向监听发送请求，body为空时不带请求体
+func (g *Gateway) Request(t testing.TB, method, name, path, body string, header http.Header) *http.Response {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, g.URL(t, name, path), r)
+	if err != nil {
+		t.Fatalf("gatewaytest: %v", err)
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	return g.Do(t, req)
+}
+
+// DialTCP 连接TCP监听，测试结束时关闭
+func (g *Gateway) DialTCP(t testing.TB, name string) net.Conn {
+	t.Helper()
+	return Dial(t, g.Addr(t, name))
+}
+
+// DialWebSocket 和WebSocket监听握手，测试结束时关闭
+func (g *Gateway) DialWebSocket(t testing.TB, name, path string, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial("ws://"+g.Addr(t, name)+path, header)
+	if err != nil {
+		if res != nil {
+			t.Fatalf("gatewaytest: websocket handshake: %v (status %d)", err, res.StatusCode)
+		}
+		t.Fatalf("gatewaytest: websocket handshake: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Dial 连接地址，测试结束时关闭
+func Dial(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("gatewaytest: dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// ServeTCP 不经过配置，直接用server.TCPServer在随机端口上运行handler，返回监听地址
+// 用于单独测试TCPServer、TCPReverseProxy和TCP中间件；srv为nil时使用默认设置
+func ServeTCP(t testing.TB, srv *server.TCPServer, handler server.TCPHandler) string {
+	t.Helper()
+	if srv == nil {
+		srv = &server.TCPServer{}
+	}
+	srv.Handler = handler
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("gatewaytest: listen: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return ln.Addr().String()
+}
+
+// testWriter 把网关的日志写到测试日志中，只有测试失败或者-v时才会显示
+type testWriter struct {
+	t testing.TB
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// strictDecode 和config.Parse一样，不认识的字段当作错误
+func strictDecode(js string, v interface{}) error {
+	dec := json.NewDecoder(strings.NewReader(js))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
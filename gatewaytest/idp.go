@@ -0,0 +1,352 @@
+package gatewaytest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// IdP 替身身份提供方，实现了OpenID Connect发现、授权码+PKCE、刷新、JWKS、令牌自省和登出
+// 授权接口不显示登录页，直接以当前用户的身份同意，带Cookie并跟随跳转的客户端就能走完登录：
+//
+//	idp := gatewaytest.NewIdP(t)
+//	gw := gatewaytest.StartJSON(t, `{"auth": {"oidc": [{"name": "sso", "issuer": "`+idp.Issuer()+`",
+//		"client_id": "`+idp.ClientID+`", "client_secret": "`+idp.ClientSecret+`",
+//		"redirect_url": "/oauth2/callback"}]}, ...}`)
+//	browser := gatewaytest.NewBrowser(t)
+//	res, _ := browser.Get(gw.URL(t, "app", "/"))   //登录后回到/
+type IdP struct {
+	ClientID     string
+	ClientSecret string
+	Server       *httptest.Server
+
+	key *rsa.PrivateKey
+
+	mu             sync.Mutex
+	subject        string
+	claims         map[string]interface{}
+	accessTTL      time.Duration
+	codes          map[string]*idpGrant //授权码
+	refreshTokens  map[string]*idpGrant
+	accessTokens   map[string]*idpGrant
+	introspections int
+	refreshes      int
+	logouts        int
+}
+
+// idpGrant 授权码、刷新令牌和访问令牌背后的授权
+type idpGrant struct {
+	subject     string
+	scope       string
+	nonce       string
+	redirectURI string
+	challenge   string
+	expires     time.Time
+}
+
+// NewIdP 启动替身身份提供方，当前用户是alice，访问令牌有效期5分钟
+func NewIdP(t testing.TB) *IdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &IdP{
+		ClientID:      "gateway",
+		ClientSecret:  "gateway-secret",
+		key:           key,
+		subject:       "alice",
+		accessTTL:     5 * time.Minute,
+		codes:         make(map[string]*idpGrant),
+		refreshTokens: make(map[string]*idpGrant),
+		accessTokens:  make(map[string]*idpGrant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/introspect", p.introspect)
+	mux.HandleFunc("/logout", p.logout)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Server.Close)
+	return p
+}
+
+// NewBrowser 带Cookie并跟随跳转的客户端，像浏览器一样走完登录流程
+func NewBrowser(t testing.TB) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar, Timeout: 10 * time.Second}
+}
+
+// Issuer 身份提供方的地址，也是发现文档和ID令牌中的iss
+func (p *IdP) Issuer() string {
+	return p.Server.URL
+}
+
+// IntrospectionURL 令牌自省接口的地址
+func (p *IdP) IntrospectionURL() string {
+	return p.Server.URL + "/introspect"
+}
+
+// SetUser 设置之后登录的用户和ID令牌中额外的声明
+func (p *IdP) SetUser(subject string, claims map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subject, p.claims = subject, claims
+}
+
+// SetAccessTokenTTL 设置之后签发的访问令牌的有效期，用来测试刷新
+func (p *IdP) SetAccessTokenTTL(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.accessTTL = d
+}
+
+// IssueAccessToken 直接签发一个不透明的访问令牌，测试令牌自省时不用走登录流程
+func (p *IdP) IssueAccessToken(subject, scope string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	token := randomString()
+	p.accessTokens[token] = &idpGrant{subject: subject, scope: scope, expires: time.Now().Add(p.accessTTL)}
+	return token
+}
+
+// Revoke 吊销访问令牌或刷新令牌
+func (p *IdP) Revoke(token string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.accessTokens, token)
+	delete(p.refreshTokens, token)
+}
+
+// Introspections 自省接口被调用的次数，用来断言网关的缓存
+func (p *IdP) Introspections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.introspections
+}
+
+// Refreshes 用刷新令牌换取令牌的次数
+func (p *IdP) Refreshes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.refreshes
+}
+
+// Logouts 登出接口被调用的次数
+func (p *IdP) Logouts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.logouts
+}
+
+func (p *IdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeIdPJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                p.Issuer(),
+		"authorization_endpoint":                p.Issuer() + "/authorize",
+		"token_endpoint":                        p.Issuer() + "/token",
+		"jwks_uri":                              p.Issuer() + "/jwks",
+		"introspection_endpoint":                p.Issuer() + "/introspect",
+		"end_session_endpoint":                  p.Issuer() + "/logout",
+		"code_challenge_methods_supported":      []string{"S256"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+// authorize 检查参数后直接同意，带着授权码跳回redirect_uri
+func (p *IdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect := q.Get("redirect_uri")
+	switch {
+	case q.Get("client_id") != p.ClientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case redirect == "":
+		http.Error(w, "missing redirect_uri", http.StatusBadRequest)
+		return
+	case q.Get("response_type") != "code", q.Get("code_challenge_method") != "S256", q.Get("code_challenge") == "":
+		http.Error(w, "authorization code with S256 PKCE is required", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	code := randomString()
+	p.codes[code] = &idpGrant{
+		subject:     p.subject,
+		scope:       q.Get("scope"),
+		nonce:       q.Get("nonce"),
+		redirectURI: redirect,
+		challenge:   q.Get("code_challenge"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	p.mu.Unlock()
+	back := url.Values{"code": {code}, "state": {q.Get("state")}}
+	http.Redirect(w, r, redirect+"?"+back.Encode(), http.StatusFound)
+}
+
+// clientAuth 检查客户端凭证，支持HTTP Basic和表单中的client_secret
+func (p *IdP) clientAuth(r *http.Request) bool {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	return id == p.ClientID && subtle.ConstantTimeCompare([]byte(secret), []byte(p.ClientSecret)) == 1
+}
+
+func (p *IdP) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeIdPError(w, "invalid_request")
+		return
+	}
+	if !p.clientAuth(r) {
+		writeIdPJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var g *idpGrant
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g = p.codes[r.PostForm.Get("code")]
+		//授权码只能用一次
+		delete(p.codes, r.PostForm.Get("code"))
+		if g == nil || now.After(g.expires) || g.redirectURI != r.PostForm.Get("redirect_uri") {
+			writeIdPError(w, "invalid_grant")
+			return
+		}
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+			writeIdPJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+	case "refresh_token":
+		g = p.refreshTokens[r.PostForm.Get("refresh_token")]
+		//刷新令牌每次都轮换
+		delete(p.refreshTokens, r.PostForm.Get("refresh_token"))
+		if g == nil {
+			writeIdPError(w, "invalid_grant")
+			return
+		}
+		p.refreshes++
+	default:
+		writeIdPError(w, "unsupported_grant_type")
+		return
+	}
+
+	access, refresh := randomString(), randomString()
+	p.accessTokens[access] = &idpGrant{subject: g.subject, scope: g.scope, expires: now.Add(p.accessTTL)}
+	p.refreshTokens[refresh] = &idpGrant{subject: g.subject, scope: g.scope}
+	idClaims := map[string]interface{}{
+		"iss": p.Issuer(), "sub": g.subject, "aud": p.ClientID,
+		"iat": now.Unix(), "exp": now.Add(time.Hour).Unix(),
+	}
+	if g.nonce != "" {
+		idClaims["nonce"] = g.nonce
+	}
+	for k, v := range p.claims {
+		idClaims[k] = v
+	}
+	writeIdPJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    int64(p.accessTTL / time.Second),
+		"refresh_token": refresh,
+		"id_token":      p.sign(idClaims),
+	})
+}
+
+// introspect RFC 7662，未知、过期和吊销的令牌都返回active=false
+func (p *IdP) introspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeIdPError(w, "invalid_request")
+		return
+	}
+	if !p.clientAuth(r) {
+		writeIdPJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.introspections++
+	g := p.accessTokens[r.PostForm.Get("token")]
+	if g == nil || time.Now().After(g.expires) {
+		writeIdPJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+	writeIdPJSON(w, http.StatusOK, map[string]interface{}{
+		"active": true, "sub": g.subject, "scope": g.scope, "client_id": p.ClientID,
+		"token_type": "Bearer", "exp": g.expires.Unix(), "iss": p.Issuer(),
+	})
+}
+
+func (p *IdP) logout(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.logouts++
+	p.mu.Unlock()
+	if after := r.URL.Query().Get("post_logout_redirect_uri"); after != "" {
+		http.Redirect(w, r, after, http.StatusFound)
+		return
+	}
+	w.Write([]byte("logged out\n"))
+}
+
+func (p *IdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := &p.key.PublicKey
+	writeIdPJSON(w, http.StatusOK, map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "kid": "idp", "alg": "RS256", "use": "sig",
+		"n": base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+// sign 用RS256签发JWT
+func (p *IdP) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "idp"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func writeIdPError(w http.ResponseWriter, code string) {
+	writeIdPJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeIdPJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,238 @@
+// Package gatewaytest 网关的进程内集成测试工具，和net/http/httptest的用法类似
+//
+// 它在随机端口上启动假的上游（HTTP、TCP回显、WebSocket回显、UDP回显），
+// 用内存中的配置启动整个网关，再提供客户端和断言函数，测试都走真实的socket：
+//
+//	func TestRoute(t *testing.T) {
+//		up := gatewaytest.NewHTTPUpstream(t, "users", nil)
+//		gw := gatewaytest.StartJSON(t, `{"http": [{"name": "api", "routes": [
+//			{"path_prefix": "/users", "strip_prefix": true, "targets": ["`+up.URL+`"]}]}]}`)
+//		res := gw.Get(t, "api", "/users/42")
+//		gatewaytest.AssertRoutedTo(t, res, up)
+//		gatewaytest.AssertEcho(t, res).Path("/42")
+//	}
+package gatewaytest
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// HeaderUpstream 假上游在每个响应中带上自己的名字，用来断言请求被转发到了哪个上游
+const HeaderUpstream = "X-Upstream"
+
+// Echo 假HTTP上游默认的响应内容：收到的请求
+type Echo struct {
+	Upstream   string      `json:"upstream"`
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	RawPath    string      `json:"raw_path,omitempty"`
+	RawQuery   string      `json:"raw_query,omitempty"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// HTTPUpstream 假的HTTP上游，记录收到的每一个请求
+type HTTPUpstream struct {
+	Name string
+	//URL 上游地址，比如http://127.0.0.1:34567，可以直接写进路由的targets
+	URL    string
+	Server *httptest.Server
+
+	mu       sync.Mutex
+	requests []Echo
+}
+
+// NewHTTPUpstream 启动一个HTTP上游，测试结束时自动关闭
+// handler为nil时把请求以Echo的JSON返回；不为nil时先记录请求再交给handler
+func NewHTTPUpstream(t testing.TB, name string, handler http.Handler) *HTTPUpstream {
+	t.Helper()
+	up := &HTTPUpstream{Name: name}
+	up.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		e := Echo{
+			Upstream:   name,
+			Method:     r.Method,
+			Host:       r.Host,
+			Path:       r.URL.Path,
+			RawPath:    r.URL.RawPath,
+			RawQuery:   r.URL.RawQuery,
+			RemoteAddr: r.RemoteAddr,
+			Header:     r.Header.Clone(),
+			Body:       string(body),
+		}
+		up.mu.Lock()
+		up.requests = append(up.requests, e)
+		up.mu.Unlock()
+
+		w.Header().Set(HeaderUpstream, name)
+		if handler != nil {
+			r.Body = io.NopCloser(strings.NewReader(string(body)))
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&e)
+	}))
+	up.URL = up.Server.URL
+	t.Cleanup(up.Server.Close)
+	return up
+}
+
+// Requests 返回收到的所有请求
+func (up *HTTPUpstream) Requests() []Echo {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	return append([]Echo(nil), up.requests...)
+}
+
+// LastRequest 返回最后一个请求，没有请求时让测试失败
+func (up *HTTPUpstream) LastRequest(t testing.TB) Echo {
+	t.Helper()
+	reqs := up.Requests()
+	if len(reqs) == 0 {
+		t.Fatalf("upstream %s received no requests", up.Name)
+	}
+	return reqs[len(reqs)-1]
+}
+
+// Addr 上游的host:port
+func (up *HTTPUpstream) Addr() string {
+	return up.Server.Listener.Addr().String()
+}
+
+// TCPUpstream TCP回显上游，收到什么就写回什么
+type TCPUpstream struct {
+	Listener net.Listener
+	conns    int64
+	wg       sync.WaitGroup
+}
+
+// NewTCPEcho 启动一个TCP回显上游，测试结束时关闭监听并等待所有连接结束
+func NewTCPEcho(t testing.TB) *TCPUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("gatewaytest: listen: %v", err)
+	}
+	up := &TCPUpstream{Listener: ln}
+	up.wg.Add(1)
+	go func() {
+		defer up.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&up.conns, 1)
+			up.wg.Add(1)
+			go func() {
+				defer up.wg.Done()
+				io.Copy(c, c)
+				//对方半关闭后也关闭写端，这样可以测试代理是否正确传递半关闭
+				if tc, ok := c.(*net.TCPConn); ok {
+					tc.CloseWrite()
+				}
+				c.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		up.wg.Wait()
+	})
+	return up
+}
+
+// Addr 上游的host:port
+func (up *TCPUpstream) Addr() string {
+	return up.Listener.Addr().String()
+}
+
+// Conns 到目前为止接收的连接数
+func (up *TCPUpstream) Conns() int64 {
+	return atomic.LoadInt64(&up.conns)
+}
+
+// WebSocketUpstream WebSocket回显上游，和websocket_server.go中的wsHandler一样，
+// 把收到的消息加上Suffix后按原来的类型写回
+type WebSocketUpstream struct {
+	Suffix string
+	//URL http地址，可以直接写进websocket监听的target
+	URL    string
+	Server *httptest.Server
+}
+
+// NewWebSocketEcho 启动一个WebSocket回显上游，任何路径都可以握手
+func NewWebSocketEcho(t testing.TB, suffix string) *WebSocketUpstream {
+	t.Helper()
+	up := &WebSocketUpstream{Suffix: suffix}
+	upgrader := websocket.Upgrader{Subprotocols: []string{"echo"}}
+	up.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(mt, append(msg, up.Suffix...)); err != nil {
+				return
+			}
+		}
+	}))
+	up.URL = up.Server.URL
+	t.Cleanup(up.Server.Close)
+	return up
+}
+
+// UDPUpstream UDP回显上游
+type UDPUpstream struct {
+	Conn net.PacketConn
+}
+
+// NewUDPEcho 启动一个UDP回显上游，每个数据报原样发回
+func NewUDPEcho(t testing.TB) *UDPUpstream {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("gatewaytest: listen udp: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 64<<10)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	t.Cleanup(func() {
+		pc.Close()
+		<-done
+	})
+	return &UDPUpstream{Conn: pc}
+}
+
+// Addr 上游的host:port
+func (up *UDPUpstream) Addr() string {
+	return up.Conn.LocalAddr().String()
+}
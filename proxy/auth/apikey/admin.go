@@ -0,0 +1,116 @@
+package apikey
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 管理接口，挂在管理监听的/apikeys下面：
+//
+//	GET    /apikeys                    所有密钥，不包括明文和摘要
+//	POST   /apikeys                    用JSON创建密钥，响应中的key字段是明文，只返回这一次
+//	GET    /apikeys/{id}               一个密钥
+//	PUT    /apikeys/{id}               用JSON替换密钥的设置，用量不变
+//	DELETE /apikeys/{id}               删除密钥
+//	GET    /apikeys/usage.csv?month=   导出用量，month的格式是2006-01，为空时导出所有月份
+
+// ServeHTTP 实现管理接口，调用方用http.StripPrefix去掉/apikeys前缀
+func (s *Store) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.Trim(req.URL.Path, "/")
+	switch {
+	case id == "":
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.List())
+		case http.MethodPost:
+			spec, err := readSpec(req.Body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			key, v, err := s.Create(spec)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, struct {
+				Key string `json:"key"`
+				View
+			}{key, v})
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+		return
+	case id == "usage.csv":
+		if req.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		s.WriteCSV(w, req.URL.Query().Get("month"))
+		return
+	}
+
+	var (
+		v   View
+		err error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		v, err = s.Get(id)
+	case http.MethodPut:
+		var spec Spec
+		if spec, err = readSpec(req.Body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		v, err = s.Update(id, spec)
+	case http.MethodDelete:
+		if err = s.Delete(id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// readSpec 严格解析密钥设置，写错的字段名直接报错，而不是悄悄变成不限制
+func readSpec(body io.Reader) (Spec, error) {
+	var spec Spec
+	dec := json.NewDecoder(io.LimitReader(body, 1<<20))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&spec)
+	return spec, err
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,57 @@
+package apikey_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gateway/gatewaytest"
+)
+
+// TestGatewayAdmin 通过网关的管理接口创建密钥，管理接口要带令牌，密钥只能访问允许的路由
+func TestGatewayAdmin(t *testing.T) {
+	up := gatewaytest.NewHTTPUpstream(t, "api", nil)
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{
+		"auth": {"api_keys": {"file": %q, "query": "api_key", "id_header": "X-Key-Id"}},
+		"admin": {"token": "admin-secret"},
+		"http": [{"name": "gw", "routes": [
+			{"name": "a", "path_prefix": "/a", "targets": [%q], "auth": {"api_key": true}},
+			{"name": "b", "path_prefix": "/b", "targets": [%q], "auth": {"api_key": true}}]}]}`,
+		filepath.Join(t.TempDir(), "keys.json"), up.URL, up.URL))
+
+	create := func(token string) *http.Response {
+		header := http.Header{}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		return gw.Request(t, http.MethodPost, "admin", "/apikeys", `{"name": "partner", "routes": ["gw/a"]}`, header)
+	}
+	for _, token := range []string{"", "wrong"} {
+		if res := create(token); res.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("create with token %q: %d", token, res.StatusCode)
+		}
+	}
+	res := create("admin-secret")
+	gatewaytest.AssertStatus(t, res, http.StatusCreated)
+	var created struct {
+		Key string `json:"key"`
+		ID  string `json:"id"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	res = gw.Get(t, "gw", "/a?x=1&api_key="+created.Key+"&y=%20")
+	gatewaytest.AssertStatus(t, res, http.StatusOK)
+	gatewaytest.AssertEcho(t, res).Query("x=1&y=%20").Header("X-Key-Id", created.ID)
+	gatewaytest.AssertStatus(t, gw.Get(t, "gw", "/b?api_key="+created.Key), http.StatusForbidden)
+	gatewaytest.AssertStatus(t, gw.Get(t, "gw", "/a"), http.StatusUnauthorized)
+
+	res = gw.Request(t, http.MethodGet, "admin", "/apikeys/usage.csv", "", http.Header{"Authorization": {"Bearer admin-secret"}})
+	if body := gatewaytest.ReadBody(t, res); !strings.Contains(body, created.ID+",partner,") {
+		t.Errorf("usage.csv = %q", body)
+	}
+}
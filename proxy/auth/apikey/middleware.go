@@ -0,0 +1,131 @@
+package apikey
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"gateway/proxy/http_proxy/reverseproxy"
+)
+
+// Auth 在请求交给反向代理之前校验API密钥
+type Auth struct {
+	Store *Store
+	//Header 密钥所在的请求头，默认X-API-Key
+	Header string
+	//Query 密钥所在的查询参数，为空时不查找
+	Query string
+	//IDHeader 校验通过后把密钥ID放在这个请求头转发给上游，为空时不转发
+	IDHeader string
+}
+
+// idKey 请求上下文中保存密钥ID的键
+type idKey struct{}
+
+// KeyIDFromContext 取出认证通过的密钥ID
+func KeyIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// Key 取出请求中的密钥，并从请求中删掉，不把密钥转发给上游
+func (a *Auth) Key(r *http.Request) string {
+	header := a.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+	if v := r.Header.Get(header); v != "" {
+		r.Header.Del(header)
+		return v
+	}
+	if a.Query != "" {
+		if v := r.URL.Query().Get(a.Query); v != "" {
+			//只删掉密钥参数，其它参数的顺序和编码不变
+			r.URL.RawQuery = reverseproxy.DelQuery(r.URL.RawQuery, a.Query)
+			return v
+		}
+	}
+	return ""
+}
+
+// Middleware 包装一条路由的处理器，route是“监听名/路由名”
+// 没有密钥或密钥无效返回401，路由不允许返回403，超过配额或限流返回429
+func (a *Auth) Middleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.IDHeader != "" {
+			r.Header.Del(a.IDHeader)
+		}
+		key := a.Key(r)
+		if key == "" {
+			http.Error(w, "missing api key", http.StatusUnauthorized)
+			return
+		}
+		id, _, err := a.Store.Check(key, route)
+		switch {
+		case errors.Is(err, ErrInvalidKey):
+			http.Error(w, "invalid api key", http.StatusUnauthorized)
+			return
+		case errors.Is(err, ErrRouteNotAllowed):
+			http.Error(w, "api key not allowed for this route", http.StatusForbidden)
+			return
+		case errors.Is(err, ErrQuotaExceeded):
+			//配额到下个月才恢复
+			now := a.Store.now()
+			w.Header().Set("Retry-After", strconv.Itoa(int(nextMonth(now).Sub(now).Seconds())+1))
+			http.Error(w, "monthly quota exceeded", http.StatusTooManyRequests)
+			return
+		case errors.Is(err, ErrRateLimited):
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if a.IDHeader != "" {
+			r.Header.Set(a.IDHeader, id)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), idKey{}, id)))
+	})
+}
+
+// nextMonth 下个月第一天的UTC零点
+func nextMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// WriteCSV 导出用量，month为空时导出所有月份
+// 每行一个密钥一个月份：id,name,prefix,month,requests,monthly_quota,last_used
+func (s *Store) WriteCSV(w io.Writer, month string) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "prefix", "month", "requests", "monthly_quota", "last_used"})
+	for _, k := range s.List() {
+		months := make([]string, 0, len(k.Usage))
+		for m := range k.Usage {
+			if month == "" || m == month {
+				months = append(months, m)
+			}
+		}
+		//指定月份没有用量的密钥也输出一行0，方便对账
+		if month != "" && len(months) == 0 {
+			months = append(months, month)
+		}
+		sort.Strings(months)
+		lastUsed := ""
+		if k.LastUsed != nil {
+			lastUsed = k.LastUsed.Format(time.RFC3339)
+		}
+		for _, m := range months {
+			cw.Write([]string{k.ID, k.Name, k.Prefix, m,
+				strconv.FormatInt(k.Usage[m], 10), strconv.FormatInt(k.MonthlyQuota, 10), lastUsed})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
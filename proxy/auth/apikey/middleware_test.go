@@ -0,0 +1,89 @@
+package apikey
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestKeyStripped 密钥不转发给上游，其它参数的顺序和编码不变
+func TestKeyStripped(t *testing.T) {
+	a := &Auth{Query: "api_key"}
+	cases := []struct {
+		name      string
+		query     string
+		header    string
+		want      string
+		wantQuery string
+	}{
+		{name: "header", query: "api_key=q&a=1", header: "h", want: "h", wantQuery: "api_key=q&a=1"},
+		{name: "query", query: "z=1&api_key=k&b=%20x+y&a=%2F", want: "k", wantQuery: "z=1&b=%20x+y&a=%2F"},
+		{name: "escaped name", query: "api%5Fkey=k&a=1", want: "k", wantQuery: "a=1"},
+		{name: "only key", query: "api_key=k", want: "k", wantQuery: ""},
+		{name: "invalid pair kept", query: "a=%zz&api_key=k", want: "k", wantQuery: "a=%zz"},
+		{name: "none", query: "a=1", want: "", wantQuery: "a=1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/x?"+c.query, nil)
+		if c.header != "" {
+			r.Header.Set("X-API-Key", c.header)
+		}
+		if got := a.Key(r); got != c.want {
+			t.Errorf("%s: Key = %q, want %q", c.name, got, c.want)
+		}
+		if r.URL.RawQuery != c.wantQuery || r.Header.Get("X-API-Key") != "" {
+			t.Errorf("%s: left query %q header %q", c.name, r.URL.RawQuery, r.Header.Get("X-API-Key"))
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	s, c := newStore(t)
+	c.t = time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC)
+	key, v := mustCreate(t, s, Spec{Name: "partner", Routes: []string{"gw/a"}, MonthlyQuota: 1})
+	a := &Auth{Store: s, IDHeader: "X-Key-Id"}
+	var seen string
+	h := a.Middleware("gw/a", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get("X-Key-Id") + "/" + KeyIDFromContext(r.Context())
+	}))
+	serve := func(route, key, forgedID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		if forgedID != "" {
+			r.Header.Set("X-Key-Id", forgedID)
+		}
+		w := httptest.NewRecorder()
+		if route == "gw/a" {
+			h.ServeHTTP(w, r)
+		} else {
+			a.Middleware(route, h).ServeHTTP(w, r)
+		}
+		return w
+	}
+
+	if w := serve("gw/a", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("no key: %d", w.Code)
+	}
+	if w := serve("gw/a", "gwk_wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong key: %d", w.Code)
+	}
+	//客户端自己带的ID头被覆盖
+	if w := serve("gw/a", key, "forged"); w.Code != http.StatusOK || seen != v.ID+"/"+v.ID {
+		t.Errorf("valid key: %d, upstream saw %q", w.Code, seen)
+	}
+	if w := serve("gw/b", key, ""); w.Code != http.StatusForbidden {
+		t.Errorf("other route: %d", w.Code)
+	}
+	//配额到下个月1日UTC零点恢复
+	w := serve("gw/a", key, "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota: %d", w.Code)
+	}
+	if after, _ := strconv.Atoi(w.Header().Get("Retry-After")); after != 3601 {
+		t.Errorf("Retry-After = %q, want 3601", w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,412 @@
+// Package apikey 合作方使用的API密钥：每个密钥有允许访问的路由、限流、每月配额和用量统计
+//
+// 密钥只在创建时返回一次明文，文件中只保存SHA-256摘要。密钥本身是24字节的随机数，
+// 不需要加盐和慢哈希，摘要可以直接作为索引查找
+// 用量先记在内存中，定期和关闭时写回文件，重启后继续累计
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gateway/proxy/ratelimit"
+)
+
+// 密钥的前缀，方便在日志和代码仓库扫描中识别
+const keyPrefix = "gwk_"
+
+var (
+	// ErrInvalidKey 密钥不存在、已停用或已过期
+	ErrInvalidKey = errors.New("apikey: invalid api key")
+	// ErrRouteNotAllowed 密钥不允许访问这条路由
+	ErrRouteNotAllowed = errors.New("apikey: route not allowed for this key")
+	// ErrQuotaExceeded 本月配额已经用完
+	ErrQuotaExceeded = errors.New("apikey: monthly quota exceeded")
+	// ErrRateLimited 超过了密钥的限流
+	ErrRateLimited = errors.New("apikey: rate limit exceeded")
+	// ErrNotFound 管理接口中找不到密钥
+	ErrNotFound = errors.New("apikey: key not found")
+)
+
+// Spec 创建和修改密钥时可以设置的字段
+type Spec struct {
+	Name string `json:"name"`
+	//Routes 允许访问的路由，写法是“监听名/路由名”，“监听名/*”表示监听下的所有路由，为空表示不限制
+	Routes []string `json:"routes,omitempty"`
+	//Rate、Burst 每秒请求数和突发量，0表示不限流
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	//MonthlyQuota 每个自然月（UTC）的请求数上限，0表示不限制
+	MonthlyQuota int64 `json:"monthly_quota,omitempty"`
+	//ExpiresAt 过期时间，为空表示不过期
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Disabled  bool       `json:"disabled,omitempty"`
+}
+
+// Key 一个密钥的记录，保存在文件中
+type Key struct {
+	ID string `json:"id"`
+	Spec
+	//Prefix 明文的前几个字符，用于在列表中辨认密钥
+	Prefix string `json:"prefix"`
+	//Hash 明文的SHA-256摘要，十六进制
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used,omitempty"`
+	//Usage 月份（2006-01）到请求数
+	Usage map[string]int64 `json:"usage,omitempty"`
+
+	limiter *ratelimit.Limiter
+}
+
+// View 管理接口输出的内容，不包括摘要
+type View struct {
+	ID string `json:"id"`
+	Spec
+	Prefix    string           `json:"prefix"`
+	CreatedAt time.Time        `json:"created_at"`
+	LastUsed  *time.Time       `json:"last_used,omitempty"`
+	Usage     map[string]int64 `json:"usage,omitempty"`
+}
+
+func (k *Key) view() View {
+	v := View{ID: k.ID, Spec: k.Spec, Prefix: k.Prefix, CreatedAt: k.CreatedAt, Usage: make(map[string]int64, len(k.Usage))}
+	v.Routes = append([]string(nil), k.Routes...)
+	if !k.LastUsed.IsZero() {
+		t := k.LastUsed
+		v.LastUsed = &t
+	}
+	for m, n := range k.Usage {
+		v.Usage[m] = n
+	}
+	return v
+}
+
+// Store 保存所有密钥的JSON文件
+type Store struct {
+	path string
+	//FlushInterval 用量写回文件的间隔，默认10秒，只在Run中使用
+	FlushInterval time.Duration
+	//Now 当前时间，测试时替换
+	Now func() time.Time
+
+	//saveMu 保证快照、写文件和改名作为一个整体按顺序执行，旧的快照不会覆盖新的
+	saveMu sync.Mutex
+	mu     sync.Mutex
+	keys   map[string]*Key //ID到密钥
+	byHash map[string]*Key
+	dirty  bool
+}
+
+// Open 打开密钥文件，文件不存在时创建空的存储，第一次保存时才写文件
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, keys: make(map[string]*Key), byHash: make(map[string]*Key)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []*Key `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("apikey: %s: %w", path, err)
+	}
+	for _, k := range file.Keys {
+		k.limiter = newLimiter(k.Spec)
+		s.keys[k.ID] = k
+		s.byHash[k.Hash] = k
+	}
+	return s, nil
+}
+
+func newLimiter(spec Spec) *ratelimit.Limiter {
+	if spec.Rate <= 0 {
+		return nil
+	}
+	burst := spec.Burst
+	if burst <= 0 {
+		burst = int(spec.Rate)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return ratelimit.NewLimiter(spec.Rate, burst)
+}
+
+func (s *Store) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// month 配额按UTC的自然月计算
+func month(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// hashKey 明文密钥的摘要
+func hashKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newID 密钥的ID，公开使用，和明文无关
+func newID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Create 创建密钥，返回明文，明文之后再也拿不到
+func (s *Store) Create(spec Spec) (string, View, error) {
+	if err := spec.validate(); err != nil {
+		return "", View{}, err
+	}
+	plaintext := keyPrefix + randomString(24)
+	k := &Key{
+		ID:        newID(),
+		Spec:      spec,
+		Prefix:    plaintext[:len(keyPrefix)+6],
+		Hash:      hashKey(plaintext),
+		CreatedAt: s.now().UTC(),
+		limiter:   newLimiter(spec),
+	}
+	s.mu.Lock()
+	s.keys[k.ID] = k
+	s.byHash[k.Hash] = k
+	v := k.view()
+	s.mu.Unlock()
+	return plaintext, v, s.Save()
+}
+
+func (spec *Spec) validate() error {
+	if spec.Name == "" {
+		return errors.New("apikey: name is required")
+	}
+	if spec.Rate < 0 || spec.Burst < 0 || spec.MonthlyQuota < 0 {
+		return errors.New("apikey: rate, burst and monthly_quota must not be negative")
+	}
+	return nil
+}
+
+// Update 替换密钥的设置，用量和明文不变
+func (s *Store) Update(id string, spec Spec) (View, error) {
+	if err := spec.validate(); err != nil {
+		return View{}, err
+	}
+	s.mu.Lock()
+	k, ok := s.keys[id]
+	if !ok {
+		s.mu.Unlock()
+		return View{}, ErrNotFound
+	}
+	k.Spec = spec
+	k.limiter = newLimiter(spec)
+	v := k.view()
+	s.mu.Unlock()
+	return v, s.Save()
+}
+
+// Delete 删除密钥
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	k, ok := s.keys[id]
+	if ok {
+		delete(s.keys, id)
+		delete(s.byHash, k.Hash)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return s.Save()
+}
+
+// Get 返回一个密钥
+func (s *Store) Get(id string) (View, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return View{}, ErrNotFound
+	}
+	return k.view(), nil
+}
+
+// List 按创建时间返回所有密钥
+func (s *Store) List() []View {
+	s.mu.Lock()
+	views := make([]View, 0, len(s.keys))
+	for _, k := range s.keys {
+		views = append(views, k.view())
+	}
+	s.mu.Unlock()
+	sort.Slice(views, func(i, j int) bool {
+		if !views[i].CreatedAt.Equal(views[j].CreatedAt) {
+			return views[i].CreatedAt.Before(views[j].CreatedAt)
+		}
+		return views[i].ID < views[j].ID
+	})
+	return views
+}
+
+// Check 校验密钥并计入用量，route是“监听名/路由名”，返回密钥的ID和名字
+// 检查顺序：密钥是否有效 -> 路由 -> 配额 -> 限流，被拒绝的请求不计入用量
+func (s *Store) Check(plaintext, route string) (id, name string, err error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byHash[hashKey(plaintext)]
+	if !ok || k.Disabled || (k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)) {
+		return "", "", ErrInvalidKey
+	}
+	if !routeAllowed(k.Routes, route) {
+		return k.ID, k.Name, ErrRouteNotAllowed
+	}
+	m := month(now)
+	if k.MonthlyQuota > 0 && k.Usage[m] >= k.MonthlyQuota {
+		return k.ID, k.Name, ErrQuotaExceeded
+	}
+	if k.limiter != nil && !k.limiter.AllowN(now, 1) {
+		return k.ID, k.Name, ErrRateLimited
+	}
+	if k.Usage == nil {
+		k.Usage = make(map[string]int64)
+	}
+	k.Usage[m]++
+	k.LastUsed = now.UTC()
+	s.dirty = true
+	return k.ID, k.Name, nil
+}
+
+// routeAllowed 路由列表为空表示不限制，“监听名/*”匹配监听下的所有路由
+func routeAllowed(routes []string, route string) bool {
+	if len(routes) == 0 {
+		return true
+	}
+	for _, r := range routes {
+		if r == route || r == "*" {
+			return true
+		}
+		if strings.HasSuffix(r, "/*") && strings.HasPrefix(route, r[:len(r)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Save 把所有密钥写回文件，先写临时文件再改名，写到一半崩溃也不会损坏原文件
+// 写失败时保留dirty标记，下一次Flush会重试，没写进去的用量不会丢
+func (s *Store) Save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	keys := make([]*Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		c := *k
+		c.Usage = make(map[string]int64, len(k.Usage))
+		for m, n := range k.Usage {
+			c.Usage[m] = n
+		}
+		keys = append(keys, &c)
+	}
+	//先清除标记，写文件期间新增的用量会重新设置它
+	s.dirty = false
+	s.mu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	if err := s.write(keys); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) write(keys []*Key) error {
+	data, err := json.MarshalIndent(struct {
+		Keys []*Key `json:"keys"`
+	}{keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	//文件里有密钥摘要，只让当前用户读写
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Flush 有新的用量时写回文件
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return s.Save()
+}
+
+// Run 定期写回用量，直到stop关闭，返回前再写一次
+func (s *Store) Run(stop <-chan struct{}) {
+	interval := s.FlushInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("apikey: flush %s: %v", s.path, err)
+			}
+		case <-stop:
+			if err := s.Flush(); err != nil {
+				log.Printf("apikey: flush %s: %v", s.path, err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package apikey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clock 测试用的时间，Store.Now返回它
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newStore(t *testing.T) (*Store, *clock) {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//限流器按创建时的真实时间初始化，测试时间要在它之后，否则不会补充令牌
+	c := &clock{t: time.Now().Add(time.Minute)}
+	s.Now = c.now
+	return s, c
+}
+
+func mustCreate(t *testing.T, s *Store, spec Spec) (string, View) {
+	t.Helper()
+	key, v, err := s.Create(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, v
+}
+
+// TestCheckOrder 检查顺序是密钥 -> 路由 -> 配额 -> 限流，被拒绝的请求不计入用量
+func TestCheckOrder(t *testing.T) {
+	s, c := newStore(t)
+	key, v := mustCreate(t, s, Spec{Name: "partner", Routes: []string{"gw/a", "admin/*"}, Rate: 1, Burst: 1, MonthlyQuota: 2})
+	usage := func() int64 {
+		got, _ := s.Get(v.ID)
+		return got.Usage[month(c.t)]
+	}
+	steps := []struct {
+		name    string
+		key     string
+		route   string
+		advance time.Duration
+		want    error
+		usage   int64
+	}{
+		{name: "unknown key", key: "gwk_nope", route: "gw/a", want: ErrInvalidKey},
+		{name: "route not allowed", key: key, route: "gw/b", want: ErrRouteNotAllowed},
+		{name: "listener wildcard", key: key, route: "admin/x", usage: 1},
+		//令牌用完了
+		{name: "rate limited", key: key, route: "gw/a", want: ErrRateLimited, usage: 1},
+		{name: "after a second", key: key, route: "gw/a", advance: time.Second, usage: 2},
+		//配额和限流同时超出时报配额，客户端知道要等到下个月
+		{name: "quota before rate", key: key, route: "gw/a", want: ErrQuotaExceeded, usage: 2},
+		{name: "route before quota", key: key, route: "gw/b", want: ErrRouteNotAllowed, usage: 2},
+		{name: "quota after rate refill", key: key, route: "gw/a", advance: time.Minute, want: ErrQuotaExceeded, usage: 2},
+	}
+	for _, st := range steps {
+		c.advance(st.advance)
+		id, _, err := s.Check(st.key, st.route)
+		if !errors.Is(err, st.want) {
+			t.Fatalf("%s: err = %v, want %v", st.name, err, st.want)
+		}
+		if err == nil && id != v.ID {
+			t.Fatalf("%s: id = %q, want %q", st.name, id, v.ID)
+		}
+		if n := usage(); n != st.usage {
+			t.Fatalf("%s: usage = %d, want %d", st.name, n, st.usage)
+		}
+	}
+
+	//停用和过期的密钥在检查路由之前就被拒绝
+	spec := Spec{Name: "partner", Routes: []string{"gw/a"}, Disabled: true}
+	if _, err := s.Update(v.ID, spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Check(key, "gw/b"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("disabled key: err = %v", err)
+	}
+	expires := c.t
+	spec = Spec{Name: "partner", ExpiresAt: &expires}
+	if _, err := s.Update(v.ID, spec); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Check(key, "gw/a"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expired key: err = %v", err)
+	}
+}
+
+// TestMonthRollover 配额按UTC的自然月计算，新的月份重新开始
+func TestMonthRollover(t *testing.T) {
+	s, c := newStore(t)
+	key, v := mustCreate(t, s, Spec{Name: "partner", MonthlyQuota: 1})
+	//北京时间2月1日早上7点还是UTC的1月31日
+	c.t = time.Date(2024, 2, 1, 7, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	if _, _, err := s.Check(key, "gw/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Check(key, "gw/a"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("second request in january: err = %v", err)
+	}
+	c.t = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	if _, _, err := s.Check(key, "gw/a"); err != nil {
+		t.Fatalf("first request in february: %v", err)
+	}
+	got, _ := s.Get(v.ID)
+	if got.Usage["2024-01"] != 1 || got.Usage["2024-02"] != 1 || len(got.Usage) != 2 {
+		t.Errorf("usage = %v", got.Usage)
+	}
+	if want := nextMonth(c.t.Add(time.Hour)); !want.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("nextMonth = %v", want)
+	}
+}
+
+// TestSaveOpen 用量写回文件，重启后继续累计；文件中没有明文
+func TestSaveOpen(t *testing.T) {
+	s, _ := newStore(t)
+	key, v := mustCreate(t, s, Spec{Name: "partner", MonthlyQuota: 3})
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Check(key, "gw/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(key)) {
+		t.Error("plaintext key written to the file")
+	}
+	if fi, _ := os.Stat(s.path); fi.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want 0600", fi.Mode().Perm())
+	}
+
+	reopened, err := Open(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Now = s.Now
+	got, err := reopened.Get(v.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Usage[month(s.now())] != 2 || got.LastUsed == nil {
+		t.Fatalf("reopened usage = %v, last used %v", got.Usage, got.LastUsed)
+	}
+	if _, _, err := reopened.Check(key, "gw/a"); err != nil {
+		t.Fatalf("key rejected after reopen: %v", err)
+	}
+	if _, _, err := reopened.Check(key, "gw/a"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("quota not carried over: err = %v", err)
+	}
+}
+
+// TestSaveFailureKeepsDirty 写文件失败时保留标记，下一次Flush重试，用量不丢
+func TestSaveFailureKeepsDirty(t *testing.T) {
+	s, _ := newStore(t)
+	key, _ := mustCreate(t, s, Spec{Name: "partner"})
+	if _, _, err := s.Check(key, "gw/a"); err != nil {
+		t.Fatal(err)
+	}
+	path := s.path
+	s.path = filepath.Join(filepath.Dir(path), "missing", "keys.json")
+	if err := s.Flush(); err == nil {
+		t.Fatal("Flush into a missing directory succeeded")
+	}
+	if !s.dirty {
+		t.Fatal("store is clean after a failed write")
+	}
+
+	s.path = path
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s.dirty {
+		t.Fatal("store is still dirty after a successful write")
+	}
+	//没有新的用量时不重复写文件
+	os.Remove(path)
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("clean Flush wrote the file again: %v", err)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	s, c := newStore(t)
+	c.t = time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	a, va := mustCreate(t, s, Spec{Name: "alpha", MonthlyQuota: 100})
+	c.advance(time.Second)
+	_, vb := mustCreate(t, s, Spec{Name: "beta"})
+	s.Check(a, "gw/a")
+	c.t = time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	s.Check(a, "gw/a")
+	s.Check(a, "gw/a")
+
+	var buf bytes.Buffer
+	if err := s.WriteCSV(&buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	want := "id,name,prefix,month,requests,monthly_quota,last_used\n" +
+		va.ID + ",alpha," + va.Prefix + ",2024-01,1,100,2024-02-01T00:00:00Z\n" +
+		va.ID + ",alpha," + va.Prefix + ",2024-02,2,100,2024-02-01T00:00:00Z\n"
+	if buf.String() != want {
+		t.Errorf("all months:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	//指定月份时没有用量的密钥输出0
+	buf.Reset()
+	s.WriteCSV(&buf, "2024-01")
+	want = "id,name,prefix,month,requests,monthly_quota,last_used\n" +
+		va.ID + ",alpha," + va.Prefix + ",2024-01,1,100,2024-02-01T00:00:00Z\n" +
+		vb.ID + ",beta," + vb.Prefix + ",2024-01,0,0,\n"
+	if buf.String() != want {
+		t.Errorf("one month:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	s, _ := newStore(t)
+	srv := httptest.NewServer(http.StripPrefix("/apikeys", s))
+	defer srv.Close()
+	do := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	res, body := do(http.MethodPost, "/apikeys", `{"name": "partner", "routes": ["gw/*"], "monthly_quota": 10}`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %d %s", res.StatusCode, body)
+	}
+	var created struct {
+		Key string `json:"key"`
+		View
+	}
+	json.Unmarshal([]byte(body), &created)
+	if !strings.HasPrefix(created.Key, keyPrefix) || !strings.HasPrefix(created.Key, created.Prefix) || created.ID == "" {
+		t.Fatalf("create returned %s", body)
+	}
+	if _, _, err := s.Check(created.Key, "gw/a"); err != nil {
+		t.Fatalf("created key rejected: %v", err)
+	}
+
+	//拼错的字段不能变成不限制
+	if res, body := do(http.MethodPost, "/apikeys", `{"name": "x", "monthly_qouta": 10}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown field: %d %s", res.StatusCode, body)
+	}
+	if res, body := do(http.MethodPost, "/apikeys", `{"rate": 1}`); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing name: %d %s", res.StatusCode, body)
+	}
+
+	//列表和详情中没有明文和摘要
+	for _, path := range []string{"/apikeys", "/apikeys/" + created.ID} {
+		res, body := do(http.MethodGet, path, "")
+		if res.StatusCode != http.StatusOK || strings.Contains(body, created.Key) || strings.Contains(body, "hash") {
+			t.Errorf("GET %s: %d %s", path, res.StatusCode, body)
+		}
+	}
+
+	res, body = do(http.MethodPut, "/apikeys/"+created.ID, `{"name": "renamed", "monthly_quota": 1}`)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"renamed"`) || !strings.Contains(body, `"usage"`) {
+		t.Errorf("update: %d %s", res.StatusCode, body)
+	}
+	//修改设置不清空用量，配额立即生效
+	if _, _, err := s.Check(created.Key, "gw/a"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("after update: err = %v", err)
+	}
+
+	res, body = do(http.MethodGet, "/apikeys/usage.csv?month="+month(s.now()), "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/csv; charset=utf-8" ||
+		!strings.Contains(body, created.ID+",renamed,") {
+		t.Errorf("usage.csv: %d %s %s", res.StatusCode, res.Header.Get("Content-Type"), body)
+	}
+	if res, _ := do(http.MethodPost, "/apikeys/usage.csv", ""); res.StatusCode != http.StatusMethodNotAllowed || res.Header.Get("Allow") != "GET" {
+		t.Errorf("POST usage.csv: %d allow %q", res.StatusCode, res.Header.Get("Allow"))
+	}
+
+	if res, _ := do(http.MethodDelete, "/apikeys/"+created.ID, ""); res.StatusCode != http.StatusNoContent {
+		t.Errorf("delete: %d", res.StatusCode)
+	}
+	if res, _ := do(http.MethodGet, "/apikeys/"+created.ID, ""); res.StatusCode != http.StatusNotFound {
+		t.Errorf("get deleted: %d", res.StatusCode)
+	}
+	if res, _ := do(http.MethodPut, "/apikeys/"+created.ID, `{"name": "x"}`); res.StatusCode != http.StatusNotFound {
+		t.Errorf("update deleted: %d", res.StatusCode)
+	}
+	if _, _, err := s.Check(created.Key, "gw/a"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("deleted key: err = %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 令牌自省（RFC 7662）：不透明的访问令牌网关自己校验不了，交给授权服务器判断是否有效
+// 每个请求都去问一次太慢，结果按令牌的摘要缓存：
+// 1、有效的令牌缓存CacheTTL，但不超过令牌自己的exp
+// 2、无效的令牌缓存NegativeCacheTTL，同一个无效令牌反复请求时不会打到授权服务器
+// 3、授权服务器出错时不缓存，返回503
+
+var (
+	// ErrInactive 授权服务器说令牌无效（过期、吊销或者根本不存在）
+	ErrInactive = errors.New("auth: token is not active")
+	// ErrScope 令牌缺少路由要求的scope
+	ErrScope = errors.New("auth: insufficient scope")
+)
+
+// Introspector 调用授权服务器的自省接口
+type Introspector struct {
+	//URL 自省接口的地址
+	URL string
+	//ClientID、ClientSecret 网关在授权服务器上的凭证，用HTTP Basic认证
+	ClientID     string
+	ClientSecret string
+	//Client 为nil时使用10秒超时的客户端
+	Client *http.Client
+	//CacheTTL 有效结果的缓存时间，默认1分钟，小于0时不缓存
+	CacheTTL time.Duration
+	//NegativeCacheTTL 无效结果的缓存时间，默认10秒，小于0时不缓存
+	NegativeCacheTTL time.Duration
+	//MaxCacheEntries 最多缓存的令牌个数，默认10000
+	MaxCacheEntries int
+	//Now 当前时间，测试时替换
+	Now func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]introspection
+}
+
+// introspection 一次自省的结果，claims为nil表示令牌无效
+type introspection struct {
+	claims  Claims
+	expires time.Time
+}
+
+func (in *Introspector) now() time.Time {
+	if in.Now != nil {
+		return in.Now()
+	}
+	return time.Now()
+}
+
+// Introspect 返回令牌的声明，令牌无效时返回ErrInactive
+func (in *Introspector) Introspect(ctx context.Context, token string) (Claims, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := in.now()
+	in.mu.Lock()
+	cached, ok := in.cache[key]
+	in.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		if cached.claims == nil {
+			return nil, ErrInactive
+		}
+		return cached.claims, nil
+	}
+
+	claims, err := in.introspect(ctx, token)
+	if err != nil && !errors.Is(err, ErrInactive) {
+		return nil, err
+	}
+	in.store(key, claims, now)
+	return claims, err
+}
+
+func (in *Introspector) introspect(ctx context.Context, token string) (Claims, error) {
+	client := in.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := postForm(ctx, client, in.URL, in.ClientID, in.ClientSecret,
+		url.Values{"token": {token}, "token_type_hint": {"access_token"}})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: introspection endpoint returned %s", res.Status)
+	}
+	//数字解析成json.Number，和JWT的声明一致
+	var claims Claims
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("auth: introspection response: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrInactive
+	}
+	//授权服务器说有效，但exp已经过了，按无效处理
+	if exp, ok, _ := claims.time("exp"); ok && !in.now().Before(exp) {
+		return nil, ErrInactive
+	}
+	return claims, nil
+}
+
+// store 缓存结果，满了先清理过期的，仍然满时随便删掉一些，缓存丢了只是多问一次
+func (in *Introspector) store(key string, claims Claims, now time.Time) {
+	ttl := in.CacheTTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+	if claims == nil {
+		ttl = in.NegativeCacheTTL
+		if ttl == 0 {
+			ttl = 10 * time.Second
+		}
+	}
+	if ttl < 0 {
+		return
+	}
+	expires := now.Add(ttl)
+	if exp, ok, _ := claims.time("exp"); ok && exp.Before(expires) {
+		expires = exp
+	}
+	max := in.MaxCacheEntries
+	if max <= 0 {
+		max = 10000
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.cache == nil {
+		in.cache = make(map[string]introspection)
+	}
+	if len(in.cache) >= max {
+		for k, e := range in.cache {
+			if !now.Before(e.expires) {
+				delete(in.cache, k)
+			}
+		}
+		for k := range in.cache {
+			if len(in.cache) < max {
+				break
+			}
+			delete(in.cache, k)
+		}
+	}
+	in.cache[key] = introspection{claims: claims, expires: expires}
+}
+
+// IntrospectionAuth 用令牌自省认证的HTTP过滤器，令牌的查找方式和JWTAuth相同
+// 也实现了wsproxy.Authenticator
+type IntrospectionAuth struct {
+	Introspector *Introspector
+
+	Header string
+	Cookie string
+	Query  string
+	//Scopes 令牌的scope必须包含所有这些值，否则返回403
+	Scopes []string
+	//ClaimHeaders 声明名到请求头名，和JWTAuth相同
+	ClaimHeaders map[string]string
+	//Optional 为true时没有令牌的请求也放行，但带了无效令牌的请求仍然拒绝
+	Optional bool
+}
+
+// Verify 取出令牌并自省，再检查scope
+func (a *IntrospectionAuth) Verify(r *http.Request) (Claims, error) {
+	token := bearerToken(r, a.Header, a.Cookie, a.Query)
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	claims, err := a.Introspector.Introspect(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	granted := strings.Fields(claims.String("scope"))
+	for _, s := range a.Scopes {
+		if !containsString(granted, s) {
+			return claims, ErrScope
+		}
+	}
+	return claims, nil
+}
+
+// Authenticate 实现wsproxy.Authenticator，返回sub作为用户标识
+func (a *IntrospectionAuth) Authenticate(r *http.Request) (string, error) {
+	claims, err := a.Verify(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject(), nil
+}
+
+// Middleware 包装处理器：令牌无效返回401，scope不够返回403，授权服务器不可用返回503
+func (a *IntrospectionAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range a.ClaimHeaders {
+			r.Header.Del(h)
+		}
+		claims, err := a.Verify(r)
+		switch {
+		case errors.Is(err, ErrNoToken) && a.Optional:
+			next.ServeHTTP(w, r)
+			return
+		case errors.Is(err, ErrNoToken), errors.Is(err, ErrInactive):
+			Unauthorized(w, err)
+			return
+		case errors.Is(err, ErrScope):
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="gateway", error="insufficient_scope", scope=%q`, strings.Join(a.Scopes, " ")))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		case err != nil:
+			log.Printf("auth: introspect %s: %v", a.Introspector.URL, err)
+			http.Error(w, "authorization server unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		for name, h := range a.ClaimHeaders {
+			if v := claims.String(name); v != "" {
+				r.Header.Set(h, v)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
@@ -0,0 +1,346 @@
+// Package auth 网关的认证过滤器，在请求转发给上游之前检查身份
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWT校验：只支持紧凑格式的JWS（header.payload.signature），算法HS256、RS256、ES256
+// 1、解析头部，按alg和kid找到密钥，密钥的类型必须和算法一致，防止用RSA公钥当HMAC密钥的算法混淆攻击
+// 2、校验签名
+// 3、检查exp、nbf、iss、aud，时间允许有ClockSkew的误差
+
+// 支持的签名算法
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	// ErrNoToken 请求中没有令牌
+	ErrNoToken = errors.New("auth: missing token")
+	// ErrMalformed 令牌格式错误
+	ErrMalformed = errors.New("auth: malformed token")
+	// ErrAlgorithm 不允许的签名算法，包括alg为none
+	ErrAlgorithm = errors.New("auth: unsupported signing algorithm")
+	// ErrUnknownKey 找不到kid对应的密钥
+	ErrUnknownKey = errors.New("auth: unknown signing key")
+	// ErrSignature 签名不正确
+	ErrSignature = errors.New("auth: invalid signature")
+	// ErrExpired 令牌已经过期
+	ErrExpired = errors.New("auth: token expired")
+	// ErrNotYetValid 还没到nbf
+	ErrNotYetValid = errors.New("auth: token not yet valid")
+	// ErrIssuer iss不匹配
+	ErrIssuer = errors.New("auth: invalid issuer")
+	// ErrAudience aud中没有期望的受众
+	ErrAudience = errors.New("auth: invalid audience")
+)
+
+// Key 一个校验签名的密钥
+type Key struct {
+	//ID 对应JWT头部的kid，为空时可以匹配任何kid
+	ID string
+	//Key HMAC密钥是[]byte，RSA是*rsa.PublicKey，EC是*ecdsa.PublicKey
+	Key interface{}
+}
+
+// algorithm 密钥类型对应的算法
+func (k *Key) algorithm() string {
+	switch pub := k.Key.(type) {
+	case []byte:
+		return HS256
+	case *rsa.PublicKey:
+		return RS256
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().Name == "P-256" {
+			return ES256
+		}
+	}
+	return ""
+}
+
+// KeySource 按kid查找密钥，静态密钥是StaticKeys，从JWKS地址获取的是JWKS
+type KeySource interface {
+	Keys(kid string) ([]Key, error)
+}
+
+// StaticKeys 固定的密钥，比如配置中的PEM公钥或者HMAC密钥
+type StaticKeys []Key
+
+// Keys 返回kid匹配的密钥，kid为空时返回所有密钥
+func (ks StaticKeys) Keys(kid string) ([]Key, error) {
+	var out []Key
+	for _, k := range ks {
+		if kid == "" || k.ID == "" || k.ID == kid {
+			out = append(out, k)
+		}
+	}
+	return out, nil
+}
+
+// KeySources 依次从多个来源查找密钥，比如JWKS加上静态的PEM公钥
+type KeySources []KeySource
+
+// Keys 合并所有来源的结果，都没有找到时返回第一个错误
+func (ks KeySources) Keys(kid string) ([]Key, error) {
+	var keys []Key
+	var firstErr error
+	for _, s := range ks {
+		k, err := s.Keys(kid)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		keys = append(keys, k...)
+	}
+	if len(keys) == 0 {
+		return nil, firstErr
+	}
+	return keys, nil
+}
+
+// Claims JWT的声明，数字是json.Number
+type Claims map[string]interface{}
+
+// String 返回字符串类型的声明，数字和布尔值也转成字符串，其它类型返回JSON
+func (c Claims) String(name string) string {
+	switch v := c[name].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return fmt.Sprint(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// Subject 返回sub
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// time 把数字声明解析为时间，没有这个声明时ok为false
+func (c Claims) time(name string) (t time.Time, ok bool, err error) {
+	v, exists := c[name]
+	if !exists {
+		return time.Time{}, false, nil
+	}
+	n, isNum := v.(json.Number)
+	if !isNum {
+		return time.Time{}, false, fmt.Errorf("%w: %s is not a number", ErrMalformed, name)
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%w: %s: %v", ErrMalformed, name, err)
+	}
+	sec, frac := int64(f), f-float64(int64(f))
+	return time.Unix(sec, int64(frac*1e9)), true, nil
+}
+
+// audiences aud可以是字符串也可以是数组
+func (c Claims) audiences() []string {
+	switch v := c["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Verifier 校验JWT
+type Verifier struct {
+	//Keys 密钥来源
+	Keys KeySource
+	//Algorithms 允许的算法，为空时允许HS256、RS256、ES256
+	Algorithms []string
+	//Issuer 不为空时iss必须相等
+	Issuer string
+	//Audience 不为空时aud必须包含其中之一
+	Audience []string
+	//ClockSkew 检查exp、nbf时允许的时钟误差
+	ClockSkew time.Duration
+	//RequireExp 为true时没有exp的令牌视为无效
+	RequireExp bool
+	//Now 当前时间，测试时替换，为nil时使用time.Now
+	Now func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Verify 校验令牌，成功时返回声明
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if !v.allowed(header.Alg) {
+		return nil, fmt.Errorf("%w: %q", ErrAlgorithm, header.Alg)
+	}
+	sig, err := decodeBase64(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := v.Keys.Keys(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	matched := false
+	verified := false
+	for i := range keys {
+		if keys[i].algorithm() != header.Alg {
+			continue
+		}
+		matched = true
+		if verifySignature(header.Alg, keys[i].Key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !matched {
+		return nil, fmt.Errorf("%w: kid %q", ErrUnknownKey, header.Kid)
+	}
+	if !verified {
+		return nil, ErrSignature
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *Verifier) allowed(alg string) bool {
+	algs := v.Algorithms
+	if len(algs) == 0 {
+		algs = []string{HS256, RS256, ES256}
+	}
+	for _, a := range algs {
+		if a == alg {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClaims 检查时间、签发者和受众
+func (v *Verifier) checkClaims(c Claims) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	exp, ok, err := c.time("exp")
+	if err != nil {
+		return err
+	}
+	if ok && !now.Before(exp.Add(v.ClockSkew)) {
+		return ErrExpired
+	}
+	if !ok && v.RequireExp {
+		return fmt.Errorf("%w: missing exp", ErrMalformed)
+	}
+	nbf, ok, err := c.time("nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(v.ClockSkew).Before(nbf) {
+		return ErrNotYetValid
+	}
+	if v.Issuer != "" && c.String("iss") != v.Issuer {
+		return ErrIssuer
+	}
+	if len(v.Audience) > 0 {
+		for _, aud := range c.audiences() {
+			for _, want := range v.Audience {
+				if aud == want {
+					return nil
+				}
+			}
+		}
+		return ErrAudience
+	}
+	return nil
+}
+
+// verifySignature 按算法校验签名
+func verifySignature(alg string, key interface{}, signed, sig []byte) bool {
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case RS256:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	case ES256:
+		//JWS的ECDSA签名是定长的r||s，不是ASN.1格式
+		if len(sig) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key.(*ecdsa.PublicKey), digest[:], r, s)
+	}
+	return false
+}
+
+// decodeBase64 JWT使用不带填充的base64url，兼容带填充的写法
+func decodeBase64(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return b, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	b, err := decodeBase64(s)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return nil
+}
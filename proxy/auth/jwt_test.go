@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _  = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testSecret    = []byte("0123456789abcdef0123456789abcdef")
+)
+
+// signToken 按header中的alg签名，key是HMAC密钥、*rsa.PrivateKey或*ecdsa.PrivateKey，alg为none时签名为空
+func signToken(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	seg := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(header) + "." + seg(claims)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// resign 替换令牌的签名部分
+func resign(token string, sig []byte) string {
+	return token[:strings.LastIndex(token, ".")+1] + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifySignature(t *testing.T) {
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: mustMarshalPKIX(t, &testRSAKey.PublicKey)})
+	claims := map[string]interface{}{"sub": "alice"}
+	asymmetric := StaticKeys{{ID: "rsa", Key: &testRSAKey.PublicKey}, {ID: "ec", Key: &testECKey.PublicKey}}
+
+	ecToken := signToken(t, map[string]interface{}{"alg": ES256, "kid": "ec"}, claims, testECKey)
+	digest := sha256.Sum256([]byte(ecToken[:strings.LastIndex(ecToken, ".")]))
+	asn1Sig, err := ecdsa.SignASN1(rand.Reader, testECKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		keys  KeySource
+		algs  []string
+		token string
+		want  error
+	}{
+		{name: "hs256", keys: StaticKeys{{Key: testSecret}},
+			token: signToken(t, map[string]interface{}{"alg": HS256}, claims, testSecret)},
+		{name: "rs256", keys: asymmetric,
+			token: signToken(t, map[string]interface{}{"alg": RS256, "kid": "rsa"}, claims, testRSAKey)},
+		{name: "es256", keys: asymmetric, token: ecToken},
+		{name: "wrong hmac secret", keys: StaticKeys{{Key: []byte("other")}},
+			token: signToken(t, map[string]interface{}{"alg": HS256}, claims, testSecret), want: ErrSignature},
+
+		//算法混淆：用RSA公钥的内容当HMAC密钥签名，只配置了RSA公钥时没有HS256的密钥可用
+		{name: "rsa public key as hs256 secret", keys: asymmetric,
+			token: signToken(t, map[string]interface{}{"alg": HS256, "kid": "rsa"}, claims, rsaPEM), want: ErrUnknownKey},
+		{name: "rsa public key der as hs256 secret", keys: asymmetric,
+			token: signToken(t, map[string]interface{}{"alg": HS256}, claims, mustMarshalPKIX(t, &testRSAKey.PublicKey)), want: ErrUnknownKey},
+		//同时有HMAC密钥时也只用HMAC密钥校验，RSA公钥不会被当成HMAC密钥
+		{name: "rsa public key as hs256 secret with hmac key", keys: append(StaticKeys{{Key: testSecret}}, asymmetric...),
+			token: signToken(t, map[string]interface{}{"alg": HS256}, claims, rsaPEM), want: ErrSignature},
+		{name: "hs256 not allowed", keys: StaticKeys{{Key: testSecret}}, algs: []string{RS256},
+			token: signToken(t, map[string]interface{}{"alg": HS256}, claims, testSecret), want: ErrAlgorithm},
+
+		{name: "alg none", keys: StaticKeys{{Key: testSecret}},
+			token: signToken(t, map[string]interface{}{"alg": "none"}, claims, nil), want: ErrAlgorithm},
+		{name: "alg None", keys: StaticKeys{{Key: testSecret}},
+			token: signToken(t, map[string]interface{}{"alg": "None"}, claims, nil), want: ErrAlgorithm},
+		{name: "alg none allowed by mistake", keys: StaticKeys{{Key: testSecret}}, algs: []string{"none"},
+			token: signToken(t, map[string]interface{}{"alg": "none"}, claims, nil), want: ErrUnknownKey},
+
+		//JWS的ES256签名必须是64字节的r||s
+		{name: "es256 asn1 signature", keys: asymmetric, token: resign(ecToken, asn1Sig), want: ErrSignature},
+		{name: "es256 63 bytes", keys: asymmetric, token: resign(ecToken, make([]byte, 63)), want: ErrSignature},
+		{name: "es256 65 bytes", keys: asymmetric, token: resign(ecToken, make([]byte, 65)), want: ErrSignature},
+		{name: "es256 zero signature", keys: asymmetric, token: resign(ecToken, make([]byte, 64)), want: ErrSignature},
+
+		{name: "unknown kid", keys: asymmetric,
+			token: signToken(t, map[string]interface{}{"alg": RS256, "kid": "other"}, claims, testRSAKey), want: ErrUnknownKey},
+		{name: "two segments", keys: asymmetric, token: "a.b", want: ErrMalformed},
+		{name: "bad base64", keys: asymmetric, token: "!!.e30.", want: ErrMalformed},
+	}
+	for _, c := range cases {
+		v := &Verifier{Keys: c.keys, Algorithms: c.algs}
+		got, err := v.Verify(c.token)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+			continue
+		}
+		if c.want == nil && got.Subject() != "alice" {
+			t.Errorf("%s: sub = %q", c.name, got.Subject())
+		}
+	}
+}
+
+func mustMarshalPKIX(t *testing.T, pub interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestVerifyClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+	cases := []struct {
+		name   string
+		claims map[string]interface{}
+		v      Verifier
+		want   error
+	}{
+		{name: "no time claims", claims: map[string]interface{}{}},
+		{name: "exp in the future", claims: map[string]interface{}{"exp": at(time.Minute)}},
+		{name: "exp now", claims: map[string]interface{}{"exp": at(0)}, want: ErrExpired},
+		{name: "expired", claims: map[string]interface{}{"exp": at(-10 * time.Second)}, want: ErrExpired},
+		{name: "expired within skew", claims: map[string]interface{}{"exp": at(-10 * time.Second)},
+			v: Verifier{ClockSkew: 30 * time.Second}},
+		{name: "expired beyond skew", claims: map[string]interface{}{"exp": at(-time.Minute)},
+			v: Verifier{ClockSkew: 30 * time.Second}, want: ErrExpired},
+		{name: "fractional exp", claims: map[string]interface{}{"exp": float64(at(0)) + 0.5}},
+		{name: "nbf in the future", claims: map[string]interface{}{"nbf": at(10 * time.Second)}, want: ErrNotYetValid},
+		{name: "nbf within skew", claims: map[string]interface{}{"nbf": at(10 * time.Second)},
+			v: Verifier{ClockSkew: 30 * time.Second}},
+		{name: "nbf beyond skew", claims: map[string]interface{}{"nbf": at(time.Minute)},
+			v: Verifier{ClockSkew: 30 * time.Second}, want: ErrNotYetValid},
+		{name: "exp required", claims: map[string]interface{}{}, v: Verifier{RequireExp: true}, want: ErrMalformed},
+		{name: "exp not a number", claims: map[string]interface{}{"exp": "tomorrow"}, want: ErrMalformed},
+
+		{name: "issuer", claims: map[string]interface{}{"iss": "https://idp"}, v: Verifier{Issuer: "https://idp"}},
+		{name: "wrong issuer", claims: map[string]interface{}{"iss": "https://evil"}, v: Verifier{Issuer: "https://idp"}, want: ErrIssuer},
+		{name: "missing issuer", claims: map[string]interface{}{}, v: Verifier{Issuer: "https://idp"}, want: ErrIssuer},
+
+		{name: "aud string", claims: map[string]interface{}{"aud": "api"}, v: Verifier{Audience: []string{"web", "api"}}},
+		{name: "aud array", claims: map[string]interface{}{"aud": []string{"other", "api"}}, v: Verifier{Audience: []string{"api"}}},
+		{name: "aud string mismatch", claims: map[string]interface{}{"aud": "apis"}, v: Verifier{Audience: []string{"api"}}, want: ErrAudience},
+		{name: "aud array mismatch", claims: map[string]interface{}{"aud": []string{"a", "b"}}, v: Verifier{Audience: []string{"api"}}, want: ErrAudience},
+		{name: "aud array of non-strings", claims: map[string]interface{}{"aud": []interface{}{1, true}}, v: Verifier{Audience: []string{"1"}}, want: ErrAudience},
+		{name: "missing aud", claims: map[string]interface{}{}, v: Verifier{Audience: []string{"api"}}, want: ErrAudience},
+		{name: "aud not checked", claims: map[string]interface{}{"aud": "anything"}},
+	}
+	for _, c := range cases {
+		v := c.v
+		v.Keys = StaticKeys{{Key: testSecret}}
+		v.Now = func() time.Time { return now }
+		claims := map[string]interface{}{"sub": "alice"}
+		for k, val := range c.claims {
+			claims[k] = val
+		}
+		_, err := v.Verify(signToken(t, map[string]interface{}{"alg": HS256}, claims, testSecret))
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+// jwksServer 返回keys中的JWK，记录请求次数
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    []JWK
+	status  int
+	fetches int32
+}
+
+func newJWKSServer(t *testing.T, keys ...JWK) *jwksServer {
+	s := &jwksServer{keys: keys, status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.fetches, 1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.status != http.StatusOK {
+			w.WriteHeader(s.status)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) set(status int, keys ...JWK) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.keys = status, keys
+}
+
+func octJWK(kid string) JWK {
+	return JWK{Kty: "oct", Kid: kid, K: base64.RawURLEncoding.EncodeToString(testSecret)}
+}
+
+// TestJWKSUnknownKid 不认识的kid会立即重新获取，但两次获取至少间隔MinRefreshInterval
+func TestJWKSUnknownKid(t *testing.T) {
+	srv := newJWKSServer(t, octJWK("k1"))
+	j := &JWKS{URL: srv.URL, RefreshInterval: 24 * time.Hour, MinRefreshInterval: time.Hour}
+	fetches := func(want int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(&srv.fetches); n != want {
+			t.Fatalf("JWKS fetched %d times, want %d", n, want)
+		}
+	}
+	// backdate 假装上一次获取已经是MinRefreshInterval之前的事
+	backdate := func() {
+		j.mu.Lock()
+		j.fetched = time.Now().Add(-2 * time.Hour)
+		j.mu.Unlock()
+	}
+
+	if keys, err := j.Keys("k1"); err != nil || len(keys) != 1 {
+		t.Fatalf("Keys(k1) = %v, %v", keys, err)
+	}
+	fetches(1)
+	//伪造的kid不会让网关不停地请求JWKS地址
+	for i := 0; i < 5; i++ {
+		if keys, _ := j.Keys("forged"); len(keys) != 0 {
+			t.Fatalf("Keys(forged) = %v", keys)
+		}
+	}
+	fetches(1)
+
+	//间隔过了之后，新的kid触发重新获取，轮换后的密钥立即可用
+	srv.set(http.StatusOK, octJWK("k1"), octJWK("k2"))
+	backdate()
+	if keys, err := j.Keys("k2"); err != nil || len(keys) != 1 {
+		t.Fatalf("Keys(k2) after rotation = %v, %v", keys, err)
+	}
+	fetches(2)
+	j.Keys("k3")
+	fetches(2)
+
+	//获取失败时继续使用旧的密钥，失败也算一次获取
+	srv.set(http.StatusInternalServerError)
+	backdate()
+	j.Keys("k3")
+	fetches(3)
+	if keys, err := j.Keys("k2"); err != nil || len(keys) != 1 {
+		t.Fatalf("Keys(k2) after failed fetch = %v, %v", keys, err)
+	}
+	j.Keys("k3")
+	fetches(3)
+
+	//通过Verifier使用JWKS
+	v := &Verifier{Keys: j}
+	token := signToken(t, map[string]interface{}{"alg": HS256, "kid": "k2"}, map[string]interface{}{"sub": "alice"}, testSecret)
+	if _, err := v.Verify(token); err != nil {
+		t.Errorf("Verify with JWKS key: %v", err)
+	}
+}
+
+func TestJWKKey(t *testing.T) {
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	coord := func(n *big.Int) []byte { return n.FillBytes(make([]byte, 32)) }
+	x, y := coord(testECKey.X), coord(testECKey.Y)
+	//y加1之后的点不在曲线上
+	offY := coord(new(big.Int).Add(testECKey.Y, big.NewInt(1)))
+
+	cases := []struct {
+		name string
+		jwk  JWK
+		ok   bool
+	}{
+		{name: "ec", jwk: JWK{Kty: "EC", Crv: "P-256", X: b64(x), Y: b64(y)}, ok: true},
+		{name: "ec off curve", jwk: JWK{Kty: "EC", Crv: "P-256", X: b64(x), Y: b64(offY)}},
+		{name: "ec zero point", jwk: JWK{Kty: "EC", Crv: "P-256", X: b64(make([]byte, 32)), Y: b64(make([]byte, 32))}},
+		{name: "ec short coordinate", jwk: JWK{Kty: "EC", Crv: "P-256", X: b64(x[1:]), Y: b64(y)}},
+		{name: "ec other curve", jwk: JWK{Kty: "EC", Crv: "P-384", X: b64(x), Y: b64(y)}},
+		{name: "rsa", jwk: JWK{Kty: "RSA", N: b64(testRSAKey.N.Bytes()), E: b64(big.NewInt(int64(testRSAKey.E)).Bytes())}, ok: true},
+		{name: "rsa huge exponent", jwk: JWK{Kty: "RSA", N: b64(testRSAKey.N.Bytes()), E: b64(make([]byte, 5))}},
+		{name: "oct", jwk: octJWK(""), ok: true},
+		{name: "unknown type", jwk: JWK{Kty: "OKP"}},
+	}
+	for _, c := range cases {
+		_, err := c.jwk.Key()
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err = %v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+
+	//ParseJWKS跳过无效的和用于加密的密钥，其它的照常使用
+	data, _ := json.Marshal(map[string]interface{}{"keys": []JWK{
+		{Kty: "EC", Kid: "bad", Crv: "P-256", X: b64(x), Y: b64(offY)},
+		{Kty: "EC", Kid: "enc", Use: "enc", Crv: "P-256", X: b64(x), Y: b64(y)},
+		{Kty: "EC", Kid: "good", Use: "sig", Crv: "P-256", X: b64(x), Y: b64(y)},
+	}})
+	keys, err := ParseJWKS(data)
+	if err != nil || len(keys) != 1 || keys[0].ID != "good" {
+		t.Fatalf("ParseJWKS = %v, %v", keys, err)
+	}
+}
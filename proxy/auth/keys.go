@@ -0,0 +1,239 @@
+package auth
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ParsePublicKeyPEM 解析PEM格式的公钥，支持PUBLIC KEY、RSA PUBLIC KEY和CERTIFICATE
+func ParsePublicKeyPEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("auth: no PEM block found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return nil, fmt.Errorf("auth: unsupported PEM block %q", block.Type)
+}
+
+// LoadPublicKeyPEM 从文件读取PEM公钥
+func LoadPublicKeyPEM(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// JWKS 从JWKS地址获取密钥并缓存
+// 1、缓存超过RefreshInterval后，下一次查找时重新获取
+// 2、遇到不认识的kid时说明签发方可能轮换了密钥，立即重新获取，但两次获取至少间隔MinRefreshInterval，
+// 防止伪造的kid让网关不停地请求JWKS地址
+// 3、获取失败时继续使用旧的密钥
+type JWKS struct {
+	URL string
+	//Client 为nil时使用10秒超时的客户端
+	Client *http.Client
+	//RefreshInterval 缓存时间，默认1小时
+	RefreshInterval time.Duration
+	//MinRefreshInterval 两次获取的最小间隔，默认30秒
+	MinRefreshInterval time.Duration
+
+	fetchMu sync.Mutex //同一时间只有一个请求在获取
+
+	mu      sync.RWMutex
+	keys    []Key
+	fetched time.Time
+}
+
+// NewJWKS 创建JWKS密钥来源，第一次查找时才获取
+func NewJWKS(url string) *JWKS {
+	return &JWKS{URL: url}
+}
+
+// Keys 实现KeySource接口
+func (j *JWKS) Keys(kid string) ([]Key, error) {
+	keys, fetched := j.cached()
+	refresh := j.RefreshInterval
+	if refresh <= 0 {
+		refresh = time.Hour
+	}
+	if time.Since(fetched) >= refresh {
+		keys, _ = j.refresh(fetched)
+	}
+	found := StaticKeys(keys)
+	if matched, _ := found.Keys(kid); len(matched) > 0 {
+		return matched, nil
+	}
+
+	//不认识的kid，可能是密钥轮换了
+	minRefresh := j.MinRefreshInterval
+	if minRefresh <= 0 {
+		minRefresh = 30 * time.Second
+	}
+	if _, fetched = j.cached(); time.Since(fetched) >= minRefresh {
+		var err error
+		if keys, err = j.refresh(fetched); err != nil && len(keys) == 0 {
+			return nil, err
+		}
+	}
+	return StaticKeys(keys).Keys(kid)
+}
+
+func (j *JWKS) cached() ([]Key, time.Time) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.keys, j.fetched
+}
+
+// refresh 重新获取密钥；等锁的时候别的协程已经获取过时直接返回新的结果
+func (j *JWKS) refresh(seen time.Time) ([]Key, error) {
+	j.fetchMu.Lock()
+	defer j.fetchMu.Unlock()
+	if keys, fetched := j.cached(); fetched.After(seen) {
+		return keys, nil
+	}
+
+	keys, err := j.fetch()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	//失败时也更新时间，按MinRefreshInterval重试，旧的密钥继续使用
+	j.fetched = time.Now()
+	if err != nil {
+		log.Printf("auth: fetch JWKS %s: %v", j.URL, err)
+		return j.keys, err
+	}
+	j.keys = keys
+	return keys, nil
+}
+
+func (j *JWKS) fetch() ([]Key, error) {
+	client := j.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	res, err := client.Get(j.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: JWKS %s returned %s", j.URL, res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+// JWK JSON Web Key中用到的字段
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	//RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	//EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	//oct（HMAC）
+	K string `json:"k,omitempty"`
+}
+
+// ParseJWKS 解析{"keys": [...]}，跳过用于加密的密钥和不支持的类型
+func ParseJWKS(data []byte) ([]Key, error) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("auth: invalid JWKS: %w", err)
+	}
+	var keys []Key
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.Key()
+		if err != nil {
+			log.Printf("auth: skip JWK %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys = append(keys, Key{ID: jwk.Kid, Key: k})
+	}
+	return keys, nil
+}
+
+// Key 把JWK转换成公钥
+func (jwk *JWK) Key() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBase64(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBase64(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 coordinates")
+		}
+		//用crypto/ecdh检查点是否在曲线上，不在曲线上的公钥可能被用来做无效曲线攻击
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "oct":
+		return decodeBase64(jwk.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// JWTAuth HTTP认证过滤器：从请求中取出JWT，校验通过后把指定的声明作为请求头转发给上游
+// 也实现了wsproxy.Authenticator，可以直接作为WebSocket握手策略的认证器
+type JWTAuth struct {
+	Verifier *Verifier
+
+	//Header 令牌所在的请求头，默认Authorization，值要以"Bearer "开头
+	Header string
+	//Cookie、Query 令牌所在的Cookie名和查询参数名，为空时不查找
+	//浏览器的WebSocket API不能设置请求头，只能用这两种方式
+	Cookie string
+	Query  string
+
+	//ClaimHeaders 声明名到请求头名，比如{"sub": "X-User-ID"}
+	//客户端自己带的同名请求头总是会被删掉，防止伪造身份
+	ClaimHeaders map[string]string
+	//Optional 为true时没有令牌的请求也放行，但带了无效令牌的请求仍然拒绝
+	Optional bool
+}
+
+// claimsKey 请求上下文中保存声明的键
+type claimsKey struct{}
+
+// ClaimsFromContext 取出认证通过的声明，没有认证的请求返回nil
+func ClaimsFromContext(ctx context.Context) Claims {
+	c, _ := ctx.Value(claimsKey{}).(Claims)
+	return c
+}
+
+// Token 按请求头、Cookie、查询参数的顺序查找令牌
+func (a *JWTAuth) Token(r *http.Request) string {
+	return bearerToken(r, a.Header, a.Cookie, a.Query)
+}
+
+// bearerToken JWT和令牌自省共用的查找顺序：请求头、Cookie、查询参数，header为空时使用Authorization
+func bearerToken(r *http.Request, header, cookie, query string) string {
+	if header == "" {
+		header = "Authorization"
+	}
+	if v := r.Header.Get(header); v != "" {
+		if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+		//Authorization头必须是Bearer方案，其它方案（比如Basic）不是给网关的
+		if !strings.EqualFold(header, "Authorization") {
+			return strings.TrimSpace(v)
+		}
+	}
+	if cookie != "" {
+		if c, err := r.Cookie(cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	if query != "" {
+		if v := r.URL.Query().Get(query); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Verify 取出令牌并校验
+func (a *JWTAuth) Verify(r *http.Request) (Claims, error) {
+	token := a.Token(r)
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	return a.Verifier.Verify(token)
+}
+
+// Authenticate 实现wsproxy.Authenticator，返回sub作为用户标识
+func (a *JWTAuth) Authenticate(r *http.Request) (string, error) {
+	claims, err := a.Verify(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject(), nil
+}
+
+// Middleware 包装处理器，认证不通过时返回401
+func (a *JWTAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range a.ClaimHeaders {
+			r.Header.Del(h)
+		}
+		claims, err := a.Verify(r)
+		if errors.Is(err, ErrNoToken) && a.Optional {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			Unauthorized(w, err)
+			return
+		}
+		for name, h := range a.ClaimHeaders {
+			if v := claims.String(name); v != "" {
+				r.Header.Set(h, v)
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
+
+// Unauthorized 按RFC 6750返回401，令牌无效时在WWW-Authenticate中说明原因
+func Unauthorized(w http.ResponseWriter, err error) {
+	challenge := `Bearer realm="gateway"`
+	if !errors.Is(err, ErrNoToken) {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description=%q`, strings.TrimPrefix(err.Error(), "auth: "))
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,705 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect依赖方：浏览器访问的应用放在网关后面，登录由网关完成，应用只需要读请求头
+// 1、没有会话的GET请求跳转到身份提供方登录，使用授权码模式和PKCE（S256）
+// 2、回调地址收到授权码后换取令牌，校验ID令牌的签名、iss、aud和nonce，创建会话
+// 3、会话保存在服务端，Cookie中只有随机的会话ID
+// 4、访问令牌快过期时用刷新令牌续期，刷新失败时重新登录
+// 5、访问登出地址删除会话，有end_session_endpoint时跳转到身份提供方登出
+
+var (
+	// ErrNoSession 请求没有有效的会话
+	ErrNoSession = errors.New("auth: no session")
+	// ErrState 回调中的state和发起登录时的不一致，或者登录已经过期
+	ErrState = errors.New("auth: invalid or expired login state")
+	// ErrNonce ID令牌中的nonce和发起登录时的不一致
+	ErrNonce = errors.New("auth: id token nonce mismatch")
+)
+
+// ProviderMetadata OpenID Connect发现文档中用到的字段
+type ProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+}
+
+// Discover 获取issuer下的/.well-known/openid-configuration，client为nil时使用10秒超时的客户端
+func Discover(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	issuer = strings.TrimSuffix(issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("auth: discovery %s returned %s", issuer, res.Status)
+	}
+	var m ProviderMetadata
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&m); err != nil {
+		return nil, fmt.Errorf("auth: discovery %s: %w", issuer, err)
+	}
+	//发现文档中的issuer必须和配置的一致，否则可能被冒充
+	if strings.TrimSuffix(m.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("auth: discovery issuer %q does not match %q", m.Issuer, issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, fmt.Errorf("auth: discovery %s: missing authorization, token or jwks endpoint", issuer)
+	}
+	return &m, nil
+}
+
+// TokenResponse 令牌接口的响应
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// Session 一个登录会话
+type Session struct {
+	ID           string
+	Claims       Claims
+	IDToken      string
+	AccessToken  string
+	RefreshToken string
+	//AccessExpiry 访问令牌的过期时间，零值表示身份提供方没有说明
+	AccessExpiry time.Time
+	//Expires 会话的最长存活时间，到期后必须重新登录，不管刷新令牌是否还有效
+	Expires time.Time
+
+	//issued 访问令牌的获取时间，用来计算提前刷新的时间
+	issued time.Time
+
+	mu sync.Mutex //刷新时加锁，同一个会话的并发请求只刷新一次
+}
+
+// SessionStore 会话的存储，默认保存在内存中，多个网关实例共享会话时可以换成外部存储
+type SessionStore interface {
+	Get(id string) *Session
+	Save(s *Session)
+	Delete(id string)
+}
+
+// MemorySessions 内存中的会话存储，过期的会话在保存新会话时顺带清理
+type MemorySessions struct {
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	lastSweep time.Time
+}
+
+// NewMemorySessions 创建内存会话存储
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{sessions: make(map[string]*Session)}
+}
+
+// Get 实现SessionStore
+func (m *MemorySessions) Get(id string) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+// Save 实现SessionStore，每分钟最多清理一次过期的会话
+func (m *MemorySessions) Save(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastSweep) > time.Minute {
+		for id, old := range m.sessions {
+			if now.After(old.Expires) {
+				delete(m.sessions, id)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.sessions[s.ID] = s
+}
+
+// Delete 实现SessionStore
+func (m *MemorySessions) Delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+}
+
+// Len 会话个数
+func (m *MemorySessions) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// pendingLogin 发起登录时保存的状态，回调时取出
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	returnTo string
+	expires  time.Time
+}
+
+// maxPendingLogins 未完成的登录最多保存的个数，防止不停发起登录占满内存
+const maxPendingLogins = 10000
+
+// RelyingParty OpenID Connect依赖方
+type RelyingParty struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	//RedirectURL 回调地址，要在身份提供方登记过，路径要落在使用这个依赖方的路由下
+	//只写路径时按请求的Host和协议拼成完整地址，网关前面还有代理时以X-Forwarded-Proto为准
+	RedirectURL string
+	//Scopes 为空时使用openid profile email，openid总是会加上
+	Scopes []string
+	//LogoutPath 登出地址，默认/oauth2/logout
+	LogoutPath string
+	//PostLogoutRedirectURL 登出后跳转的地址，默认/
+	PostLogoutRedirectURL string
+	//CookieName 会话Cookie的名字，默认gw_session
+	CookieName string
+	//SessionTTL 会话的最长存活时间，默认24小时
+	SessionTTL time.Duration
+	//ClaimHeaders 声明名到请求头名，和JWTAuth相同
+	ClaimHeaders map[string]string
+	//ForwardAccessToken 为true时把访问令牌放在Authorization头转发给上游
+	ForwardAccessToken bool
+	//Sessions 会话存储，为nil时使用内存存储
+	Sessions SessionStore
+	//Client 访问身份提供方的客户端，为nil时使用10秒超时的客户端
+	Client *http.Client
+	//Now 当前时间，测试时替换
+	Now func() time.Time
+
+	mu       sync.Mutex
+	meta     *ProviderMetadata
+	verifier *Verifier
+	pending  map[string]*pendingLogin
+}
+
+func (rp *RelyingParty) now() time.Time {
+	if rp.Now != nil {
+		return rp.Now()
+	}
+	return time.Now()
+}
+
+func (rp *RelyingParty) client() *http.Client {
+	if rp.Client != nil {
+		return rp.Client
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (rp *RelyingParty) cookieName() string {
+	if rp.CookieName != "" {
+		return rp.CookieName
+	}
+	return "gw_session"
+}
+
+func (rp *RelyingParty) logoutPath() string {
+	if rp.LogoutPath != "" {
+		return rp.LogoutPath
+	}
+	return "/oauth2/logout"
+}
+
+// redirectURL 完整的回调地址
+func (rp *RelyingParty) redirectURL(r *http.Request) string {
+	if !strings.HasPrefix(rp.RedirectURL, "/") {
+		return rp.RedirectURL
+	}
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + rp.RedirectURL
+}
+
+// secure 回调地址是https时Cookie只在https上发送
+func (rp *RelyingParty) secure(r *http.Request) bool {
+	return strings.HasPrefix(rp.redirectURL(r), "https://")
+}
+
+// metadata 第一次使用时获取发现文档，失败时下一个请求重试
+// 获取文档时不持有rp.mu，身份提供方很慢时不会卡住其它请求，并发的请求各自获取，先完成的生效
+func (rp *RelyingParty) metadata(ctx context.Context) (*ProviderMetadata, *Verifier, error) {
+	rp.mu.Lock()
+	meta, verifier := rp.meta, rp.verifier
+	rp.mu.Unlock()
+	if meta != nil {
+		return meta, verifier, nil
+	}
+	m, err := Discover(ctx, rp.Client, rp.Issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	jwks := NewJWKS(m.JWKSURI)
+	jwks.Client = rp.Client
+	//ID令牌是身份提供方用私钥签的，不接受HS256
+	v := &Verifier{
+		Keys:       jwks,
+		Algorithms: []string{RS256, ES256},
+		Issuer:     m.Issuer,
+		Audience:   []string{rp.ClientID},
+		ClockSkew:  time.Minute,
+		RequireExp: true,
+		Now:        rp.Now,
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.meta == nil {
+		rp.meta, rp.verifier = m, v
+	}
+	return rp.meta, rp.verifier, nil
+}
+
+func (rp *RelyingParty) sessions() SessionStore {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.Sessions == nil {
+		rp.Sessions = NewMemorySessions()
+	}
+	return rp.Sessions
+}
+
+// Middleware 包装处理器，处理回调和登出地址，其它请求必须有会话
+func (rp *RelyingParty) Middleware(next http.Handler) http.Handler {
+	return rp.middleware(next, false)
+}
+
+// OptionalMiddleware 和Middleware相同，但没有会话的请求也放行，不跳转登录
+// 会话保存在依赖方中，不能像JWTAuth那样复制一份再设置Optional
+func (rp *RelyingParty) OptionalMiddleware(next http.Handler) http.Handler {
+	return rp.middleware(next, true)
+}
+
+func (rp *RelyingParty) middleware(next http.Handler, optional bool) http.Handler {
+	callbackPath := "/"
+	if u, err := url.Parse(rp.RedirectURL); err == nil && u.Path != "" {
+		callbackPath = u.Path
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case callbackPath:
+			rp.callback(w, r)
+			return
+		case rp.logoutPath():
+			rp.logout(w, r)
+			return
+		}
+
+		for _, h := range rp.ClaimHeaders {
+			r.Header.Del(h)
+		}
+		sess := rp.Session(r)
+		if sess == nil {
+			if optional {
+				next.ServeHTTP(w, removeCookie(r, rp.cookieName()))
+				return
+			}
+			rp.login(w, r)
+			return
+		}
+		for name, h := range rp.ClaimHeaders {
+			if v := sess.Claims.String(name); v != "" {
+				r.Header.Set(h, v)
+			}
+		}
+		if rp.ForwardAccessToken {
+			r.Header.Set("Authorization", "Bearer "+sess.AccessToken)
+		}
+		//会话Cookie只给网关用，不转发给上游
+		r = removeCookie(r, rp.cookieName())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, sess.Claims)))
+	})
+}
+
+// SessionInfo 会话在某一时刻的快照
+// 同一个会话的其它请求可能正在刷新令牌，使用会话时只读快照，不直接读Session的字段
+type SessionInfo struct {
+	ID          string
+	Claims      Claims
+	AccessToken string
+}
+
+// snapshot 复制会话的字段，调用方持有sess.mu
+func (sess *Session) snapshot() *SessionInfo {
+	return &SessionInfo{ID: sess.ID, Claims: sess.Claims, AccessToken: sess.AccessToken}
+}
+
+// Session 返回请求的会话快照，访问令牌快过期时先刷新，没有会话或刷新失败时返回nil
+func (rp *RelyingParty) Session(r *http.Request) *SessionInfo {
+	c, err := r.Cookie(rp.cookieName())
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	store := rp.sessions()
+	sess := store.Get(c.Value)
+	if sess == nil {
+		return nil
+	}
+	now := rp.now()
+	if now.After(sess.Expires) {
+		store.Delete(sess.ID)
+		return nil
+	}
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	//提前30秒刷新，避免令牌在转发途中过期；有效期很短的令牌最多提前一半的有效期
+	margin := 30 * time.Second
+	if half := sess.AccessExpiry.Sub(sess.issued) / 2; half < margin {
+		margin = half
+	}
+	if sess.AccessExpiry.IsZero() || now.Add(margin).Before(sess.AccessExpiry) {
+		return sess.snapshot()
+	}
+	if sess.RefreshToken == "" {
+		store.Delete(sess.ID)
+		return nil
+	}
+	if err := rp.refresh(r.Context(), sess); err != nil {
+		log.Printf("auth: refresh session for %q: %v", sess.Claims.Subject(), err)
+		store.Delete(sess.ID)
+		return nil
+	}
+	store.Save(sess)
+	return sess.snapshot()
+}
+
+// refresh 用刷新令牌续期，调用方持有sess.mu
+func (rp *RelyingParty) refresh(ctx context.Context, sess *Session) error {
+	meta, verifier, err := rp.metadata(ctx)
+	if err != nil {
+		return err
+	}
+	tok, err := rp.token(ctx, meta.TokenEndpoint, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {sess.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	//刷新时可以返回新的ID令牌，里面没有nonce
+	if tok.IDToken != "" {
+		claims, err := verifier.Verify(tok.IDToken)
+		if err != nil {
+			return err
+		}
+		if claims.Subject() != sess.Claims.Subject() {
+			return fmt.Errorf("auth: refreshed id token subject %q does not match %q", claims.Subject(), sess.Claims.Subject())
+		}
+		sess.Claims, sess.IDToken = claims, tok.IDToken
+	}
+	sess.AccessToken = tok.AccessToken
+	sess.AccessExpiry, sess.issued = rp.expiry(tok), rp.now()
+	//有的身份提供方每次刷新都换一个刷新令牌
+	if tok.RefreshToken != "" {
+		sess.RefreshToken = tok.RefreshToken
+	}
+	return nil
+}
+
+func (rp *RelyingParty) expiry(tok *TokenResponse) time.Time {
+	if tok.ExpiresIn <= 0 {
+		return time.Time{}
+	}
+	return rp.now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+}
+
+// login 发起登录：GET和HEAD跳转到身份提供方，其它方法跳转后会丢掉请求体，直接返回401
+func (rp *RelyingParty) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		Unauthorized(w, ErrNoSession)
+		return
+	}
+	meta, _, err := rp.metadata(r.Context())
+	if err != nil {
+		log.Printf("auth: oidc %s: %v", rp.Issuer, err)
+		http.Error(w, "identity provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	rp.mu.Lock()
+	if rp.pending == nil {
+		rp.pending = make(map[string]*pendingLogin)
+	}
+	now := rp.now()
+	if len(rp.pending) >= maxPendingLogins {
+		for s, p := range rp.pending {
+			if now.After(p.expires) {
+				delete(rp.pending, s)
+			}
+		}
+	}
+	full := len(rp.pending) >= maxPendingLogins
+	if !full {
+		rp.pending[state] = &pendingLogin{verifier: verifier, nonce: nonce, returnTo: localPath(r.URL.RequestURI()), expires: now.Add(10 * time.Minute)}
+	}
+	rp.mu.Unlock()
+	if full {
+		http.Error(w, "too many pending logins", http.StatusServiceUnavailable)
+		return
+	}
+
+	//state同时写进Cookie，回调时两者必须一致，防止攻击者把自己的登录结果塞给用户
+	http.SetCookie(w, &http.Cookie{
+		Name: rp.cookieName() + "_state", Value: state, Path: "/", MaxAge: 600,
+		HttpOnly: true, Secure: rp.secure(r), SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := rp.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	} else if !containsString(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.ClientID},
+		"redirect_uri":          {rp.redirectURL(r)},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, withQuery(meta.AuthorizationEndpoint, q), http.StatusFound)
+}
+
+// callback 处理身份提供方的回调
+func (rp *RelyingParty) callback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("auth: oidc %s login failed: %s %s", rp.Issuer, e, q.Get("error_description"))
+		http.Error(w, "login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	state := q.Get("state")
+	c, err := r.Cookie(rp.cookieName() + "_state")
+	if state == "" || err != nil || c.Value != state {
+		http.Error(w, ErrState.Error(), http.StatusBadRequest)
+		return
+	}
+	rp.mu.Lock()
+	p := rp.pending[state]
+	delete(rp.pending, state)
+	rp.mu.Unlock()
+	if p == nil || rp.now().After(p.expires) {
+		http.Error(w, ErrState.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, err := rp.exchange(r.Context(), q.Get("code"), rp.redirectURL(r), p)
+	if err != nil {
+		log.Printf("auth: oidc %s callback: %v", rp.Issuer, err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return
+	}
+	rp.sessions().Save(sess)
+	http.SetCookie(w, &http.Cookie{Name: rp.cookieName() + "_state", Value: "", Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{
+		Name: rp.cookieName(), Value: sess.ID, Path: "/", Expires: sess.Expires,
+		HttpOnly: true, Secure: rp.secure(r), SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, p.returnTo, http.StatusFound)
+}
+
+// exchange 用授权码和PKCE的verifier换取令牌，校验ID令牌后创建会话
+func (rp *RelyingParty) exchange(ctx context.Context, code, redirectURL string, p *pendingLogin) (*Session, error) {
+	meta, verifier, err := rp.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := rp.token(ctx, meta.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {p.verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tok.IDToken == "" {
+		return nil, errors.New("auth: token response has no id_token")
+	}
+	claims, err := verifier.Verify(tok.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.String("nonce") != p.nonce {
+		return nil, ErrNonce
+	}
+	ttl := rp.SessionTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	return &Session{
+		ID:           randomToken(),
+		Claims:       claims,
+		IDToken:      tok.IDToken,
+		AccessToken:  tok.AccessToken,
+		RefreshToken: tok.RefreshToken,
+		AccessExpiry: rp.expiry(tok),
+		Expires:      rp.now().Add(ttl),
+		issued:       rp.now(),
+	}, nil
+}
+
+// token 请求令牌接口，有客户端密钥时用HTTP Basic认证，否则是公开客户端，只带client_id
+func (rp *RelyingParty) token(ctx context.Context, endpoint string, form url.Values) (*TokenResponse, error) {
+	res, err := postForm(ctx, rp.client(), endpoint, rp.ClientID, rp.ClientSecret, form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &e)
+		return nil, fmt.Errorf("auth: token endpoint returned %s: %s %s", res.Status, e.Error, e.Description)
+	}
+	var tok TokenResponse
+	if err := json.Unmarshal(body, &tok); err != nil {
+		return nil, fmt.Errorf("auth: token response: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return nil, errors.New("auth: token response has no access_token")
+	}
+	return &tok, nil
+}
+
+// logout 删除会话和Cookie，身份提供方支持时一起登出
+func (rp *RelyingParty) logout(w http.ResponseWriter, r *http.Request) {
+	var idToken string
+	if c, err := r.Cookie(rp.cookieName()); err == nil {
+		store := rp.sessions()
+		if sess := store.Get(c.Value); sess != nil {
+			idToken = sess.IDToken
+			store.Delete(sess.ID)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: rp.cookieName(), Value: "", Path: "/", MaxAge: -1})
+
+	after := rp.PostLogoutRedirectURL
+	if after == "" {
+		after = "/"
+	}
+	meta, _, err := rp.metadata(r.Context())
+	if err != nil || meta.EndSessionEndpoint == "" || idToken == "" {
+		http.Redirect(w, r, after, http.StatusFound)
+		return
+	}
+	q := url.Values{"id_token_hint": {idToken}, "client_id": {rp.ClientID}}
+	//身份提供方只接受完整的地址，相对路径跳回网关自己
+	if strings.HasPrefix(after, "http://") || strings.HasPrefix(after, "https://") {
+		q.Set("post_logout_redirect_uri", after)
+	}
+	http.Redirect(w, r, withQuery(meta.EndSessionEndpoint, q), http.StatusFound)
+}
+
+// postForm 发送表单请求，令牌接口和自省接口共用
+func postForm(ctx context.Context, client *http.Client, endpoint, clientID, clientSecret string, form url.Values) (*http.Response, error) {
+	if clientSecret == "" {
+		form.Set("client_id", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientSecret != "" {
+		//RFC 6749要求先对客户端ID和密钥做表单编码
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+	return client.Do(req)
+}
+
+// localPath 登录后跳回的地址只接受站内路径，否则回到/
+// Router不清理路径，//evil.example/x和/\evil.example/x在浏览器看来都是别的网站，不能原样跳转
+func localPath(uri string) string {
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.HasPrefix(uri, "/\\") {
+		return "/"
+	}
+	for i := 0; i < len(uri); i++ {
+		if uri[i] < 0x20 || uri[i] == 0x7f {
+			return "/"
+		}
+	}
+	return uri
+}
+
+// removeCookie 从转发的请求中删掉网关自己的Cookie
+func removeCookie(r *http.Request, name string) *http.Request {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name && c.Name != name+"_state" {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func withQuery(endpoint string, q url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + q.Encode()
+	}
+	return endpoint + "?" + q.Encode()
+}
+
+// randomToken 32字节的随机数，用作state、nonce、PKCE的verifier和会话ID
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
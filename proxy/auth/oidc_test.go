@@ -0,0 +1,235 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"gateway/gatewaytest"
+)
+
+// startOIDC 启动替身身份提供方、上游和网关，/api用令牌自省，其它路径用OIDC登录
+func startOIDC(t *testing.T) (*gatewaytest.IdP, *gatewaytest.HTTPUpstream, *gatewaytest.Gateway) {
+	t.Helper()
+	idp := gatewaytest.NewIdP(t)
+	up := gatewaytest.NewHTTPUpstream(t, "app", nil)
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{
+		"auth": {
+			"oidc": [{"name": "sso", "issuer": %q, "client_id": %q, "client_secret": %q,
+				"redirect_url": "/oauth2/callback", "claim_headers": {"sub": "X-User", "email": "X-Email"}}],
+			"introspection": [{"name": "api", "url": %q, "client_id": %q, "client_secret": %q,
+				"scopes": ["read"], "claim_headers": {"sub": "X-User"}}]
+		},
+		"http": [{"name": "web", "routes": [
+			{"name": "api", "path_prefix": "/api", "targets": [%q], "auth": {"introspection": "api"}},
+			{"name": "app", "path_prefix": "/", "targets": [%q], "auth": {"oidc": "sso"}}
+		]}]}`,
+		idp.Issuer(), idp.ClientID, idp.ClientSecret,
+		idp.IntrospectionURL(), idp.ClientID, idp.ClientSecret, up.URL, up.URL))
+	return idp, up, gw
+}
+
+// browse 用浏览器访问网关，返回上游收到的请求
+func browse(t *testing.T, browser *http.Client, url string) gatewaytest.Echo {
+	t.Helper()
+	res, err := browser.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	gatewaytest.AssertStatus(t, res, http.StatusOK)
+	var e gatewaytest.Echo
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// noFollow 和browser共用Cookie但不跟随跳转
+func noFollow(browser *http.Client) *http.Client {
+	return &http.Client{Jar: browser.Jar, Timeout: browser.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp, _, gw := startOIDC(t)
+	idp.SetUser("bob", map[string]interface{}{"email": "bob@example.com"})
+
+	//没有会话的GET跳转到身份提供方，其它方法返回401
+	res := gw.Get(t, "web", "/page")
+	gatewaytest.AssertStatus(t, res, http.StatusFound)
+	res = gw.Request(t, http.MethodPost, "web", "/page", "", nil)
+	gatewaytest.AssertStatus(t, res, http.StatusUnauthorized)
+
+	browser := gatewaytest.NewBrowser(t)
+	e := browse(t, browser, gw.URL(t, "web", "/page?a=1"))
+	if e.Path != "/page" || e.RawQuery != "a=1" {
+		t.Errorf("after login got %s?%s, want /page?a=1", e.Path, e.RawQuery)
+	}
+	gatewaytest.AssertHeader(t, e.Header, "X-User", "bob")
+	gatewaytest.AssertHeader(t, e.Header, "X-Email", "bob@example.com")
+	gatewaytest.AssertHeader(t, e.Header, "Cookie", "")
+
+	//客户端自己带的声明头被覆盖
+	req, _ := http.NewRequest(http.MethodGet, gw.URL(t, "web", "/other"), nil)
+	req.Header.Set("X-User", "root")
+	res, err := browser.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(res.Body).Decode(&e)
+	res.Body.Close()
+	if got := e.Header.Values("X-User"); len(got) != 1 || got[0] != "bob" {
+		t.Errorf("X-User = %q, want [bob]", got)
+	}
+}
+
+func TestOIDCLoginStaysOnSite(t *testing.T) {
+	_, _, gw := startOIDC(t)
+	for _, path := range []string{"//evil.example/x", "///evil.example/x"} {
+		browser := gatewaytest.NewBrowser(t)
+		var hosts []string
+		browser.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			hosts = append(hosts, req.URL.Host)
+			return nil
+		}
+		e := browse(t, browser, gw.URL(t, "web", path))
+		if e.Path != "/" {
+			t.Errorf("%s: after login got %s, want /", path, e.Path)
+		}
+		for _, h := range hosts {
+			if h == "evil.example" {
+				t.Errorf("%s: redirected to %s", path, h)
+			}
+		}
+	}
+}
+
+func TestOIDCBadState(t *testing.T) {
+	_, _, gw := startOIDC(t)
+	res := gw.Get(t, "web", "/oauth2/callback?code=x&state=y")
+	gatewaytest.AssertStatus(t, res, http.StatusBadRequest)
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	idp, _, gw := startOIDC(t)
+	idp.SetAccessTokenTTL(2 * time.Second)
+	browser := gatewaytest.NewBrowser(t)
+	browse(t, browser, gw.URL(t, "web", "/a"))
+	browse(t, browser, gw.URL(t, "web", "/b"))
+	if n := idp.Refreshes(); n != 0 {
+		t.Fatalf("refreshed %d times before the token was close to expiry", n)
+	}
+	//离过期不到一半的有效期时续期
+	time.Sleep(1100 * time.Millisecond)
+	e := browse(t, browser, gw.URL(t, "web", "/c"))
+	if n := idp.Refreshes(); n != 1 {
+		t.Errorf("refreshes = %d, want 1", n)
+	}
+	gatewaytest.AssertHeader(t, e.Header, "X-User", "alice")
+}
+
+// TestOIDCConcurrentRefresh 同一个会话的并发请求只刷新一次，正在刷新时其它请求读到的声明和令牌不会被改到一半
+func TestOIDCConcurrentRefresh(t *testing.T) {
+	idp, _, gw := startOIDC(t)
+	idp.SetAccessTokenTTL(2 * time.Second)
+	browser := gatewaytest.NewBrowser(t)
+	browse(t, browser, gw.URL(t, "web", "/a"))
+	time.Sleep(1100 * time.Millisecond)
+
+	//browse失败时调用t.Fatal，不能在其它goroutine中用
+	base := gw.URL(t, "web", "")
+	users := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := browser.Get(base + fmt.Sprintf("/p%d", i))
+			if err != nil {
+				return
+			}
+			defer res.Body.Close()
+			var e gatewaytest.Echo
+			if res.StatusCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&e) == nil {
+				users[i] = e.Header.Get("X-User")
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, u := range users {
+		if u != "alice" {
+			t.Errorf("request %d: upstream saw X-User %q, want alice", i, u)
+		}
+	}
+	if n := idp.Refreshes(); n != 1 {
+		t.Errorf("refreshes = %d, want 1", n)
+	}
+}
+
+func TestOIDCLogout(t *testing.T) {
+	idp, _, gw := startOIDC(t)
+	browser := gatewaytest.NewBrowser(t)
+	browse(t, browser, gw.URL(t, "web", "/page"))
+
+	client := noFollow(browser)
+	res, err := client.Get(gw.URL(t, "web", "/oauth2/logout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	gatewaytest.AssertStatus(t, res, http.StatusFound)
+	res, err = client.Get(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if n := idp.Logouts(); n != 1 {
+		t.Errorf("logouts = %d, want 1", n)
+	}
+
+	//会话已经删除，再访问要重新登录
+	res, err = client.Get(gw.URL(t, "web", "/page"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	gatewaytest.AssertStatus(t, res, http.StatusFound)
+}
+
+func TestIntrospection(t *testing.T) {
+	idp, up, gw := startOIDC(t)
+	call := func(token string) int {
+		h := http.Header{}
+		if token != "" {
+			h.Set("Authorization", "Bearer "+token)
+		}
+		res := gw.Request(t, http.MethodGet, "web", "/api/x", "", h)
+		gatewaytest.ReadBody(t, res)
+		return res.StatusCode
+	}
+
+	token := idp.IssueAccessToken("carol", "read write")
+	for i := 0; i < 3; i++ {
+		if code := call(token); code != http.StatusOK {
+			t.Fatalf("active token: status %d", code)
+		}
+	}
+	if n := idp.Introspections(); n != 1 {
+		t.Errorf("introspections = %d, want 1 (cached)", n)
+	}
+	gatewaytest.AssertHeader(t, up.LastRequest(t).Header, "X-User", "carol")
+
+	if code := call(idp.IssueAccessToken("dave", "write")); code != http.StatusForbidden {
+		t.Errorf("insufficient scope: status %d, want 403", code)
+	}
+	if code := call(""); code != http.StatusUnauthorized {
+		t.Errorf("no token: status %d, want 401", code)
+	}
+	if code := call("bogus"); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %d, want 401", code)
+	}
+}
@@ -0,0 +1,68 @@
+package signature
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"gateway/proxy/clientip"
+)
+
+// Auth 校验签名的中间件
+type Auth struct {
+	Verifier *Verifier
+	//Logger 记录校验失败的原因，为nil时使用log包默认的Logger
+	Logger *log.Logger
+}
+
+// Middleware 包装处理器，签名错误返回401，请求体过大返回413
+// 重放、过期等具体原因只写日志，不告诉调用方
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := a.Verifier.Verify(r); err != nil {
+			a.logf("signature: %s %s from %s rejected: %v", r.Method, r.URL.Path, clientip.String(r), err)
+			switch {
+			case errors.Is(err, ErrBodyTooLarge):
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			case errors.Is(err, ErrNonceCacheFull):
+				http.Error(w, "try again later", http.StatusServiceUnavailable)
+			default:
+				http.Error(w, "invalid signature", http.StatusUnauthorized)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Auth) logf(format string, args ...interface{}) {
+	if a.Logger != nil {
+		a.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Transport 用网关的密钥给转发到上游的请求重新签名，会覆盖调用方的签名
+// 上游只需要信任网关一个密钥，调用方的密钥轮换不影响上游
+// 签名在RoundTrip中计算，这时路径已经去掉前缀、拼上了上游地址，每次重试都会换一个新的随机数
+func (s *Signer) Transport(next http.RoundTripper) http.RoundTripper {
+	return &signingTransport{signer: s, next: next}
+}
+
+type signingTransport struct {
+	signer *Signer
+	next   http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	//RoundTripper不能修改传进来的请求，复制一份再设置签名头
+	out := req.Clone(req.Context())
+	if err := t.signer.Sign(out); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(out)
+}
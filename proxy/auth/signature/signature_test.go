@@ -0,0 +1,291 @@
+package signature
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Unix(1700000000, 0)
+
+func clock() time.Time { return now }
+
+func TestCanonical(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "http://api.example.com/a%2Fb/c?z=1&a=2&a=1", nil)
+	r.Header.Add("X-Tenant", " t1")
+	r.Header.Add("X-Tenant", "t2 ")
+	got := canonical(r, []string{"Host", "X-Tenant"}, "hash", "123", "n")
+	want := "POST\n/a%2Fb/c\na=2&a=1&z=1\nhost:api.example.com\nx-tenant:t1,t2\nhash\n123\nn"
+	if got != want {
+		t.Errorf("canonical =\n%q\nwant\n%q", got, want)
+	}
+
+	//发出去的请求Host为空时用地址中的Host
+	out, _ := http.NewRequest(http.MethodGet, "http://upstream:8080/x", nil)
+	out.Host = ""
+	if got := canonical(out, []string{"host"}, "h", "1", "n"); !strings.Contains(got, "\nhost:upstream:8080\n") {
+		t.Errorf("outgoing host: %q", got)
+	}
+}
+
+func signed(t *testing.T, s *Signer, method, target, body string) *http.Request {
+	t.Helper()
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, rd)
+	r.Header.Set("X-Tenant", "t1")
+	if err := s.Sign(r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestRoundTrip Signer签名的请求能通过Verifier，校验后请求体还能再读
+func TestRoundTrip(t *testing.T) {
+	s := &Signer{Secret: Secret{ID: "k1", Key: []byte("secret")}, Headers: []string{"Host", "X-Tenant"}, Now: clock}
+	v := &Verifier{Secrets: []Secret{{ID: "k1", Key: []byte("secret")}}, Headers: s.Headers, Now: clock}
+
+	r := signed(t, s, http.MethodPost, "/hook?b=2&a=1", `{"id":1}`)
+	if id, err := v.Verify(r); err != nil || id != "k1" {
+		t.Fatalf("Verify = %q, %v", id, err)
+	}
+	if b, _ := io.ReadAll(r.Body); string(b) != `{"id":1}` {
+		t.Errorf("body after verify = %q", b)
+	}
+
+	//签名覆盖的每一部分被改动都要失败
+	tamper := map[string]func(*http.Request){
+		"method": func(r *http.Request) { r.Method = http.MethodPut },
+		"path":   func(r *http.Request) { r.URL.Path = "/other" },
+		"query":  func(r *http.Request) { r.URL.RawQuery = "a=1&b=3" },
+		"header": func(r *http.Request) { r.Header.Set("X-Tenant", "t2") },
+		"body":   func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"id":2}`)) },
+		"nonce":  func(r *http.Request) { r.Header.Set(HeaderNonce, "other") },
+	}
+	for name, f := range tamper {
+		r := signed(t, s, http.MethodPost, "/hook?b=2&a=1", `{"id":1}`)
+		f(r)
+		if _, err := v.Verify(r); !errors.Is(err, ErrMismatch) {
+			t.Errorf("%s tampered: %v, want ErrMismatch", name, err)
+		}
+	}
+
+	//参数顺序不同不影响签名
+	r = signed(t, s, http.MethodGet, "/hook?b=2&a=1", "")
+	r.URL.RawQuery = "a=1&b=2"
+	if _, err := v.Verify(r); err != nil {
+		t.Errorf("reordered query: %v", err)
+	}
+
+	r = signed(t, s, http.MethodGet, "/", "")
+	r.Header.Del(HeaderNonce)
+	if _, err := v.Verify(r); !errors.Is(err, ErrMissing) {
+		t.Errorf("missing nonce: %v", err)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	key := Secret{ID: "k", Key: []byte("secret")}
+	v := &Verifier{Secrets: []Secret{key}, Window: time.Minute, Now: clock}
+	cases := []struct {
+		skew time.Duration
+		err  error
+	}{
+		{0, nil},
+		{time.Minute, nil},
+		{-time.Minute, nil},
+		{time.Minute + time.Second, ErrExpired},
+		{-time.Minute - time.Second, ErrExpired},
+	}
+	for _, c := range cases {
+		at := now.Add(c.skew)
+		s := &Signer{Secret: key, Now: func() time.Time { return at }}
+		if _, err := v.Verify(signed(t, s, http.MethodGet, "/", "")); !errors.Is(err, c.err) {
+			t.Errorf("skew %v: %v, want %v", c.skew, err, c.err)
+		}
+	}
+
+	r := signed(t, &Signer{Secret: key, Now: clock}, http.MethodGet, "/", "")
+	r.Header.Set(HeaderTimestamp, "soon")
+	if _, err := v.Verify(r); !errors.Is(err, ErrExpired) {
+		t.Errorf("bad timestamp: %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	key := Secret{ID: "k", Key: []byte("secret")}
+	v := &Verifier{Secrets: []Secret{key}, Window: time.Minute, Now: clock}
+	r := signed(t, &Signer{Secret: key, Now: clock}, http.MethodPost, "/", "x")
+	replay := r.Clone(r.Context())
+	replay.Body = io.NopCloser(strings.NewReader("x"))
+
+	if _, err := v.Verify(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(replay); !errors.Is(err, ErrReplay) {
+		t.Errorf("replay: %v, want ErrReplay", err)
+	}
+
+	//签名不对的请求不占用缓存
+	bad := signed(t, &Signer{Secret: Secret{ID: "k", Key: []byte("wrong")}, Now: clock}, http.MethodGet, "/", "")
+	if _, err := v.Verify(bad); !errors.Is(err, ErrMismatch) {
+		t.Errorf("wrong key: %v", err)
+	}
+	if n := v.Nonces.Len(); n != 1 {
+		t.Errorf("cache has %d nonces, want 1", n)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	c := NewNonceCache(2)
+	exp := now.Add(time.Minute)
+	if err := c.Add("a", exp, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("a", exp, now); !errors.Is(err, ErrReplay) {
+		t.Errorf("duplicate: %v", err)
+	}
+	if err := c.Add("b", now.Add(2*time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	//窗口内的随机数不能被淘汰
+	if err := c.Add("c", exp, now); !errors.Is(err, ErrNonceCacheFull) {
+		t.Errorf("full: %v, want ErrNonceCacheFull", err)
+	}
+	//a过期后被清理，腾出位置，过期的随机数也可以再用
+	later := exp
+	if err := c.Add("c", later.Add(time.Minute), later); err != nil {
+		t.Errorf("after expiry: %v", err)
+	}
+	if err := c.Add("a", later.Add(time.Minute), later); !errors.Is(err, ErrNonceCacheFull) {
+		t.Errorf("still full: %v", err)
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len = %d", c.Len())
+	}
+
+	//中间件把缓存满映射成503
+	key := Secret{Key: []byte("secret")}
+	full := NewNonceCache(0)
+	a := &Auth{Verifier: &Verifier{Secrets: []Secret{key}, Nonces: full, Now: clock}}
+	w := httptest.NewRecorder()
+	a.Middleware(http.NotFoundHandler()).ServeHTTP(w, signed(t, &Signer{Secret: key, Now: clock}, http.MethodGet, "/", ""))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("middleware with full cache: %d", w.Code)
+	}
+}
+
+// TestRotation 新旧密钥同时配置，带密钥ID时只用对应的密钥
+func TestRotation(t *testing.T) {
+	old := Secret{ID: "old", Key: []byte("old-secret")}
+	cur := Secret{ID: "new", Key: []byte("new-secret")}
+	v := &Verifier{Secrets: []Secret{cur, old}, Now: clock}
+
+	for _, s := range []Secret{old, cur} {
+		if id, err := v.Verify(signed(t, &Signer{Secret: s, Now: clock}, http.MethodGet, "/", "")); err != nil || id != s.ID {
+			t.Errorf("%s: %q, %v", s.ID, id, err)
+		}
+	}
+	//不带密钥ID时依次尝试
+	if id, err := v.Verify(signed(t, &Signer{Secret: Secret{Key: old.Key}, Now: clock}, http.MethodGet, "/", "")); err != nil || id != "old" {
+		t.Errorf("no key id: %q, %v", id, err)
+	}
+	//密钥ID指定的密钥不对，不会用其它密钥再试
+	r := signed(t, &Signer{Secret: old, Now: clock}, http.MethodGet, "/", "")
+	r.Header.Set(HeaderKeyID, "new")
+	if _, err := v.Verify(r); !errors.Is(err, ErrMismatch) {
+		t.Errorf("wrong key id: %v", err)
+	}
+	r = signed(t, &Signer{Secret: Secret{ID: "gone", Key: old.Key}, Now: clock}, http.MethodGet, "/", "")
+	if _, err := v.Verify(r); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("unknown key id: %v", err)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestTransport 转发时用网关的密钥重新签名，不修改传进来的请求，每次重试换新的随机数
+func TestTransport(t *testing.T) {
+	caller := Secret{ID: "caller", Key: []byte("caller-secret")}
+	gw := Secret{ID: "gateway", Key: []byte("gateway-secret")}
+	upstream := &Verifier{Secrets: []Secret{gw}, Headers: []string{"Host"}, Now: clock}
+
+	var nonces []string
+	tr := (&Signer{Secret: gw, Headers: []string{"Host"}, Now: clock}).Transport(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		nonces = append(nonces, r.Header.Get(HeaderNonce))
+		if _, err := upstream.Verify(r); err != nil {
+			return nil, err
+		}
+		if b, _ := io.ReadAll(r.Body); string(b) != "payload" {
+			t.Errorf("upstream body = %q", b)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+
+	in, _ := http.NewRequest(http.MethodPost, "http://upstream:8080/hook", strings.NewReader("payload"))
+	if err := (&Signer{Secret: caller, Now: clock}).Sign(in); err != nil {
+		t.Fatal(err)
+	}
+	callerSig := in.Header.Get(HeaderSignature)
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			in.Body, _ = in.GetBody()
+		}
+		if _, err := tr.RoundTrip(in); err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if in.Header.Get(HeaderSignature) != callerSig || in.Header.Get(HeaderKeyID) != "caller" {
+		t.Error("RoundTrip modified the incoming request")
+	}
+	if len(nonces) != 2 || nonces[0] == nonces[1] {
+		t.Errorf("nonces = %q, want two different", nonces)
+	}
+
+	//请求体太大时不转发
+	big := &Signer{Secret: gw, MaxBodySize: 3, Now: clock}
+	in, _ = http.NewRequest(http.MethodPost, "http://upstream/", strings.NewReader("payload"))
+	if _, err := big.Transport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		t.Error("oversized request forwarded")
+		return nil, nil
+	})).RoundTrip(in); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("oversized: %v", err)
+	}
+}
+
+func TestMiddlewareStatus(t *testing.T) {
+	key := Secret{Key: []byte("secret")}
+	a := &Auth{Verifier: &Verifier{Secrets: []Secret{key}, MaxBodySize: 4, Now: clock}}
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s := &Signer{Secret: key, Now: clock}
+
+	//请求体比签名时长，校验时超过上限
+	big := signed(t, s, http.MethodPost, "/", "ok")
+	big.Body = io.NopCloser(strings.NewReader("too long"))
+	big.ContentLength = -1
+
+	cases := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"signed", signed(t, s, http.MethodPost, "/", "ok"), http.StatusOK},
+		{"unsigned", httptest.NewRequest(http.MethodGet, "/", nil), http.StatusUnauthorized},
+		{"body too large", big, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, c.r)
+		if w.Code != c.want {
+			t.Errorf("%s: %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
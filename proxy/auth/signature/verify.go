@@ -0,0 +1,140 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Verifier 校验请求的签名
+type Verifier struct {
+	//Secrets 可以接受的密钥，请求带密钥ID时只用对应的密钥，不带时依次尝试
+	Secrets []Secret
+	//Headers 参与签名的请求头，必须和调用方一致
+	Headers []string
+	//Window 时间戳和当前时间相差的上限，默认5分钟
+	Window time.Duration
+	//MaxBodySize 缓冲请求体的上限，默认1MB
+	MaxBodySize int64
+	//Nonces 记录用过的随机数，为nil时使用容量为100000的缓存
+	Nonces *NonceCache
+	//Now 当前时间，测试时替换
+	Now func() time.Time
+
+	once sync.Once
+}
+
+func (v *Verifier) window() time.Duration {
+	if v.Window > 0 {
+		return v.Window
+	}
+	return 5 * time.Minute
+}
+
+// Verify 校验签名和时间戳，最后才记录随机数，签名不对的请求不会占用缓存
+// 返回签名所用密钥的ID
+func (v *Verifier) Verify(r *http.Request) (string, error) {
+	sig := r.Header.Get(HeaderSignature)
+	tsHeader := r.Header.Get(HeaderTimestamp)
+	nonce := r.Header.Get(HeaderNonce)
+	if sig == "" || tsHeader == "" || nonce == "" {
+		return "", ErrMissing
+	}
+	ts, err := strconv.ParseInt(tsHeader, 10, 64)
+	if err != nil {
+		return "", ErrExpired
+	}
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	t := time.Unix(ts, 0)
+	if d := now.Sub(t); d > v.window() || d < -v.window() {
+		return "", ErrExpired
+	}
+
+	secrets := v.Secrets
+	if id := r.Header.Get(HeaderKeyID); id != "" {
+		secrets = nil
+		for _, s := range v.Secrets {
+			if s.ID == id {
+				secrets = []Secret{s}
+				break
+			}
+		}
+		if secrets == nil {
+			return "", ErrUnknownKey
+		}
+	}
+
+	bodyHash, err := readBody(r, v.MaxBodySize)
+	if err != nil {
+		return "", err
+	}
+	s := canonical(r, v.Headers, bodyHash, tsHeader, nonce)
+	got := []byte(sig)
+	for _, secret := range secrets {
+		//hmac.Equal是常量时间比较，不会通过耗时泄漏签名
+		if hmac.Equal(got, []byte(sign(secret.Key, s))) {
+			v.once.Do(func() {
+				if v.Nonces == nil {
+					v.Nonces = NewNonceCache(100000)
+				}
+			})
+			//随机数按密钥区分，超出窗口的随机数一定会被时间戳检查拒绝，到时候就可以忘掉了
+			if err := v.Nonces.Add(secret.ID+"/"+nonce, t.Add(v.window()), now); err != nil {
+				return "", err
+			}
+			return secret.ID, nil
+		}
+	}
+	return "", ErrMismatch
+}
+
+// ErrNonceCacheFull 窗口内的随机数超过了缓存容量，为了不放过重放，新请求被拒绝
+var ErrNonceCacheFull = errors.New("signature: nonce cache full")
+
+// NonceCache 记录窗口内用过的随机数
+type NonceCache struct {
+	max int
+
+	mu      sync.Mutex
+	entries map[string]time.Time //随机数到过期时间
+}
+
+// NewNonceCache 创建缓存，max是最多记录的随机数个数
+func NewNonceCache(max int) *NonceCache {
+	return &NonceCache{max: max, entries: make(map[string]time.Time)}
+}
+
+// Add 记录一个随机数，已经存在时返回ErrReplay
+// 缓存满了先清理过期的，仍然满时返回ErrNonceCacheFull，而不是淘汰还在窗口内的随机数
+func (c *NonceCache) Add(nonce string, expires, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exp, ok := c.entries[nonce]; ok && now.Before(exp) {
+		return ErrReplay
+	}
+	if len(c.entries) >= c.max {
+		for n, exp := range c.entries {
+			if !now.Before(exp) {
+				delete(c.entries, n)
+			}
+		}
+		if len(c.entries) >= c.max {
+			return ErrNonceCacheFull
+		}
+	}
+	c.entries[nonce] = expires
+	return nil
+}
+
+// Len 缓存中的随机数个数，包括已经过期还没清理的
+func (c *NonceCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,185 @@
+package clientip
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gateway/proxy/proxyproto"
+)
+
+// ErrDenied IP被访问列表拒绝
+var ErrDenied = errors.New("clientip: access denied")
+
+// rules 一份生效中的规则，整体替换，不在原地修改
+type rules struct {
+	allow, deny []*net.IPNet
+}
+
+// AccessList IP访问列表：先检查deny，再检查allow，allow为空表示允许所有
+// 规则来自配置中的静态网段和可选的文件，文件修改后自动重新加载，加载失败时继续使用旧的规则
+//
+// 文件每行一条规则，#开头的是注释：
+//
+//	allow 10.0.0.0/8
+//	deny  10.1.2.3
+type AccessList struct {
+	//File 规则文件，为空时只有静态规则
+	File string
+	//ReloadInterval 检查文件是否修改的间隔，默认10秒，只在Run中使用
+	ReloadInterval time.Duration
+
+	static  rules
+	current atomic.Value //*rules
+	modTime time.Time
+}
+
+// NewAccessList 用静态网段创建访问列表，file不为空时同时加载文件
+func NewAccessList(allow, deny []string, file string) (*AccessList, error) {
+	l := &AccessList{File: file}
+	var err error
+	if l.static.allow, err = proxyproto.ParseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if l.static.deny, err = proxyproto.ParseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	l.current.Store(&l.static)
+	if file != "" {
+		if err := l.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Reload 重新读取规则文件，和静态规则合并后替换当前的规则
+func (l *AccessList) Reload() error {
+	if l.File == "" {
+		return nil
+	}
+	st, err := os.Stat(l.File)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(l.File)
+	if err != nil {
+		return err
+	}
+	r, err := parseRules(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.File, err)
+	}
+	r.allow = append(append([]*net.IPNet(nil), l.static.allow...), r.allow...)
+	r.deny = append(append([]*net.IPNet(nil), l.static.deny...), r.deny...)
+	l.current.Store(r)
+	l.modTime = st.ModTime()
+	return nil
+}
+
+// parseRules 解析规则文件的内容
+func parseRules(data []byte) (*rules, error) {
+	r := &rules{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"allow|deny CIDR\"", n)
+		}
+		nets, err := proxyproto.ParseCIDRs(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			r.allow = append(r.allow, nets...)
+		case "deny":
+			r.deny = append(r.deny, nets...)
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", n, fields[0])
+		}
+	}
+	return r, sc.Err()
+}
+
+// Run 定期检查规则文件的修改时间，修改了就重新加载，直到stop关闭
+func (l *AccessList) Run(stop <-chan struct{}) {
+	if l.File == "" {
+		return
+	}
+	interval := l.ReloadInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		st, err := os.Stat(l.File)
+		if err != nil {
+			log.Printf("clientip: %s: %v, keep the previous rules", l.File, err)
+			continue
+		}
+		if st.ModTime().Equal(l.modTime) {
+			continue
+		}
+		if err := l.Reload(); err != nil {
+			log.Printf("clientip: reload %v, keep the previous rules", err)
+			continue
+		}
+		log.Printf("clientip: reloaded %s", l.File)
+	}
+}
+
+// Allowed 判断IP是否允许访问，拿不到IP时只在没有allow限制时放行
+func (l *AccessList) Allowed(ip net.IP) bool {
+	r := l.current.Load().(*rules)
+	if ip == nil {
+		return len(r.allow) == 0
+	}
+	for _, n := range r.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(r.allow) == 0 {
+		return true
+	}
+	for _, n := range r.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware 拒绝不允许的客户端，返回403，客户端IP用FromRequest取得
+func (l *AccessList) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := FromRequest(r); !l.Allowed(ip) {
+			log.Printf("clientip: %v: %s %s from %s", ErrDenied, r.Method, r.URL.Path, String(r))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,164 @@
+// Package clientip 找出请求的真实客户端IP，并按IP网段过滤请求和连接
+//
+// 网关前面还有负载均衡或CDN时，req.RemoteAddr是上一跳代理的地址，真实的客户端IP在
+// X-Forwarded-For、X-Real-IP或Forwarded头中。这些头客户端可以随便写，所以只有上一跳在
+// 受信任网段内时才采用，并且只看代理实际写入的那一个头，从右往左跳过受信任的代理，取第一个不受信任的地址
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"gateway/proxy/proxyproto"
+)
+
+// DefaultHeader 默认只看X-Forwarded-For，常见的负载均衡都会在它后面追加地址
+const DefaultHeader = "X-Forwarded-For"
+
+// forwardingHeaders 上一跳不受信任时要删掉的转发头，不管用的是哪一个
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"}
+
+// Resolver 解析真实客户端IP
+type Resolver struct {
+	//TrustedProxies 受信任的代理网段，为空时不信任任何请求头，总是使用RemoteAddr
+	TrustedProxies []*net.IPNet
+	//Header 受信任的代理写入客户端地址的请求头，为空时使用DefaultHeader
+	//只看这一个头：代理通常只追加其中一个，其它的头原样透传，客户端可以随便写
+	Header string
+}
+
+// NewResolver 从字符串解析受信任的网段，写法见proxyproto.ParseCIDRs
+func NewResolver(trusted []string, header string) (*Resolver, error) {
+	nets, err := proxyproto.ParseCIDRs(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{TrustedProxies: nets, Header: header}, nil
+}
+
+func (res *Resolver) header() string {
+	if res.Header != "" {
+		return res.Header
+	}
+	return DefaultHeader
+}
+
+func (res *Resolver) trusted(ip net.IP) bool {
+	for _, n := range res.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP 返回请求的真实客户端IP，res为nil时直接使用RemoteAddr
+func (res *Resolver) ClientIP(r *http.Request) net.IP {
+	peer := parseIP(r.RemoteAddr)
+	if res == nil || peer == nil || !res.trusted(peer) {
+		return peer
+	}
+	h := res.header()
+	values := r.Header.Values(h)
+	if len(values) == 0 {
+		return peer
+	}
+	var chain []string
+	switch http.CanonicalHeaderKey(h) {
+	case "Forwarded":
+		chain = forwardedFor(values)
+	case "X-Real-Ip":
+		//X-Real-IP只有一个地址，由上一跳代理直接写入
+		chain = values[len(values)-1:]
+	default:
+		for _, v := range values {
+			chain = append(chain, strings.Split(v, ",")...)
+		}
+	}
+	if ip := res.walk(chain); ip != nil {
+		return ip
+	}
+	return peer
+}
+
+// walk 从右往左跳过受信任的代理，返回第一个不受信任的地址；全都受信任时返回最左边的地址
+// 遇到无法解析的地址就停下，它左边的内容都可能是伪造的
+func (res *Resolver) walk(chain []string) net.IP {
+	var last net.IP
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseIP(strings.TrimSpace(chain[i]))
+		if ip == nil {
+			return last
+		}
+		if !res.trusted(ip) {
+			return ip
+		}
+		last = ip
+	}
+	return last
+}
+
+// forwardedFor 取出RFC 7239 Forwarded头中的for参数，按出现顺序排列
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, elem := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(k, "for") {
+					continue
+				}
+				//for="[2001:db8::1]:4711"，IPv6和带端口的地址要加引号
+				out = append(out, strings.Trim(val, `"`))
+			}
+		}
+	}
+	return out
+}
+
+// parseIP 解析IP，可以带端口，IPv6可以带方括号
+func parseIP(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// ipKey 请求上下文中保存客户端IP的键
+type ipKey struct{}
+
+// Middleware 解析客户端IP并保存在请求上下文中，之后用FromRequest取出
+// 上一跳不受信任时删掉请求中的转发头，防止伪造的地址被转发给上游
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer := parseIP(r.RemoteAddr); peer != nil && !res.trusted(peer) {
+			for _, h := range forwardingHeaders {
+				r.Header.Del(h)
+			}
+			r.Header.Del(res.header())
+		}
+		ip := res.ClientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ipKey{}, ip)))
+	})
+}
+
+// FromRequest 返回Middleware解析出的客户端IP，请求没有经过Middleware时使用RemoteAddr
+func FromRequest(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(ipKey{}).(net.IP); ok && ip != nil {
+		return ip
+	}
+	return parseIP(r.RemoteAddr)
+}
+
+// String 和FromRequest相同，返回字符串，拿不到IP时返回RemoteAddr原样
+func String(r *http.Request) string {
+	if ip := FromRequest(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,111 @@
+package fault
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// 管理接口，挂在管理监听的/faults下面：
+//
+//	GET    /faults                       所有路由和监听的故障
+//	GET    /faults/http/{route}          一条路由的故障，route是“监听名/路由名”
+//	PUT    /faults/http/{route}          用JSON设置并开启故障
+//	DELETE /faults/http/{route}          清除故障
+//	POST   /faults/http/{route}?enabled=false|true  关闭或重新开启，不修改故障内容
+//
+// TCP监听把http换成tcp
+
+// ServeHTTP 实现管理接口，调用方用http.StripPrefix去掉/faults前缀
+func (in *Injector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "" || req.URL.Path == "/" {
+		if req.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, in.Snapshot())
+		return
+	}
+
+	kind, key := splitKey(req.URL.Path)
+	if in.table(kind) == nil || key == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		err = in.put(kind, key, req.Body)
+	case http.MethodDelete:
+		if kind == "http" {
+			err = in.SetHTTP(key, nil)
+		} else {
+			err = in.SetTCP(key, nil)
+		}
+	case http.MethodPost:
+		switch req.URL.Query().Get("enabled") {
+		case "true":
+			err = in.Enable(kind, key, true)
+		case "false":
+			err = in.Enable(kind, key, false)
+		default:
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE, POST")
+		return
+	}
+	if errors.Is(err, ErrUnknownTarget) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": err.Error(), "known": in.keys(kind)})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	in.mu.RLock()
+	e, ok := in.table(kind)[key]
+	in.mu.RUnlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": ErrUnknownTarget.Error(), "known": in.keys(kind)})
+		return
+	}
+	writeJSON(w, http.StatusOK, e)
+}
+
+func (in *Injector) put(kind, key string, body io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if kind == "http" {
+		var f HTTPFault
+		if err := json.Unmarshal(data, &f); err != nil {
+			return err
+		}
+		return in.SetHTTP(key, &f)
+	}
+	var f TCPFault
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	return in.SetTCP(key, &f)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,215 @@
+package fault
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 故障注入：通过网关对后面的服务做混沌测试
+// HTTP路由可以注入延迟、直接返回错误、限制响应带宽，也可以由请求头触发
+// TCP代理可以注入连接延迟、转发N字节后发送RST，以及在实验室模式下篡改字节
+//
+// Injector保存每条HTTP路由和每个TCP监听的故障配置，中间件每次处理请求时都去查一次，
+// 所以通过管理接口修改之后马上生效，不需要重启
+
+// ErrLabMode 篡改字节会破坏数据，只能在实验室模式下开启
+var ErrLabMode = errors.New("fault: corrupt_rate requires lab mode")
+
+// ErrUnknownTarget 管理接口修改了一个没有注册过的路由或监听
+var ErrUnknownTarget = errors.New("fault: unknown route or listener")
+
+// Injector 故障配置的注册表，可以同时给多个路由和监听使用
+type Injector struct {
+	//LabMode 为true时才允许篡改字节
+	LabMode bool
+
+	mu   sync.RWMutex
+	http map[string]*entry
+	tcp  map[string]*entry
+}
+
+// entry 一个路由或监听的故障，Enabled为false时保留配置但不生效
+type entry struct {
+	Enabled bool       `json:"enabled"`
+	HTTP    *HTTPFault `json:"http,omitempty"`
+	TCP     *TCPFault  `json:"tcp,omitempty"`
+}
+
+// NewInjector 创建注册表
+func NewInjector() *Injector {
+	return &Injector{http: make(map[string]*entry), tcp: make(map[string]*entry)}
+}
+
+func (in *Injector) table(kind string) map[string]*entry {
+	switch kind {
+	case "http":
+		return in.http
+	case "tcp":
+		return in.tcp
+	}
+	return nil
+}
+
+// register 注册一个名字，已经注册过时什么也不做
+func (in *Injector) register(kind, key string) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	t := in.table(kind)
+	if _, ok := t[key]; !ok {
+		t[key] = &entry{}
+	}
+}
+
+// SetHTTP 设置并开启路由的故障，f为nil时清除
+func (in *Injector) SetHTTP(key string, f *HTTPFault) error {
+	if f != nil {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+	}
+	return in.set("http", key, &entry{Enabled: f != nil, HTTP: f})
+}
+
+// SetTCP 设置并开启监听的故障，f为nil时清除
+func (in *Injector) SetTCP(key string, f *TCPFault) error {
+	if f != nil {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		if f.CorruptRate > 0 && !in.LabMode {
+			return ErrLabMode
+		}
+	}
+	return in.set("tcp", key, &entry{Enabled: f != nil, TCP: f})
+}
+
+func (in *Injector) set(kind, key string, e *entry) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	t := in.table(kind)
+	if _, ok := t[key]; !ok {
+		return fmt.Errorf("%w: %s %q", ErrUnknownTarget, kind, key)
+	}
+	t[key] = e
+	return nil
+}
+
+// Enable 开启或关闭已经设置的故障，不修改故障的内容
+func (in *Injector) Enable(kind, key string, enabled bool) error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	e, ok := in.table(kind)[key]
+	if !ok {
+		return fmt.Errorf("%w: %s %q", ErrUnknownTarget, kind, key)
+	}
+	//替换整个entry，中间件拿到的旧entry不会被修改
+	n := *e
+	n.Enabled = enabled
+	in.table(kind)[key] = &n
+	return nil
+}
+
+// lookup 返回开启的故障，没有时返回nil
+func (in *Injector) lookup(kind, key string) *entry {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	e := in.table(kind)[key]
+	if e == nil || !e.Enabled {
+		return nil
+	}
+	return e
+}
+
+// Snapshot 返回所有注册的名字和故障，管理接口用它输出列表
+func (in *Injector) Snapshot() map[string]map[string]interface{} {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	out := map[string]map[string]interface{}{"http": {}, "tcp": {}}
+	for kind, t := range map[string]map[string]*entry{"http": in.http, "tcp": in.tcp} {
+		for k, e := range t {
+			out[kind][k] = e
+		}
+	}
+	return out
+}
+
+// keys 排序后的名字，错误信息中使用
+func (in *Injector) keys(kind string) []string {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	var keys []string
+	for k := range in.table(kind) {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hit 按百分比判断是否命中，percent为0时表示100%
+func hit(percent float64) bool {
+	if percent <= 0 || percent >= 100 {
+		return true
+	}
+	return rand.Float64()*100 < percent
+}
+
+// sleep 等待d，ctx结束时提前返回false
+func sleep(done <-chan struct{}, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// strictUnmarshal 解析JSON，不认识的字段当作错误，和config.Parse的做法一致
+func strictUnmarshal(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func parseDuration(field, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("fault: invalid %s %q", field, s)
+	}
+	return d, nil
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+func checkPercent(field string, p float64) error {
+	if p < 0 || p > 100 {
+		return fmt.Errorf("fault: %s %v out of range [0, 100]", field, p)
+	}
+	return nil
+}
+
+// splitKey 把管理接口的路径/http/api/users拆成http和api/users
+func splitKey(path string) (kind, key string) {
+	path = strings.TrimPrefix(path, "/")
+	kind, key, _ = strings.Cut(path, "/")
+	return kind, key
+}
@@ -0,0 +1,189 @@
+package fault
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 请求头触发的故障，只有开启了HeaderControl的路由才认，转发前会删掉这些头部
+const (
+	HeaderDelay    = "X-Fault-Delay"    //延迟，比如200ms
+	HeaderAbort    = "X-Fault-Abort"    //直接返回的状态码，比如503
+	HeaderThrottle = "X-Fault-Throttle" //响应带宽，每秒字节数
+)
+
+// HTTPFault 一条路由的故障
+type HTTPFault struct {
+	//Delay 转发前的延迟，DelayPercent是命中的百分比，0表示所有请求
+	Delay        time.Duration
+	DelayPercent float64
+	//AbortStatus 不转发，直接返回这个状态码，AbortPercent是命中的百分比，0表示所有请求
+	AbortStatus  int
+	AbortPercent float64
+	//Bandwidth 响应体每秒最多写出的字节数，0表示不限制
+	Bandwidth int64
+	//HeaderControl 允许客户端用X-Fault-*请求头触发故障，只应该在测试环境开启
+	HeaderControl bool
+}
+
+type httpFaultJSON struct {
+	Delay         string  `json:"delay,omitempty"`
+	DelayPercent  float64 `json:"delay_percent,omitempty"`
+	AbortStatus   int     `json:"abort_status,omitempty"`
+	AbortPercent  float64 `json:"abort_percent,omitempty"`
+	Bandwidth     int64   `json:"bandwidth,omitempty"`
+	HeaderControl bool    `json:"header_control,omitempty"`
+}
+
+// MarshalJSON 输出JSON，时间写成"200ms"这样的字符串
+func (f HTTPFault) MarshalJSON() ([]byte, error) {
+	return json.Marshal(httpFaultJSON{
+		Delay:         durationString(f.Delay),
+		DelayPercent:  f.DelayPercent,
+		AbortStatus:   f.AbortStatus,
+		AbortPercent:  f.AbortPercent,
+		Bandwidth:     f.Bandwidth,
+		HeaderControl: f.HeaderControl,
+	})
+}
+
+// UnmarshalJSON 解析JSON，不认识的字段当作错误
+func (f *HTTPFault) UnmarshalJSON(data []byte) error {
+	var v httpFaultJSON
+	if err := strictUnmarshal(data, &v); err != nil {
+		return err
+	}
+	d, err := parseDuration("delay", v.Delay)
+	if err != nil {
+		return err
+	}
+	*f = HTTPFault{
+		Delay:         d,
+		DelayPercent:  v.DelayPercent,
+		AbortStatus:   v.AbortStatus,
+		AbortPercent:  v.AbortPercent,
+		Bandwidth:     v.Bandwidth,
+		HeaderControl: v.HeaderControl,
+	}
+	return f.Validate()
+}
+
+// Validate 检查百分比和状态码
+func (f *HTTPFault) Validate() error {
+	if err := checkPercent("delay_percent", f.DelayPercent); err != nil {
+		return err
+	}
+	if err := checkPercent("abort_percent", f.AbortPercent); err != nil {
+		return err
+	}
+	if f.AbortStatus != 0 && (f.AbortStatus < 200 || f.AbortStatus > 599) {
+		return fmt.Errorf("fault: invalid abort_status %d", f.AbortStatus)
+	}
+	if f.Delay < 0 || f.Bandwidth < 0 {
+		return fmt.Errorf("fault: delay and bandwidth must not be negative")
+	}
+	return nil
+}
+
+// decide 决定这个请求的故障，请求头触发的故障优先
+func (f *HTTPFault) decide(req *http.Request) (delay time.Duration, abort int, bandwidth int64) {
+	if f.Delay > 0 && hit(f.DelayPercent) {
+		delay = f.Delay
+	}
+	if f.AbortStatus != 0 && hit(f.AbortPercent) {
+		abort = f.AbortStatus
+	}
+	bandwidth = f.Bandwidth
+
+	if f.HeaderControl {
+		if d, err := time.ParseDuration(req.Header.Get(HeaderDelay)); err == nil && d > 0 {
+			delay = d
+		}
+		if c, err := strconv.Atoi(req.Header.Get(HeaderAbort)); err == nil && c >= 200 && c <= 599 {
+			abort = c
+		}
+		if b, err := strconv.ParseInt(req.Header.Get(HeaderThrottle), 10, 64); err == nil && b > 0 {
+			bandwidth = b
+		}
+		req.Header.Del(HeaderDelay)
+		req.Header.Del(HeaderAbort)
+		req.Header.Del(HeaderThrottle)
+	}
+	return delay, abort, bandwidth
+}
+
+// HTTP 给路由的处理器加上故障注入，key是路由的名字，Router.Handle时包装在反向代理外面
+func (in *Injector) HTTP(key string, next http.Handler) http.Handler {
+	in.register("http", key)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		e := in.lookup("http", key)
+		if e == nil || e.HTTP == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		delay, abort, bandwidth := e.HTTP.decide(req)
+		if !sleep(req.Context().Done(), delay) {
+			return
+		}
+		if abort != 0 {
+			http.Error(w, "fault filter abort", abort)
+			return
+		}
+		if bandwidth > 0 {
+			w = &throttledWriter{ResponseWriter: w, bandwidth: bandwidth, done: req.Context().Done()}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+var errClientGone = errors.New("fault: client went away while throttling")
+
+// throttledWriter 限制响应体的带宽，每次最多写出十分之一秒的量，写完后等待相应的时间
+type throttledWriter struct {
+	http.ResponseWriter
+	bandwidth int64
+	done      <-chan struct{}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	chunk := int(tw.bandwidth / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for len(p) > 0 {
+		n := chunk
+		if n > len(p) {
+			n = len(p)
+		}
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		p = p[n:]
+		if !sleep(tw.done, time.Duration(n)*time.Second/time.Duration(tw.bandwidth)) {
+			return written, errClientGone
+		}
+	}
+	return written, nil
+}
+
+// Flush 响应已经在每次Write之后刷新，这里只是转发
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 让http.ResponseController找到原始的ResponseWriter
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
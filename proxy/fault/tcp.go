@@ -0,0 +1,230 @@
+package fault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/proxy/tcp_proxy/server"
+	"log"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjectedReset 转发的字节数达到ResetAfter后，连接被故障注入重置
+var ErrInjectedReset = errors.New("fault: injected connection reset")
+
+// TCPFault 一个TCP监听的故障
+type TCPFault struct {
+	//Delay 连接进来后、拨号上游之前的延迟，DelayPercent是命中的百分比，0表示所有连接
+	Delay        time.Duration
+	DelayPercent float64
+	//ResetAfter 两个方向一共转发这么多字节后发送RST断开，ResetPercent是命中的百分比，0表示所有连接
+	ResetAfter   int64
+	ResetPercent float64
+	//CorruptRate 每个字节被翻转一位的概率，0到1，只在实验室模式下生效
+	CorruptRate float64
+}
+
+type tcpFaultJSON struct {
+	Delay        string  `json:"delay,omitempty"`
+	DelayPercent float64 `json:"delay_percent,omitempty"`
+	ResetAfter   int64   `json:"reset_after,omitempty"`
+	ResetPercent float64 `json:"reset_percent,omitempty"`
+	CorruptRate  float64 `json:"corrupt_rate,omitempty"`
+}
+
+// MarshalJSON 输出JSON，时间写成"200ms"这样的字符串
+func (f TCPFault) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tcpFaultJSON{
+		Delay:        durationString(f.Delay),
+		DelayPercent: f.DelayPercent,
+		ResetAfter:   f.ResetAfter,
+		ResetPercent: f.ResetPercent,
+		CorruptRate:  f.CorruptRate,
+	})
+}
+
+// UnmarshalJSON 解析JSON，不认识的字段当作错误
+func (f *TCPFault) UnmarshalJSON(data []byte) error {
+	var v tcpFaultJSON
+	if err := strictUnmarshal(data, &v); err != nil {
+		return err
+	}
+	d, err := parseDuration("delay", v.Delay)
+	if err != nil {
+		return err
+	}
+	*f = TCPFault{
+		Delay:        d,
+		DelayPercent: v.DelayPercent,
+		ResetAfter:   v.ResetAfter,
+		ResetPercent: v.ResetPercent,
+		CorruptRate:  v.CorruptRate,
+	}
+	return f.Validate()
+}
+
+// Validate 检查百分比和概率的范围
+func (f *TCPFault) Validate() error {
+	if err := checkPercent("delay_percent", f.DelayPercent); err != nil {
+		return err
+	}
+	if err := checkPercent("reset_percent", f.ResetPercent); err != nil {
+		return err
+	}
+	if f.CorruptRate < 0 || f.CorruptRate > 1 {
+		return fmt.Errorf("fault: corrupt_rate %v out of range [0, 1]", f.CorruptRate)
+	}
+	if f.Delay < 0 || f.ResetAfter < 0 {
+		return fmt.Errorf("fault: delay and reset_after must not be negative")
+	}
+	return nil
+}
+
+// TCP 返回TCP中间件，key是监听的名字，放在TCPReverseProxy外面
+// 延迟发生在拨号之前；重置和篡改通过包装客户端连接实现，两个方向的数据都会经过它
+func (in *Injector) TCP(key string) server.Middleware {
+	in.register("tcp", key)
+	return func(next server.TCPHandler) server.TCPHandler {
+		return server.TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			e := in.lookup("tcp", key)
+			if e == nil || e.TCP == nil {
+				next.ServeTCP(ctx, conn)
+				return
+			}
+			f := e.TCP
+			if f.Delay > 0 && hit(f.DelayPercent) && !sleep(ctx.Done(), f.Delay) {
+				conn.Close()
+				return
+			}
+
+			fc := &faultConn{Conn: conn}
+			if f.ResetAfter > 0 && hit(f.ResetPercent) {
+				fc.resetAfter = f.ResetAfter
+			}
+			//配置是在LabMode下设置的，之后关闭了LabMode也不再篡改
+			if in.LabMode {
+				fc.corruptRate = f.CorruptRate
+			}
+			if fc.resetAfter == 0 && fc.corruptRate == 0 {
+				next.ServeTCP(ctx, conn)
+				return
+			}
+			next.ServeTCP(ctx, fc)
+		})
+	}
+}
+
+// faultConn 统计经过的字节数，达到上限时重置连接，按概率篡改字节
+type faultConn struct {
+	net.Conn
+	resetAfter  int64
+	corruptRate float64
+
+	total int64
+	reset int32
+}
+
+// allow 预留n个字节的额度，返回实际允许的字节数，额度用完时返回0
+func (c *faultConn) allow(n int) int {
+	if c.resetAfter == 0 {
+		return n
+	}
+	for {
+		total := atomic.LoadInt64(&c.total)
+		left := c.resetAfter - total
+		if left <= 0 {
+			return 0
+		}
+		if int64(n) > left {
+			n = int(left)
+		}
+		if atomic.CompareAndSwapInt64(&c.total, total, total+int64(n)) {
+			return n
+		}
+	}
+}
+
+// exhausted 额度已经用完
+func (c *faultConn) exhausted() bool {
+	return c.resetAfter > 0 && atomic.LoadInt64(&c.total) >= c.resetAfter
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	if c.exhausted() {
+		return 0, c.doReset()
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		//读到的数据超过额度时截断，多出来的部分丢弃
+		n = c.allow(n)
+		c.corrupt(p[:n])
+	}
+	if n == 0 && err == nil && c.exhausted() {
+		err = c.doReset()
+	}
+	return n, err
+}
+
+func (c *faultConn) Write(p []byte) (int, error) {
+	n := c.allow(len(p))
+	if n == 0 {
+		return 0, c.doReset()
+	}
+	buf := p[:n]
+	if c.corruptRate > 0 {
+		buf = append([]byte(nil), buf...)
+		c.corrupt(buf)
+	}
+	m, err := c.Conn.Write(buf)
+	if err == nil && m < len(p) {
+		err = c.doReset()
+	}
+	return m, err
+}
+
+// corrupt 按概率翻转字节中的一位
+func (c *faultConn) corrupt(p []byte) {
+	if c.corruptRate <= 0 {
+		return
+	}
+	for i := range p {
+		if rand.Float64() < c.corruptRate {
+			p[i] ^= 1 << uint(rand.Intn(8))
+		}
+	}
+}
+
+// doReset SO_LINGER设为0后关闭，对方收到RST
+func (c *faultConn) doReset() error {
+	if atomic.CompareAndSwapInt32(&c.reset, 0, 1) {
+		if tc := tcpConn(c.Conn); tc != nil {
+			tc.SetLinger(0)
+		}
+		c.Conn.Close()
+		log.Printf("fault: reset %v after %d bytes", c.Conn.RemoteAddr(), c.resetAfter)
+	}
+	return ErrInjectedReset
+}
+
+// NetConn 返回被包装的连接，TCPReverseProxy通过它找到DeadlineConn和CloseWrite
+func (c *faultConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// tcpConn 沿着NetConn找到*net.TCPConn
+func tcpConn(c net.Conn) *net.TCPConn {
+	for {
+		if tc, ok := c.(*net.TCPConn); ok {
+			return tc
+		}
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = nc.NetConn()
+	}
+}
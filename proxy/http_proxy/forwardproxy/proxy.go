@@ -0,0 +1,51 @@
+package forwardproxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+)
+
+// 正向代理，从http/forward_proxy.go中提取出来，供cmd/gateway和演示程序共用
+// 客户端把代理地址配置为这个服务，请求行中是完整的目标地址，代理原样转发
+
+// Proxy 正向代理，实现http.Handler
+type Proxy struct {
+	//Transport 转发使用的连接池，为nil时使用http.DefaultTransport
+	Transport http.RoundTripper
+	//Logger 记录每个请求，为nil时不记录
+	Logger *log.Logger
+}
+
+// ServeHTTP 具体实现方法
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.Logger != nil {
+		p.Logger.Printf("Received request %s %s %s", req.Method, req.Host, req.RemoteAddr)
+	}
+
+	//1、代理服务器接收客户端请求，赋值，封装成新请求
+	//浅拷贝一份请求，RoundTrip要求RequestURI为空
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+
+	//2、发送新请求到下游真实服务器，接收响应
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(outReq)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	//3、处理响应并返回上游客户端，拷贝响应头、状态码和响应体
+	for key, value := range res.Header {
+		for _, v := range value {
+			rw.Header().Add(key, v)
+		}
+	}
+	rw.WriteHeader(res.StatusCode)
+	io.Copy(rw, res.Body)
+}
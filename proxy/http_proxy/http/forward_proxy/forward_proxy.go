@@ -0,0 +1,15 @@
+package main
+
+import (
+	"fmt"
+	"gateway/proxy/http_proxy/forwardproxy"
+	"log"
+	"net/http"
+)
+
+// 正向代理的实现已经移到forwardproxy包，cmd/gateway forward-proxy也使用它
+func main() {
+	fmt.Println("正向代理服务器启动：8080")
+	http.Handle("/", &forwardproxy.Proxy{Logger: log.Default()})
+	http.ListenAndServe("127.0.0.1:8080", nil)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"gateway/proxy/http_proxy/reverseproxy"
+	"gateway/proxy/proxyproto"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+//HTTP反向代理完整版：用ReverseProxy结构体实现
+
+//支持功能：URL重写、更改内容（响应改写链）、错误信息回调、连接池
+
+func main() {
+	//下游真实服务器地址
+	realServer := "http://127.0.0.1:8001?a=1&b=2#container"
+
+	//parse解析url成结构体
+	serverURL, err := url.Parse(realServer)
+	if err != nil {
+		log.Println(err)
+	}
+
+	//方法内使用解析后的url结构体，创建了一个反向代理对象,算是一个handler
+	proxy := NewSingleHostReverseProxy(serverURL)
+
+	//代理服务器地址
+	var addr = "127.0.0.1:8081"
+
+	log.Println("Starting proxy http server at:" + addr)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//用proxyproto.Listener包装监听，四层负载均衡写入PROXY头部时，req.RemoteAddr就是真实客户端地址
+	//只信任本机的负载均衡，其它来源的头部不解析，没有头部的连接照常处理
+	trusted, _ := proxyproto.ParseCIDRs([]string{"127.0.0.0/8", "::1"})
+	http.Serve(&proxyproto.Listener{Listener: ln, Config: &proxyproto.Config{TrustedCIDRs: trusted}}, proxy)
+}
+
+// 在包外通过http.调用Transport结构体的方法，实现连接池的自定义
+var transport = &http.Transport{
+	//之所以不设置Proxy，是因为这段代码本身就是代理
+	//Proxy: ProxyFromEnvironment,
+
+	//defaultTransportDialContext 在这里是一个函数，该函数接收一个 *net.Dialer 作为参数
+	//并返回一个与 net.Dialer 的 DialContext 方法签名相同的函数或接口类型
+	//这种写法的目的是为了封装或扩展 DialContext 方法的默认行为
+	//DialContext: defaultTransportDialContext
+
+	//以下写法是为了更加了解http的源码运行逻辑，所以将默认的DialContext方法展开，自定义了一些参数
+	//1、创建了具体的net.Dialer指针
+	//2、并访问了其DialContext方法，使其作为了外部DialContext参数的值
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	//默认就是true
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second, //TLS握手超时时间
+	ExpectContinueTimeout: 1 * time.Second,  //100code响应超时时间，通常用于发送大文件时出现
+}
+
+// NewSingleHostReverseProxy 只有一个上游的反向代理
+// URL重写（拼接路径、合并查询参数）由reverseproxy.NewRouteProxy完成，这里只配置改写链、错误回调和连接池
+func NewSingleHostReverseProxy(target *url.URL) *httputil.ReverseProxy {
+	proxy := reverseproxy.NewRouteProxy(&reverseproxy.Route{
+		Name:   "demo",
+		Target: target,
+		//修改返回响应体
+		//原来的写法把200的响应体整个读进内存，在后面追加"lz"，读取失败时panic
+		//现在改为按顺序执行的响应改写链，101协议切换会被跳过，压缩和Content-Length由改写链处理
+		ResponseTransformers: []reverseproxy.ResponseTransformer{
+			//追加一个响应头，标记经过了网关
+			&reverseproxy.HeaderTransformer{Set: map[string]string{"X-Proxy": "gateway"}},
+			//在文本响应体的末尾追加"lz"，\z匹配文本的结尾
+			&reverseproxy.RegexReplace{Pattern: regexp.MustCompile(`\z`), Replacement: "lz"},
+		},
+		Transport: transport,
+	})
+
+	//错误回调函数，后台出现错误时会调用这个函数
+	//为空时，返回502 Bad Gateway
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		fmt.Println("errorFunc")
+		http.Error(w, "ErrorHandler error"+err.Error(), http.StatusInternalServerError)
+	}
+	return proxy
+}
@@ -0,0 +1,221 @@
+package realserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Behavior 测试后端的行为，每个实例一份，运行时可以通过PUT /admin/behavior修改
+// 处理顺序：延迟 -> 断开连接 -> 返回错误 -> 正常响应（可以慢速分块输出）
+type Behavior struct {
+	//Latency 每个请求的延迟，写法见ParseLatency
+	Latency Latency `json:"latency,omitempty"`
+	//ErrorRate 返回错误的概率，0到1
+	ErrorRate float64 `json:"error_rate,omitempty"`
+	//ErrorCodes 返回错误时随机选一个状态码，为空时使用500
+	ErrorCodes []int `json:"error_codes,omitempty"`
+	//ResponseSize 响应体的字节数，0表示使用默认的响应内容
+	ResponseSize int `json:"response_size,omitempty"`
+	//ChunkSize、ChunkInterval 慢速响应：每次输出ChunkSize字节（默认1KB），间隔ChunkInterval
+	ChunkSize     int           `json:"chunk_size,omitempty"`
+	ChunkInterval time.Duration `json:"-"`
+	//DropRate 不返回响应、直接断开连接的概率，0到1
+	DropRate float64 `json:"drop_rate,omitempty"`
+	//DropReset 断开时发送RST而不是FIN，模拟进程崩溃或者中间设备重置连接
+	DropReset bool `json:"drop_reset,omitempty"`
+}
+
+// behaviorJSON ChunkInterval在JSON中写成"100ms"这样的字符串
+type behaviorJSON Behavior
+
+// MarshalJSON 输出JSON，时间写成字符串
+func (b Behavior) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		behaviorJSON
+		ChunkInterval string `json:"chunk_interval,omitempty"`
+	}{behaviorJSON(b), durationString(b.ChunkInterval)})
+}
+
+// UnmarshalJSON 解析JSON，不认识的字段忽略
+func (b *Behavior) UnmarshalJSON(data []byte) error {
+	var v struct {
+		behaviorJSON
+		ChunkInterval string `json:"chunk_interval"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = Behavior(v.behaviorJSON)
+	if v.ChunkInterval != "" {
+		d, err := time.ParseDuration(v.ChunkInterval)
+		if err != nil {
+			return fmt.Errorf("chunk_interval: %w", err)
+		}
+		b.ChunkInterval = d
+	}
+	return b.Validate()
+}
+
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// Validate 检查概率和状态码的范围
+func (b *Behavior) Validate() error {
+	if b.ErrorRate < 0 || b.ErrorRate > 1 {
+		return fmt.Errorf("error_rate %v out of range [0, 1]", b.ErrorRate)
+	}
+	if b.DropRate < 0 || b.DropRate > 1 {
+		return fmt.Errorf("drop_rate %v out of range [0, 1]", b.DropRate)
+	}
+	for _, c := range b.ErrorCodes {
+		if c < 100 || c > 599 {
+			return fmt.Errorf("invalid error code %d", c)
+		}
+	}
+	if b.ResponseSize < 0 || b.ChunkSize < 0 || b.ChunkInterval < 0 {
+		return fmt.Errorf("response_size, chunk_size and chunk_interval must not be negative")
+	}
+	return nil
+}
+
+// errorCode 随机选一个错误状态码
+func (b *Behavior) errorCode() int {
+	if len(b.ErrorCodes) == 0 {
+		return 500
+	}
+	return b.ErrorCodes[rand.Intn(len(b.ErrorCodes))]
+}
+
+// 延迟的分布
+const (
+	DistFixed       = "fixed"       //固定延迟
+	DistUniform     = "uniform"     //在[Min, Max)之间均匀分布
+	DistNormal      = "normal"      //正态分布，小于0时取0
+	DistExponential = "exponential" //指数分布，模拟长尾
+)
+
+// Latency 延迟的分布
+type Latency struct {
+	Distribution string
+	//fixed、exponential使用Mean；uniform使用Min、Max；normal使用Mean、StdDev
+	Mean, StdDev, Min, Max time.Duration
+}
+
+// ParseLatency 解析延迟的写法：
+//
+//	50ms              固定50毫秒
+//	10ms-100ms        10到100毫秒均匀分布
+//	normal:50ms:10ms  均值50毫秒、标准差10毫秒的正态分布
+//	exp:50ms          均值50毫秒的指数分布
+func ParseLatency(s string) (Latency, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Latency{}, nil
+	}
+	parts := strings.Split(s, ":")
+	durations := func(list []string) ([]time.Duration, error) {
+		ds := make([]time.Duration, len(list))
+		for i, p := range list {
+			d, err := time.ParseDuration(p)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid latency %q", s)
+			}
+			ds[i] = d
+		}
+		return ds, nil
+	}
+
+	switch {
+	case len(parts) == 3 && parts[0] == "normal":
+		ds, err := durations(parts[1:])
+		if err != nil {
+			return Latency{}, err
+		}
+		return Latency{Distribution: DistNormal, Mean: ds[0], StdDev: ds[1]}, nil
+	case len(parts) == 2 && (parts[0] == "exp" || parts[0] == DistExponential):
+		ds, err := durations(parts[1:])
+		if err != nil {
+			return Latency{}, err
+		}
+		return Latency{Distribution: DistExponential, Mean: ds[0]}, nil
+	case len(parts) == 1 && strings.Contains(s, "-"):
+		ds, err := durations(strings.SplitN(s, "-", 2))
+		if err != nil {
+			return Latency{}, err
+		}
+		if ds[1] < ds[0] {
+			return Latency{}, fmt.Errorf("invalid latency %q: max is less than min", s)
+		}
+		return Latency{Distribution: DistUniform, Min: ds[0], Max: ds[1]}, nil
+	case len(parts) == 1:
+		ds, err := durations(parts)
+		if err != nil {
+			return Latency{}, err
+		}
+		return Latency{Distribution: DistFixed, Mean: ds[0]}, nil
+	}
+	return Latency{}, fmt.Errorf("invalid latency %q", s)
+}
+
+// String 和ParseLatency的写法一致
+func (l Latency) String() string {
+	switch l.Distribution {
+	case DistFixed:
+		return l.Mean.String()
+	case DistUniform:
+		return l.Min.String() + "-" + l.Max.String()
+	case DistNormal:
+		return "normal:" + l.Mean.String() + ":" + l.StdDev.String()
+	case DistExponential:
+		return "exp:" + l.Mean.String()
+	}
+	return ""
+}
+
+// MarshalJSON 输出成ParseLatency的写法
+func (l Latency) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.String())
+}
+
+// UnmarshalJSON 按ParseLatency解析
+func (l *Latency) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := ParseLatency(s)
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// Sample 按分布取一个延迟
+func (l Latency) Sample() time.Duration {
+	var d float64
+	switch l.Distribution {
+	case DistFixed:
+		return l.Mean
+	case DistUniform:
+		if l.Max <= l.Min {
+			return l.Min
+		}
+		return l.Min + time.Duration(rand.Int63n(int64(l.Max-l.Min)))
+	case DistNormal:
+		d = rand.NormFloat64()*float64(l.StdDev) + float64(l.Mean)
+	case DistExponential:
+		d = rand.ExpFloat64() * float64(l.Mean)
+	default:
+		return 0
+	}
+	return time.Duration(math.Max(d, 0))
+}
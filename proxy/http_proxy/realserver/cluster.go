@@ -0,0 +1,80 @@
+package realserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Cluster 同一台机器上的一组测试后端，端口连续
+type Cluster struct {
+	Servers []*RealServer
+}
+
+// NewCluster 从addr的端口开始，在连续的n个端口上各创建一个实例，调用Start后开始监听
+// behaviors按顺序对应每个实例，数量不够时后面的实例使用最后一个，为空时都使用默认行为
+// addr的端口为0时每个实例使用随机端口
+func NewCluster(addr string, n int, behaviors []Behavior) (*Cluster, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	if n < 1 {
+		return nil, errors.New("realserver: instance count must be at least 1")
+	}
+
+	c := &Cluster{}
+	for i := 0; i < n; i++ {
+		var b Behavior
+		if len(behaviors) > 0 {
+			b = behaviors[len(behaviors)-1]
+			if i < len(behaviors) {
+				b = behaviors[i]
+			}
+		}
+		p := 0
+		if port != 0 {
+			p = port + i
+		}
+		c.Servers = append(c.Servers, NewRealServer(net.JoinHostPort(host, strconv.Itoa(p)), b))
+	}
+	return c, nil
+}
+
+// Start 启动所有实例，有一个失败时关闭已经启动的实例
+func (c *Cluster) Start() error {
+	for i, s := range c.Servers {
+		if err := s.Start(); err != nil {
+			for _, started := range c.Servers[:i] {
+				started.Shutdown(context.Background())
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Addrs 所有实例的实际地址
+func (c *Cluster) Addrs() []string {
+	addrs := make([]string, len(c.Servers))
+	for i, s := range c.Servers {
+		addrs[i] = s.ListenAddr()
+	}
+	return addrs
+}
+
+// Shutdown 关闭所有实例
+func (c *Cluster) Shutdown(ctx context.Context) error {
+	var errs []error
+	for _, s := range c.Servers {
+		if err := s.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
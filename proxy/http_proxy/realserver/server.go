@@ -0,0 +1,344 @@
+package realserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 下游真实服务器，从downsteam_real_server.go中提取出来，供cmd/gateway test-backend和演示程序共用
+// 为了测试网关，它是一个可以编程的后端：延迟、错误率、响应大小、慢速响应、断开连接都可以配置，运行时也能修改
+//
+// 路由：
+//
+//	/RealServer      返回服务器地址和请求路径，和原来一样
+//	/echo            把请求的方法、路径、头部、请求体以JSON返回
+//	/health          健康检查，GET返回200或503，POST/PUT ?healthy=false|true 切换状态
+//	/admin/behavior  GET返回当前行为，PUT用JSON替换
+//	/admin/stats     请求数、错误数、断开数
+//	其它路径          按ResponseSize返回指定大小的响应体
+//
+// 除了/health和/admin/，其它路由都按Behavior注入延迟、错误和断开
+
+// RealServer 下游真实服务器
+type RealServer struct {
+	Addr string //服务器主机地址：{host:port}
+	//WriteTimeout 写响应的超时时间，0表示不限制，慢速响应需要足够长
+	WriteTimeout time.Duration
+
+	mu        sync.RWMutex
+	behavior  Behavior
+	unhealthy int32
+
+	requests, errors, drops int64
+
+	server *http.Server
+	ln     net.Listener
+}
+
+// NewRealServer 创建测试后端
+func NewRealServer(addr string, b Behavior) *RealServer {
+	return &RealServer{Addr: addr, behavior: b}
+}
+
+// Behavior 返回当前的行为
+func (r *RealServer) Behavior() Behavior {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.behavior
+}
+
+// SetBehavior 修改行为，对之后的请求生效
+func (r *RealServer) SetBehavior(b Behavior) {
+	r.mu.Lock()
+	r.behavior = b
+	r.mu.Unlock()
+}
+
+// SetHealthy 切换健康检查的结果
+func (r *RealServer) SetHealthy(healthy bool) {
+	var v int32
+	if !healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&r.unhealthy, v)
+}
+
+// Healthy 健康检查是否返回200
+func (r *RealServer) Healthy() bool {
+	return atomic.LoadInt32(&r.unhealthy) == 0
+}
+
+// Stats 请求统计
+type Stats struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+	Drops    int64 `json:"drops"`
+}
+
+// Stats 返回请求统计
+func (r *RealServer) Stats() Stats {
+	return Stats{
+		Requests: atomic.LoadInt64(&r.requests),
+		Errors:   atomic.LoadInt64(&r.errors),
+		Drops:    atomic.LoadInt64(&r.drops),
+	}
+}
+
+// Handler 返回路由
+func (r *RealServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/RealServer", r.inject(http.HandlerFunc(r.HelloHandler)))
+	mux.Handle("/echo", r.inject(http.HandlerFunc(r.EchoHandler)))
+	mux.Handle("/", r.inject(http.HandlerFunc(r.PayloadHandler)))
+	mux.HandleFunc("/health", r.HealthHandler)
+	mux.HandleFunc("/admin/behavior", r.behaviorHandler)
+	mux.HandleFunc("/admin/stats", r.statsHandler)
+	return mux
+}
+
+// Start 监听地址并在新协程中提供服务，监听失败时返回错误
+// Addr的端口写0时，Start之后可以从ListenAddr拿到实际的地址
+func (r *RealServer) Start() error {
+	ln, err := net.Listen("tcp", r.Addr)
+	if err != nil {
+		return err
+	}
+	r.ln = ln
+	r.server = &http.Server{
+		Handler:      r.Handler(),
+		WriteTimeout: r.WriteTimeout,
+	}
+	go r.server.Serve(ln)
+	return nil
+}
+
+// Run 新建协程启动服务器，和原来的用法一致，监听失败时只能忽略
+func (r *RealServer) Run() {
+	r.Start()
+}
+
+// ListenAddr 实际监听的地址，Start之前返回Addr
+func (r *RealServer) ListenAddr() string {
+	if r.ln != nil {
+		return r.ln.Addr().String()
+	}
+	return r.Addr
+}
+
+// Shutdown 优雅关闭
+func (r *RealServer) Shutdown(ctx context.Context) error {
+	if r.server == nil {
+		return nil
+	}
+	return r.server.Shutdown(ctx)
+}
+
+// inject 按Behavior注入延迟、断开和错误，都没有命中时交给next
+func (r *RealServer) inject(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&r.requests, 1)
+		b := r.Behavior()
+
+		if d := b.Latency.Sample(); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-req.Context().Done():
+				return
+			}
+		}
+		if b.DropRate > 0 && rand.Float64() < b.DropRate {
+			atomic.AddInt64(&r.drops, 1)
+			drop(w, b.DropReset)
+			return
+		}
+		if b.ErrorRate > 0 && rand.Float64() < b.ErrorRate {
+			atomic.AddInt64(&r.errors, 1)
+			code := b.errorCode()
+			http.Error(w, fmt.Sprintf("injected error from %s", r.ListenAddr()), code)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// drop 劫持连接后直接关闭，客户端收不到任何响应
+func drop(w http.ResponseWriter, reset bool) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		//HTTP/2等不能劫持的连接，用panic中止，net/http会断开这个流
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	if tc, ok := conn.(*net.TCPConn); ok && reset {
+		//SO_LINGER为0时close会发送RST
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// HelloHandler 路由处理器
+func (r *RealServer) HelloHandler(w http.ResponseWriter, req *http.Request) {
+	//Sprintf函数用于根据格式化字符串生成一个新的字符串，并返回这个字符串
+	newPath := fmt.Sprintf("Here is real server:http://%s%s", r.ListenAddr(), req.URL.Path)
+	r.writeBody(w, []byte(newPath))
+	/*
+		//这里是一个死循环，一直在写入
+		//在http协议中这样操作，客户端是收不到相应的
+		//因为http处理是一个请求一个响应，死循环会导致客户端一直等待
+		//所以这里是一个错误的写法，就算用goroutine也是不行的
+		//因为goroutine是一个协程，它的生命周期是随着主线程的结束而结束的
+		for {
+			w.Write([]byte(newPath))
+			time.Sleep(1 * time.Second)
+		}
+	*/
+}
+
+// EchoRequest /echo返回的内容
+type EchoRequest struct {
+	Server     string      `json:"server"`
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	Path       string      `json:"path"`
+	Query      string      `json:"query,omitempty"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// EchoHandler 把请求以JSON返回，方便检查网关转发时改了哪些内容
+func (r *RealServer) EchoHandler(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, _ := json.Marshal(&EchoRequest{
+		Server:     r.ListenAddr(),
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		Query:      req.URL.RawQuery,
+		RemoteAddr: req.RemoteAddr,
+		Header:     req.Header,
+		Body:       string(body),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	r.writeBody(w, out)
+}
+
+// PayloadHandler 返回ResponseSize字节的响应体，没有设置时返回服务器地址
+func (r *RealServer) PayloadHandler(w http.ResponseWriter, req *http.Request) {
+	size := r.Behavior().ResponseSize
+	if size <= 0 {
+		r.writeBody(w, []byte(fmt.Sprintf("Here is real server:http://%s%s", r.ListenAddr(), req.URL.Path)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	r.writeBody(w, payload(size))
+}
+
+// payload 生成指定大小的可读内容，方便在抓包时看出是否被截断
+func payload(size int) []byte {
+	const pattern = "0123456789abcdefghijklmnopqrstuvwxyz\n"
+	return bytes.Repeat([]byte(pattern), size/len(pattern)+1)[:size]
+}
+
+// writeBody 写响应体，配置了ChunkInterval时分块慢速输出
+func (r *RealServer) writeBody(w http.ResponseWriter, body []byte) {
+	b := r.Behavior()
+	if b.ChunkInterval <= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Write(body)
+		return
+	}
+	chunk := b.ChunkSize
+	if chunk <= 0 {
+		chunk = 1 << 10
+	}
+	flusher, _ := w.(http.Flusher)
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[n:]
+		if len(body) > 0 {
+			time.Sleep(b.ChunkInterval)
+		}
+	}
+}
+
+// HealthHandler 健康检查，POST或PUT时按healthy参数切换状态
+func (r *RealServer) HealthHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		switch req.URL.Query().Get("healthy") {
+		case "true", "1", "up":
+			r.SetHealthy(true)
+		case "false", "0", "down":
+			r.SetHealthy(false)
+		default:
+			http.Error(w, "healthy must be true or false", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.Healthy() {
+		http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func (r *RealServer) behaviorHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var b Behavior
+		dec := json.NewDecoder(io.LimitReader(req.Body, 1<<20))
+		if err := dec.Decode(&b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.SetBehavior(b)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r.Behavior())
+}
+
+func (r *RealServer) statsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, r.Stats())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,143 @@
+package reverseproxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 可复用的HTTP反向代理，在reverseproxy_full.go的基础上按路由组织：
+// 每条路由有自己的上游地址和响应改写链，Router按路径前缀选择路由
+
+// Route 一条路由的转发配置
+type Route struct {
+	//Name 路由名，用于日志
+	Name string
+	//PathPrefix 匹配的路径前缀，Router按最长前缀匹配
+	PathPrefix string
+	//StripPrefix 为true时转发前去掉路径前缀
+	StripPrefix bool
+	//Target 上游地址
+	Target *url.URL
+	//Targets 多个上游地址，不为空时轮询选择并忽略Target，重试时会换一个上游
+	Targets []*url.URL
+
+	//RequestTransformers 请求改写链，在Director中按顺序执行
+	RequestTransformers []RequestTransformer
+	//ResponseTransformers 响应改写链，按顺序执行
+	ResponseTransformers []ResponseTransformer
+	//HostPolicy 转发时的Host头：HostPreserve（默认）、HostUpstream，或者直接写一个固定的Host
+	HostPolicy string
+	//Retry 重试策略，为nil时不重试
+	Retry *RetryPolicy
+	//Transport 这条路由转发用的RoundTripper，为nil时使用共用的Transport
+	//每次尝试（包括重试）都会经过它，适合做请求签名这类必须看到最终地址的处理
+	Transport http.RoundTripper
+
+	//rr 轮询计数
+	rr uint32
+}
+
+// Transport 所有路由共用的连接池，参数和reverseproxy_full.go中的transport一致
+var Transport http.RoundTripper = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// NewRouteProxy 按路由配置创建反向代理
+func NewRouteProxy(route *Route) *httputil.ReverseProxy {
+	director := func(req *http.Request) {
+		if route.StripPrefix {
+			stripPrefix(req, route.PathPrefix)
+		}
+		for _, t := range route.RequestTransformers {
+			if err := t.TransformRequest(req); err != nil {
+				setDirectorError(req, err)
+				return
+			}
+		}
+		target := route.nextTarget(nil)
+		switch route.HostPolicy {
+		case "", HostPreserve:
+		case HostUpstream:
+			req.Host = target.Host
+		default:
+			req.Host = route.HostPolicy
+		}
+		//保存改写前的地址，重试换上游时要从它重新拼接
+		state := &upstreamState{origURL: *req.URL, tried: []*url.URL{target}}
+		*req = *req.WithContext(context.WithValue(req.Context(), upstreamKey{}, state))
+		RewriteURL(req.URL, target)
+	}
+
+	var modifyResponse func(*http.Response) error
+	if len(route.ResponseTransformers) > 0 {
+		modifyResponse = ResponseChain(route.ResponseTransformers...)
+	}
+
+	transport := route.Transport
+	if transport == nil {
+		transport = Transport
+	}
+	return &httputil.ReverseProxy{
+		Director:       director,
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler(route),
+		Transport:      &directorErrorTransport{next: &retryTransport{route: route, next: transport}},
+	}
+}
+
+// errorHandler 上游出错或者响应改写出错时返回502，并记录路由名
+func errorHandler(route *Route) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("reverseproxy: route %q %s %s error: %v", route.Name, r.Method, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+}
+
+func stripPrefix(req *http.Request, prefix string) {
+	p := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(prefix, "/"))
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	req.URL.Path = p
+	req.URL.RawPath = ""
+}
+
+// RewriteURL 把u换成上游地址：使用target的协议和主机，拼接路径，合并查询参数
+// 反向代理的Director、重试和wsproxy拨号上游都用它
+func RewriteURL(u, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path = joinURLPath(target.Path, u.Path)
+	if target.RawQuery == "" || u.RawQuery == "" {
+		u.RawQuery = target.RawQuery + u.RawQuery
+	} else {
+		u.RawQuery = target.RawQuery + "&" + u.RawQuery
+	}
+}
+
+// joinURLPath 拼接两个路径，中间只保留一个"/"
+func joinURLPath(a, b string) string {
+	aSlash := strings.HasSuffix(a, "/")
+	bSlash := strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case aSlash || bSlash:
+		return a + b
+	}
+	return a + "/" + b
+}
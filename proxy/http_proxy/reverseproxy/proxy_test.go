@@ -0,0 +1,44 @@
+package reverseproxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestJoinURLPath(t *testing.T) {
+	cases := []struct{ a, b, want string }{
+		{"", "/x", "/x"},
+		{"/", "/x", "/x"},
+		{"/base", "/x", "/base/x"},
+		{"/base/", "/x", "/base/x"},
+		{"/base", "x", "/base/x"},
+		{"/base/", "x", "/base/x"},
+		{"/base", "/", "/base/"},
+	}
+	for _, c := range cases {
+		if got := joinURLPath(c.a, c.b); got != c.want {
+			t.Errorf("joinURLPath(%q, %q) = %q, want %q", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	cases := []struct{ target, request, want string }{
+		{"http://up:8001", "/a?x=1", "http://up:8001/a?x=1"},
+		{"http://up:8001/base", "/a", "http://up:8001/base/a"},
+		{"http://up:8001/base/?k=v", "/a?x=1", "http://up:8001/base/a?k=v&x=1"},
+		{"https://up?k=v", "/", "https://up/?k=v"},
+	}
+	for _, c := range cases {
+		target, err := url.Parse(c.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", c.request, nil)
+		RewriteURL(req.URL, target)
+		if got := req.URL.String(); got != c.want {
+			t.Errorf("RewriteURL(%q, %q) = %q, want %q", c.target, c.request, got, c.want)
+		}
+	}
+}
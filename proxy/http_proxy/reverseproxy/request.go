@@ -0,0 +1,328 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 请求改写：在Director中、转发之前执行
+// 执行顺序：去掉路由前缀 -> 请求改写链 -> Host策略 -> 拼接上游地址（RewriteURL）
+// Director没有返回值，改写出错时把错误放进请求的上下文，由transport取出并交给ErrorHandler
+
+// Host策略
+const (
+	// HostPreserve 保留客户端请求的Host，和httputil.NewSingleHostReverseProxy的默认行为一致
+	HostPreserve = "preserve"
+	// HostUpstream 使用上游地址作为Host，上游按虚拟主机区分站点时需要
+	HostUpstream = "upstream"
+)
+
+// RequestTransformer 请求转换器
+type RequestTransformer interface {
+	TransformRequest(req *http.Request) error
+}
+
+// RequestTransformerFunc 把普通函数适配为RequestTransformer
+type RequestTransformerFunc func(req *http.Request) error
+
+// TransformRequest 实现RequestTransformer接口
+func (f RequestTransformerFunc) TransformRequest(req *http.Request) error {
+	return f(req)
+}
+
+// RequestHeaderTransformer 设置、追加、删除、重命名请求头
+type RequestHeaderTransformer struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+	//Rename 旧名到新名，比如把X-Token改成Authorization
+	Rename map[string]string
+}
+
+// TransformRequest 实现RequestTransformer接口，执行顺序：重命名、删除、设置、追加
+func (t *RequestHeaderTransformer) TransformRequest(req *http.Request) error {
+	for from, to := range t.Rename {
+		if vs := req.Header.Values(from); len(vs) > 0 {
+			vs = append([]string(nil), vs...)
+			req.Header.Del(from)
+			req.Header.Del(to)
+			for _, v := range vs {
+				req.Header.Add(to, v)
+			}
+		}
+	}
+	for _, k := range t.Remove {
+		req.Header.Del(k)
+	}
+	for k, v := range t.Set {
+		req.Header.Set(k, v)
+	}
+	for k, v := range t.Add {
+		req.Header.Add(k, v)
+	}
+	return nil
+}
+
+// QueryTransformer 设置、追加、删除查询参数
+// 直接编辑原始查询串，没有涉及的参数保持原来的顺序和编码
+type QueryTransformer struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+// TransformRequest 实现RequestTransformer接口
+func (t *QueryTransformer) TransformRequest(req *http.Request) error {
+	raw := req.URL.RawQuery
+	for _, k := range t.Remove {
+		raw = DelQuery(raw, k)
+	}
+	//按参数名排序，新增参数的顺序不受map遍历顺序影响
+	for _, k := range sortedKeys(t.Set) {
+		raw = SetQuery(raw, k, t.Set[k])
+	}
+	for _, k := range sortedKeys(t.Add) {
+		raw = AddQuery(raw, k, t.Add[k])
+	}
+	req.URL.RawQuery = raw
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 查询串按原始的键值对编辑，不经过url.Values
+// url.Values.Encode会按参数名重新排序、重新编码（比如%20变成+），上游校验签名或者按原始查询串做缓存键时会出错
+
+// DelQuery 删除原始查询串中名为name的所有参数
+func DelQuery(rawQuery, name string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		if queryKey(pair) != name {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// SetQuery 把名为name的参数设置为value：替换第一个同名参数并删除其余的，没有时追加在末尾
+func SetQuery(rawQuery, name, value string) string {
+	pair := url.QueryEscape(name) + "=" + url.QueryEscape(value)
+	if rawQuery == "" {
+		return pair
+	}
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	found := false
+	for _, p := range pairs {
+		if queryKey(p) != name {
+			kept = append(kept, p)
+		} else if !found {
+			kept = append(kept, pair)
+			found = true
+		}
+	}
+	if !found {
+		kept = append(kept, pair)
+	}
+	return strings.Join(kept, "&")
+}
+
+// AddQuery 在原始查询串末尾追加一个参数
+func AddQuery(rawQuery, name, value string) string {
+	pair := url.QueryEscape(name) + "=" + url.QueryEscape(value)
+	if rawQuery == "" {
+		return pair
+	}
+	return rawQuery + "&" + pair
+}
+
+// queryKey 取出一个键值对中解码后的参数名，解码失败时按原样比较
+func queryKey(pair string) string {
+	key, _, _ := strings.Cut(pair, "=")
+	if k, err := url.QueryUnescape(key); err == nil {
+		return k
+	}
+	return key
+}
+
+// PathRewrite 用正则改写请求路径，Replacement中可以用$1、${name}引用分组
+// 比如 Pattern: ^/v1/users/(\d+)$  Replacement: /users?id=$1 中的问号不会被当作查询参数，只改路径
+type PathRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// TransformRequest 实现RequestTransformer接口，不匹配时不改写
+func (t *PathRewrite) TransformRequest(req *http.Request) error {
+	if !t.Pattern.MatchString(req.URL.Path) {
+		return nil
+	}
+	req.URL.Path = t.Pattern.ReplaceAllString(req.URL.Path, t.Replacement)
+	req.URL.RawPath = ""
+	return nil
+}
+
+// DefaultOverrideMethods 没有配置Allowed时，请求头中允许改成的方法
+var DefaultOverrideMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// MethodOverride 改写请求方法
+// Method不为空时固定改成Method；否则从Header指定的请求头中读取（常见的是X-HTTP-Method-Override）
+type MethodOverride struct {
+	Method string
+	Header string
+	//Allowed 请求头中允许改成的方法，为空时使用DefaultOverrideMethods
+	//请求头由客户端填写，不在列表中的方法（比如CONNECT、TRACE）被忽略，保留原来的方法
+	Allowed []string
+}
+
+// TransformRequest 实现RequestTransformer接口
+func (t *MethodOverride) TransformRequest(req *http.Request) error {
+	if t.Method != "" {
+		req.Method = strings.ToUpper(t.Method)
+		return nil
+	}
+	if t.Header == "" {
+		return nil
+	}
+	method := strings.ToUpper(strings.TrimSpace(req.Header.Get(t.Header)))
+	req.Header.Del(t.Header)
+	if method != "" && t.allowed(method) {
+		req.Method = method
+	}
+	return nil
+}
+
+func (t *MethodOverride) allowed(method string) bool {
+	allowed := t.Allowed
+	if len(allowed) == 0 {
+		allowed = DefaultOverrideMethods
+	}
+	for _, m := range allowed {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// JSONBodyFields 向JSON请求体中注入字段，字段路径用"."分隔，中间缺少的对象会被创建
+type JSONBodyFields struct {
+	Add map[string]interface{}
+	//MaxBodySize 缓冲上限，超过时不改写，为0时使用DefaultMaxBodySize
+	MaxBodySize int64
+}
+
+// TransformRequest 实现RequestTransformer接口，请求体不是JSON对象时原样转发
+func (t *JSONBodyFields) TransformRequest(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if !strings.HasSuffix(mt, "json") {
+		return nil
+	}
+	maxSize := t.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	if req.ContentLength > maxSize {
+		return nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > maxSize {
+		//超过上限，读出来的部分放回去原样转发
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil
+	}
+	req.Body.Close()
+
+	doc, err := decodeJSON(buf)
+	obj, ok := doc.(map[string]interface{})
+	if err != nil || !ok {
+		setRequestBody(req, buf)
+		return nil
+	}
+	for p, v := range t.Add {
+		setJSONPath(obj, strings.Split(p, "."), v)
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	setRequestBody(req, out)
+	return nil
+}
+
+// setJSONPath 沿着路径设置字段，中间缺少的对象会被创建
+func setJSONPath(obj map[string]interface{}, path []string, value interface{}) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			obj[key] = next
+		}
+		obj = next
+	}
+	obj[path[len(path)-1]] = value
+}
+
+// setRequestBody 替换请求体，同时更新长度和GetBody，让请求可以被重放
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
+
+// directorErrKey Director中改写出错时，错误保存在请求上下文的这个键下
+type directorErrKey struct{}
+
+// setDirectorError 把错误放进请求的上下文
+// Director拿到的是请求的指针，只能通过整体替换的方式换上新的上下文
+func setDirectorError(req *http.Request, err error) {
+	*req = *req.WithContext(context.WithValue(req.Context(), directorErrKey{}, err))
+}
+
+// directorErrorTransport 转发之前检查Director中是否出错，出错时不发请求，直接返回错误
+type directorErrorTransport struct {
+	next http.RoundTripper
+}
+
+func (t *directorErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err, ok := req.Context().Value(directorErrKey{}).(error); ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
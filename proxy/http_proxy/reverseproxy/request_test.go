@@ -0,0 +1,39 @@
+package reverseproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryTransformer(t *testing.T) {
+	cases := []struct {
+		name  string
+		t     QueryTransformer
+		query string
+		want  string
+	}{
+		//没有涉及的参数保持原来的顺序和编码，不会被排序，%20也不会变成+
+		{"untouched pairs keep order and encoding", QueryTransformer{Remove: []string{"debug"}},
+			"z=1&q=a%20b&debug=1&a=%2F&flag", "z=1&q=a%20b&a=%2F&flag"},
+		{"remove every occurrence", QueryTransformer{Remove: []string{"x"}}, "x=1&y=2&x=3", "y=2"},
+		{"remove encoded name", QueryTransformer{Remove: []string{"api key"}}, "api%20key=s&a=1", "a=1"},
+		{"remove last pair", QueryTransformer{Remove: []string{"x"}}, "x=1", ""},
+		{"set replaces first in place", QueryTransformer{Set: map[string]string{"page": "2"}},
+			"q=a%20b&page=1&sort=asc&page=9", "q=a%20b&page=2&sort=asc"},
+		{"set appends when missing", QueryTransformer{Set: map[string]string{"lang": "zh CN", "b": "1"}},
+			"q=x", "q=x&b=1&lang=zh+CN"},
+		{"set on empty query", QueryTransformer{Set: map[string]string{"a": "1"}}, "", "a=1"},
+		{"add keeps existing", QueryTransformer{Add: map[string]string{"tag": "b"}}, "tag=a", "tag=a&tag=b"},
+		{"remove then set then add", QueryTransformer{Remove: []string{"x"}, Set: map[string]string{"y": "2"}, Add: map[string]string{"x": "new"}},
+			"x=old&y=1&z=%7E", "y=2&z=%7E&x=new"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/p?"+c.query, nil)
+		if err := c.t.TransformRequest(req); err != nil {
+			t.Fatal(err)
+		}
+		if req.URL.RawQuery != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, req.URL.RawQuery, c.want)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// 响应改写链，替代reverseproxy_full.go中写死的modifyResponse
+// 1、101协议切换、HEAD请求、204和304没有响应体，改写响应体的转换器会跳过它们
+// 2、只改响应头和状态码的转换器不读取响应体，不影响流式转发
+// 3、需要完整响应体的转换器（正则替换、JSON字段）在大小上限内缓冲，超过上限原样转发
+// 4、HTML注入边读边改，不缓冲整个响应体
+// 5、gzip和deflate会先解压再改写，改写后以不压缩的形式返回，其它编码跳过改写
+
+// DefaultMaxBodySize 需要缓冲响应体时的默认上限
+const DefaultMaxBodySize = 1 << 20
+
+// ResponseTransformer 响应转换器
+type ResponseTransformer interface {
+	TransformResponse(res *http.Response) error
+}
+
+// ResponseTransformerFunc 把普通函数适配为ResponseTransformer
+type ResponseTransformerFunc func(res *http.Response) error
+
+// TransformResponse 实现ResponseTransformer接口
+func (f ResponseTransformerFunc) TransformResponse(res *http.Response) error {
+	return f(res)
+}
+
+// ResponseChain 把多个转换器串成ReverseProxy.ModifyResponse
+// 101协议切换直接跳过，升级后的连接不能再改
+func ResponseChain(transformers ...ResponseTransformer) func(*http.Response) error {
+	return func(res *http.Response) error {
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			return nil
+		}
+		for _, t := range transformers {
+			if err := t.TransformResponse(res); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// HeaderTransformer 设置、追加、删除响应头
+type HeaderTransformer struct {
+	Set    map[string]string
+	Add    map[string]string
+	Remove []string
+}
+
+// TransformResponse 实现ResponseTransformer接口，先删除再设置最后追加
+func (t *HeaderTransformer) TransformResponse(res *http.Response) error {
+	for _, k := range t.Remove {
+		res.Header.Del(k)
+	}
+	for k, v := range t.Set {
+		res.Header.Set(k, v)
+	}
+	for k, v := range t.Add {
+		res.Header.Add(k, v)
+	}
+	return nil
+}
+
+// StatusRemap 把上游的状态码换成另一个，比如把上游的500统一成502
+type StatusRemap map[int]int
+
+// TransformResponse 实现ResponseTransformer接口
+func (m StatusRemap) TransformResponse(res *http.Response) error {
+	if to, ok := m[res.StatusCode]; ok {
+		res.StatusCode = to
+		res.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+	}
+	return nil
+}
+
+// hasBody 判断响应是否可能有响应体
+func hasBody(res *http.Response) bool {
+	if res.Request != nil && res.Request.Method == http.MethodHead {
+		return false
+	}
+	switch {
+	case res.StatusCode < 200, res.StatusCode == http.StatusNoContent, res.StatusCode == http.StatusNotModified:
+		return false
+	}
+	return res.Body != nil && res.Body != http.NoBody
+}
+
+// matchContentType 判断响应的Content-Type是否在列表中，列表为空时匹配所有文本和JSON
+func matchContentType(res *http.Response, types []string) bool {
+	mt, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if len(types) == 0 {
+		return strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "json") || strings.HasSuffix(mt, "xml")
+	}
+	for _, t := range types {
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) || mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// decodedBody 按Content-Encoding返回解压后的响应体，不支持的编码返回false
+func decodedBody(res *http.Response) (io.ReadCloser, bool, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return res.Body, true, nil
+	case "gzip", "x-gzip":
+		//gzip.NewReader会先读取头部，失败时把读出来的字节放回去，响应体原样转发
+		rec := &recordReader{r: res.Body, record: true}
+		zr, err := gzip.NewReader(rec)
+		if err != nil {
+			res.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(rec.buf.Bytes()), res.Body), res.Body}
+			return nil, true, err
+		}
+		rec.record = false
+		rec.buf = bytes.Buffer{}
+		return struct {
+			io.Reader
+			io.Closer
+		}{zr, res.Body}, true, nil
+	case "deflate":
+		return struct {
+			io.Reader
+			io.Closer
+		}{flate.NewReader(res.Body), res.Body}, true, nil
+	}
+	return nil, false, nil
+}
+
+// recordReader 记录读出的字节，直到record被关闭
+type recordReader struct {
+	r      io.Reader
+	buf    bytes.Buffer
+	record bool
+}
+
+func (r *recordReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.record {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// isEncoded 响应体是否经过压缩
+func isEncoded(res *http.Response) bool {
+	enc := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	return enc != "" && enc != "identity"
+}
+
+// setDecodedBody 替换为改写后的未压缩响应体，length为-1表示长度未知，使用分块传输
+func setDecodedBody(res *http.Response, body io.ReadCloser, length int64) {
+	res.Body = body
+	res.Header.Del("Content-Encoding")
+	//压缩前后内容不同，上游的ETag不再准确，改成弱校验
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set("ETag", "W/"+etag)
+	}
+	res.ContentLength = length
+	if length >= 0 {
+		res.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	} else {
+		res.Header.Del("Content-Length")
+	}
+}
+
+// rewriteBody 缓冲响应体并用fn改写，超过maxSize或编码不支持时原样转发
+func rewriteBody(res *http.Response, maxSize int64, fn func([]byte) ([]byte, error)) error {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	if res.ContentLength > maxSize {
+		return nil
+	}
+	body, ok, err := decodedBody(res)
+	if err != nil || !ok {
+		//解压失败或者编码不支持时不改写，交给客户端自己处理
+		return nil
+	}
+
+	//多读一个字节，用来判断是否超过上限
+	buf, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > maxSize {
+		//已经读出来的部分要放回去，和剩下的部分拼起来原样转发
+		rest := struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), body), body}
+		if isEncoded(res) {
+			//读出来的是解压后的数据，只能以不压缩的形式继续转发
+			setDecodedBody(res, rest, -1)
+		} else {
+			res.Body = rest
+		}
+		return nil
+	}
+	res.Body.Close()
+
+	out, err := fn(buf)
+	if err != nil {
+		return err
+	}
+	setDecodedBody(res, io.NopCloser(bytes.NewReader(out)), int64(len(out)))
+	return nil
+}
+
+// RegexReplace 用正则替换响应体，替换串中可以用$1引用分组
+type RegexReplace struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	//ContentTypes 只改写这些类型，为空时改写文本、JSON和XML
+	ContentTypes []string
+	//MaxBodySize 缓冲上限，为0时使用DefaultMaxBodySize
+	MaxBodySize int64
+}
+
+// TransformResponse 实现ResponseTransformer接口
+func (t *RegexReplace) TransformResponse(res *http.Response) error {
+	if !hasBody(res) || !matchContentType(res, t.ContentTypes) {
+		return nil
+	}
+	return rewriteBody(res, t.MaxBodySize, func(b []byte) ([]byte, error) {
+		return t.Pattern.ReplaceAll(b, []byte(t.Replacement)), nil
+	})
+}
+
+// JSONFields 增加、删除、打码JSON响应中的字段
+// 字段路径用"."分隔，比如"user.password"，数组中的每个元素都会处理
+type JSONFields struct {
+	Add    map[string]interface{}
+	Remove []string
+	Mask   []string
+	//MaskWith 打码后的值，默认"***"
+	MaskWith    string
+	MaxBodySize int64
+}
+
+// TransformResponse 实现ResponseTransformer接口，响应体不是合法JSON时原样转发
+func (t *JSONFields) TransformResponse(res *http.Response) error {
+	if !hasBody(res) || !matchContentType(res, []string{"application/json"}) {
+		return nil
+	}
+	return rewriteBody(res, t.MaxBodySize, func(b []byte) ([]byte, error) {
+		doc, err := decodeJSON(b)
+		if err != nil {
+			return b, nil
+		}
+		mask := t.MaskWith
+		if mask == "" {
+			mask = "***"
+		}
+		for _, p := range t.Remove {
+			walkJSON(doc, strings.Split(p, "."), func(obj map[string]interface{}, key string) {
+				delete(obj, key)
+			})
+		}
+		for _, p := range t.Mask {
+			walkJSON(doc, strings.Split(p, "."), func(obj map[string]interface{}, key string) {
+				if _, ok := obj[key]; ok {
+					obj[key] = mask
+				}
+			})
+		}
+		for p, v := range t.Add {
+			value := v
+			walkJSON(doc, strings.Split(p, "."), func(obj map[string]interface{}, key string) {
+				obj[key] = value
+			})
+		}
+		return json.Marshal(doc)
+	})
+}
+
+// decodeJSON 解析JSON，数字保留为json.Number，大整数不会因为转成float64丢失精度
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid character after top-level value")
+	}
+	return doc, nil
+}
+
+// walkJSON 沿着路径找到最后一级所在的对象，对它调用fn
+func walkJSON(node interface{}, path []string, fn func(obj map[string]interface{}, key string)) {
+	switch n := node.(type) {
+	case []interface{}:
+		for _, item := range n {
+			walkJSON(item, path, fn)
+		}
+	case map[string]interface{}:
+		if len(path) == 1 {
+			fn(n, path[0])
+			return
+		}
+		if next, ok := n[path[0]]; ok {
+			walkJSON(next, path[1:], fn)
+		}
+	}
+}
+
+// HTMLInject 在HTML响应的某个标签前注入内容，比如在</body>前插入统计脚本
+// 边读边改，不缓冲整个响应体，找不到标签时原样转发
+type HTMLInject struct {
+	//Before 在这个标签之前注入，默认"</body>"，不区分大小写
+	Before  string
+	Content string
+}
+
+// TransformResponse 实现ResponseTransformer接口
+func (t *HTMLInject) TransformResponse(res *http.Response) error {
+	if !hasBody(res) || !matchContentType(res, []string{"text/html"}) {
+		return nil
+	}
+	body, ok, err := decodedBody(res)
+	if err != nil || !ok {
+		return nil
+	}
+	marker := t.Before
+	if marker == "" {
+		marker = "</body>"
+	}
+	setDecodedBody(res, &injectReader{src: body, marker: []byte(marker), content: []byte(t.Content)}, -1)
+	return nil
+}
+
+// injectReader 在marker第一次出现的位置之前插入content
+// 每次读取时保留最后len(marker)-1个字节不输出，防止marker跨两次读取被截断
+type injectReader struct {
+	src     io.ReadCloser
+	marker  []byte
+	content []byte
+	pending []byte //已经读出但还没输出的数据
+	done    bool   //已经注入过了
+	eof     bool
+}
+
+func (r *injectReader) Read(p []byte) (int, error) {
+	for {
+		if !r.done {
+			if i := indexFold(r.pending, r.marker); i >= 0 {
+				out := make([]byte, 0, len(r.pending)+len(r.content))
+				out = append(append(append(out, r.pending[:i]...), r.content...), r.pending[i:]...)
+				r.pending, r.done = out, true
+			}
+		}
+
+		//注入完成或者上游读完后，直接输出剩下的数据
+		if r.done || r.eof {
+			if len(r.pending) > 0 {
+				n := copy(p, r.pending)
+				r.pending = r.pending[n:]
+				return n, nil
+			}
+			if r.eof {
+				return 0, io.EOF
+			}
+			return r.src.Read(p)
+		}
+
+		//保留可能是marker开头的尾部，其余的先输出
+		if keep := len(r.marker) - 1; len(r.pending) > keep {
+			n := copy(p, r.pending[:len(r.pending)-keep])
+			r.pending = r.pending[n:]
+			return n, nil
+		}
+
+		buf := make([]byte, 32<<10)
+		n, err := r.src.Read(buf)
+		r.pending = append(r.pending, buf[:n]...)
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *injectReader) Close() error {
+	return r.src.Close()
+}
+
+// indexFold 不区分大小写查找sep第一次出现的位置，直接在原始字节上比较，返回的下标可以直接用于s
+func indexFold(s, sep []byte) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,293 @@
+package reverseproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 自动重试：原来的transport只尝试一次，失败后ErrorHandler直接返回错误
+// 1、只重试幂等的方法（GET、HEAD、OPTIONS、TRACE、PUT、DELETE），其它方法需要路由开启或者请求带Idempotency-Key
+// 2、重试的条件：拨号失败、连接被重置、上游返回配置的状态码（默认502、503、504）
+// 3、每次重试尽量换一个上游，两次尝试之间按指数退避并加随机抖动
+// 4、请求体在上限内缓冲，以便重放；超过上限的请求不重试
+// 5、所有路由共享一个重试预算，重试数超过请求数的一定比例时不再重试，防止重试风暴
+
+// RetryPolicy 路由的重试策略
+type RetryPolicy struct {
+	//Attempts 最多尝试的次数，包括第一次，小于2表示不重试
+	Attempts int
+	//RetryOn 需要重试的状态码，为空时使用502、503、504
+	RetryOn []int
+	//RetryNonIdempotent 为true时POST、PATCH等非幂等方法也重试
+	RetryNonIdempotent bool
+	//BackoffBase 第一次重试前的退避时间，之后每次翻倍，默认25毫秒
+	BackoffBase time.Duration
+	//BackoffMax 退避时间的上限，默认1秒
+	BackoffMax time.Duration
+	//MaxBodySize 为了重放而缓冲的请求体上限，为0时使用DefaultMaxBodySize
+	MaxBodySize int64
+	//Budget 重试预算，为nil时使用DefaultRetryBudget
+	Budget *RetryBudget
+}
+
+var defaultRetryOn = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// idempotent 判断请求是否可以安全地重试
+func (rp *RetryPolicy) idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return rp.RetryNonIdempotent || req.Header.Get("Idempotency-Key") != ""
+}
+
+// shouldRetry 判断这次尝试的结果是否需要重试
+func (rp *RetryPolicy) shouldRetry(ctx context.Context, res *http.Response, err error) bool {
+	if err != nil {
+		return retryableError(ctx, err)
+	}
+	codes := rp.RetryOn
+	if len(codes) == 0 {
+		codes = defaultRetryOn
+	}
+	for _, c := range codes {
+		if res.StatusCode == c {
+			return true
+		}
+	}
+	return false
+}
+
+// retryableError 拨号失败和连接被重置可以重试，请求本身被取消或超时时不重试
+// 拨号超时也是拨号失败，换一个上游重试，所以先判断拨号错误，再看请求的上下文
+func retryableError(ctx context.Context, err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// backoff 第n次重试前的等待时间，使用完全随机抖动：[0, min(max, base*2^(n-1)))
+func (rp *RetryPolicy) backoff(n int) time.Duration {
+	base, max := rp.BackoffBase, rp.BackoffMax
+	if base <= 0 {
+		base = 25 * time.Millisecond
+	}
+	if max <= 0 {
+		max = time.Second
+	}
+	d := base << uint(n-1)
+	if d > max || d <= 0 {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// RetryBudget 重试预算，统计最近一段时间的请求数和重试数
+// 重试数不能超过 请求数*Ratio + MinRetries，超过时新的重试被拒绝
+type RetryBudget struct {
+	//Ratio 重试数占请求数的比例，比如0.2表示最多多出20%的流量
+	Ratio float64
+	//MinRetries 统计窗口内至少允许的重试数，避免低流量时完全不能重试
+	MinRetries int
+	//Window 统计窗口，默认10秒
+	Window time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	prev    [2]int64 //上一个窗口的请求数和重试数
+	current [2]int64 //当前窗口的请求数和重试数
+}
+
+// DefaultRetryBudget 所有路由默认共享的重试预算
+var DefaultRetryBudget = &RetryBudget{Ratio: 0.2, MinRetries: 10}
+
+// rotate 按窗口滚动计数，用上一个窗口和当前窗口的加权和近似滑动窗口
+func (b *RetryBudget) rotate(now time.Time) float64 {
+	window := b.Window
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	if b.start.IsZero() {
+		b.start = now
+	}
+	elapsed := now.Sub(b.start)
+	if elapsed >= 2*window {
+		b.prev, b.current, b.start = [2]int64{}, [2]int64{}, now
+		elapsed = 0
+	} else if elapsed >= window {
+		b.prev, b.current = b.current, [2]int64{}
+		b.start = b.start.Add(window)
+		elapsed -= window
+	}
+	//上一个窗口的权重随时间递减
+	return 1 - float64(elapsed)/float64(window)
+}
+
+// Request 记录一次请求
+func (b *RetryBudget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rotate(time.Now())
+	b.current[0]++
+}
+
+// Withdraw 申请一次重试，预算不足时返回false
+func (b *RetryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w := b.rotate(time.Now())
+	requests := float64(b.current[0]) + w*float64(b.prev[0])
+	retries := float64(b.current[1]) + w*float64(b.prev[1])
+	if retries+1 > requests*b.Ratio+float64(b.MinRetries) {
+		return false
+	}
+	b.current[1]++
+	return true
+}
+
+// bufferBody 把请求体缓冲下来并设置GetBody，超过上限时返回false，请求不能重放
+func bufferBody(req *http.Request, maxSize int64) bool {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return true
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	if req.ContentLength > maxSize {
+		return false
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil || int64(len(buf)) > maxSize {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return true
+}
+
+// upstreamKey 请求上下文中保存转发目标的键
+type upstreamKey struct{}
+
+// upstreamState Director改写前的请求地址和已经尝试过的上游
+type upstreamState struct {
+	origURL url.URL
+	tried   []*url.URL
+}
+
+// retryTransport 按路由的重试策略重试请求
+type retryTransport struct {
+	route *Route
+	next  http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rp := t.route.Retry
+	if rp == nil || rp.Attempts < 2 {
+		return t.next.RoundTrip(req)
+	}
+	budget := rp.Budget
+	if budget == nil {
+		budget = DefaultRetryBudget
+	}
+	budget.Request()
+
+	state, _ := req.Context().Value(upstreamKey{}).(*upstreamState)
+	if !rp.idempotent(req) || state == nil || !bufferBody(req, rp.MaxBodySize) {
+		return t.next.RoundTrip(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := t.next.RoundTrip(req)
+		if attempt >= rp.Attempts || !rp.shouldRetry(req.Context(), res, err) || !budget.Withdraw() {
+			return res, err
+		}
+		if err != nil {
+			log.Printf("reverseproxy: route %q attempt %d to %s failed: %v", t.route.Name, attempt, req.URL.Host, err)
+		} else {
+			log.Printf("reverseproxy: route %q attempt %d to %s returned %d", t.route.Name, attempt, req.URL.Host, res.StatusCode)
+			//读掉一小部分响应体再关闭，连接才能回到连接池
+			io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(rp.backoff(attempt))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		//换一个没有尝试过的上游，重新生成请求
+		next := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if next.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		target := t.route.nextTarget(state.tried)
+		state.tried = append(state.tried, target)
+		next.URL = &url.URL{}
+		*next.URL = state.origURL
+		RewriteURL(next.URL, target)
+		if t.route.HostPolicy == HostUpstream {
+			next.Host = target.Host
+		}
+		req = next
+	}
+}
+
+// nextTarget 轮询选择上游，优先选择没有尝试过的
+func (r *Route) nextTarget(tried []*url.URL) *url.URL {
+	targets := r.Targets
+	if len(targets) == 0 {
+		return r.Target
+	}
+	n := uint32(len(targets))
+	start := atomic.AddUint32(&r.rr, 1)
+	for i := uint32(0); i < n; i++ {
+		t := targets[(start+i)%n]
+		if !containsURL(tried, t) {
+			return t
+		}
+	}
+	//都试过了就按轮询继续，但不连续两次选同一个
+	t := targets[start%n]
+	if n > 1 && len(tried) > 0 && t == tried[len(tried)-1] {
+		t = targets[(start+1)%n]
+	}
+	return t
+}
+
+func containsURL(list []*url.URL, u *url.URL) bool {
+	for _, x := range list {
+		if x == u {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package reverseproxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"gateway/gatewaytest"
+)
+
+func TestRouteRewrite(t *testing.T) {
+	api := gatewaytest.NewHTTPUpstream(t, "api", nil)
+	web := gatewaytest.NewHTTPUpstream(t, "web", nil)
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{"http": [{"name": "gw", "routes": [
+		{"path_prefix": "/api/", "strip_prefix": true, "targets": [%q]},
+		{"path_prefix": "/", "targets": [%q]}]}]}`, api.URL+"/v1?key=k", web.URL))
+
+	res := gw.Get(t, "gw", "/api/users?id=7")
+	gatewaytest.AssertRoutedTo(t, res, api)
+	gatewaytest.AssertEcho(t, res).Path("/v1/users").Query("key=k&id=7")
+
+	res = gw.Get(t, "gw", "/index.html")
+	gatewaytest.AssertRoutedTo(t, res, web)
+	gatewaytest.AssertEcho(t, res).Path("/index.html").Query("")
+}
+
+// TestRouteTransformersFromConfig 配置文件中的请求和响应改写都能生效
+func TestRouteTransformersFromConfig(t *testing.T) {
+	api := gatewaytest.NewHTTPUpstream(t, "api", nil)
+	page := gatewaytest.NewHTTPUpstream(t, "page", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/page/index.html" {
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<html><BODY>hi</BODY></html>")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"msg":"internal host db-1","user":{"name":"bob","password":"p"},"trace":"x"}`)
+	}))
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{"http": [{"name": "gw", "routes": [
+		{"path_prefix": "/api/", "targets": [%q],
+			"path_rewrite": {"pattern": "^/api/users/(\\d+)$", "replacement": "/users/$1/profile"},
+			"request_query": {"set": {"v": "2"}, "remove": ["debug"]},
+			"method_override": {"header": "X-HTTP-Method-Override"},
+			"request_json": {"add": {"meta.source": "gateway"}}},
+		{"path_prefix": "/page/", "targets": [%q],
+			"status_remap": {"500": 502},
+			"body_replace": [{"pattern": "db-\\d+", "replacement": "***"}],
+			"response_json": {"remove": ["trace"], "mask": ["user.password"]},
+			"html_inject": {"content": "<script>x</script>"}}]}]}`, api.URL, page.URL))
+
+	res := gw.Request(t, http.MethodPost, "gw", "/api/users/7?debug=1&b=%20", `{"a":1}`, http.Header{
+		"Content-Type":           {"application/json"},
+		"X-Http-Method-Override": {"PATCH"},
+	})
+	e := gatewaytest.AssertEcho(t, res).Path("/users/7/profile").Query("b=%20&v=2").Header("X-Http-Method-Override", "").
+		Body(`{"a":1,"meta":{"source":"gateway"}}`)
+	if e.Method != http.MethodPatch {
+		t.Errorf("upstream method = %s, want PATCH", e.Method)
+	}
+
+	res = gw.Get(t, "gw", "/page/data")
+	gatewaytest.AssertStatus(t, res, http.StatusBadGateway)
+	if body := gatewaytest.ReadBody(t, res); body != `{"msg":"internal host ***","user":{"name":"bob","password":"***"}}` {
+		t.Errorf("json body = %s", body)
+	}
+	res = gw.Get(t, "gw", "/page/index.html")
+	if body := gatewaytest.ReadBody(t, res); body != "<html><BODY>hi<script>x</script></BODY></html>" {
+		t.Errorf("html body = %s", body)
+	}
+}
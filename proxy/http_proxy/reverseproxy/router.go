@@ -0,0 +1,85 @@
+package reverseproxy
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Router 按路径前缀把请求分发给路由，实现了http.Handler
+// 多条路由都匹配时，选前缀最长的那条
+type Router struct {
+	mu     sync.RWMutex
+	routes []*routeEntry
+}
+
+type routeEntry struct {
+	route   *Route
+	handler http.Handler
+}
+
+// NewRouter 创建路由器
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// AddRoute 添加一条路由，使用NewRouteProxy创建处理器
+func (rt *Router) AddRoute(route *Route) {
+	rt.Handle(route, NewRouteProxy(route))
+}
+
+// Handle 添加一条路由，使用自定义的处理器，比如在反向代理外面包装了中间件
+func (rt *Router) Handle(route *Route, handler http.Handler) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes = append(rt.routes, &routeEntry{route: route, handler: handler})
+	//按前缀长度从长到短排序，匹配时第一个命中的就是最长前缀
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		return len(rt.routes[i].route.PathPrefix) > len(rt.routes[j].route.PathPrefix)
+	})
+}
+
+// Routes 返回所有路由
+func (rt *Router) Routes() []*Route {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	routes := make([]*Route, 0, len(rt.routes))
+	for _, e := range rt.routes {
+		routes = append(routes, e.route)
+	}
+	return routes
+}
+
+// Match 返回匹配请求路径的路由和处理器
+func (rt *Router) Match(path string) (*Route, http.Handler) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for _, e := range rt.routes {
+		if matchPrefix(e.route.PathPrefix, path) {
+			return e.route, e.handler
+		}
+	}
+	return nil, nil
+}
+
+// matchPrefix 前缀按路径段匹配，/api 匹配 /api 和 /api/x，不匹配 /apix
+func matchPrefix(prefix, path string) bool {
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// ServeHTTP 实现http.Handler接口，没有匹配的路由时返回404
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, h := rt.Match(r.URL.Path)
+	if h == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
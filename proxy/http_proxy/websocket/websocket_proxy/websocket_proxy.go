@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"gateway/proxy/http_proxy/wsproxy"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	proxyAddr = "127.0.0.1:8082"
+	serverURL = "http://127.0.0.1:8002"
+	//messageMode 为true时使用消息级别的代理，网关可以看到每一条消息
+	//为false时使用httputil.ReverseProxy，升级后只是盲目地对拷字节
+	messageMode = true
+)
+
+func main() {
+	url, err := url.Parse(serverURL)
+	if err != nil {
+
+		log.Println(err)
+	}
+
+	var proxy http.Handler = httputil.NewSingleHostReverseProxy(url)
+	var wsProxy *wsproxy.WebSocketProxy
+	if messageMode {
+		wsProxy = wsproxy.NewWebSocketProxy(url)
+		wsProxy.MaxMessageSize = 64 << 10 //单条消息最大64KB
+		wsProxy.MessageRate = 100         //每秒最多转发100条消息
+		wsProxy.MessageBurst = 20
+		wsProxy.LogMessages = true
+		//握手策略：浏览器只允许本地页面发起，客户端通过?token=demo-token认证，每个用户最多3个会话
+		wsProxy.Policy = &wsproxy.Policy{
+			AllowedOrigins:     []string{"http://localhost:8082", "http://127.0.0.1:8082"},
+			AllowMissingOrigin: true,
+			Auth: &wsproxy.TokenAuth{
+				Header: "Authorization",
+				Query:  "token",
+				Cookie: "token",
+				Tokens: map[string]string{"demo-token": "demo"},
+			},
+			UserHeader:         "X-Gateway-User",
+			MaxSessionsPerUser: 3,
+		}
+		//和下游wsHandler的3秒心跳类似，10秒收不到任何帧就认为连接已断开
+		wsProxy.IdleTimeout = 10 * time.Second
+		wsProxy.PingInterval = 3 * time.Second
+		wsProxy.DrainTimeout = 5 * time.Second
+		proxy = wsProxy
+	}
+
+	server := &http.Server{Addr: proxyAddr, Handler: proxy}
+	go func() {
+		log.Println("Starting websocket proxy at " + proxyAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	//收到退出信号后，先停止接收新连接，再向所有会话发送1001关闭帧
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	if wsProxy != nil {
+		remaining := wsProxy.Shutdown(ctx)
+		log.Printf("websocket proxy stopped, %d sessions closed forcibly", len(remaining))
+	}
+}
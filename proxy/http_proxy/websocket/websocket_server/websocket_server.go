@@ -50,7 +50,7 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 			log.Println("read error:", err)
 			break
 		}
-		fmt.Printf("receive mt:%s, msg:%s\n", mt, msg)
+		fmt.Printf("receive mt:%d, msg:%s\n", mt, msg)
 
 		newMsg := string(msg) + "lz"
 		msg = []byte(newMsg)
@@ -0,0 +1,141 @@
+package wsproxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 优雅关闭和心跳
+// http.Server.Shutdown不会等待被劫持（Hijack）的连接，WebSocket会话需要代理自己关闭：
+// 1、标记正在关闭，新的握手返回503
+// 2、向所有会话的客户端和上游发送1001（Going Away）关闭帧，标记之后才登记的会话在登记时自己发送
+// 3、等待双方回应关闭帧，会话自然结束
+// 4、超过等待时间的会话强制关闭底层连接，并报告剩余的会话
+
+// heartbeatPayload 网关心跳ping的内容，对应的pong不会转发给另一方
+const heartbeatPayload = "gateway-heartbeat"
+
+// defaultDrainTimeout 没有配置DrainTimeout、ctx也没有截止时间时的等待时间
+// 发送关闭帧最多writeWait，之后每个会话最多再等closeWait，正常的会话在这之前都已经结束
+const defaultDrainTimeout = writeWait + closeWait
+
+func (p *WebSocketProxy) shuttingDown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inShutdown
+}
+
+// trackSession 登记或注销会话，登记时返回是否正在关闭
+func (p *WebSocketProxy) trackSession(s *Session, add bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions == nil {
+		p.sessions = make(map[*Session]struct{})
+	}
+	if add {
+		p.sessions[s] = struct{}{}
+	} else {
+		delete(p.sessions, s)
+	}
+	return p.inShutdown
+}
+
+// Sessions 返回当前所有会话的快照
+func (p *WebSocketProxy) Sessions() []*Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]*Session, 0, len(p.sessions))
+	for s := range p.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// goingAway 向会话的两端发送1001关闭帧
+func goingAway(s *Session) {
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "gateway shutting down")
+	deadline := time.Now().Add(writeWait)
+	s.Client.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+	s.Upstream.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+}
+
+// Shutdown 向所有会话发送1001关闭帧并等待会话结束
+// 等待时间取DrainTimeout和ctx中较早的一个，返回还没结束、被强制关闭的会话
+func (p *WebSocketProxy) Shutdown(ctx context.Context) []*Session {
+	//标记和快照在同一把锁下，之后登记的会话由serveSession自己发送1001
+	p.mu.Lock()
+	p.inShutdown = true
+	snapshot := make([]*Session, 0, len(p.sessions))
+	for s := range p.sessions {
+		snapshot = append(snapshot, s)
+	}
+	p.mu.Unlock()
+
+	for _, s := range snapshot {
+		goingAway(s)
+	}
+
+	timeout := p.DrainTimeout
+	if _, ok := ctx.Deadline(); !ok && timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	//和http.Server.Shutdown一样，轮询检查会话是否已经全部结束
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		remaining := p.Sessions()
+		if len(remaining) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			for _, s := range remaining {
+				p.logf("wsproxy: session %s (user %q, %s) still open after drain, closing", s.ID, s.User, s.Request.RemoteAddr)
+				s.Client.Close()
+				s.Upstream.Close()
+			}
+			return remaining
+		case <-ticker.C:
+		}
+	}
+}
+
+// touch 收到任何帧都说明对端还活着，刷新读超时
+func (p *WebSocketProxy) touch(c *websocket.Conn) {
+	if p.IdleTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+	}
+}
+
+// heartbeat 定时向两端发送ping，参考websocket_server.go中每3秒一次的心跳
+// 对端不回应pong时读超时到期，relay读取出错，会话以1001结束
+func (p *WebSocketProxy) heartbeat(s *Session) {
+	interval := p.PingInterval
+	if interval == 0 {
+		interval = p.IdleTimeout / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(writeWait)
+			if err := s.Client.WriteControl(websocket.PingMessage, []byte(heartbeatPayload), deadline); err != nil {
+				return
+			}
+			if err := s.Upstream.WriteControl(websocket.PingMessage, []byte(heartbeatPayload), deadline); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package wsproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair 返回一对已经握手的WebSocket连接
+func wsPair(t *testing.T) (client, server *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = <-conns
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// expectGoingAway 读到的下一帧必须是1001关闭帧，默认的回调会回应关闭帧
+func expectGoingAway(t *testing.T, name string, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway {
+		t.Errorf("%s: got %v, want close 1001", name, err)
+	}
+}
+
+// startSession 在p上运行一个会话，返回测试持有的客户端和上游两端
+func startSession(t *testing.T, p *WebSocketProxy) (client, upstream *websocket.Conn) {
+	t.Helper()
+	client, gwClient := wsPair(t)
+	gwUpstream, upstream := wsPair(t)
+	s := newSession(httptest.NewRequest(http.MethodGet, "/", nil), gwClient, gwUpstream)
+	go p.serveSession(s)
+	return client, upstream
+}
+
+func TestShutdown(t *testing.T) {
+	p := &WebSocketProxy{ErrorLog: discardLog}
+	client, upstream := startSession(t, p)
+	//等会话登记
+	for deadline := time.Now().Add(5 * time.Second); len(p.Sessions()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not tracked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	done := make(chan []*Session, 1)
+	go func() { done <- p.Shutdown(context.Background()) }()
+	expectGoingAway(t, "client", client)
+	expectGoingAway(t, "upstream", upstream)
+	select {
+	case remaining := <-done:
+		if len(remaining) != 0 {
+			t.Errorf("%d sessions were force closed", len(remaining))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after both sides answered")
+	}
+
+	//关闭后新的握手返回503
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("handshake after Shutdown: status %d, want 503", w.Code)
+	}
+}
+
+// TestShutdownLateSession 通过了握手检查、在Shutdown取快照之后才登记的会话也要收到1001
+func TestShutdownLateSession(t *testing.T) {
+	p := &WebSocketProxy{ErrorLog: discardLog}
+	if remaining := p.Shutdown(context.Background()); remaining != nil {
+		t.Fatalf("Shutdown without sessions returned %v", remaining)
+	}
+	client, upstream := startSession(t, p)
+	expectGoingAway(t, "client", client)
+	expectGoingAway(t, "upstream", upstream)
+}
+
+// TestShutdownDrainTimeout 对端不回应关闭帧时，DrainTimeout到期后强制关闭
+func TestShutdownDrainTimeout(t *testing.T) {
+	p := &WebSocketProxy{ErrorLog: discardLog, DrainTimeout: 100 * time.Millisecond}
+	startSession(t, p)
+	for deadline := time.Now().Add(5 * time.Second); len(p.Sessions()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("session was not tracked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	//测试持有的两端不读，不会回应关闭帧
+	start := time.Now()
+	if remaining := p.Shutdown(context.Background()); len(remaining) != 1 {
+		t.Errorf("Shutdown returned %d sessions, want the one that did not answer", len(remaining))
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Shutdown took %v with a 100ms drain timeout", d)
+	}
+}
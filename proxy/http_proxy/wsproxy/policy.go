@@ -0,0 +1,213 @@
+package wsproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gateway/proxy/http_proxy/reverseproxy"
+
+	"github.com/gorilla/websocket"
+)
+
+// 网关侧的WebSocket握手策略，在拨号上游之前检查，不通过时返回普通的HTTP错误，不会升级
+// 检查顺序：
+// 1、Origin白名单，不通过返回403
+// 2、认证，不通过返回401
+// 3、子协议协商，没有可用的子协议返回400
+// 4、每个用户的并发会话数，超过返回429
+
+var (
+	// ErrNoToken 请求中没有找到令牌
+	ErrNoToken = errors.New("wsproxy: missing token")
+	// ErrInvalidToken 令牌无效
+	ErrInvalidToken = errors.New("wsproxy: invalid token")
+)
+
+// Authenticator 认证握手请求，返回用户标识
+type Authenticator interface {
+	Authenticate(r *http.Request) (user string, err error)
+}
+
+// AuthenticatorFunc 把普通函数适配为Authenticator
+type AuthenticatorFunc func(r *http.Request) (string, error)
+
+// Authenticate 实现Authenticator接口
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// TokenAuth 从请求头、查询参数或Cookie中取出令牌并校验
+// 浏览器的WebSocket API不能自定义请求头，所以查询参数和Cookie也很常用
+type TokenAuth struct {
+	//Header 令牌所在的请求头，Authorization头会去掉"Bearer "前缀
+	Header string
+	//Query 令牌所在的查询参数名
+	Query string
+	//Cookie 令牌所在的Cookie名
+	Cookie string
+
+	//Tokens 静态的令牌到用户的映射
+	Tokens map[string]string
+	//Validate 自定义校验，优先于Tokens
+	Validate func(token string) (user string, err error)
+}
+
+// TokenSource 令牌在请求中的位置
+type TokenSource int
+
+const (
+	// TokenNotFound 请求中没有令牌
+	TokenNotFound TokenSource = iota
+	// TokenFromHeader 令牌在请求头中
+	TokenFromHeader
+	// TokenFromQuery 令牌在查询参数中
+	TokenFromQuery
+	// TokenFromCookie 令牌在Cookie中
+	TokenFromCookie
+)
+
+// Token 按Header、Query、Cookie的顺序查找令牌，同时返回令牌所在的位置
+func (ta *TokenAuth) Token(r *http.Request) (string, TokenSource) {
+	if ta.Header != "" {
+		if v := r.Header.Get(ta.Header); v != "" {
+			if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+				v = v[7:]
+			}
+			return strings.TrimSpace(v), TokenFromHeader
+		}
+	}
+	if ta.Query != "" {
+		if v := r.URL.Query().Get(ta.Query); v != "" {
+			return v, TokenFromQuery
+		}
+	}
+	if ta.Cookie != "" {
+		if c, err := r.Cookie(ta.Cookie); err == nil && c.Value != "" {
+			return c.Value, TokenFromCookie
+		}
+	}
+	return "", TokenNotFound
+}
+
+// Strip 从请求中删掉src位置的令牌，其它查询参数和Cookie保持原样
+func (ta *TokenAuth) Strip(r *http.Request, src TokenSource) {
+	switch src {
+	case TokenFromHeader:
+		r.Header.Del(ta.Header)
+	case TokenFromQuery:
+		r.URL.RawQuery = reverseproxy.DelQuery(r.URL.RawQuery, ta.Query)
+	case TokenFromCookie:
+		removeCookie(r.Header, ta.Cookie)
+	}
+}
+
+// Authenticate 实现Authenticator接口
+// 和apikey.Auth.Key一样，令牌只给网关校验，找到后从请求中删掉，拨号上游时不会带过去
+func (ta *TokenAuth) Authenticate(r *http.Request) (string, error) {
+	token, src := ta.Token(r)
+	if token == "" {
+		return "", ErrNoToken
+	}
+	ta.Strip(r, src)
+	if ta.Validate != nil {
+		return ta.Validate(token)
+	}
+	if user, ok := ta.Tokens[token]; ok {
+		return user, nil
+	}
+	return "", ErrInvalidToken
+}
+
+// removeCookie 从Cookie头中删掉名为name的Cookie，删空的Cookie头整个去掉
+func removeCookie(h http.Header, name string) {
+	lines := h.Values("Cookie")
+	h.Del("Cookie")
+	for _, line := range lines {
+		var kept []string
+		for _, part := range strings.Split(line, ";") {
+			key, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if key != name {
+				kept = append(kept, strings.TrimSpace(part))
+			}
+		}
+		if len(kept) > 0 {
+			h.Add("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
+
+// Policy 握手策略
+type Policy struct {
+	//AllowedOrigins 允许的Origin，支持"*"和"https://*.example.com"这样的子域名通配
+	//为空时使用gorilla默认的同源检查
+	AllowedOrigins []string
+	//AllowMissingOrigin 允许没有Origin头的请求，非浏览器客户端通常不带Origin
+	AllowMissingOrigin bool
+
+	//Subprotocols 允许的子协议，为空时不过滤，客户端请求的子协议全部交给上游选择
+	Subprotocols []string
+	//RequireSubprotocol 为true时，客户端必须请求至少一个允许的子协议
+	RequireSubprotocol bool
+
+	//Auth 认证器，为nil时不认证
+	Auth Authenticator
+	//UserHeader 认证通过后把用户标识通过这个请求头转发给上游，为空时不转发
+	UserHeader string
+
+	//MaxSessionsPerUser 每个用户的最大并发会话数，0表示不限制
+	//没有配置认证时，按客户端IP计数
+	MaxSessionsPerUser int
+}
+
+// checkOrigin 判断Origin是否在白名单中
+func (pl *Policy) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return pl.AllowMissingOrigin
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range pl.AllowedOrigins {
+		if matchOrigin(allowed, u) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrigin(pattern string, origin *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	p, err := url.Parse(pattern)
+	if err != nil || !strings.EqualFold(p.Scheme, origin.Scheme) {
+		return false
+	}
+	//*.example.com 匹配所有子域名，但不匹配example.com本身
+	if strings.HasPrefix(p.Host, "*.") {
+		return strings.HasSuffix(strings.ToLower(origin.Host), strings.ToLower(p.Host[1:]))
+	}
+	return strings.EqualFold(p.Host, origin.Host)
+}
+
+// subprotocols 返回客户端请求的子协议中被允许的部分，保持客户端的优先顺序
+func (pl *Policy) subprotocols(r *http.Request) []string {
+	requested := websocket.Subprotocols(r)
+	if len(pl.Subprotocols) == 0 {
+		return requested
+	}
+	var allowed []string
+	for _, sp := range requested {
+		for _, a := range pl.Subprotocols {
+			if sp == a {
+				allowed = append(allowed, sp)
+				break
+			}
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,187 @@
+package wsproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var discardLog = log.New(io.Discard, "", 0)
+
+func TestCheckPolicy(t *testing.T) {
+	tokens := func() Authenticator {
+		return &TokenAuth{Header: "Authorization", Query: "token", Cookie: "token", Tokens: map[string]string{"t1": "alice"}}
+	}
+	cases := []struct {
+		name   string
+		policy *Policy
+		query  string
+		header http.Header
+		//status 为0表示检查通过
+		status       int
+		user         string
+		subprotocols []string
+	}{
+		{name: "no policy", header: http.Header{"Sec-Websocket-Protocol": {"a, b"}}, subprotocols: []string{"a", "b"}},
+
+		{name: "exact origin", policy: &Policy{AllowedOrigins: []string{"https://app.example.com"}},
+			header: http.Header{"Origin": {"https://APP.example.com"}}},
+		{name: "origin scheme differs", policy: &Policy{AllowedOrigins: []string{"https://app.example.com"}},
+			header: http.Header{"Origin": {"http://app.example.com"}}, status: 403},
+		{name: "origin any", policy: &Policy{AllowedOrigins: []string{"*"}},
+			header: http.Header{"Origin": {"https://anything.test"}}},
+		{name: "wildcard subdomain", policy: &Policy{AllowedOrigins: []string{"https://*.example.com"}},
+			header: http.Header{"Origin": {"https://a.b.example.com"}}},
+		{name: "wildcard excludes apex", policy: &Policy{AllowedOrigins: []string{"https://*.example.com"}},
+			header: http.Header{"Origin": {"https://example.com"}}, status: 403},
+		{name: "wildcard suffix lookalike", policy: &Policy{AllowedOrigins: []string{"https://*.example.com"}},
+			header: http.Header{"Origin": {"https://evilexample.com"}}, status: 403},
+		{name: "wildcard other domain", policy: &Policy{AllowedOrigins: []string{"https://*.example.com"}},
+			header: http.Header{"Origin": {"https://a.example.com.evil.test"}}, status: 403},
+		{name: "missing origin", policy: &Policy{AllowedOrigins: []string{"*"}}, status: 403},
+		{name: "missing origin allowed", policy: &Policy{AllowedOrigins: []string{"https://app.example.com"}, AllowMissingOrigin: true}},
+
+		{name: "no token", policy: &Policy{Auth: tokens()}, status: 401},
+		{name: "unknown token", policy: &Policy{Auth: tokens()}, query: "token=t2", status: 401},
+		{name: "bearer header", policy: &Policy{Auth: tokens()}, header: http.Header{"Authorization": {"Bearer t1"}}, user: "alice"},
+		{name: "query token", policy: &Policy{Auth: tokens()}, query: "token=t1", user: "alice"},
+		{name: "cookie token", policy: &Policy{Auth: tokens()}, header: http.Header{"Cookie": {"token=t1"}}, user: "alice"},
+		//Origin在认证之前检查
+		{name: "origin before auth", policy: &Policy{AllowedOrigins: []string{"https://app.example.com"}, Auth: tokens()},
+			header: http.Header{"Origin": {"https://evil.test"}}, status: 403},
+
+		{name: "filter subprotocols in client order", policy: &Policy{Subprotocols: []string{"v2", "v1"}},
+			header: http.Header{"Sec-Websocket-Protocol": {"v1, v3, v2"}}, subprotocols: []string{"v1", "v2"}},
+		{name: "no allowed subprotocol", policy: &Policy{Subprotocols: []string{"v2"}},
+			header: http.Header{"Sec-Websocket-Protocol": {"v1"}}},
+		{name: "subprotocol required", policy: &Policy{Subprotocols: []string{"v2"}, RequireSubprotocol: true},
+			header: http.Header{"Sec-Websocket-Protocol": {"v1"}}, status: 400},
+		//认证在子协议之前检查
+		{name: "auth before subprotocol", policy: &Policy{Auth: tokens(), Subprotocols: []string{"v2"}, RequireSubprotocol: true},
+			status: 401},
+	}
+	for _, c := range cases {
+		p := &WebSocketProxy{Policy: c.policy, ErrorLog: discardLog}
+		r := httptest.NewRequest(http.MethodGet, "/ws?"+c.query, nil)
+		for k, v := range c.header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		user, subprotocols, ok := p.checkPolicy(w, r)
+		if c.status != 0 {
+			if ok || w.Code != c.status {
+				t.Errorf("%s: ok=%v status=%d, want status %d", c.name, ok, w.Code, c.status)
+			}
+			if c.status == 401 && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: 401 without WWW-Authenticate", c.name)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: rejected with %d %q", c.name, w.Code, w.Body)
+			continue
+		}
+		if user != c.user || fmt.Sprint(subprotocols) != fmt.Sprint(c.subprotocols) {
+			t.Errorf("%s: got user %q subprotocols %q, want %q %q", c.name, user, subprotocols, c.user, c.subprotocols)
+		}
+	}
+}
+
+// TestTokenStripped 认证用的令牌不转发给上游，其它参数和Cookie不变
+func TestTokenStripped(t *testing.T) {
+	ta := &TokenAuth{Header: "Authorization", Query: "token", Cookie: "token", Tokens: map[string]string{"t1": "alice"}}
+	cases := []struct {
+		name      string
+		query     string
+		header    http.Header
+		wantQuery string
+		wantAuth  string
+		//wantCookie 为nil表示没有Cookie头
+		wantCookie []string
+	}{
+		{name: "header", query: "token=other", header: http.Header{"Authorization": {"Bearer t1"}},
+			wantQuery: "token=other"},
+		{name: "query", query: "a=1&token=t1&b=%2F+x", wantQuery: "a=1&b=%2F+x"},
+		{name: "escaped query name", query: "to%6Ben=t1&a=1", wantQuery: "a=1"},
+		{name: "cookie", header: http.Header{"Cookie": {"x=1; token=t1; y=2"}}, wantCookie: []string{"x=1; y=2"}},
+		{name: "only cookie", header: http.Header{"Cookie": {"token=t1"}}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/ws?"+c.query, nil)
+		for k, v := range c.header {
+			r.Header[k] = v
+		}
+		if user, err := ta.Authenticate(r); user != "alice" || err != nil {
+			t.Errorf("%s: Authenticate = %q, %v", c.name, user, err)
+			continue
+		}
+		if r.URL.RawQuery != c.wantQuery || r.Header.Get("Authorization") != c.wantAuth ||
+			fmt.Sprint(r.Header["Cookie"]) != fmt.Sprint(c.wantCookie) {
+			t.Errorf("%s: left query %q authorization %q cookie %q", c.name, r.URL.RawQuery, r.Header.Get("Authorization"), r.Header["Cookie"])
+		}
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	req := func(remote string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = remote
+		return r
+	}
+	p := &WebSocketProxy{Policy: &Policy{MaxSessionsPerUser: 2}}
+	releases := map[string][]func(){}
+	steps := []struct {
+		user   string
+		remote string
+		ok     bool
+	}{
+		{"alice", "10.0.0.1:1000", true},
+		//同一个用户从不同的地址连接，按用户计数
+		{"alice", "10.0.0.2:1000", true},
+		{"alice", "10.0.0.3:1000", false},
+		{"bob", "10.0.0.1:1001", true},
+		//没有认证时按IP计数，端口不同也是同一个客户端
+		{"", "10.0.0.9:1000", true},
+		{"", "10.0.0.9:1001", true},
+		{"", "10.0.0.9:1002", false},
+		{"", "10.0.0.8:1000", true},
+	}
+	for i, s := range steps {
+		key := sessionKey(s.user, req(s.remote))
+		release, ok := p.acquire(key)
+		if ok != s.ok {
+			t.Fatalf("step %d (%s): acquire = %v, want %v", i, key, ok, s.ok)
+		}
+		if ok {
+			releases[key] = append(releases[key], release)
+		}
+	}
+
+	//释放一个名额后可以再建立一个会话
+	releases["user:alice"][0]()
+	releases["user:alice"] = releases["user:alice"][1:]
+	if release, ok := p.acquire("user:alice"); !ok {
+		t.Error("alice still limited after a release")
+	} else {
+		release()
+	}
+	for _, list := range releases {
+		for _, release := range list {
+			release()
+		}
+	}
+	if n := len(p.userSessions); n != 0 {
+		t.Errorf("%d keys left after all sessions were released: %v", n, p.userSessions)
+	}
+
+	//不限制时不拒绝
+	p = &WebSocketProxy{}
+	for i := 0; i < 10; i++ {
+		if _, ok := p.acquire("user:alice"); !ok {
+			t.Fatal("acquire without a limit was refused")
+		}
+	}
+}
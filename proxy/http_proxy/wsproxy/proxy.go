@@ -0,0 +1,415 @@
+package wsproxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"gateway/proxy/clientip"
+	"gateway/proxy/http_proxy/reverseproxy"
+	"gateway/proxy/ratelimit"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket代理：和httputil.ReverseProxy的区别
+// ReverseProxy收到101后只是把两条TCP连接对拷，网关看不到任何消息
+// 这里网关自己和客户端完成握手，再作为客户端连接上游，按消息转发
+// 步骤：
+// 1、拨号上游，把客户端请求的子协议带过去
+// 2、用上游选中的子协议完成和客户端的握手
+// 3、两个协程分别转发两个方向的消息，数据消息经过钩子，控制帧原样转发
+// 4、一方关闭时把关闭码转发给另一方，等待另一方回应后结束会话
+
+const (
+	// writeWait 写控制帧的超时时间
+	writeWait = 5 * time.Second
+	// closeWait 一方关闭后，等待另一方回应关闭帧的时间
+	closeWait = 5 * time.Second
+)
+
+// WebSocketProxy 消息级别的WebSocket代理，实现了http.Handler
+type WebSocketProxy struct {
+	//Target 上游地址，http/https会被换成ws/wss，请求路径拼接在Target.Path后面
+	Target *url.URL
+
+	//Upgrader 和客户端握手用的升级器，为nil时使用默认配置
+	Upgrader *websocket.Upgrader
+	//Dialer 连接上游用的拨号器，为nil时使用websocket.DefaultDialer
+	Dialer *websocket.Dialer
+
+	//MaxMessageSize 单条消息的最大字节数，超过时以1009（Message Too Big）关闭，0表示不限制
+	MaxMessageSize int64
+	//MessageRate 每个会话每个方向每秒允许转发的消息数，0表示不限制
+	//超过时不丢弃消息，而是暂停读取，让压力传回发送方
+	MessageRate  float64
+	MessageBurst int
+
+	//Hooks 数据消息的钩子，用于检查和改写消息
+	Hooks []MessageHook
+	//LogMessages 为true时记录每条消息的方向、类型和长度
+	LogMessages bool
+	//ErrorLog 日志输出，为nil时使用log包的默认Logger
+	ErrorLog *log.Logger
+
+	//Policy 握手策略：Origin、子协议、认证和并发会话数，为nil时不检查
+	Policy *Policy
+
+	//IdleTimeout 连接在这段时间内没有收到任何帧（包括pong）就认为已经断开，0表示不检测
+	//网关会每隔PingInterval向两端发送ping，存活的对端会回应pong，从而刷新超时
+	IdleTimeout time.Duration
+	//PingInterval 心跳间隔，为0时取IdleTimeout的一半
+	PingInterval time.Duration
+	//DrainTimeout Shutdown发出1001关闭帧后等待会话结束的时间
+	//为0时只受ctx限制，ctx也没有截止时间时等待defaultDrainTimeout
+	DrainTimeout time.Duration
+
+	mu sync.Mutex
+	//userSessions 每个用户当前的会话数
+	userSessions map[string]int
+	//sessions 当前所有的会话，Shutdown时逐个关闭
+	sessions map[*Session]struct{}
+	//inShutdown 正在关闭，和sessions一起由mu保护，Shutdown取快照之后登记的会话也能收到1001
+	inShutdown bool
+}
+
+// NewWebSocketProxy 创建一个转发到target的WebSocket代理
+func NewWebSocketProxy(target *url.URL) *WebSocketProxy {
+	return &WebSocketProxy{Target: target}
+}
+
+func (p *WebSocketProxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// ServeHTTP 实现http.Handler接口
+func (p *WebSocketProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	//正在关闭时不再接受新的会话
+	if p.shuttingDown() {
+		http.Error(w, "websocket proxy is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	//0、握手策略检查，不通过时直接返回HTTP错误
+	user, subprotocols, ok := p.checkPolicy(w, r)
+	if !ok {
+		return
+	}
+	release, ok := p.acquire(sessionKey(user, r))
+	if !ok {
+		http.Error(w, "too many websocket sessions", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	//1、先拨号上游，上游拒绝时客户端还没升级，可以直接返回HTTP错误
+	dialer := websocket.DefaultDialer
+	if p.Dialer != nil {
+		dialer = p.Dialer
+	}
+	//拷贝一份拨号器，每个请求的子协议不同
+	d := *dialer
+	d.Subprotocols = subprotocols
+	header := upstreamHeader(r)
+	if p.Policy != nil && p.Policy.UserHeader != "" && user != "" {
+		header.Set(p.Policy.UserHeader, user)
+	}
+	upstream, resp, err := d.DialContext(r.Context(), p.upstreamURL(r).String(), header)
+	if err != nil {
+		p.logf("wsproxy: dial upstream %v error: %v", p.Target, err)
+		if resp != nil {
+			//把上游的拒绝原因（比如401、403）原样返回
+			http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+			return
+		}
+		http.Error(w, "upstream websocket dial failed", http.StatusBadGateway)
+		return
+	}
+
+	//2、和客户端握手，子协议使用上游选中的那个
+	respHeader := http.Header{}
+	if sp := upstream.Subprotocol(); sp != "" {
+		respHeader.Set("Sec-Websocket-Protocol", sp)
+	}
+	upgrader := &websocket.Upgrader{}
+	if p.Upgrader != nil {
+		upgrader = p.Upgrader
+	}
+	if p.Policy != nil && len(p.Policy.AllowedOrigins) > 0 {
+		//Origin已经按白名单检查过了，不再使用gorilla默认的同源检查
+		u := *upgrader
+		u.CheckOrigin = func(*http.Request) bool { return true }
+		upgrader = &u
+	}
+	client, err := upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		//Upgrade失败时已经给客户端写了错误响应
+		upstream.Close()
+		return
+	}
+
+	s := newSession(r, client, upstream)
+	s.User = user
+	p.serveSession(s)
+}
+
+// checkPolicy 按策略检查握手请求，不通过时写入错误响应并返回false
+// 返回认证得到的用户和要发给上游的子协议
+func (p *WebSocketProxy) checkPolicy(w http.ResponseWriter, r *http.Request) (string, []string, bool) {
+	pl := p.Policy
+	if pl == nil {
+		return "", websocket.Subprotocols(r), true
+	}
+
+	if len(pl.AllowedOrigins) > 0 && !pl.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return "", nil, false
+	}
+
+	var user string
+	if pl.Auth != nil {
+		var err error
+		user, err = pl.Auth.Authenticate(r)
+		if err != nil {
+			p.logf("wsproxy: authenticate %s error: %v", r.RemoteAddr, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return "", nil, false
+		}
+	}
+
+	subprotocols := pl.subprotocols(r)
+	if pl.RequireSubprotocol && len(subprotocols) == 0 {
+		http.Error(w, "no acceptable websocket subprotocol", http.StatusBadRequest)
+		return "", nil, false
+	}
+	return user, subprotocols, true
+}
+
+// sessionKey 并发会话的计数键，没有认证时按客户端IP计数
+// 经过clientip.Resolver.Middleware时是转发头中的真实客户端IP，否则是连接的地址
+func sessionKey(user string, r *http.Request) string {
+	if user != "" {
+		return "user:" + user
+	}
+	return "ip:" + clientip.String(r)
+}
+
+// acquire 占用一个会话名额，返回释放函数
+func (p *WebSocketProxy) acquire(key string) (func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.userSessions == nil {
+		p.userSessions = make(map[string]int)
+	}
+	if p.Policy != nil && p.Policy.MaxSessionsPerUser > 0 &&
+		p.userSessions[key] >= p.Policy.MaxSessionsPerUser {
+		return nil, false
+	}
+	p.userSessions[key]++
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.userSessions[key]--; p.userSessions[key] <= 0 {
+			delete(p.userSessions, key)
+		}
+	}, true
+}
+
+// serveSession 在两个连接之间转发消息，直到会话结束
+func (p *WebSocketProxy) serveSession(s *Session) {
+	defer s.cancel()
+	defer s.Client.Close()
+	defer s.Upstream.Close()
+	if p.trackSession(s, true) {
+		//Shutdown已经给快照中的会话发过1001，这个会话登记得晚，自己发
+		goingAway(s)
+	}
+	defer p.trackSession(s, false)
+
+	if p.MaxMessageSize > 0 {
+		s.Client.SetReadLimit(p.MaxMessageSize)
+		s.Upstream.SetReadLimit(p.MaxMessageSize)
+	}
+	p.bridgeControl(s.Client, s.Upstream)
+	p.bridgeControl(s.Upstream, s.Client)
+	if p.IdleTimeout > 0 {
+		p.touch(s.Client)
+		p.touch(s.Upstream)
+		go p.heartbeat(s)
+	}
+
+	errc := make(chan error, 2)
+	go p.relay(s, ClientToUpstream, s.Client, s.Upstream, errc)
+	go p.relay(s, UpstreamToClient, s.Upstream, s.Client, errc)
+
+	//一个方向结束后，关闭帧已经转发给另一方，等它回应关闭帧或者超时
+	<-errc
+	t := time.NewTimer(closeWait)
+	defer t.Stop()
+	select {
+	case <-errc:
+	case <-t.C:
+	}
+
+	if p.LogMessages {
+		st := s.Stats()
+		p.logf("wsproxy: session %s closed after %v, client->upstream %d msgs/%d bytes, upstream->client %d msgs/%d bytes",
+			s.ID, st.Duration, st.ClientMessages, st.ClientBytes, st.UpstreamMessages, st.UpstreamBytes)
+	}
+}
+
+// bridgeControl 把src收到的ping/pong原样转发给dst，由真正的对端来回应
+// 关闭帧不在这里自动回应，而是交给relay转发，这样关闭码能完整地传到另一方
+// 网关自己心跳的pong只用来刷新超时，不转发
+func (p *WebSocketProxy) bridgeControl(src, dst *websocket.Conn) {
+	src.SetPingHandler(func(data string) error {
+		p.touch(src)
+		err := dst.WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(writeWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	src.SetPongHandler(func(data string) error {
+		p.touch(src)
+		if data == heartbeatPayload {
+			return nil
+		}
+		err := dst.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	src.SetCloseHandler(func(code int, text string) error {
+		return nil
+	})
+}
+
+// relay 转发一个方向的消息
+func (p *WebSocketProxy) relay(s *Session, dir Direction, src, dst *websocket.Conn, errc chan<- error) {
+	var limiter *ratelimit.Limiter
+	if p.MessageRate > 0 {
+		limiter = ratelimit.NewLimiter(p.MessageRate, p.MessageBurst)
+	}
+
+	for {
+		mt, data, err := src.ReadMessage()
+		if err != nil {
+			forwardClose(dst, err)
+			errc <- err
+			return
+		}
+		p.touch(src)
+
+		if limiter != nil {
+			if err := limiter.Wait(s.ctx); err != nil {
+				errc <- err
+				return
+			}
+		}
+
+		msg := &Message{Session: s, Direction: dir, Type: mt, Data: data}
+		if err := p.runHooks(msg); err != nil {
+			if errors.Is(err, ErrDropMessage) {
+				continue
+			}
+			//钩子拒绝消息，两边都以1008关闭
+			p.logf("wsproxy: session %s %v message rejected: %v", s.ID, dir, err)
+			closeMsg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+			deadline := time.Now().Add(writeWait)
+			src.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+			dst.WriteControl(websocket.CloseMessage, closeMsg, deadline)
+			errc <- err
+			return
+		}
+
+		if p.LogMessages {
+			p.logf("wsproxy: session %s %v type=%d len=%d", s.ID, dir, msg.Type, len(msg.Data))
+		}
+		if err := dst.WriteMessage(msg.Type, msg.Data); err != nil {
+			errc <- err
+			return
+		}
+		s.count(dir, len(msg.Data))
+	}
+}
+
+func (p *WebSocketProxy) runHooks(msg *Message) error {
+	for _, hook := range p.Hooks {
+		if err := hook(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwardClose 把读取错误转换成关闭帧发给另一方
+// 收到对端的关闭帧时原样转发关闭码；连接异常断开时发送1001（Going Away）
+func forwardClose(dst *websocket.Conn, err error) {
+	var msg []byte
+	var ce *websocket.CloseError
+	switch {
+	case errors.As(err, &ce) && ce.Code == websocket.CloseNoStatusReceived:
+		//对端没有给关闭码，转发一个空的关闭帧
+		msg = []byte{}
+	case errors.As(err, &ce) && ce.Code != websocket.CloseAbnormalClosure:
+		msg = websocket.FormatCloseMessage(ce.Code, ce.Text)
+	case errors.Is(err, websocket.ErrReadLimit):
+		msg = websocket.FormatCloseMessage(websocket.CloseMessageTooBig, "")
+	default:
+		msg = websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	}
+	dst.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+}
+
+// upstreamURL 和反向代理一样拼接上游地址，并换成ws协议
+func (p *WebSocketProxy) upstreamURL(r *http.Request) *url.URL {
+	u := *r.URL
+	reverseproxy.RewriteURL(&u, p.Target)
+	u.User = p.Target.User
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	u.Fragment = ""
+	return &u
+}
+
+// handshakeHeaders 由websocket.Dialer自己生成的握手头部，不能从客户端请求中拷贝
+var handshakeHeaders = []string{
+	"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version",
+	"Sec-Websocket-Extensions", "Sec-Websocket-Protocol",
+}
+
+// upstreamHeader 拷贝客户端请求头，并追加X-Forwarded-For
+// 和ReverseProxy一样保留原始的Host，上游按Origin做同源检查时不会因为网关而失败
+func upstreamHeader(r *http.Request) http.Header {
+	h := r.Header.Clone()
+	for _, k := range handshakeHeaders {
+		h.Del(k)
+	}
+	h.Set("Host", r.Host)
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := h.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		h.Set("X-Forwarded-For", ip)
+	}
+	return h
+}
@@ -0,0 +1,117 @@
+package wsproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Direction 消息的转发方向
+type Direction int
+
+const (
+	// ClientToUpstream 客户端发往上游
+	ClientToUpstream Direction = iota
+	// UpstreamToClient 上游发往客户端
+	UpstreamToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToUpstream {
+		return "client->upstream"
+	}
+	return "upstream->client"
+}
+
+// ErrDropMessage 钩子返回这个错误时，丢弃当前消息但不关闭会话
+var ErrDropMessage = errors.New("wsproxy: drop message")
+
+// Message 一条完整的WebSocket数据消息，控制帧（ping/pong/close）不经过钩子
+type Message struct {
+	Session   *Session
+	Direction Direction
+	//Type websocket.TextMessage或websocket.BinaryMessage
+	Type int
+	//Data 钩子可以直接替换Data，实现消息改写
+	Data []byte
+}
+
+// MessageHook 消息钩子，按顺序执行
+// 返回ErrDropMessage丢弃消息，返回其它错误则以1008（Policy Violation）关闭会话
+type MessageHook func(msg *Message) error
+
+// Session 一次代理的WebSocket会话，由客户端连接和上游连接组成
+type Session struct {
+	ID       string
+	User     string //认证得到的用户，没有认证时为空
+	Request  *http.Request
+	Client   *websocket.Conn
+	Upstream *websocket.Conn
+	Start    time.Time
+
+	//ctx 会话结束时取消，用于中断限流等待
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	//以下计数器用原子操作，两个方向的转发协程会同时修改
+	clientMessages   int64
+	upstreamMessages int64
+	clientBytes      int64
+	upstreamBytes    int64
+}
+
+var sessionSeq int64
+
+func newSession(r *http.Request, client, upstream *websocket.Conn) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		ID:       strconv.FormatInt(atomic.AddInt64(&sessionSeq, 1), 10),
+		Request:  r,
+		Client:   client,
+		Upstream: upstream,
+		Start:    time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Context 会话的上下文，会话结束时被取消
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// count 记录某个方向转发的消息数和字节数
+func (s *Session) count(dir Direction, n int) {
+	if dir == ClientToUpstream {
+		atomic.AddInt64(&s.clientMessages, 1)
+		atomic.AddInt64(&s.clientBytes, int64(n))
+		return
+	}
+	atomic.AddInt64(&s.upstreamMessages, 1)
+	atomic.AddInt64(&s.upstreamBytes, int64(n))
+}
+
+// Stats 会话的统计信息
+type Stats struct {
+	ClientMessages   int64 //客户端发往上游的消息数
+	UpstreamMessages int64 //上游发往客户端的消息数
+	ClientBytes      int64
+	UpstreamBytes    int64
+	Duration         time.Duration
+}
+
+// Stats 返回当前的统计信息
+func (s *Session) Stats() Stats {
+	return Stats{
+		ClientMessages:   atomic.LoadInt64(&s.clientMessages),
+		UpstreamMessages: atomic.LoadInt64(&s.upstreamMessages),
+		ClientBytes:      atomic.LoadInt64(&s.clientBytes),
+		UpstreamBytes:    atomic.LoadInt64(&s.upstreamBytes),
+		Duration:         time.Since(s.Start),
+	}
+}
@@ -0,0 +1,330 @@
+package wsproxy_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gateway/gatewaytest"
+	"gateway/proxy/http_proxy/wsproxy"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRelay(t *testing.T) {
+	up := gatewaytest.NewWebSocketEcho(t, "!")
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{"websocket": [{"name": "ws", "target": %q}]}`, up.URL))
+
+	conn := gw.DialWebSocket(t, "ws", "/chat", http.Header{"Sec-Websocket-Protocol": {"echo"}})
+	if sp := conn.Subprotocol(); sp != "echo" {
+		t.Errorf("subprotocol = %q, want the one chosen by the upstream", sp)
+	}
+	for _, m := range []struct {
+		typ  int
+		data string
+	}{
+		{websocket.TextMessage, "hello"},
+		{websocket.BinaryMessage, "\x00\x01\x02"},
+		{websocket.TextMessage, strings.Repeat("x", 64<<10)},
+	} {
+		mt, data := roundTrip(t, conn, m.typ, m.data)
+		if mt != m.typ || string(data) != m.data+"!" {
+			t.Errorf("got type %d %q, want type %d %q", mt, abbrev(data), m.typ, abbrev([]byte(m.data+"!")))
+		}
+	}
+}
+
+// TestReadLimit 超过max_message_size的消息以1009关闭，比它小的消息照常转发
+func TestReadLimit(t *testing.T) {
+	up := gatewaytest.NewWebSocketEcho(t, "")
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{"websocket": [{"name": "ws", "target": %q, "max_message_size": 16}]}`, up.URL))
+
+	conn := gw.DialWebSocket(t, "ws", "/", nil)
+	if _, data := roundTrip(t, conn, websocket.TextMessage, "small"); string(data) != "small" {
+		t.Fatalf("got %q, want small", data)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 17))); err != nil {
+		t.Fatal(err)
+	}
+	assertCloseCode(t, conn, websocket.CloseMessageTooBig)
+}
+
+func TestHooks(t *testing.T) {
+	up := newRecordingUpstream(t)
+	p := wsproxy.NewWebSocketProxy(up.target)
+	var seen []wsproxy.Direction
+	p.Hooks = []wsproxy.MessageHook{
+		func(msg *wsproxy.Message) error {
+			seen = append(seen, msg.Direction)
+			switch string(msg.Data) {
+			case "drop":
+				return wsproxy.ErrDropMessage
+			case "forbidden":
+				return errors.New("forbidden word")
+			}
+			return nil
+		},
+		//钩子按顺序执行，后面的钩子看到前面的改写
+		func(msg *wsproxy.Message) error {
+			msg.Data = []byte(strings.ToUpper(string(msg.Data)))
+			return nil
+		},
+	}
+	conn := dial(t, serve(t, p))
+
+	//被丢弃的消息不到达上游，会话继续
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("drop")); err != nil {
+		t.Fatal(err)
+	}
+	//上游回显的消息也经过钩子，所以被改写了两次
+	if _, data := roundTrip(t, conn, websocket.TextMessage, "keep"); string(data) != "KEEP" {
+		t.Errorf("got %q, want KEEP", data)
+	}
+	want := []wsproxy.Direction{wsproxy.ClientToUpstream, wsproxy.ClientToUpstream, wsproxy.UpstreamToClient}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("hook saw %v, want %v", seen, want)
+	}
+
+	//其它错误以1008关闭两端
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("forbidden")); err != nil {
+		t.Fatal(err)
+	}
+	assertCloseCode(t, conn, websocket.ClosePolicyViolation)
+	if ce := up.closeError(t); ce.Code != websocket.ClosePolicyViolation {
+		t.Errorf("upstream close code = %d, want %d", ce.Code, websocket.ClosePolicyViolation)
+	}
+}
+
+func TestCloseCodeForwarding(t *testing.T) {
+	t.Run("client", func(t *testing.T) {
+		up := newRecordingUpstream(t)
+		conn := dial(t, serve(t, wsproxy.NewWebSocketProxy(up.target)))
+		//已经发过关闭帧，默认的回调回应关闭帧会失败
+		conn.SetCloseHandler(func(int, string) error { return nil })
+		msg := websocket.FormatCloseMessage(4001, "bye")
+		if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if ce := up.closeError(t); ce.Code != 4001 || ce.Text != "bye" {
+			t.Errorf("upstream got %d %q, want 4001 \"bye\"", ce.Code, ce.Text)
+		}
+		//上游回应的关闭帧也转发回客户端
+		assertCloseCode(t, conn, 4001)
+	})
+	t.Run("upstream", func(t *testing.T) {
+		up := newRecordingUpstream(t)
+		conn := dial(t, serve(t, wsproxy.NewWebSocketProxy(up.target)))
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("close 4002")); err != nil {
+			t.Fatal(err)
+		}
+		assertCloseCode(t, conn, 4002)
+	})
+}
+
+// TestPingPong ping和pong由真正的对端回应，网关只负责转发
+func TestPingPong(t *testing.T) {
+	up := newRecordingUpstream(t)
+	conn := dial(t, serve(t, wsproxy.NewWebSocketProxy(up.target)))
+	pongs := make(chan string, 1)
+	conn.SetPongHandler(func(data string) error {
+		pongs <- data
+		return nil
+	})
+	//控制帧的回调只在读取时执行
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := conn.WriteControl(websocket.PingMessage, []byte("p1"), time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-up.pings:
+		if data != "p1" {
+			t.Errorf("upstream got ping %q, want p1", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ping was not forwarded to the upstream")
+	}
+	select {
+	case data := <-pongs:
+		if data != "p1" {
+			t.Errorf("client got pong %q, want p1", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the upstream's pong was not forwarded to the client")
+	}
+}
+
+// TestHandshakePolicy 握手策略不通过时返回HTTP错误，认证用的令牌不转发给上游
+func TestHandshakePolicy(t *testing.T) {
+	up := newRecordingUpstream(t)
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{"websocket": [{"name": "ws", "target": %q,
+		"allowed_origins": ["https://*.example.com"], "tokens": {"t1": "alice"}, "max_sessions_per_user": 1}]}`,
+		up.target.String()))
+	addr := "ws://" + gw.Addr(t, "ws")
+	origin := func(o string) http.Header { return http.Header{"Origin": {o}} }
+
+	for _, c := range []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+	}{
+		{"origin not allowed", "/ws?token=t1", origin("https://evil.test"), http.StatusForbidden},
+		{"missing token", "/ws", origin("https://app.example.com"), http.StatusUnauthorized},
+		{"unknown token", "/ws?token=t2", origin("https://app.example.com"), http.StatusUnauthorized},
+	} {
+		_, res, err := websocket.DefaultDialer.Dial(addr+c.path, c.header)
+		if err == nil || res == nil || res.StatusCode != c.status {
+			t.Errorf("%s: got %v, want status %d", c.name, err, c.status)
+		}
+	}
+
+	header := origin("https://app.example.com")
+	header.Set("Cookie", "theme=dark")
+	conn := gw.DialWebSocket(t, "ws", "/ws?room=7&token=t1&x=%2F", header)
+	select {
+	case r := <-up.handshakes:
+		if r.URL.RawQuery != "room=7&x=%2F" || r.Header.Get("Cookie") != "theme=dark" {
+			t.Errorf("upstream got query %q cookie %q, want the token removed", r.URL.RawQuery, r.Header.Get("Cookie"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream saw no handshake")
+	}
+	if _, data := roundTrip(t, conn, websocket.TextMessage, "hi"); string(data) != "hi" {
+		t.Errorf("got %q, want hi", data)
+	}
+
+	//同一个用户的第二个会话超过了限制
+	header.Set("Authorization", "Bearer t1")
+	if _, res, err := websocket.DefaultDialer.Dial(addr+"/ws", header); err == nil || res == nil || res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second session: got %v, want status 429", err)
+	}
+}
+
+// recordingUpstream 测试用的上游：记录握手请求、收到的ping和关闭帧，把消息原样写回，
+// 收到"close <code>"时以这个关闭码主动关闭
+type recordingUpstream struct {
+	target     *url.URL
+	handshakes chan *http.Request
+	pings      chan string
+	closes     chan *websocket.CloseError
+}
+
+func newRecordingUpstream(t *testing.T) *recordingUpstream {
+	t.Helper()
+	up := &recordingUpstream{handshakes: make(chan *http.Request, 8), pings: make(chan string, 8),
+		closes: make(chan *websocket.CloseError, 1)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up.handshakes <- r
+		//Origin由网关检查
+		upgrader := &websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetPingHandler(func(data string) error {
+			up.pings <- data
+			return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		for {
+			mt, data, err := conn.ReadMessage()
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				up.closes <- ce
+			}
+			if err != nil {
+				return
+			}
+			if code, ok := strings.CutPrefix(string(data), "close "); ok {
+				n, _ := strconv.Atoi(code)
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(n, "later"), time.Now().Add(time.Second))
+				continue
+			}
+			if err := conn.WriteMessage(mt, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	up.target, _ = url.Parse(srv.URL)
+	return up
+}
+
+func (up *recordingUpstream) closeError(t *testing.T) *websocket.CloseError {
+	t.Helper()
+	select {
+	case ce := <-up.closes:
+		return ce
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream received no close frame")
+		return nil
+	}
+}
+
+// serve 不经过配置直接运行代理，返回ws地址
+func serve(t *testing.T, p *wsproxy.WebSocketProxy) string {
+	t.Helper()
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, u string) *websocket.Conn {
+	t.Helper()
+	conn, res, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		if res != nil {
+			t.Fatalf("handshake: %v (status %d)", err, res.StatusCode)
+		}
+		t.Fatalf("handshake: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func roundTrip(t *testing.T, conn *websocket.Conn, typ int, data string) (int, []byte) {
+	t.Helper()
+	if err := conn.WriteMessage(typ, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	mt, got, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return mt, got
+}
+
+// assertCloseCode 读到的下一帧必须是带有code的关闭帧
+func assertCloseCode(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("got %q, %v, want close %d", abbrev(data), err, code)
+	}
+	if ce.Code != code {
+		t.Errorf("close code = %d (%q), want %d", ce.Code, ce.Text, code)
+	}
+}
+
+func abbrev(b []byte) []byte {
+	if len(b) > 40 {
+		return append(append([]byte(nil), b[:40]...), "..."...)
+	}
+	return b
+}
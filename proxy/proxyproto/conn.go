@@ -0,0 +1,169 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultHeaderTimeout 读取头部的默认超时时间，防止一直不发数据的连接让RemoteAddr永远阻塞
+const DefaultHeaderTimeout = 5 * time.Second
+
+// Config 解析头部时的配置
+type Config struct {
+	//TrustedCIDRs 只有来自这些网段的连接才会解析头部，为空时不信任任何来源，所有连接原样透传
+	//不受信任的连接原样透传，防止直连的客户端伪造头部冒充别的地址
+	TrustedCIDRs []*net.IPNet
+	//Required 受信任的连接必须带头部，否则返回ErrNoProxyHeader
+	Required bool
+	//HeaderTimeout 读取头部的超时时间，0表示使用DefaultHeaderTimeout
+	HeaderTimeout time.Duration
+}
+
+// Trusted 判断地址是否在受信任网段内，Config为nil或者没有网段时总是返回false
+func (cfg *Config) Trusted(addr net.Addr) bool {
+	if cfg == nil || len(cfg.TrustedCIDRs) == 0 {
+		return false
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range cfg.TrustedCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// ParseCIDRs 把字符串解析为网段，单个IP按/32或/128处理
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Conn 包装了net.Conn，在第一次读取或者获取地址时解析头部
+// 解析是惰性的，这样Accept循环不会被某个迟迟不发数据的连接阻塞
+type Conn struct {
+	net.Conn
+	br  *bufio.Reader
+	cfg *Config
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// NewConn 创建一个会解析PROXY协议头部的连接
+func NewConn(c net.Conn, cfg *Config) *Conn {
+	return &Conn{Conn: c, br: bufio.NewReader(c), cfg: cfg}
+}
+
+// ReadHeader 主动触发头部解析，返回解析结果
+// 没有头部且不要求必须有时，返回nil, nil
+func (c *Conn) ReadHeader() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) readHeader() {
+	//不受信任的来源不解析，直接透传
+	if !c.cfg.Trusted(c.Conn.RemoteAddr()) {
+		return
+	}
+	//能走到这里cfg一定不为nil
+	timeout := c.cfg.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	//这里清空超时，之后的超时交给调用方自己设置
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	h, err := ReadHeader(c.br)
+	if errors.Is(err, ErrNoProxyHeader) && !c.cfg.Required {
+		return
+	}
+	c.header, c.err = h, err
+}
+
+// Read 先解析头部，再从缓冲区读取头部之后的数据
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr 有PROXY头部时返回头部中的源地址，也就是真实的客户端地址
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Command == CmdProxy && c.header.SourceAddr != nil {
+		return c.header.SourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 有PROXY头部时返回头部中的目标地址，也就是客户端连接的负载均衡地址
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && c.header.Command == CmdProxy && c.header.DestAddr != nil {
+		return c.header.DestAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// NetConn 返回被包装的原始连接，和tls.Conn.NetConn的命名一致
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Listener 包装了net.Listener，Accept返回的连接都是*Conn
+// 可以直接交给http.Server.Serve使用，让HTTP监听也支持PROXY协议
+type Listener struct {
+	net.Listener
+	//Config 为nil或者没有受信任的网段时不解析任何头部
+	Config *Config
+}
+
+// Accept 接收连接并包装，头部在连接被读取时才解析
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, l.Config), nil
+}
@@ -0,0 +1,109 @@
+package proxyproto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// accept 在回环地址上建立一条连接，客户端写入data，返回服务端包装后的连接
+func accept(t *testing.T, cfg *Config, data string) *Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if data != "" {
+		if _, err := io.WriteString(client, data); err != nil {
+			t.Fatal(err)
+		}
+		client.(*net.TCPConn).CloseWrite()
+	}
+	c, err := (&Listener{Listener: ln, Config: cfg}).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c.(*Conn)
+}
+
+func cidrs(t *testing.T, list ...string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+func TestConnTrust(t *testing.T) {
+	const header = "PROXY TCP4 192.0.2.1 198.51.100.2 1000 443\r\n"
+	cases := []struct {
+		name string
+		cfg  *Config
+		//trusted 为true时头部被解析，否则头部作为普通数据透传
+		trusted bool
+	}{
+		{"nil config", nil, false},
+		{"no cidrs", &Config{}, false},
+		{"untrusted cidr", &Config{TrustedCIDRs: cidrs(t, "10.0.0.0/8", "::1")}, false},
+		{"trusted cidr", &Config{TrustedCIDRs: cidrs(t, "127.0.0.0/8")}, true},
+		{"trusted host", &Config{TrustedCIDRs: cidrs(t, "127.0.0.1")}, true},
+	}
+	for _, c := range cases {
+		conn := accept(t, c.cfg, header+"hello")
+		body, err := io.ReadAll(conn)
+		if err != nil {
+			t.Errorf("%s: read: %v", c.name, err)
+			continue
+		}
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		if c.trusted {
+			if ip != "192.0.2.1" || string(body) != "hello" {
+				t.Errorf("%s: got %s %q, want 192.0.2.1 \"hello\"", c.name, ip, body)
+			}
+			continue
+		}
+		if ip != "127.0.0.1" || string(body) != header+"hello" {
+			t.Errorf("%s: got %s %q, want the peer address and the header passed through", c.name, ip, body)
+		}
+	}
+}
+
+func TestConnRequired(t *testing.T) {
+	cfg := &Config{TrustedCIDRs: cidrs(t, "127.0.0.0/8"), Required: true}
+	if _, err := accept(t, cfg, "hello").ReadHeader(); !errors.Is(err, ErrNoProxyHeader) {
+		t.Errorf("required without header: err = %v, want ErrNoProxyHeader", err)
+	}
+	cfg.Required = false
+	conn := accept(t, cfg, "hello")
+	if h, err := conn.ReadHeader(); h != nil || err != nil {
+		t.Errorf("optional without header: got %v, %v", h, err)
+	}
+	if body, _ := io.ReadAll(conn); string(body) != "hello" {
+		t.Errorf("optional without header: read %q", body)
+	}
+}
+
+// TestConnHeaderTimeout 受信任的来源连上来不发数据，不能让RemoteAddr一直阻塞
+func TestConnHeaderTimeout(t *testing.T) {
+	cfg := &Config{TrustedCIDRs: cidrs(t, "127.0.0.0/8"), HeaderTimeout: 50 * time.Millisecond}
+	conn := accept(t, cfg, "")
+	start := time.Now()
+	_, err := conn.ReadHeader()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("ReadHeader took %v", d)
+	}
+}
@@ -0,0 +1,368 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol 协议（HAProxy 提出）
+// 四层负载均衡把连接转发给网关后，网关看到的RemoteAddr是负载均衡的地址
+// 负载均衡在连接最前面写入一个头部，告诉下游真实的客户端地址和目标地址
+// v1：文本格式，例如 "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+// v2：二进制格式，以12字节的固定签名开头
+
+var (
+	// ErrNoProxyHeader 连接开头不是PROXY协议头部
+	ErrNoProxyHeader = errors.New("proxyproto: no PROXY protocol header")
+	// ErrInvalidHeader 头部格式错误
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+)
+
+// v2Signature v2头部的固定签名
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1Prefix v1头部的固定前缀
+var v1Prefix = []byte("PROXY ")
+
+const (
+	// v1MaxLength v1头部最长107字节（包括结尾的\r\n）
+	v1MaxLength = 107
+	// v2HeaderLength v2固定部分：签名12字节 + 版本命令1字节 + 地址族协议1字节 + 长度2字节
+	v2HeaderLength = 16
+)
+
+// Command 头部命令
+type Command byte
+
+const (
+	// CmdLocal 负载均衡自己发起的连接（比如健康检查），地址信息应被忽略
+	CmdLocal Command = 0x0
+	// CmdProxy 代理的连接，地址信息就是真实的客户端和目标地址
+	CmdProxy Command = 0x1
+)
+
+// 地址族和传输协议，对应v2头部第14个字节的高4位和低4位
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+
+	transportUnspec = 0x0
+	transportStream = 0x1
+	transportDgram  = 0x2
+)
+
+// Header PROXY协议头部解析结果
+type Header struct {
+	Version    byte    //1或2
+	Command    Command //LOCAL或PROXY
+	SourceAddr net.Addr
+	DestAddr   net.Addr
+	//TLVs v2中地址之后的扩展字段，这里只保留原始字节，不做解析
+	TLVs []byte
+}
+
+// ReadHeader 从br中读取PROXY协议头部
+// 没有头部时返回ErrNoProxyHeader，此时br中的数据没有被消费
+// 逐字节Peek，是为了在客户端先发的数据比签名短的时候不会一直阻塞
+func ReadHeader(br *bufio.Reader) (*Header, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v2Signature[0]:
+		if !peekPrefix(br, v2Signature) {
+			return nil, ErrNoProxyHeader
+		}
+		return readV2(br)
+	case v1Prefix[0]:
+		if !peekPrefix(br, v1Prefix) {
+			return nil, ErrNoProxyHeader
+		}
+		return readV1(br)
+	}
+	return nil, ErrNoProxyHeader
+}
+
+// peekPrefix 逐字节比较，一旦不相同立刻返回
+func peekPrefix(br *bufio.Reader, prefix []byte) bool {
+	for i := 1; i <= len(prefix); i++ {
+		b, err := br.Peek(i)
+		if err != nil || !bytes.Equal(b, prefix[:i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func readV1(br *bufio.Reader) (*Header, error) {
+	//最多读取107个字节，找不到\r\n就认为格式错误，防止恶意的超长头部
+	var line []byte
+	for len(line) < v1MaxLength {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	//PROXY TCP4 源地址 目标地址 源端口 目标端口
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1, Command: CmdProxy}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		//UNKNOWN表示负载均衡不知道地址，按LOCAL处理
+		h.Command = CmdLocal
+		return h, nil
+	}
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	src, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	h.SourceAddr, h.DestAddr = src, dst
+	return h, nil
+}
+
+func parseV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrInvalidHeader
+	}
+	//TCP4必须是IPv4地址，TCP6必须是IPv6地址
+	switch proto {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, ErrInvalidHeader
+		}
+	case "TCP6":
+		if ip.To4() != nil {
+			return nil, ErrInvalidHeader
+		}
+	default:
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(br *bufio.Reader) (*Header, error) {
+	var fixed [v2HeaderLength]byte
+	if _, err := io.ReadFull(br, fixed[:]); err != nil {
+		return nil, err
+	}
+	//高4位是版本，必须是2；低4位是命令
+	if fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+	h := &Header{Version: 2, Command: Command(fixed[12] & 0x0F)}
+	if h.Command != CmdLocal && h.Command != CmdProxy {
+		return nil, ErrInvalidHeader
+	}
+
+	//剩余部分的长度，包括地址和TLV
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+	//LOCAL命令直接忽略地址
+	if h.Command == CmdLocal {
+		return h, nil
+	}
+
+	family, transport := fixed[13]>>4, fixed[13]&0x0F
+	var addrLen int
+	switch family {
+	case familyInet:
+		addrLen = 12
+		if len(payload) < addrLen {
+			return nil, ErrInvalidHeader
+		}
+		h.SourceAddr = v2Addr(transport, payload[0:4], payload[8:10])
+		h.DestAddr = v2Addr(transport, payload[4:8], payload[10:12])
+	case familyInet6:
+		addrLen = 36
+		if len(payload) < addrLen {
+			return nil, ErrInvalidHeader
+		}
+		h.SourceAddr = v2Addr(transport, payload[0:16], payload[32:34])
+		h.DestAddr = v2Addr(transport, payload[16:32], payload[34:36])
+	case familyUnix:
+		addrLen = 216
+		if len(payload) < addrLen {
+			return nil, ErrInvalidHeader
+		}
+		h.SourceAddr = &net.UnixAddr{Name: cString(payload[0:108]), Net: "unix"}
+		h.DestAddr = &net.UnixAddr{Name: cString(payload[108:216]), Net: "unix"}
+	default:
+		//UNSPEC：地址未知，保留原始连接的地址
+	}
+	h.TLVs = payload[addrLen:]
+	return h, nil
+}
+
+func v2Addr(transport byte, ip, port []byte) net.Addr {
+	p := int(binary.BigEndian.Uint16(port))
+	if transport == transportDgram {
+		return &net.UDPAddr{IP: net.IP(append([]byte(nil), ip...)), Port: p}
+	}
+	return &net.TCPAddr{IP: net.IP(append([]byte(nil), ip...)), Port: p}
+}
+
+// cString 截掉unix地址末尾补齐的\x00
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// Format 把头部序列化为对应版本的字节
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1()
+	case 2:
+		return h.formatV2()
+	}
+	return nil, fmt.Errorf("proxyproto: unsupported version %d", h.Version)
+}
+
+// WriteTo 把头部写入w，实现io.WriterTo接口
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	src, srcOK := h.SourceAddr.(*net.TCPAddr)
+	dst, dstOK := h.DestAddr.(*net.TCPAddr)
+	//v1只支持TCP，其它情况一律写UNKNOWN
+	if h.Command == CmdLocal || !srcOK || !dstOK {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	proto := "TCP4"
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if (srcIP == nil) != (dstIP == nil) {
+		//v1的两个地址必须是同一个地址族，IPv4地址写在TCP6后面会被对方拒绝
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	if srcIP == nil {
+		proto = "TCP6"
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, src.Port, dst.Port)), nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, v2HeaderLength+36))
+	buf.Write(v2Signature)
+	buf.WriteByte(0x20 | byte(h.Command))
+
+	var addrs []byte
+	famByte := byte(familyUnspec<<4 | transportUnspec)
+	if h.Command == CmdProxy {
+		famByte, addrs = v2Addrs(h.SourceAddr, h.DestAddr)
+	}
+	buf.WriteByte(famByte)
+
+	length := len(addrs) + len(h.TLVs)
+	if length > 0xFFFF {
+		return nil, ErrInvalidHeader
+	}
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(length))
+	buf.Write(l[:])
+	buf.Write(addrs)
+	buf.Write(h.TLVs)
+	return buf.Bytes(), nil
+}
+
+// v2Addrs 按地址类型生成v2的地址族字节和地址部分
+func v2Addrs(src, dst net.Addr) (byte, []byte) {
+	var (
+		srcIP, dstIP     net.IP
+		srcPort, dstPort int
+		transport        byte
+	)
+	switch s := src.(type) {
+	case *net.TCPAddr:
+		d, ok := dst.(*net.TCPAddr)
+		if !ok {
+			return familyUnspec << 4, nil
+		}
+		srcIP, dstIP, srcPort, dstPort, transport = s.IP, d.IP, s.Port, d.Port, transportStream
+	case *net.UDPAddr:
+		d, ok := dst.(*net.UDPAddr)
+		if !ok {
+			return familyUnspec << 4, nil
+		}
+		srcIP, dstIP, srcPort, dstPort, transport = s.IP, d.IP, s.Port, d.Port, transportDgram
+	case *net.UnixAddr:
+		d, ok := dst.(*net.UnixAddr)
+		if !ok {
+			return familyUnspec << 4, nil
+		}
+		addrs := make([]byte, 216)
+		copy(addrs[0:108], s.Name)
+		copy(addrs[108:216], d.Name)
+		return familyUnix<<4 | transportStream, addrs
+	default:
+		return familyUnspec << 4, nil
+	}
+
+	if srcIP.To16() == nil || dstIP.To16() == nil {
+		return familyUnspec << 4, nil
+	}
+	var addrs []byte
+	family := byte(familyInet)
+	if s4, d4 := srcIP.To4(), dstIP.To4(); s4 != nil && d4 != nil {
+		addrs = append(append(addrs, s4...), d4...)
+	} else {
+		family = familyInet6
+		addrs = append(append(addrs, srcIP.To16()...), dstIP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(srcPort))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dstPort))
+	return family<<4 | transport, addrs
+}
+
+// HeaderFor 根据客户端连接生成需要发给上游的头部
+// 源地址是客户端地址，目标地址是客户端连接到的网关地址
+func HeaderFor(version byte, conn net.Conn) *Header {
+	return &Header{
+		Version:    version,
+		Command:    CmdProxy,
+		SourceAddr: conn.RemoteAddr(),
+		DestAddr:   conn.LocalAddr(),
+	}
+}
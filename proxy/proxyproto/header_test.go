@@ -0,0 +1,224 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func read(s string) (*Header, *bufio.Reader, error) {
+	br := bufio.NewReader(strings.NewReader(s))
+	h, err := ReadHeader(br)
+	return h, br, err
+}
+
+func TestReadV1(t *testing.T) {
+	cases := []struct {
+		name, in string
+		err      error
+		src, dst string
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", nil, "192.0.2.1:56324", "198.51.100.2:443"},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 1 2\r\n", nil, "[2001:db8::1]:1", "[2001:db8::2]:2"},
+		{"unknown", "PROXY UNKNOWN\r\n", nil, "", ""},
+		{"unknown with addresses", "PROXY UNKNOWN 2001:db8::1 2001:db8::2 1 2\r\n", nil, "", ""},
+		{"tcp4 with ipv6 source", "PROXY TCP4 2001:db8::1 198.51.100.2 1 2\r\n", ErrInvalidHeader, "", ""},
+		{"tcp4 with ipv6 destination", "PROXY TCP4 192.0.2.1 2001:db8::2 1 2\r\n", ErrInvalidHeader, "", ""},
+		{"tcp6 with ipv4 source", "PROXY TCP6 192.0.2.1 2001:db8::2 1 2\r\n", ErrInvalidHeader, "", ""},
+		{"unknown protocol", "PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n", ErrInvalidHeader, "", ""},
+		{"port out of range", "PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n", ErrInvalidHeader, "", ""},
+		{"missing port", "PROXY TCP4 192.0.2.1 198.51.100.2 443\r\n", ErrInvalidHeader, "", ""},
+		{"bare newline", "PROXY TCP4 192.0.2.1 198.51.100.2 1 2\n", ErrInvalidHeader, "", ""},
+		{"too long", "PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n", ErrInvalidHeader, "", ""},
+		{"truncated", "PROXY TCP4 192.0.2.1", io.EOF, "", ""},
+	}
+	for _, c := range cases {
+		h, _, err := read(c.in)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if h.Version != 1 {
+			t.Errorf("%s: version = %d", c.name, h.Version)
+		}
+		if c.src == "" {
+			if h.Command != CmdLocal || h.SourceAddr != nil {
+				t.Errorf("%s: got command %d source %v, want LOCAL without addresses", c.name, h.Command, h.SourceAddr)
+			}
+			continue
+		}
+		if h.Command != CmdProxy || h.SourceAddr.String() != c.src || h.DestAddr.String() != c.dst {
+			t.Errorf("%s: got %v -> %v, want %s -> %s", c.name, h.SourceAddr, h.DestAddr, c.src, c.dst)
+		}
+	}
+}
+
+// TestReadV1MaxLength 协议规定的最长头部正好107字节
+func TestReadV1MaxLength(t *testing.T) {
+	line := "PROXY UNKNOWN ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"
+	if len(line) != v1MaxLength {
+		t.Fatalf("test line is %d bytes", len(line))
+	}
+	if _, _, err := read(line); err != nil {
+		t.Errorf("107-byte header: %v", err)
+	}
+	//多一个字节就找不到结尾，不能继续读下去
+	if _, _, err := read(strings.Replace(line, "PROXY UNKNOWN ", "PROXY UNKNOWN  ", 1)); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("108-byte header: err = %v, want ErrInvalidHeader", err)
+	}
+}
+
+// v2 拼出一个v2头部，length是长度字段的值，和payload的实际长度可以不同
+func v2(verCmd, famProto byte, length int, payload []byte) string {
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, verCmd, famProto)
+	b = binary.BigEndian.AppendUint16(b, uint16(length))
+	return string(append(b, payload...))
+}
+
+func TestReadV2(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb}
+	inet6 := make([]byte, 36)
+	copy(inet6[0:16], net.ParseIP("2001:db8::1"))
+	copy(inet6[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(inet6[32:], 1)
+	binary.BigEndian.PutUint16(inet6[34:], 2)
+	unix := make([]byte, 216)
+	copy(unix, "/run/src.sock")
+	copy(unix[108:], "/run/dst.sock")
+
+	cases := []struct {
+		name, in string
+		err      error
+		src, dst string
+	}{
+		{"tcp4", v2(0x21, 0x11, 12, inet), nil, "192.0.2.1:56324", "198.51.100.2:443"},
+		{"udp4", v2(0x21, 0x12, 12, inet), nil, "192.0.2.1:56324", "198.51.100.2:443"},
+		{"tcp6", v2(0x21, 0x21, 36, inet6), nil, "[2001:db8::1]:1", "[2001:db8::2]:2"},
+		{"unix", v2(0x21, 0x31, 216, unix), nil, "/run/src.sock", "/run/dst.sock"},
+		{"local ignores addresses", v2(0x20, 0x11, 12, inet), nil, "", ""},
+		{"unspec", v2(0x21, 0x00, 0, nil), nil, "", ""},
+		{"version 1", v2(0x11, 0x11, 12, inet), ErrInvalidHeader, "", ""},
+		{"unknown command", v2(0x22, 0x11, 12, inet), ErrInvalidHeader, "", ""},
+		{"length shorter than inet addresses", v2(0x21, 0x11, 11, inet[:11]), ErrInvalidHeader, "", ""},
+		{"length shorter than inet6 addresses", v2(0x21, 0x21, 12, inet), ErrInvalidHeader, "", ""},
+		{"length shorter than unix addresses", v2(0x21, 0x31, 215, unix[:215]), ErrInvalidHeader, "", ""},
+		{"truncated payload", v2(0x21, 0x11, 12, inet[:5]), io.ErrUnexpectedEOF, "", ""},
+		{"truncated fixed part", v2(0x21, 0x11, 12, nil)[:14], io.ErrUnexpectedEOF, "", ""},
+	}
+	for _, c := range cases {
+		h, _, err := read(c.in)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.src == "" {
+			if h.SourceAddr != nil || h.DestAddr != nil {
+				t.Errorf("%s: got addresses %v -> %v, want none", c.name, h.SourceAddr, h.DestAddr)
+			}
+			continue
+		}
+		if h.SourceAddr.String() != c.src || h.DestAddr.String() != c.dst {
+			t.Errorf("%s: got %v -> %v, want %s -> %s", c.name, h.SourceAddr, h.DestAddr, c.src, c.dst)
+		}
+	}
+}
+
+// TestReadV2Length 长度字段之后的TLV保留下来，再之后的数据留在缓冲区里
+func TestReadV2Length(t *testing.T) {
+	tlv := []byte{0x04, 0x00, 0x01, 'x'}
+	in := v2(0x21, 0x11, 12+len(tlv), append([]byte{192, 0, 2, 1, 198, 51, 100, 2, 0, 1, 0, 2}, tlv...)) + "hello"
+	h, br, err := read(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h.TLVs, tlv) {
+		t.Errorf("TLVs = %x, want %x", h.TLVs, tlv)
+	}
+	rest, _ := io.ReadAll(br)
+	if string(rest) != "hello" {
+		t.Errorf("data after header = %q, want hello", rest)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, in := range []string{"GET / HTTP/1.1\r\n\r\n", "PROXX TCP4", "\r\n\r\nhello", "P"} {
+		_, br, err := read(in)
+		if !errors.Is(err, ErrNoProxyHeader) {
+			t.Errorf("%q: err = %v, want ErrNoProxyHeader", in, err)
+			continue
+		}
+		//没有头部时一个字节都不能消费
+		if rest, _ := io.ReadAll(br); string(rest) != in {
+			t.Errorf("%q: left %q in the reader", in, rest)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+	cases := []struct {
+		name     string
+		h        Header
+		src, dst string //为空表示读回来是LOCAL或者没有地址
+	}{
+		{"v1 tcp4", Header{Version: 1, Command: CmdProxy, SourceAddr: tcp("192.0.2.1:1"), DestAddr: tcp("198.51.100.2:2")}, "192.0.2.1:1", "198.51.100.2:2"},
+		{"v1 tcp6", Header{Version: 1, Command: CmdProxy, SourceAddr: tcp("[2001:db8::1]:1"), DestAddr: tcp("[2001:db8::2]:2")}, "[2001:db8::1]:1", "[2001:db8::2]:2"},
+		{"v1 mixed families", Header{Version: 1, Command: CmdProxy, SourceAddr: tcp("192.0.2.1:1"), DestAddr: tcp("[2001:db8::2]:2")}, "", ""},
+		{"v1 local", Header{Version: 1, Command: CmdLocal}, "", ""},
+		{"v2 tcp4", Header{Version: 2, Command: CmdProxy, SourceAddr: tcp("192.0.2.1:1"), DestAddr: tcp("198.51.100.2:2")}, "192.0.2.1:1", "198.51.100.2:2"},
+		{"v2 tcp6", Header{Version: 2, Command: CmdProxy, SourceAddr: tcp("[2001:db8::1]:1"), DestAddr: tcp("[2001:db8::2]:2")}, "[2001:db8::1]:1", "[2001:db8::2]:2"},
+		{"v2 udp", Header{Version: 2, Command: CmdProxy, SourceAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}, DestAddr: &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 53}}, "192.0.2.1:53", "198.51.100.2:53"},
+		{"v2 unix", Header{Version: 2, Command: CmdProxy, SourceAddr: &net.UnixAddr{Name: "/a", Net: "unix"}, DestAddr: &net.UnixAddr{Name: "/b", Net: "unix"}}, "/a", "/b"},
+		{"v2 local", Header{Version: 2, Command: CmdLocal}, "", ""},
+	}
+	for _, c := range cases {
+		b, err := c.h.Format()
+		if err != nil {
+			t.Errorf("%s: Format: %v", c.name, err)
+			continue
+		}
+		h, br, err := read(string(b) + "x")
+		if err != nil {
+			t.Errorf("%s: ReadHeader(%q): %v", c.name, b, err)
+			continue
+		}
+		if rest, _ := io.ReadAll(br); string(rest) != "x" {
+			t.Errorf("%s: left %q after the header", c.name, rest)
+		}
+		if h.Version != c.h.Version {
+			t.Errorf("%s: version = %d", c.name, h.Version)
+		}
+		if c.src == "" {
+			if h.SourceAddr != nil {
+				t.Errorf("%s: got source %v, want none", c.name, h.SourceAddr)
+			}
+			continue
+		}
+		if h.SourceAddr == nil || h.SourceAddr.String() != c.src || h.DestAddr.String() != c.dst {
+			t.Errorf("%s: got %v -> %v, want %s -> %s", c.name, h.SourceAddr, h.DestAddr, c.src, c.dst)
+		}
+	}
+
+	if _, err := (&Header{Version: 3}).Format(); err == nil {
+		t.Error("version 3: want an error")
+	}
+	big := Header{Version: 2, Command: CmdLocal, TLVs: make([]byte, 0x10000)}
+	if _, err := big.Format(); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("oversized TLVs: err = %v, want ErrInvalidHeader", err)
+	}
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶限流器
+// 桶的容量是burst，每秒向桶中放入rate个令牌，每次请求消耗一个令牌
+// 桶空了就拒绝（Allow）或者等待（Wait）
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64   //每秒产生的令牌数
+	burst  float64   //桶的容量
+	tokens float64   //当前令牌数
+	last   time.Time //上次计算令牌的时间
+}
+
+// NewLimiter 创建限流器，初始时桶是满的
+// burst小于1时按1处理，否则一个令牌都放不下
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill 按照距离上次的时间补充令牌，调用方需要持有锁
+func (l *Limiter) refill(now time.Time) {
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed > 0 {
+		l.tokens += elapsed * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+}
+
+// Allow 有令牌时消耗一个并返回true，没有时返回false
+func (l *Limiter) Allow() bool {
+	return l.AllowN(time.Now(), 1)
+}
+
+// AllowN 一次消耗n个令牌，比如按字节数限速时n就是字节数
+func (l *Limiter) AllowN(now time.Time, n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// reserve 预先扣除n个令牌，返回需要等待的时间，令牌可以被扣成负数
+func (l *Limiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 || l.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait 等待直到拿到一个令牌，ctx结束时返回ctx的错误
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.WaitN(ctx, 1)
+}
+
+// WaitN 等待直到拿到n个令牌
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	d := l.reserve(time.Now(), n)
+	if d == 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 下游故障切换：
+// 1、轮询选择起始地址，把最近拨号失败的地址排到后面
+// 2、每个地址的拨号受DialTimeout限制，所有尝试受ConnectBudget限制
+// 3、失败的地址记录失败时间，FailTimeout内视为不健康
+// 4、全部失败时返回*DialError，交给OnError
+
+// DialAttempt 一次拨号尝试
+type DialAttempt struct {
+	Addr     string
+	Err      error
+	Duration time.Duration
+}
+
+// DialError 所有下游地址都拨号失败
+type DialError struct {
+	Attempts []DialAttempt
+}
+
+func (e *DialError) Error() string {
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		parts = append(parts, fmt.Sprintf("%s: %v", a.Addr, a.Err))
+	}
+	return "tcp proxy: all upstreams failed: " + strings.Join(parts, "; ")
+}
+
+// Unwrap 返回最后一次尝试的错误，方便用errors.Is判断超时等原因
+func (e *DialError) Unwrap() error {
+	if len(e.Attempts) == 0 {
+		return nil
+	}
+	return e.Attempts[len(e.Attempts)-1].Err
+}
+
+// upstreamHealth 记录每个地址最近一次拨号失败的时间
+type upstreamHealth struct {
+	mu     sync.Mutex
+	failed map[string]time.Time
+	rr     uint32
+}
+
+// newUpstreamHealth 每个TCPReverseProxy有自己的健康记录，不同代理的同一个地址互不影响
+func newUpstreamHealth() *upstreamHealth {
+	return &upstreamHealth{failed: make(map[string]time.Time)}
+}
+
+func (h *upstreamHealth) markFailed(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failed[addr] = time.Now()
+}
+
+func (h *upstreamHealth) markOK(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.failed, addr)
+}
+
+// order 按轮询的起点排列地址，健康的在前，不健康的按失败时间从早到晚排在后面
+func (h *upstreamHealth) order(addrs []string, failTimeout time.Duration) []string {
+	n := uint32(len(addrs))
+	start := atomic.AddUint32(&h.rr, 1)
+	healthy := make([]string, 0, n)
+	var unhealthy []string
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := uint32(0); i < n; i++ {
+		addr := addrs[(start+i)%n]
+		if t, ok := h.failed[addr]; ok && time.Since(t) < failTimeout {
+			unhealthy = append(unhealthy, addr)
+			continue
+		}
+		healthy = append(healthy, addr)
+	}
+	for i := 1; i < len(unhealthy); i++ {
+		for j := i; j > 0 && h.failed[unhealthy[j]].Before(h.failed[unhealthy[j-1]]); j-- {
+			unhealthy[j], unhealthy[j-1] = unhealthy[j-1], unhealthy[j]
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// upstreams 返回需要尝试的地址，addr是OnConnect选择的地址
+func (py *TCPReverseProxy) upstreams(addr string) []string {
+	if addr != "" {
+		return []string{addr}
+	}
+	if len(py.Addrs) == 0 {
+		return []string{py.Addr}
+	}
+	failTimeout := py.FailTimeout
+	if failTimeout == 0 {
+		failTimeout = 10 * time.Second
+	}
+	return py.health.order(py.Addrs, failTimeout)
+}
+
+// dialUpstream 依次拨号，返回第一个成功的连接
+func (py *TCPReverseProxy) dialUpstream(ctx context.Context, addr string) (net.Conn, error) {
+	if py.ConnectBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, py.ConnectBudget)
+		defer cancel()
+	}
+
+	dialErr := &DialError{}
+	for _, addr := range py.upstreams(addr) {
+		//总时间已经用完，不再尝试
+		if ctx.Err() != nil {
+			dialErr.Attempts = append(dialErr.Attempts, DialAttempt{Addr: addr, Err: ctx.Err()})
+			break
+		}
+		start := time.Now()
+		conn, err := py.dialOne(ctx, addr)
+		if err == nil {
+			py.health.markOK(addr)
+			return conn, nil
+		}
+		py.health.markFailed(addr)
+		dialErr.Attempts = append(dialErr.Attempts, DialAttempt{Addr: addr, Err: err, Duration: time.Since(start)})
+	}
+	return nil, dialErr
+}
+
+func (py *TCPReverseProxy) dialOne(ctx context.Context, addr string) (net.Conn, error) {
+	if py.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, py.DialTimeout)
+		defer cancel()
+	}
+	return py.dial(ctx, "tcp", addr)
+}
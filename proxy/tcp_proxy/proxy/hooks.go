@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrorCause 错误发生的阶段
+type ErrorCause int
+
+const (
+	// CauseRejected OnConnect拒绝了连接
+	CauseRejected ErrorCause = iota + 1
+	// CauseDial 拨号上游失败
+	CauseDial
+	// CauseProxyHeader 向上游写PROXY协议头部失败
+	CauseProxyHeader
+	// CauseClientCopy 从客户端读取或者向上游写入时出错
+	CauseClientCopy
+	// CauseUpstreamCopy 从上游读取或者向客户端写入时出错
+	CauseUpstreamCopy
+)
+
+func (c ErrorCause) String() string {
+	switch c {
+	case CauseRejected:
+		return "rejected"
+	case CauseDial:
+		return "dial"
+	case CauseProxyHeader:
+		return "proxy-header"
+	case CauseClientCopy:
+		return "client-copy"
+	case CauseUpstreamCopy:
+		return "upstream-copy"
+	}
+	return "unknown"
+}
+
+// ProxyError TCP代理的错误，带上出错的阶段和上游地址
+type ProxyError struct {
+	Cause ErrorCause
+	Addr  string //上游地址，拨号之前出错时为空
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	if e.Addr != "" {
+		return fmt.Sprintf("tcp proxy %v (%s): %v", e.Cause, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("tcp proxy %v: %v", e.Cause, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Stats 一次代理连接的统计
+type Stats struct {
+	Upstream      string //实际连接的上游地址
+	BytesSent     int64  //客户端发往上游的字节数
+	BytesReceived int64  //上游发往客户端的字节数
+	Start         time.Time
+	Duration      time.Duration
+}
+
+// ConnWrapper 包装连接，返回的连接代替原来的连接参与转发
+type ConnWrapper func(net.Conn) net.Conn
+
+// InspectConn 观察经过连接的字节，onRead在每次读到数据后调用，onWrite在每次写入前调用
+// 回调中不能修改p，也不能保留p
+func InspectConn(onRead, onWrite func(p []byte)) ConnWrapper {
+	return func(c net.Conn) net.Conn {
+		return &inspectConn{Conn: c, onRead: onRead, onWrite: onWrite}
+	}
+}
+
+type inspectConn struct {
+	net.Conn
+	onRead, onWrite func(p []byte)
+}
+
+func (c *inspectConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.onRead != nil {
+		c.onRead(p[:n])
+	}
+	return n, err
+}
+
+func (c *inspectConn) Write(p []byte) (int, error) {
+	if c.onWrite != nil {
+		c.onWrite(p)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *inspectConn) NetConn() net.Conn { return c.Conn }
+
+// TransformConn 改写从连接读出的字节流，fn拿到原始的Reader，返回改写后的Reader
+// 比如用bufio按行读取后替换内容，写入方向不变
+func TransformConn(fn func(r io.Reader) io.Reader) ConnWrapper {
+	return func(c net.Conn) net.Conn {
+		return &transformConn{Conn: c, r: fn(c)}
+	}
+}
+
+type transformConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *transformConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *transformConn) NetConn() net.Conn { return c.Conn }
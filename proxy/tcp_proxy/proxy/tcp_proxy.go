@@ -2,19 +2,33 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"gateway/proxy/proxyproto"
+	"gateway/proxy/tcp_proxy/server"
 	"io"
 	"net"
-	"net/http"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type TCPReverseProxy struct {
 	//下游真实服务器地址
 	Addr string
+	//Addrs 多个下游地址，不为空时忽略Addr，拨号失败或超时会依次尝试下一个健康的地址
+	Addrs []string
+	//ConnectBudget 一次连接所有拨号尝试的总时间，为0时只受每次的DialTimeout限制
+	ConnectBudget time.Duration
+	//FailTimeout 拨号失败的地址在这段时间内被视为不健康，优先跳过，默认10秒
+	FailTimeout time.Duration
 
 	DialTimeout     time.Duration //拨号超时
 	Deadline        time.Duration //截止时间
 	KeepAlivePeriod time.Duration //长连接超时时间
+	//IdleTimeout 客户端和上游两边的空闲超时，每次读写成功后重新计时
+	IdleTimeout time.Duration
+	//MaxConnectionAge 客户端和上游两边连接的最长存活时间，到期后不管是否空闲都会切断
+	MaxConnectionAge time.Duration
 
 	//TCP拨号方法：net.Dial，这个方法中定义了一个Dialer结构体是拨号的核心对象
 	//又返回（调用）Dialer.Dial方法，它封装了Dialer.Dial.DialContext方法
@@ -22,11 +36,29 @@ type TCPReverseProxy struct {
 	//最后通过系统拨号器sysDialer的dialParallel返回一个net.Conn对象
 	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
 
-	//修改响应
-	//如果返回错误，将调用ErrorHandler
-	ModifyResponse func(*http.Response) error
-	//错误处理
-	ErrorHandler func(http.ResponseWriter, *http.Request, error)
+	//原来的ModifyResponse和ErrorHandler是照着http.ReverseProxy写的，参数是*http.Response和http.ResponseWriter，
+	//在原始的TCP字节流上没法使用，这里换成TCP自己的扩展点：
+
+	//OnConnect 客户端连接进来、拨号之前调用，返回错误时拒绝连接
+	//返回非空的地址时只连接这个地址，比如按客户端地址选择上游
+	OnConnect func(ctx context.Context, src net.Conn) (addr string, err error)
+	//WrapClient、WrapUpstream 包装客户端连接和上游连接，可以检查、改写经过的字节流
+	WrapClient   ConnWrapper
+	WrapUpstream ConnWrapper
+	//OnError 错误回调，err.Cause说明是哪个阶段出的错
+	//所有地址都拨号失败时，err.Err是*DialError，里面记录了每一次尝试的地址和错误
+	OnError func(ctx context.Context, src net.Conn, err *ProxyError)
+	//OnClose 连接结束时调用，带上转发的字节数和持续时间
+	OnClose func(ctx context.Context, src net.Conn, stats Stats)
+
+	//ProxyProtocolVersion 拨号成功后先向上游写入PROXY协议头部，让上游拿到真实客户端地址
+	//0表示不写，1或2表示对应的协议版本
+	ProxyProtocolVersion byte
+
+	//once 第一次处理连接时创建拨号方法和健康记录，之后多个连接并发读取，不再修改
+	once   sync.Once
+	dial   func(ctx context.Context, network, address string) (net.Conn, error)
+	health *upstreamHealth
 }
 
 func NewTCPReverseProxy(addr string) *TCPReverseProxy {
@@ -42,61 +74,164 @@ func NewTCPReverseProxy(addr string) *TCPReverseProxy {
 	}
 }
 
+// NewMultiTCPReverseProxy 创建有多个下游地址的代理，拨号失败时自动切换
+func NewMultiTCPReverseProxy(addrs []string) *TCPReverseProxy {
+	if len(addrs) == 0 {
+		panic("TCP ADDRESS must not be empty!")
+	}
+
+	return &TCPReverseProxy{
+		Addrs:           addrs,
+		DialTimeout:     10 * time.Second,
+		Deadline:        time.Minute,
+		KeepAlivePeriod: time.Hour,
+		ConnectBudget:   30 * time.Second,
+	}
+}
+
 // ServeTCP TCP服务函数，用于处理TCP连接，实现TCPHandler接口
 func (py *TCPReverseProxy) ServeTCP(ctx context.Context, src net.Conn) {
-	var cancel context.CancelFunc //检查是否取消操作
-	if py.DialTimeout >= 0 {      //连接超时时间
-		ctx, cancel = context.WithTimeout(ctx, py.Deadline)
+	stats := Stats{Start: time.Now()}
+	if py.OnClose != nil {
+		defer func() {
+			stats.Duration = time.Since(stats.Start)
+			py.OnClose(ctx, src, stats)
+		}()
 	}
-	if py.Deadline >= 0 { //截止时间
+
+	//截止时间，原来的写法中DialTimeout分支用的也是Deadline，而且第一个cancel会被覆盖泄漏
+	if py.Deadline > 0 {
+		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, time.Now().Add(py.Deadline))
-	}
-	if cancel != nil {
 		defer cancel()
 	}
 
-	//完成了取消检查后，开始拨号，拨号参考tcp_client.go中的net.Dial
-	if py.DialContext == nil {
-		//主要是自定义了结构体参数部分，然后将拨号方法传入拨号器
-		//将拨号超时、截止时间、长连接超时时间传入拨号器后，返回该拨号器下执行的拨号方法给DialContext
-		py.DialContext = (&net.Dialer{
-			Timeout:   py.DialTimeout,
-			Deadline:  time.Now().Add(py.Deadline),
-			KeepAlive: py.KeepAlivePeriod,
-		}).DialContext
+	//连接进来后先交给OnConnect，决定是否接受以及连接哪个上游
+	var addr string
+	if py.OnConnect != nil {
+		var err error
+		if addr, err = py.OnConnect(ctx, src); err != nil {
+			py.onError(ctx, src, &ProxyError{Cause: CauseRejected, Err: err})
+			return
+		}
 	}
 
+	//完成了取消检查后，开始拨号，拨号参考tcp_client.go中的net.Dial
+	py.once.Do(py.init)
+
 	//拨号方法自定义完成后，开始拨号向下游服务器发送请求，返回一个对下游的net.Conn对象
-	dst, err := py.DialContext(ctx, "tcp", py.Addr)
+	//有多个地址时依次尝试，直到成功或者超过ConnectBudget
+	dst, err := py.dialUpstream(ctx, addr)
 	if err != nil {
-		// TODO: 错误处理
+		py.onError(ctx, src, &ProxyError{Cause: CauseDial, Err: err})
 		return
 	}
 	defer dst.Close() //记得关闭连接
+	stats.Upstream = dst.RemoteAddr().String()
 
-	//收到请求后，modifyResponse对响应进行修改
-	if !py.modifyResponse(dst) {
-		//这里的错误通常在modifyResponse中返回
-		return
+	//上游需要真实客户端地址时，在转发任何数据之前先写入PROXY协议头部
+	//如果src本身是解析过PROXY头部的连接，这里的地址就是最初的客户端地址
+	if py.ProxyProtocolVersion != 0 {
+		if _, err = proxyproto.HeaderFor(py.ProxyProtocolVersion, src).WriteTo(dst); err != nil {
+			py.onError(ctx, src, &ProxyError{Cause: CauseProxyHeader, Addr: stats.Upstream, Err: err})
+			return
+		}
 	}
 
-	//将响应拷贝到源连接中，返回给客户端
-	//_, err = io.Copy(src, dst)
-	//自定义写法
-	_, err = bytesCopy(src, dst)
+	//包装两端的连接，之后所有的读写都经过包装
+	//先加上空闲超时，客户端连接已经被TCPServer包装过时会取两者中更严格的设置
+	client := server.NewDeadlineConn(src, py.IdleTimeout, py.MaxConnectionAge)
+	upstream := server.NewDeadlineConn(dst, py.IdleTimeout, py.MaxConnectionAge)
+	if py.WrapClient != nil {
+		client = py.WrapClient(client)
+	}
+	if py.WrapUpstream != nil {
+		upstream = py.WrapUpstream(upstream)
+	}
+
+	//双向拷贝：原来的写法只把客户端的数据拷贝给上游，上游的响应回不到客户端
+	sent, received, cause, err := biCopy(client, upstream)
+	stats.BytesSent, stats.BytesReceived = sent, received
+	if err != nil {
+		py.onError(ctx, src, &ProxyError{Cause: cause, Addr: stats.Upstream, Err: err})
+	}
 }
 
-// 如果修改成功返回true，否则返回false
-func (py *TCPReverseProxy) modifyResponse(res net.Conn) bool {
+// init 创建拨号方法和健康记录，只在第一个连接进来时执行一次
+// 连接是并发处理的，不能在ServeTCP中给DialContext赋值，也不修改调用方设置的字段
+func (py *TCPReverseProxy) init() {
+	py.health = newUpstreamHealth()
+	py.dial = py.DialContext
+	if py.dial == nil {
+		//主要是自定义了结构体参数部分，然后将拨号方法传入拨号器
+		//这里不能设置Dialer.Deadline：它是一个固定的时间点，拨号方法只在第一次连接时创建，
+		//一分钟后所有的拨号都会失败。截止时间交给ServeTCP中的ctx控制
+		py.dial = (&net.Dialer{
+			KeepAlive: py.KeepAlivePeriod,
+		}).DialContext
+	}
+}
 
-	return true
+func (py *TCPReverseProxy) onError(ctx context.Context, src net.Conn, err *ProxyError) {
+	if py.OnError != nil {
+		py.OnError(ctx, src, err)
+	}
+}
+
+// biCopy 双向拷贝两个连接的数据，两个方向都结束后返回
+// 一个方向读到EOF时，只关闭对方的写端（半关闭），另一个方向还可以继续传输
+// 一个方向出错时关闭两个连接，让另一个方向也尽快结束
+func biCopy(client, upstream net.Conn) (sent, received int64, cause ErrorCause, err error) {
+	type result struct {
+		n     int64
+		cause ErrorCause
+		err   error
+	}
+	up := make(chan result, 1)
+	go func() {
+		n, err := io.Copy(upstream, client)
+		closeWrite(upstream)
+		if err != nil {
+			client.Close()
+			upstream.Close()
+		}
+		up <- result{n, CauseClientCopy, err}
+	}()
+
+	n, rerr := io.Copy(client, upstream)
+	closeWrite(client)
+	if rerr != nil {
+		client.Close()
+		upstream.Close()
+	}
+	r := <-up
+
+	sent, received = r.n, n
+	//对方关闭导致的错误不算错误，只报告最先发生的真正错误
+	switch {
+	case rerr != nil && !isClosedErr(rerr):
+		return sent, received, CauseUpstreamCopy, rerr
+	case r.err != nil && !isClosedErr(r.err):
+		return sent, received, r.cause, r.err
+	}
+	return sent, received, 0, nil
+}
+
+// closeWrite 关闭连接的写端，包装过的连接通过NetConn取出原始连接
+func closeWrite(c net.Conn) {
+	for {
+		if cw, ok := c.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+			return
+		}
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		c = nc.NetConn()
+	}
 }
 
-// 拷贝两个连接的数据
-func bytesCopy(src, dst net.Conn) (len int64, err error) {
-	_, err = io.Copy(dst, src)
-	//q:为什么return中没有len和err也没报错
-	//a:因为io.Copy()函数返回的是int64和error，所以这里的返回值也是int64和error
-	//直接return裸返回也是对的，但是为了更好的可读性，还是写上了len和err
-	return len, err
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
 }
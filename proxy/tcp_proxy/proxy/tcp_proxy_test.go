@@ -0,0 +1,42 @@
+package proxy_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gateway/gatewaytest"
+	"gateway/proxy/tcp_proxy/proxy"
+)
+
+func TestTCPReverseProxy(t *testing.T) {
+	up := gatewaytest.NewTCPEcho(t)
+	addr := gatewaytest.ServeTCP(t, nil, proxy.NewTCPReverseProxy(up.Addr()))
+	conn := gatewaytest.Dial(t, addr)
+	gatewaytest.AssertRoundTrip(t, conn, []byte("hello"))
+	gatewaytest.AssertRoundTrip(t, conn, make([]byte, 256<<10))
+
+	//客户端半关闭后上游也关闭，代理把两个方向都传递过去
+	conn.(*net.TCPConn).CloseWrite()
+	gatewaytest.AssertClosed(t, conn)
+}
+
+func TestTCPReverseProxyFailover(t *testing.T) {
+	//先占一个端口再关闭，得到一个没有服务在监听的地址
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ln.Addr().String()
+	ln.Close()
+
+	up := gatewaytest.NewTCPEcho(t)
+	py := proxy.NewMultiTCPReverseProxy([]string{dead, up.Addr()})
+	py.DialTimeout = time.Second
+	addr := gatewaytest.ServeTCP(t, nil, py)
+	conn := gatewaytest.Dial(t, addr)
+	gatewaytest.AssertRoundTrip(t, conn, []byte("hello"))
+	if n := up.Conns(); n != 1 {
+		t.Errorf("upstream connections = %d, want 1", n)
+	}
+}
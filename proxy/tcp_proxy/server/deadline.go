@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// 空闲超时：原来在Accept时设置一次绝对的读写截止时间，连接再忙也会在到期时被切断
+// 这里改成每次读写成功后把截止时间往后推，只有连接在IdleTimeout内没有任何数据时才会超时
+// MaxConnectionAge是另一回事，它是连接的最长存活时间，不管忙不忙，到期都会切断
+
+// DeadlineConn 会自动刷新截止时间的连接
+// 读和写任意一个方向有数据都算活跃，同时刷新读写两个截止时间
+// 否则只下载不上传的连接，读会在空闲超时后失败
+type DeadlineConn struct {
+	net.Conn
+	idle   time.Duration //空闲超时，0表示不检测空闲
+	expire time.Time     //最长存活的截止时间，零值表示不限制
+}
+
+// NewDeadlineConn 包装连接，idle是空闲超时，maxAge是从现在开始算的最长存活时间，0表示不限制
+// 如果c里面已经包装过DeadlineConn（比如TCPServer包装过，又交给TCPReverseProxy），
+// 不再重复包装，而是收紧已有的限制，两层各自刷新会互相覆盖对方的截止时间
+// 收紧时不能有其它协程正在读写c
+func NewDeadlineConn(c net.Conn, idle, maxAge time.Duration) net.Conn {
+	if idle <= 0 && maxAge <= 0 {
+		return c
+	}
+	var expire time.Time
+	if maxAge > 0 {
+		expire = time.Now().Add(maxAge)
+	}
+
+	if dc := findDeadlineConn(c); dc != nil {
+		if idle > 0 && (dc.idle <= 0 || idle < dc.idle) {
+			dc.idle = idle
+		}
+		if !expire.IsZero() && (dc.expire.IsZero() || expire.Before(dc.expire)) {
+			dc.expire = expire
+		}
+		dc.Refresh()
+		return c
+	}
+
+	dc := &DeadlineConn{Conn: c, idle: idle, expire: expire}
+	dc.Refresh()
+	return dc
+}
+
+// findDeadlineConn 沿着NetConn一层层往里找DeadlineConn
+func findDeadlineConn(c net.Conn) *DeadlineConn {
+	for {
+		if dc, ok := c.(*DeadlineConn); ok {
+			return dc
+		}
+		nc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		c = nc.NetConn()
+	}
+}
+
+// Refresh 按空闲超时和最长存活时间重新设置读写截止时间
+// 别的代码临时改过截止时间后（比如嗅探协议、读取PROXY头部），调用它恢复
+func (c *DeadlineConn) Refresh() {
+	var d time.Time
+	if c.idle > 0 {
+		d = time.Now().Add(c.idle)
+	}
+	if !c.expire.IsZero() && (d.IsZero() || c.expire.Before(d)) {
+		d = c.expire
+	}
+	c.Conn.SetDeadline(d)
+}
+
+func (c *DeadlineConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && c.idle > 0 {
+		c.Refresh()
+	}
+	return n, err
+}
+
+func (c *DeadlineConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 && c.idle > 0 {
+		c.Refresh()
+	}
+	return n, err
+}
+
+// NetConn 返回被包装的原始连接
+func (c *DeadlineConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// restoreDeadline 恢复连接的截止时间：包装过DeadlineConn时按它的设置刷新，否则清空
+func restoreDeadline(c net.Conn) {
+	if dc := findDeadlineConn(c); dc != nil {
+		dc.Refresh()
+		return
+	}
+	c.SetDeadline(time.Time{})
+}
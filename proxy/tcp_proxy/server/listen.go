@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ListenConfig 监听选项，各字段的含义见TCPServer中的同名字段
+// TCPServer.ListenAndServe和cmd/gateway的各类监听都用它创建Listener
+type ListenConfig struct {
+	Network        string
+	IPv6Only       bool
+	ReusePort      int
+	Backlog        int
+	UnixSocketMode os.FileMode
+	//Inherit 不为nil时由它取得Listener：有可以沿用的socket（热升级时从父进程继承的）就直接返回，否则调用create新建
+	//cmd/gateway run传入upgrade.Upgrader.ListenWith
+	Inherit func(network, addr string, create func(network, addr string) (net.Listener, error)) (net.Listener, error)
+}
+
+// listen 按TCPServer的监听选项创建Listener
+func (ts *TCPServer) listen(addr string) ([]net.Listener, error) {
+	lc := &ListenConfig{
+		Network:        ts.Network,
+		IPv6Only:       ts.IPv6Only,
+		ReusePort:      ts.ReusePort,
+		Backlog:        ts.Backlog,
+		UnixSocketMode: ts.UnixSocketMode,
+	}
+	return lc.Listen(addr)
+}
+
+// Listen 创建Listener，开启ReusePort时返回多个监听同一地址的Listener，否则只有一个
+func (lc *ListenConfig) Listen(addr string) ([]net.Listener, error) {
+	network := lc.Network
+	if network == "" {
+		network = "tcp"
+	}
+	if lc.IPv6Only && network == "tcp" {
+		//Go对tcp6的通配地址会设置IPV6_V6ONLY，tcp则是双栈
+		network = "tcp6"
+	}
+	if network == "unix" && lc.ReusePort > 0 {
+		return nil, errors.New("tcp: ReusePort is not supported on unix sockets")
+	}
+
+	n := lc.ReusePort
+	if n < 1 {
+		n = 1
+	}
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		var ln net.Listener
+		var err error
+		if lc.Inherit != nil {
+			ln, err = lc.Inherit(network, addr, lc.create)
+		} else {
+			ln, err = lc.create(network, addr)
+		}
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		//端口写0时第一个Listener拿到随机端口，后面的都要监听同一个端口
+		if i == 0 && network != "unix" {
+			addr = ln.Addr().String()
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// create 新建一个socket，SO_REUSEPORT必须在bind之前设置，全连接队列的长度在listen之后修改
+func (lc *ListenConfig) create(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		return listenUnix(addr, lc.UnixSocketMode)
+	}
+	nlc := net.ListenConfig{}
+	if lc.ReusePort > 0 {
+		//Control正好在创建socket之后、bind之前调用
+		nlc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) { serr = setReusePort(fd) }); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	ln, err := nlc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Backlog > 0 {
+		if err := setBacklog(ln, lc.Backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// NagleListener 包装Listener，Accept到的TCP连接关闭TCP_NODELAY，效果和TCPServer.DisableNoDelay相同
+func NagleListener(ln net.Listener) net.Listener {
+	return nagleListener{ln}
+}
+
+type nagleListener struct {
+	net.Listener
+}
+
+func (l nagleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetNoDelay(false)
+	}
+	return c, err
+}
+
+// listenUnix 监听unix socket，上次进程异常退出留下的socket文件会先删掉，否则bind会失败
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		//还有进程在监听时不能删
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, &net.OpError{Op: "listen", Net: "unix", Addr: &net.UnixAddr{Name: path, Net: "unix"}, Err: syscall.EADDRINUSE}
+		}
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// soReusePort Linux上SO_REUSEPORT的值，标准库的syscall包没有导出这个常量
+const soReusePort = 0xf
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+// setBacklog 修改全连接队列的长度
+// Go在Listen时固定使用somaxconn，Linux允许对已经在监听的socket再调用一次listen来修改backlog
+func setBacklog(ln net.Listener, backlog int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) { lerr = syscall.Listen(int(fd), backlog) }); err != nil {
+		return err
+	}
+	return lerr
+}
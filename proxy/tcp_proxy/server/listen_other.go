@@ -0,0 +1,16 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+func setReusePort(fd uintptr) error {
+	return errors.New("tcp: ReusePort is only supported on linux")
+}
+
+func setBacklog(ln net.Listener, backlog int) error {
+	return errors.New("tcp: Backlog is only supported on linux")
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/proxy/clientip"
+	"gateway/proxy/ratelimit"
+	"log"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// TCP中间件：和http中间件一样，一个中间件接收下一个TCPHandler，返回包装后的TCPHandler
+// 用法：server.Chain(tcpProxy, server.Recover(), server.Logging(nil), server.IPFilter(accessList))
+// Chain中第一个中间件在最外层，最先拿到连接
+
+// TCPHandlerFunc 把普通函数适配为TCPHandler
+type TCPHandlerFunc func(ctx context.Context, conn net.Conn)
+
+// ServeTCP 实现TCPHandler接口
+func (f TCPHandlerFunc) ServeTCP(ctx context.Context, conn net.Conn) {
+	f(ctx, conn)
+}
+
+// Middleware TCP中间件
+type Middleware func(next TCPHandler) TCPHandler
+
+// Chain 把中间件按顺序包装到h外面
+func Chain(h TCPHandler, middlewares ...Middleware) TCPHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// ErrConnDenied IP不在允许的网段或者在拒绝的网段中
+var ErrConnDenied = errors.New("tcp: connection denied")
+
+// IPFilter 按客户端IP过滤连接，规则和TCPServer.AccessList相同，都由clientip.AccessList判断
+// 用于不经过TCPServer的场景，或者只想在中间件链的某一层过滤；开启了PROXY协议时，RemoteAddr已经是头部中的真实客户端地址
+func IPFilter(l *clientip.AccessList) Middleware {
+	return func(next TCPHandler) TCPHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			if !l.Allowed(remoteIP(conn.RemoteAddr())) {
+				log.Printf("tcp: %v from %v", ErrConnDenied, conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			next.ServeTCP(ctx, conn)
+		})
+	}
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// CountingConn 统计读写字节数的连接，计数可以在其它协程中读取
+type CountingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *CountingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *CountingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// BytesRead 从客户端读到的字节数
+func (c *CountingConn) BytesRead() int64 { return atomic.LoadInt64(&c.read) }
+
+// BytesWritten 写给客户端的字节数
+func (c *CountingConn) BytesWritten() int64 { return atomic.LoadInt64(&c.written) }
+
+// NetConn 返回被包装的原始连接
+func (c *CountingConn) NetConn() net.Conn { return c.Conn }
+
+// CountBytes 统计每个连接的读写字节数，连接处理完后调用report
+func CountBytes(report func(conn net.Conn, read, written int64)) Middleware {
+	return func(next TCPHandler) TCPHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			cc := &CountingConn{Conn: conn}
+			defer func() { report(conn, cc.BytesRead(), cc.BytesWritten()) }()
+			next.ServeTCP(ctx, cc)
+		})
+	}
+}
+
+// Logging 记录连接的建立和关闭，关闭时带上持续时间和读写字节数，logger为nil时使用log包默认的Logger
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return func(next TCPHandler) TCPHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			start := time.Now()
+			cc := &CountingConn{Conn: conn}
+			logger.Printf("tcp: accept %v -> %v", conn.RemoteAddr(), conn.LocalAddr())
+			defer func() {
+				logger.Printf("tcp: close %v after %v, read %d bytes, written %d bytes",
+					conn.RemoteAddr(), time.Since(start).Round(time.Millisecond), cc.BytesRead(), cc.BytesWritten())
+			}()
+			next.ServeTCP(ctx, cc)
+		})
+	}
+}
+
+// Recover 捕获处理过程中的panic，打印调用栈后关闭连接
+// conn.serve中也有同样的兜底，这个中间件用于不经过TCPServer的场景，或者希望panic后继续执行外层中间件
+func Recover() Middleware {
+	return func(next TCPHandler) TCPHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			defer func() {
+				if err := recover(); err != nil {
+					if err != ErrAbortHandler {
+						logPanic(conn.RemoteAddr().String(), err)
+					}
+					conn.Close()
+				}
+			}()
+			next.ServeTCP(ctx, conn)
+		})
+	}
+}
+
+// logPanic 打印panic和当前协程的调用栈
+func logPanic(remoteAddr string, err interface{}) {
+	//设定一个栈大小，64KB，作为buf的长度
+	const size = 64 << 10
+	buf := make([]byte, size)
+	//runtime.Stack方法，获取当前goroutine的调用栈信息，返回值是int，也就是写入buf的字节数
+	//此时的buf是一个切片，所以buf[:n]是一个切片，也就是buf的前n个元素，输出的时候error
+	buf = buf[:runtime.Stack(buf, false)]
+	fmt.Printf("http: panic serving %v: %v\n%s", remoteAddr, err, buf)
+}
+
+// RateLimit 限制新连接的速率，令牌不够时直接关闭连接
+// 所有连接共用一个limiter，比如ratelimit.NewLimiter(100, 200)表示每秒100个新连接，最多突发200个
+func RateLimit(limiter *ratelimit.Limiter) Middleware {
+	return func(next TCPHandler) TCPHandler {
+		return TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			if !limiter.Allow() {
+				log.Printf("tcp: rate limit exceeded, close %v", conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+			next.ServeTCP(ctx, conn)
+		})
+	}
+}
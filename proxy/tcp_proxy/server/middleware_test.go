@@ -0,0 +1,48 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"gateway/proxy/clientip"
+	"gateway/proxy/tcp_proxy/server"
+)
+
+// addrConn 只用来提供RemoteAddr的连接
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+	closed bool
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c *addrConn) Close() error         { c.closed = true; return nil }
+
+// TestIPFilter IPFilter和TCPServer.AccessList用同一份规则
+func TestIPFilter(t *testing.T) {
+	al, err := clientip.NewAccessList([]string{"10.0.0.0/8"}, []string{"10.1.2.3"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := false
+	h := server.Chain(server.TCPHandlerFunc(func(ctx context.Context, conn net.Conn) { served = true }), server.IPFilter(al))
+	cases := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}, false},
+		//拿不到IP的连接在有allow限制时拒绝
+		{&net.UnixAddr{Name: "/tmp/gw.sock", Net: "unix"}, false},
+	}
+	for _, c := range cases {
+		served = false
+		conn := &addrConn{remote: c.addr}
+		h.ServeTCP(context.Background(), conn)
+		if served != c.want || conn.closed == c.want {
+			t.Errorf("%v: served %v closed %v, want served %v", c.addr, served, conn.closed, c.want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 协议嗅探：一个端口同时提供HTTP、TLS、WebSocket和原始TCP服务
+// 步骤：
+// 1、Peek连接开头的几个字节，不消费数据
+// 2、根据特征判断协议：TLS ClientHello、HTTP/1.x方法名、HTTP/2前言，其它都算原始TCP
+// 3、把Peek过的数据和连接一起交给对应的TCPHandler，数据会被重新读到
+
+// Protocol 嗅探出的协议类型
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolTLS
+	ProtocolHTTP
+	ProtocolHTTP2
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolTLS:
+		return "tls"
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolHTTP2:
+		return "h2c"
+	}
+	return "unknown"
+}
+
+// http2Preface HTTP/2明文连接的前言
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// httpMethods HTTP/1.x请求行开头的方法名，后面必须跟一个空格
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("PUT "), []byte("DELETE "),
+	[]byte("HEAD "), []byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+}
+
+// sniffLength 判断协议最多需要Peek的字节数，"OPTIONS "和"CONNECT "是8个字节
+const sniffLength = 8
+
+// ProtocolMux 按协议分发连接的TCPHandler，作为TCPServer的Handler使用
+type ProtocolMux struct {
+	//TLS 收到TLS ClientHello时使用，可以是透传的TCPReverseProxy，也可以是NewTLSHandler终止TLS
+	TLS TCPHandler
+	//HTTP 收到HTTP/1.x请求时使用，WebSocket握手也是HTTP请求，一并交给它
+	HTTP TCPHandler
+	//HTTP2 收到HTTP/2明文前言时使用，为nil时交给HTTP
+	HTTP2 TCPHandler
+	//Fallback SSH等其它协议，以及超时还没发数据的连接（服务端先说话的协议）
+	Fallback TCPHandler
+
+	//SniffTimeout 等待客户端首包的时间，默认1秒
+	SniffTimeout time.Duration
+}
+
+// ServeTCP 实现TCPHandler接口
+func (m *ProtocolMux) ServeTCP(ctx context.Context, conn net.Conn) {
+	timeout := m.SniffTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	proto := Sniff(br)
+	//嗅探结束后恢复服务器的读超时设置
+	restoreDeadline(conn)
+
+	h := m.handler(proto)
+	if h == nil {
+		return
+	}
+	h.ServeTCP(ctx, &peekedConn{Conn: conn, r: br})
+}
+
+func (m *ProtocolMux) handler(proto Protocol) TCPHandler {
+	switch proto {
+	case ProtocolTLS:
+		if m.TLS != nil {
+			return m.TLS
+		}
+	case ProtocolHTTP2:
+		if m.HTTP2 != nil {
+			return m.HTTP2
+		}
+		if m.HTTP != nil {
+			return m.HTTP
+		}
+	case ProtocolHTTP:
+		if m.HTTP != nil {
+			return m.HTTP
+		}
+	}
+	return m.Fallback
+}
+
+// Sniff 根据br开头的数据判断协议，不会消费br中的数据
+func Sniff(br *bufio.Reader) Protocol {
+	b, err := br.Peek(1)
+	if err != nil {
+		return ProtocolUnknown
+	}
+	//TLS记录层：第一个字节0x16表示握手消息，第二个字节是主版本号0x03
+	if b[0] == 0x16 {
+		if b, _ = br.Peek(2); len(b) == 2 && b[1] == 0x03 {
+			return ProtocolTLS
+		}
+		return ProtocolUnknown
+	}
+
+	//逐字节Peek，一旦和所有方法名都不匹配就立刻返回，不必等够8个字节
+	for n := 1; n <= sniffLength; n++ {
+		b, err = br.Peek(n)
+		if err != nil {
+			return ProtocolUnknown
+		}
+		candidate := false
+		for _, m := range httpMethods {
+			if len(m) == n && bytes.Equal(b, m) {
+				return ProtocolHTTP
+			}
+			if len(m) > n && bytes.HasPrefix(m, b) {
+				candidate = true
+			}
+		}
+		//HTTP/2前言以"PRI "开头
+		if n == 4 && bytes.Equal(b, http2Preface[:4]) {
+			return ProtocolHTTP2
+		}
+		if !candidate && !bytes.HasPrefix(http2Preface, b) {
+			return ProtocolUnknown
+		}
+	}
+	return ProtocolUnknown
+}
+
+// peekedConn 读取时先读bufio中Peek过的数据，再读原始连接
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn 返回被包装的原始连接
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// NewTLSHandler 终止TLS后把解密的连接交给next，比如再交给HTTP得到HTTPS
+func NewTLSHandler(config *tls.Config, next TCPHandler) TCPHandler {
+	return &tlsHandler{config: config, next: next}
+}
+
+type tlsHandler struct {
+	config *tls.Config
+	next   TCPHandler
+}
+
+func (th *tlsHandler) ServeTCP(ctx context.Context, conn net.Conn) {
+	tc := tls.Server(conn, th.config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return
+	}
+	th.next.ServeTCP(ctx, tc)
+}
+
+// HTTPHandler 把http.Handler适配为TCPHandler
+// 内部有一个http.Server，ServeTCP把连接投递给它，直到http.Server关闭连接才返回
+// 这样反向代理、WebSocket代理等http.Handler就可以挂在ProtocolMux上
+type HTTPHandler struct {
+	Server *http.Server
+
+	once sync.Once
+	ln   *chanListener
+}
+
+// NewHTTPHandler 用默认的http.Server包装handler
+func NewHTTPHandler(handler http.Handler) *HTTPHandler {
+	return &HTTPHandler{Server: &http.Server{Handler: handler}}
+}
+
+// ServeTCP 实现TCPHandler接口
+func (hh *HTTPHandler) ServeTCP(ctx context.Context, conn net.Conn) {
+	hh.once.Do(func() {
+		hh.ln = &chanListener{conns: make(chan net.Conn), done: make(chan struct{}), addr: conn.LocalAddr()}
+		go hh.Server.Serve(hh.ln)
+	})
+
+	//http.Server处理完连接会调用Close，这时才让ServeTCP返回，
+	//否则conn.serve中的defer会提前把连接关掉
+	nc := &notifyCloseConn{Conn: conn, closed: make(chan struct{})}
+	select {
+	case hh.ln.conns <- nc:
+	case <-hh.ln.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-nc.closed:
+	case <-ctx.Done():
+	}
+}
+
+// Close 关闭内部的http.Server
+func (hh *HTTPHandler) Close() error {
+	if hh.ln == nil {
+		return nil
+	}
+	return hh.Server.Close()
+}
+
+// chanListener 用channel代替真正的监听，把连接一个一个交给http.Server
+type chanListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	addr  net.Addr
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("server: listener closed")
+	}
+}
+
+func (l *chanListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *chanListener) Addr() net.Addr { return l.addr }
+
+// notifyCloseConn 连接关闭时关闭closed通知
+type notifyCloseConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,182 @@
+package server_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gateway/gatewaytest"
+	"gateway/proxy/tcp_proxy/server"
+)
+
+// clientHello 截取一个真实的TLS ClientHello记录
+func clientHello(t *testing.T) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake()
+	defer c.Close()
+	var hdr [5]byte
+	if _, err := io.ReadFull(s, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr[:], body...)
+}
+
+func TestSniff(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		want server.Protocol
+	}{
+		{"tls", string(clientHello(t)), server.ProtocolTLS},
+		{"get", "GET / HTTP/1.1\r\n\r\n", server.ProtocolHTTP},
+		{"options", "OPTIONS * HTTP/1.1\r\n\r\n", server.ProtocolHTTP},
+		{"connect", "CONNECT example.com:443 HTTP/1.1\r\n\r\n", server.ProtocolHTTP},
+		{"h2 preface", "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", server.ProtocolHTTP2},
+		{"ssh", "SSH-2.0-OpenSSH_9.6\r\n", server.ProtocolUnknown},
+		{"method without space", "GETX / HTTP/1.1\r\n", server.ProtocolUnknown},
+		{"lower case method", "get / HTTP/1.1\r\n", server.ProtocolUnknown},
+		{"0x16 without tls version", "\x16\x00\x00", server.ProtocolUnknown},
+		{"short method then eof", "GE", server.ProtocolUnknown},
+		{"empty", "", server.ProtocolUnknown},
+	}
+	for _, c := range cases {
+		br := bufio.NewReader(strings.NewReader(c.in))
+		if got := server.Sniff(br); got != c.want {
+			t.Errorf("%s: Sniff = %v, want %v", c.name, got, c.want)
+		}
+		//嗅探不能消费数据
+		if rest, _ := io.ReadAll(br); string(rest) != c.in {
+			t.Errorf("%s: %d bytes left after Sniff, want %d", c.name, len(rest), len(c.in))
+		}
+	}
+}
+
+// tagHandler 先写入自己的名字，再把收到的数据原样写回，用来确认连接交给了谁、Peek过的数据有没有重放
+type tagHandler string
+
+func (h tagHandler) ServeTCP(ctx context.Context, conn net.Conn) {
+	io.WriteString(conn, string(h)+":")
+	io.Copy(conn, conn)
+}
+
+// exchange 发送payload并半关闭，读回服务端写的所有数据
+func exchange(t *testing.T, addr string, payload []byte) []byte {
+	t.Helper()
+	conn := gatewaytest.Dial(t, addr)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestProtocolMux(t *testing.T) {
+	mux := &server.ProtocolMux{
+		TLS:      tagHandler("tls"),
+		HTTP:     tagHandler("http"),
+		HTTP2:    tagHandler("h2c"),
+		Fallback: tagHandler("raw"),
+	}
+	addr := gatewaytest.ServeTCP(t, nil, mux)
+
+	cases := []struct {
+		name    string
+		payload []byte
+		handler string
+	}{
+		{"tls client hello", clientHello(t), "tls"},
+		{"http/1.1 request", []byte("GET /x HTTP/1.1\r\nHost: a\r\n\r\n"), "http"},
+		{"http/2 preface", []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n\x00\x00\x00\x04\x00\x00\x00\x00\x00"), "h2c"},
+		{"ssh banner", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "raw"},
+		//比嗅探长度还短的数据也要完整地交给处理器
+		{"single byte", []byte("G"), "raw"},
+	}
+	for _, c := range cases {
+		got := exchange(t, addr, c.payload)
+		want := append([]byte(c.handler+":"), c.payload...)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", c.name, abbrev(got), abbrev(want))
+		}
+	}
+}
+
+// TestProtocolMuxServerFirst 客户端不说话的协议在SniffTimeout后交给Fallback
+func TestProtocolMuxServerFirst(t *testing.T) {
+	mux := &server.ProtocolMux{
+		HTTP:         tagHandler("http"),
+		Fallback:     tagHandler("raw"),
+		SniffTimeout: 50 * time.Millisecond,
+	}
+	conn := gatewaytest.Dial(t, gatewaytest.ServeTCP(t, nil, mux))
+	if got := gatewaytest.ReadN(t, conn, 4); string(got) != "raw:" {
+		t.Fatalf("got %q, want raw:", got)
+	}
+	//嗅探的超时不能留在连接上
+	time.Sleep(100 * time.Millisecond)
+	gatewaytest.AssertRoundTrip(t, conn, []byte("hello"))
+}
+
+// TestProtocolMuxNoHTTP2Handler 没有HTTP2处理器时前言交给HTTP
+func TestProtocolMuxNoHTTP2Handler(t *testing.T) {
+	addr := gatewaytest.ServeTCP(t, nil, &server.ProtocolMux{HTTP: tagHandler("http"), Fallback: tagHandler("raw")})
+	preface := []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	if got := exchange(t, addr, preface); !bytes.HasPrefix(got, []byte("http:")) {
+		t.Errorf("got %q, want the HTTP handler", got)
+	}
+}
+
+// TestHTTPHandler 通过chanListener把连接交给http.Server，同一个连接上可以发多个请求
+func TestHTTPHandler(t *testing.T) {
+	hh := server.NewHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "path "+r.URL.Path)
+	}))
+	t.Cleanup(func() { hh.Close() })
+	addr := gatewaytest.ServeTCP(t, nil, &server.ProtocolMux{HTTP: hh, Fallback: tagHandler("raw")})
+
+	conn := gatewaytest.Dial(t, addr)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	for _, path := range []string{"/a", "/b"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+		if err := req.Write(conn); err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.ReadResponse(br, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := gatewaytest.ReadBody(t, res); body != "path "+path {
+			t.Errorf("got %q, want %q", body, "path "+path)
+		}
+	}
+
+	//其它协议不受影响
+	if got := exchange(t, addr, []byte("SSH-2.0-x\r\n")); string(got) != "raw:SSH-2.0-x\r\n" {
+		t.Errorf("fallback got %q", got)
+	}
+}
+
+func abbrev(b []byte) []byte {
+	if len(b) > 40 {
+		return append(append([]byte(nil), b[:40]...), "..."...)
+	}
+	return b
+}
@@ -3,11 +3,14 @@ package server
 import (
 	"context"
 	"errors"
-	"fmt"
+	"gateway/proxy/clientip"
+	"gateway/proxy/proxyproto"
+	"log"
 	"net"
-	"runtime"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -35,9 +38,15 @@ type TCPServer struct {
 	err         error
 
 	//time.Duration是一个时间段，表示持续的时间长度，默认单位是纳秒
+	//ReadTimeout、WriteTimeout 原来在Accept时设置一次绝对截止时间，忙碌的连接也会被切断
+	//现在只作为IdleTimeout的默认值：没有设置IdleTimeout时，取两者中较大的一个
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	KeepAlive    time.Duration
+	//IdleTimeout 空闲超时，每次读写成功后重新计时，一直有数据的连接不会被切断
+	IdleTimeout time.Duration
+	//MaxConnectionAge 连接的最长存活时间，从Accept开始计算，到期后不管是否空闲都会切断
+	MaxConnectionAge time.Duration
 
 	//互斥锁
 	//比如执行连接的关闭、初始化等操作时，需要加锁
@@ -52,8 +61,39 @@ type TCPServer struct {
 	//onShutdown []func()
 	//以上写法比较复杂，这里用一个简单的int32类型的变量代替，0表示未关闭，1表示关闭
 	inShutdown int32
+	//activeConn 正在处理的连接数，Shutdown等它降到0
+	activeConn int64
+	//serving 正在运行的Accept循环，Shutdown要等它们退出后再统计连接数，
+	//否则刚Accept、还没来得及计数的连接会被漏掉
+	serving sync.WaitGroup
 	//onceCloseListener是一个包装过的Listener，，用于控制listener的关闭，防止多次关闭导致panic
-	l *onceCloseListener
+	//开启ReusePort后同一个地址上有多个Listener，所以这里用切片
+	listeners []*onceCloseListener
+
+	//监听选项，见listen.go
+	//Network 监听的网络类型：tcp（默认）、tcp4、tcp6、unix，unix时Addr是socket文件路径
+	Network string
+	//IPv6Only 只接收IPv6连接，默认监听[::]时是双栈，同时接收IPv4连接
+	IPv6Only bool
+	//ReusePort 大于0时开启SO_REUSEPORT，在同一个地址上打开ReusePort个Listener，每个有自己的Accept循环，
+	//由内核在它们之间分配连接
+	ReusePort int
+	//Backlog 全连接队列的长度，0表示使用系统默认值（net.core.somaxconn）
+	Backlog int
+	//DisableNoDelay Go默认对TCP连接开启TCP_NODELAY，设置为true时关闭，启用Nagle算法合并小包
+	DisableNoDelay bool
+	//UnixSocketMode unix socket文件的权限，0表示不修改
+	UnixSocketMode os.FileMode
+
+	//ProxyProtocol 开启后，解析四层负载均衡在连接开头写入的PROXY协议头部（v1/v2）
+	//并用头部中的真实客户端地址覆盖连接的RemoteAddr
+	ProxyProtocol bool
+	//ProxyProtocolConfig 受信任的来源网段等配置，为nil或者没有网段时不信任任何来源，头部不会被解析
+	ProxyProtocolConfig *proxyproto.Config
+
+	//AccessList 客户端IP的访问列表，在Handler之前检查，为nil时不检查
+	//开启了PROXY协议时检查的是头部中的真实客户端地址；规则文件修改后自动生效，不用重启监听
+	AccessList *clientip.AccessList
 }
 
 // shuttingDown TCPServer的关闭确认
@@ -78,34 +118,49 @@ func (ts *TCPServer) ListenAndServe() error {
 		ts.Handler = &tcpHandler{}
 	}
 
-	//Listen方法可以按需创建一个指定类型的Listener，ln就是这个实例
-	ln, err := net.Listen("tcp", addr)
+	//listen按监听选项创建Listener，开启ReusePort时有多个
+	lns, err := ts.listen(addr)
 	if err != nil {
 		return err
 	}
 
 	//确认服务没有关闭，Address不为空，Listener不为空后，使用ln实例提供服务
-	return ts.Serve(ln)
+	//多个Listener时，其它的在单独的协程中Accept，返回第一个结束的错误
+	if len(lns) == 1 {
+		return ts.Serve(lns[0])
+	}
+	errc := make(chan error, len(lns))
+	for _, ln := range lns {
+		go func(ln net.Listener) { errc <- ts.Serve(ln) }(ln)
+	}
+	err = <-errc
+	ts.closeListeners()
+	return err
 }
 
 // Serve 拿着ListenAndServe中的ln实例提供服务
 func (ts *TCPServer) Serve(l net.Listener) error {
 	//把ListenAndServe中的ln封装进onceCloseListener，保证只关闭一次
-	//同时，onceCloseListener的封装完成，也填充了TCPServer的l属性
-	ts.l = &onceCloseListener{Listener: l}
-	defer l.Close() //关闭Listener
-
-	//初始化BaseContext
-	if ts.BaseContext == nil {
+	//同时，onceCloseListener的封装完成，也填充了TCPServer的listeners属性
+	ol := &onceCloseListener{Listener: l}
+	ts.mu.Lock()
+	ts.listeners = append(ts.listeners, ol)
+	ts.serving.Add(1)
+	ts.mu.Unlock()
+	defer ts.serving.Done()
+	defer ts.untrackListener(ol)
+	defer ol.Close() //关闭Listener
+
+	//获取Ctx，多个Accept循环会同时调用Serve，这里不写回ts.BaseContext
+	baseCtx := ts.BaseContext
+	if baseCtx == nil {
 		//BaseContext是一个初始化的上下文，用于存储一些基础信息
-		ts.BaseContext = context.Background()
+		baseCtx = context.Background()
 	}
 
-	//获取Ctx
-	baseCtx := ts.BaseContext
-
 	//ctx是对baseCtx的一个封装，在baseCtx上下文结构体中增加了ServerContextKey/ts键值对
 	ctx := context.WithValue(baseCtx, ServerContextKey, ts)
+	var tempDelay time.Duration //Accept临时出错后等待的时间
 	for {
 		rw, err := l.Accept()
 		if err != nil {
@@ -113,15 +168,37 @@ func (ts *TCPServer) Serve(l net.Listener) error {
 			if ts.shuttingDown() {
 				return ErrServerClosed
 			}
-			//这里为了简化实现，取消了重试机制
+			//和net/http一样，文件描述符用完等临时错误不退出，按指数退避重试：5ms、10ms……最多1秒
+			//否则一次EMFILE就会让整个代理停止服务
+			if isTemporaryAcceptError(err) {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				log.Printf("tcp: Accept error: %v; retrying in %v", err, tempDelay)
+				timer := time.NewTimer(tempDelay)
+				select {
+				case <-timer.C:
+				case <-ts.getDoneChan():
+					timer.Stop()
+					return ErrServerClosed
+				}
+				continue
+			}
 			return err
 		}
+		tempDelay = 0
 		//Accept的返回值是一个Conn接口，这里用newConn方法创建一个Conn实例，所以用c接收
 		//newConn方法，是对Conn接口的一个封装，增加了一些属性
 		//如果没有必要则可以直接使用Conn接口，不用newConn
 		c := ts.newConn(rw)
 		//http中，这里会对c的rwc，也就是底层链接设置状态，这里是TCP代理，不需要设置状态
 		//serve方法是对Conn接口的一个封装，增加了一些方法，生成一个更高级的Conn实例
+		atomic.AddInt64(&ts.activeConn, 1)
 		go c.serve(ctx)
 	}
 }
@@ -134,13 +211,13 @@ func (ts *TCPServer) newConn(rwc net.Conn) *conn {
 	}
 
 	//从TCPServer中取参数，设置TCPConn的超时参数
+	//包装成DeadlineConn，每次读写后刷新截止时间，而不是在这里设置一次绝对时间
+	c.rwc = NewDeadlineConn(rwc, ts.idleTimeout(), ts.MaxConnectionAge)
 
-	if t := ts.ReadTimeout; t != 0 {
-		c.rwc.SetReadDeadline(time.Now().Add(t)) //设置读取超时时间,当前系统时间加上t
-	}
-
-	if t := ts.WriteTimeout; t != 0 {
-		c.rwc.SetWriteDeadline(time.Now().Add(t)) //设置写超时时间,当前系统时间加上t
+	if ts.DisableNoDelay {
+		if tc, ok := rwc.(*net.TCPConn); ok {
+			tc.SetNoDelay(false)
+		}
 	}
 
 	if t := ts.KeepAlive; t != 0 {
@@ -154,6 +231,17 @@ func (ts *TCPServer) newConn(rwc net.Conn) *conn {
 	return c
 }
 
+// idleTimeout 空闲超时，没有设置时兼容原来的ReadTimeout、WriteTimeout
+func (ts *TCPServer) idleTimeout() time.Duration {
+	if ts.IdleTimeout != 0 {
+		return ts.IdleTimeout
+	}
+	if ts.ReadTimeout > ts.WriteTimeout {
+		return ts.ReadTimeout
+	}
+	return ts.WriteTimeout
+}
+
 func (c *conn) serve(ctx context.Context) {
 
 	//tcp中不需要响应头，所以这里省略
@@ -161,17 +249,31 @@ func (c *conn) serve(ctx context.Context) {
 	//无论是否有错误，最后都会关闭连接
 	defer func() {
 		if err := recover(); err != nil && err != ErrAbortHandler {
-			//设定一个栈大小，64KB，作为buf的长度
-			const size = 64 << 10
-			buf := make([]byte, size)
-			//runtime.Stack方法，获取当前goroutine的调用栈信息，返回值是int，也就是写入buf的字节数
-			//此时的buf是一个切片，所以buf[:n]是一个切片，也就是buf的前n个元素，输出的时候error
-			buf = buf[:runtime.Stack(buf, false)]
-			fmt.Printf("http: panic serving %v: %v\n%s", c.remoteAddr, err, buf)
+			logPanic(c.remoteAddr, err)
 		}
 		c.rwc.Close()
+		atomic.AddInt64(&c.server.activeConn, -1)
 	}()
 
+	//PROXY协议的头部在这里解析，而不是在Accept循环中，避免慢连接阻塞Accept
+	if c.server.ProxyProtocol {
+		pc := proxyproto.NewConn(c.rwc, c.server.ProxyProtocolConfig)
+		if _, err := pc.ReadHeader(); err != nil {
+			log.Printf("tcp: proxy protocol error from %v: %v", c.remoteAddr, err)
+			return
+		}
+		c.rwc = pc
+		c.remoteAddr = pc.RemoteAddr().String()
+		//HeaderTimeout会在读完头部后清空截止时间，这里恢复空闲超时
+		restoreDeadline(pc)
+	}
+
+	//访问列表在PROXY头部解析之后检查，被拒绝的连接不会到达Handler和它的中间件
+	if al := c.server.AccessList; al != nil && !al.Allowed(remoteIP(c.rwc.RemoteAddr())) {
+		log.Printf("tcp: %v from %v", ErrConnDenied, c.remoteAddr)
+		return
+	}
+
 	//在上下文中增加本地地址键值对LocoalAddrContextKey/c.rwc.LocalAddr()
 	ctx = context.WithValue(ctx, LocoalAddrContextKey, c.rwc.LocalAddr())
 
@@ -233,19 +335,103 @@ func (oc *onceCloseListener) Close() error {
 
 func (oc *onceCloseListener) close() { oc.closeErr = oc.Listener.Close() }
 
+// isTemporaryAcceptError 判断Accept的错误是否是临时的：文件描述符用完、内存不足、连接在Accept前被重置
+func isTemporaryAcceptError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
+
+// getDoneChan 懒加载doneChan，零值的TCPServer也能直接使用
+func (ts *TCPServer) getDoneChan() chan struct{} {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.doneChan == nil {
+		ts.doneChan = make(chan struct{})
+	}
+	return ts.doneChan
+}
+
+// untrackListener Serve返回后不再记录它的Listener，和net/http一样，
+// 监听被别人关闭（比如热升级）后，Close和Shutdown不会再去关闭它并返回错误
+func (ts *TCPServer) untrackListener(ol *onceCloseListener) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for i, l := range ts.listeners {
+		if l == ol {
+			ts.listeners = append(ts.listeners[:i], ts.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// closeListeners 关闭所有Listener，返回第一个错误
+func (ts *TCPServer) closeListeners() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	var err error
+	for _, l := range ts.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // Close 服务器关闭
 // 以下处理顺序不能变：
-// 需要关闭doneChan，因为它是一个容器，关闭后会释放资源
-// inShutdown设置为1，表示关闭
+// inShutdown设置为1，表示关闭，Accept循环看到它后返回ErrServerClosed
+// 需要关闭doneChan，正在退避等待的Accept循环会被唤醒
 // *onceCloseListener的Close方法会关闭Listener
 func (ts *TCPServer) Close() error {
 	//为了避免并发关闭，加锁，不能直接ts.inShutdown = 1
 	//这里用了原子操作,避免了加锁,类似于事务
 	atomic.StoreInt32(&ts.inShutdown, 1)
-	close(ts.doneChan) //关闭doneChan
-	err := ts.l.Close()
-	if err != nil {
-		return err
-	} //关闭Listener
-	return nil
+	return ts.closeListenersAndDone()
+}
+
+// closeListenersAndDone 关闭doneChan和所有Listener
+func (ts *TCPServer) closeListenersAndDone() error {
+	done := ts.getDoneChan()
+	ts.mu.Lock()
+	select {
+	case <-done: //已经关闭过了，重复关闭channel会panic
+	default:
+		close(done) //关闭doneChan
+	}
+	ts.mu.Unlock()
+	return ts.closeListeners() //关闭Listener
+}
+
+// Shutdown 优雅关闭：先关闭Listener不再接收新连接，再等待正在处理的连接结束
+// TCP没有HTTP那样的空闲连接可以主动关闭，只能等连接自己结束，或者ctx到期后返回ctx.Err()
+// ctx到期时仍然活跃的连接不会被关闭，调用方随后退出进程即可
+func (ts *TCPServer) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&ts.inShutdown, 1)
+	lnerr := ts.closeListenersAndDone()
+	ts.serving.Wait()
+
+	//和net/http一样轮询，开始时间隔短，之后逐渐变长，最多500毫秒
+	pollInterval := time.Millisecond
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	for {
+		if atomic.LoadInt64(&ts.activeConn) == 0 {
+			return lnerr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			if pollInterval *= 2; pollInterval > 500*time.Millisecond {
+				pollInterval = 500 * time.Millisecond
+			}
+			timer.Reset(pollInterval)
+		}
+	}
+}
+
+// ActiveConnections 正在处理的连接数
+func (ts *TCPServer) ActiveConnections() int64 {
+	return atomic.LoadInt64(&ts.activeConn)
 }
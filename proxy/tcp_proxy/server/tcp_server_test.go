@@ -0,0 +1,75 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"gateway/gatewaytest"
+	"gateway/proxy/tcp_proxy/server"
+)
+
+// echoHandler 把收到的数据原样写回
+type echoHandler struct{}
+
+func (echoHandler) ServeTCP(ctx context.Context, conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func TestTCPServer(t *testing.T) {
+	addr := gatewaytest.ServeTCP(t, nil, echoHandler{})
+	conn := gatewaytest.Dial(t, addr)
+	gatewaytest.AssertRoundTrip(t, conn, []byte("hello"))
+	gatewaytest.AssertRoundTrip(t, conn, make([]byte, 64<<10))
+}
+
+func TestTCPServerIdleTimeout(t *testing.T) {
+	addr := gatewaytest.ServeTCP(t, &server.TCPServer{IdleTimeout: 100 * time.Millisecond}, echoHandler{})
+	conn := gatewaytest.Dial(t, addr)
+	gatewaytest.AssertRoundTrip(t, conn, []byte("ping"))
+	gatewaytest.AssertClosed(t, conn)
+}
+
+// TestListenOptionsFromConfig 配置中的监听选项交给server.ListenConfig创建监听
+func TestListenOptionsFromConfig(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reuse_port and backlog are only supported on linux")
+	}
+	echo := gatewaytest.NewTCPEcho(t)
+	sock := filepath.Join(t.TempDir(), "gw.sock")
+	gw := gatewaytest.StartJSON(t, fmt.Sprintf(`{"tcp": [
+		{"name": "unix", "network": "unix", "addr": %q, "unix_socket_mode": "0600", "upstreams": [%q]},
+		{"name": "shared", "reuse_port": 2, "backlog": 16, "disable_no_delay": true, "upstreams": [%q]}]}`,
+		sock, echo.Addr(), echo.Addr()))
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, want 0600", fi.Mode().Perm())
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	gatewaytest.AssertRoundTrip(t, conn, []byte("over unix"))
+
+	//网关的监听开启了SO_REUSEPORT，同一个地址上还能再监听
+	addr := gw.Addr(t, "shared")
+	lns, err := (&server.ListenConfig{ReusePort: 1}).Listen(addr)
+	if err != nil {
+		t.Fatalf("listen on %s with SO_REUSEPORT: %v", addr, err)
+	}
+	lns[0].Close()
+	for i := 0; i < 4; i++ {
+		gatewaytest.AssertRoundTrip(t, gw.DialTCP(t, "shared"), []byte("over tcp"))
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"gateway/proxy/clientip"
+	"gateway/proxy/ratelimit"
 	"gateway/proxy/tcp_proxy/proxy"
 	"gateway/proxy/tcp_proxy/server"
 	"log"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 //TCP代理服务器，实现服务与代理分离
@@ -30,6 +33,9 @@ func main() {
 			//以下&tcpHandler{}是实现了TCPHandler接口的对象
 			//与http不同的是，这里是TCP，直接把连接交给客户端处理，实现代理连接读写
 			Handler: &Handler{},
+			//空闲30秒没有数据就断开，连接最长保持10分钟
+			IdleTimeout:      30 * time.Second,
+			MaxConnectionAge: 10 * time.Minute,
 		}
 
 		//2、启动监听提供服务
@@ -45,18 +51,41 @@ func main() {
 	//启动TCP代理客户端
 	go func() {
 		//1、创建TCP代理实例
-		tcpProxy := proxy.NewTCPReverseProxy(tcpServerAddr)
-		//2、启动监听提供服务
+		//第一个地址没有服务在监听，用来演示拨号失败后切换到下一个地址
+		tcpProxy := proxy.NewMultiTCPReverseProxy([]string{"127.0.0.1:8004", tcpServerAddr})
+		tcpProxy.DialTimeout = 2 * time.Second
+		tcpProxy.IdleTimeout = time.Minute
+		tcpProxy.OnError = func(ctx context.Context, src net.Conn, err *proxy.ProxyError) {
+			log.Printf("tcp proxy error from %v: %v", src.RemoteAddr(), err)
+		}
+		tcpProxy.OnClose = func(ctx context.Context, src net.Conn, stats proxy.Stats) {
+			log.Printf("tcp proxy %v -> %s closed, sent %d bytes, received %d bytes in %v",
+				src.RemoteAddr(), stats.Upstream, stats.BytesSent, stats.BytesReceived, stats.Duration)
+		}
+		//2、用中间件包装代理：panic兜底、连接日志、只允许本机访问、每秒最多100个新连接
+		local, err := clientip.NewAccessList([]string{"127.0.0.0/8", "::1"}, nil, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler := server.Chain(tcpProxy,
+			server.Recover(),
+			server.Logging(nil),
+			server.IPFilter(local),
+			server.RateLimit(ratelimit.NewLimiter(100, 200)),
+		)
+
+		//3、启动监听提供服务
 		fmt.Println("Starting TCP Proxy at " + tcpProxyAddr)
-		err := server.ListenAndServe(tcpProxyAddr, tcpProxy)
+		err = server.ListenAndServe(tcpProxyAddr, handler)
 		if err != nil {
 			return
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	//Signal Interrupt和Signal Terminate
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
 }
 
 // Handler 负责具体实现TCPHandler接口的对象
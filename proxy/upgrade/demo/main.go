@@ -0,0 +1,111 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gateway/proxy/tcp_proxy/server"
+	"gateway/proxy/upgrade"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// 零停机升级的演示，同时监听一个TCP服务和一个HTTP服务，都返回当前进程的pid
+// 用法：
+//
+//	go build -o /tmp/gateway-upgrade ./proxy/upgrade/demo
+//	/tmp/gateway-upgrade                启动服务，kill -USR2 <pid> 触发升级
+//	go test ./proxy/upgrade             升级过程中不停地建立连接，检查有没有失败的连接
+//
+// 升级时执行的是磁盘上的二进制，替换文件后再发SIGUSR2就能换成新版本
+
+var (
+	tcpAddr  = flag.String("tcp", "127.0.0.1:8090", "TCP服务的监听地址")
+	httpAddr = flag.String("http", "127.0.0.1:8091", "HTTP服务的监听地址")
+	pidFile  = flag.String("pidfile", filepath.Join(os.TempDir(), "gateway-upgrade.pid"), "就绪后写入pid的文件")
+)
+
+func main() {
+	flag.Parse()
+	if err := serve(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func serve() error {
+	upg, err := upgrade.New()
+	if err != nil {
+		return err
+	}
+	upg.PIDFile = *pidFile
+	pid := os.Getpid()
+
+	//1、监听：升级启动的子进程会拿到父进程的socket，否则新建
+	tln, err := upg.Listen("tcp", *tcpAddr)
+	if err != nil {
+		return err
+	}
+	hln, err := upg.Listen("tcp", *httpAddr)
+	if err != nil {
+		return err
+	}
+
+	//2、提供服务
+	tcpServer := &server.TCPServer{
+		Handler: server.TCPHandlerFunc(func(ctx context.Context, conn net.Conn) {
+			fmt.Fprintf(conn, "pid %d\n", pid)
+		}),
+	}
+	httpServer := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "pid %d\n", pid)
+		}),
+	}
+	//关闭时先等刚Accept的连接读到请求，见下面第5步
+	shutdownHTTP := upgrade.GracefulShutdown(httpServer)
+	go tcpServer.Serve(tln)
+	go httpServer.Serve(hln)
+
+	//3、通知父进程可以退出了
+	if err := upg.Ready(); err != nil {
+		return err
+	}
+	log.Printf("pid %d serving tcp %s, http %s", pid, *tcpAddr, *httpAddr)
+
+	//4、SIGUSR2升级，SIGINT、SIGTERM退出
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2, syscall.SIGINT, syscall.SIGTERM)
+wait:
+	for {
+		select {
+		case s := <-sig:
+			if s != syscall.SIGUSR2 {
+				break wait
+			}
+			log.Printf("pid %d upgrading", pid)
+			if err := upg.Upgrade(); err != nil {
+				log.Printf("pid %d upgrade failed: %v", pid, err)
+			}
+		case <-upg.Exit():
+			break wait
+		}
+	}
+
+	//5、不再接收新连接，等已有的连接处理完后退出
+	//http.Server.Shutdown之后才读到请求的连接会被直接关闭，客户端看到EOF
+	//升级成功时Listener已经关了，shutdownHTTP先等刚Accept的连接读到请求，再调用Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	shutdownHTTP(ctx)
+	tcpServer.Shutdown(ctx)
+	log.Printf("pid %d exited", pid)
+	return nil
+}
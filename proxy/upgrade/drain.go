@@ -0,0 +1,44 @@
+package upgrade
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// newConnWait Shutdown之前等待新连接读到请求的最长时间
+const newConnWait = time.Second
+
+// GracefulShutdown 记录srv上已经Accept、还没读到请求的连接，返回代替srv.Shutdown的关闭函数，必须在Serve之前调用
+// http.Server.Shutdown之后才读到请求的连接会被直接关闭，客户端看到EOF
+// 升级成功时Listener已经关了，关闭函数先等刚Accept的连接读到请求，再调用Shutdown
+func GracefulShutdown(srv *http.Server) func(ctx context.Context) error {
+	var newConns int64
+	var pending sync.Map
+	next := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		//离开StateNew时减一，用map记录哪些连接还处于StateNew，长连接之后的状态变化不影响计数
+		if state == http.StateNew {
+			pending.Store(conn, struct{}{})
+			atomic.AddInt64(&newConns, 1)
+		} else if _, ok := pending.LoadAndDelete(conn); ok {
+			atomic.AddInt64(&newConns, -1)
+		}
+		if next != nil {
+			next(conn, state)
+		}
+	}
+	return func(ctx context.Context) error {
+		for deadline := time.Now().Add(newConnWait); atomic.LoadInt64(&newConns) > 0 && time.Now().Before(deadline); {
+			select {
+			case <-ctx.Done():
+				return srv.Shutdown(ctx)
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+		return srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,287 @@
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 零停机升级：优雅关闭只能保证已有的连接处理完，但新进程启动之前端口是关着的，这段时间的连接会被拒绝
+// 这里参考nginx的做法，让新旧进程共用同一个监听socket：
+// 1、旧进程收到SIGUSR2后，用新的二进制启动子进程，把监听socket作为继承的文件描述符传下去
+// 2、子进程用继承的socket创建Listener，开始Accept后通过管道告诉父进程自己就绪了
+// 3、父进程关闭自己的Listener（socket还被子进程持有，不会关闭），等已有的连接处理完后退出
+// 子进程没有在ReadyTimeout内就绪时，父进程杀掉它并继续提供服务，升级失败不影响线上
+//
+// 文件描述符的约定：3是就绪管道的写端，4开始依次是监听socket，名字通过环境变量传递
+
+const (
+	envReady     = "GATEWAY_UPGRADE_READY"
+	envListeners = "GATEWAY_UPGRADE_LISTENERS"
+)
+
+var (
+	// ErrUpgradeInProgress 上一次升级还没有结束
+	ErrUpgradeInProgress = errors.New("upgrade: upgrade already in progress")
+	// ErrUpgradeDone 已经升级成功，当前进程正在退出
+	ErrUpgradeDone = errors.New("upgrade: already upgraded, process is exiting")
+	// ErrReadyTimeout 子进程没有在ReadyTimeout内就绪
+	ErrReadyTimeout = errors.New("upgrade: timed out waiting for new process")
+)
+
+// Upgrader 管理可以被继承的监听socket
+type Upgrader struct {
+	//ReadyTimeout 等待新进程就绪的时间，默认1分钟
+	ReadyTimeout time.Duration
+	//PIDFile 就绪后把pid写入这个文件，systemd等进程管理器可以据此找到新进程，为空时不写
+	PIDFile string
+
+	mu        sync.Mutex
+	inherited map[string][]*os.File //从父进程继承、还没有被Listen取走的socket
+	listeners []listener            //当前进程正在使用的Listener，升级时传给子进程
+	readyPipe *os.File              //子进程中指向父进程的就绪管道
+	upgrading bool
+	exitC     chan struct{}
+}
+
+type listener struct {
+	key string
+	ln  net.Listener
+}
+
+// filer TCPListener和UnixListener都有File方法，返回复制出来的文件描述符
+type filer interface {
+	File() (*os.File, error)
+}
+
+// New 创建Upgrader，如果当前进程是升级启动的子进程，读取继承的socket
+func New() (*Upgrader, error) {
+	u := &Upgrader{inherited: make(map[string][]*os.File), exitC: make(chan struct{})}
+
+	fd := 3
+	if os.Getenv(envReady) != "" {
+		u.readyPipe = os.NewFile(uintptr(fd), "upgrade-ready")
+		fd++
+	}
+	if names := os.Getenv(envListeners); names != "" {
+		for _, key := range strings.Split(names, ",") {
+			f := os.NewFile(uintptr(fd), key)
+			if f == nil {
+				return nil, fmt.Errorf("upgrade: invalid inherited fd %d for %s", fd, key)
+			}
+			u.inherited[key] = append(u.inherited[key], f)
+			fd++
+		}
+	}
+	//清掉环境变量，之后启动的其它子进程不会误以为自己是升级启动的
+	os.Unsetenv(envReady)
+	os.Unsetenv(envListeners)
+	return u, nil
+}
+
+// HasParent 当前进程是否由升级启动，父进程还在等它就绪
+func (u *Upgrader) HasParent() bool {
+	return u.readyPipe != nil
+}
+
+// Listen 创建Listener，有继承下来的同名socket时直接使用，否则新建
+// 新旧两个版本必须用相同的network和addr调用，才能对上继承的socket
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	return u.ListenWith(network, addr, net.Listen)
+}
+
+// ListenWith 和Listen相同，只是没有继承的socket时用create新建
+// SO_REUSEPORT等选项必须在bind之前设置，只能由create完成；继承的socket上已经设置过了
+// 同一个地址调用多次时依次取走继承的socket，开启SO_REUSEPORT的多个Listener也能对上
+func (u *Upgrader) ListenWith(network, addr string, create func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	key := network + ":" + addr
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if files := u.inherited[key]; len(files) > 0 {
+		f := files[0]
+		u.inherited[key] = files[1:]
+		ln, err := net.FileListener(f)
+		//FileListener复制了一份文件描述符，这里的可以关掉了
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("upgrade: inherit %s: %w", key, err)
+		}
+		u.listeners = append(u.listeners, listener{key, ln})
+		return ln, nil
+	}
+
+	ln, err := create(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	u.listeners = append(u.listeners, listener{key, ln})
+	return ln, nil
+}
+
+// Ready 当前进程已经开始提供服务，通知父进程退出
+// 没有被Listen取走的继承socket会被关闭，不是升级启动的进程调用它只会写PID文件
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, files := range u.inherited {
+		for _, f := range files {
+			f.Close()
+		}
+		delete(u.inherited, key)
+	}
+	if u.PIDFile != "" {
+		if err := writePIDFile(u.PIDFile); err != nil {
+			return err
+		}
+	}
+	if u.readyPipe == nil {
+		return nil
+	}
+	_, err := u.readyPipe.Write([]byte{1})
+	u.readyPipe.Close()
+	u.readyPipe = nil
+	return err
+}
+
+// writePIDFile 先写临时文件再改名，读的一方不会读到写了一半的内容
+func writePIDFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	return os.Rename(tmp.Name(), path)
+}
+
+// Exit 升级成功后关闭，此时Listen返回的Listener都已经关闭，新连接全部由新进程接收
+// 当前进程处理完已有的连接后退出
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.exitC
+}
+
+// Upgrade 启动新的二进制并把监听socket传给它，等它就绪后返回
+// 返回nil表示升级成功，Exit()随即关闭；返回错误时当前进程照常提供服务
+// 二进制文件路径取os.Executable()，命令行参数和环境变量与当前进程相同
+func (u *Upgrader) Upgrade() error {
+	u.mu.Lock()
+	select {
+	case <-u.exitC:
+		u.mu.Unlock()
+		return ErrUpgradeDone
+	default:
+	}
+	if u.upgrading {
+		u.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	u.upgrading = true
+	listeners := append([]listener(nil), u.listeners...)
+	u.mu.Unlock()
+
+	err := u.upgrade(listeners)
+
+	u.mu.Lock()
+	u.upgrading = false
+	if err == nil {
+		close(u.exitC)
+	}
+	u.mu.Unlock()
+	return err
+}
+
+func (u *Upgrader) upgrade(listeners []listener) error {
+	//复制每个Listener的文件描述符，子进程启动后这边的副本就可以关掉了
+	keys := make([]string, 0, len(listeners))
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		fl, ok := l.ln.(filer)
+		if !ok {
+			return fmt.Errorf("upgrade: listener %s can not be inherited", l.key)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("upgrade: listener %s: %w", l.key, err)
+		}
+		keys = append(keys, l.key)
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), envReady+"=1", envListeners+"="+strings.Join(keys, ","))
+	cmd.ExtraFiles = append([]*os.File{w}, files...)
+	err = cmd.Start()
+	//父进程必须关掉写端，子进程退出时读端才能读到EOF
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("upgrade: start %s: %w", exe, err)
+	}
+
+	timeout := u.ReadyTimeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if n, err := r.Read(buf); n == 1 {
+			ready <- nil
+		} else {
+			ready <- fmt.Errorf("upgrade: new process exited before ready: %v", err)
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-ready:
+	case <-timer.C:
+		err = ErrReadyTimeout
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	//新进程会比当前进程活得久，这里只是在当前进程退出前回收它，避免出现僵尸进程
+	go cmd.Wait()
+
+	//马上关闭自己的Listener，不再和新进程抢连接，之后Accept到的连接都属于新进程
+	//unix socket的Listener关闭时默认会删除socket文件，新进程还在用，不能删
+	for _, l := range listeners {
+		if ul, ok := l.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.ln.Close()
+	}
+	return nil
+}
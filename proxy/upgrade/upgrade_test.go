@@ -0,0 +1,255 @@
+//go:build !windows
+
+package upgrade_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"gateway/app"
+	"gateway/config"
+	"gateway/gatewaytest"
+	"gateway/proxy/upgrade"
+)
+
+// 测试进程重新执行自己：带上envTestServer时作为被升级的网关运行，升级时Upgrade执行的也是测试二进制，
+// 参数和环境变量相同，所以新进程同样进入网关模式
+// 网关就是cmd/gateway run运行的app.App，HTTP响应头中带上处理请求的进程pid
+
+const (
+	envTestServer = "GATEWAY_UPGRADE_TEST_SERVER"
+	envTestConfig = "GATEWAY_UPGRADE_TEST_CONFIG"
+	envTestPID    = "GATEWAY_UPGRADE_TEST_PIDFILE"
+	headerPID     = "X-Gateway-Pid"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv(envTestServer) != "" {
+		if err := serveForTest(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// serveForTest 和cmd/gateway run相同：用upgrade.Upgrader的监听运行app.App，SIGUSR2升级，SIGTERM退出
+func serveForTest() error {
+	upg, err := upgrade.New()
+	if err != nil {
+		return err
+	}
+	upg.PIDFile = os.Getenv(envTestPID)
+	pid := os.Getpid()
+
+	cfg, err := config.Parse([]byte(os.Getenv(envTestConfig)))
+	if err != nil {
+		return err
+	}
+	for i := range cfg.HTTP[0].Routes {
+		cfg.HTTP[0].Routes[i].ResponseHeaders = &config.HeaderRules{Set: map[string]string{headerPID: strconv.Itoa(pid)}}
+	}
+	a, err := app.New(cfg)
+	if err != nil {
+		return err
+	}
+	a.Listen = upg.ListenWith
+	if err := a.Start(); err != nil {
+		return err
+	}
+	if err := upg.Ready(); err != nil {
+		return err
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2, syscall.SIGTERM)
+wait:
+	for {
+		select {
+		case s := <-sig:
+			if s != syscall.SIGUSR2 {
+				break wait
+			}
+			if err := upg.Upgrade(); err != nil {
+				fmt.Fprintf(os.Stderr, "pid %d upgrade failed: %v\n", pid, err)
+			}
+		case <-upg.Exit():
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return a.Shutdown(ctx)
+}
+
+// TestUpgradeNoDroppedConnections 几个客户端不停地建立新连接，期间触发升级，
+// 升级前后都不能有失败的连接，并且新旧两个进程都处理过请求
+func TestUpgradeNoDroppedConnections(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts two server processes")
+	}
+	dir := t.TempDir()
+	pidFile := dir + "/upgrade.pid"
+	tcpAddr, httpAddr := freeAddr(t), freeAddr(t)
+	//上游在测试进程中，新旧两个网关进程转发到同一组上游
+	web := gatewaytest.NewHTTPUpstream(t, "web", nil)
+	echo := gatewaytest.NewTCPEcho(t)
+	cfg := fmt.Sprintf(`{"http": [{"name": "http", "addr": %q, "routes": [{"path_prefix": "/", "targets": [%q]}]}],
+		"tcp": [{"name": "tcp", "addr": %q, "upstreams": [%q]}]}`, httpAddr, web.URL, tcpAddr, echo.Addr())
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), envTestServer+"=1", envTestConfig+"="+cfg, envTestPID+"="+pidFile)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var second int
+	t.Cleanup(func() {
+		//旧进程升级后自己退出，新进程由这里结束
+		if second != 0 {
+			syscall.Kill(second, syscall.SIGTERM)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	first := waitPID(t, pidFile, 0)
+
+	var (
+		ok, failed int64
+		mu         sync.Mutex
+		pids       = make(map[string]int)
+		wg         sync.WaitGroup
+		stop       = make(chan struct{})
+	)
+	//关闭长连接，每个请求都是一个新连接
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				//TCP连接只检查有没有失败，HTTP响应头中的pid记录是哪个进程处理的
+				var pid string
+				var err error
+				if i%2 == 0 {
+					err = tcpEcho(tcpAddr)
+				} else {
+					pid, err = httpGet(client, "http://"+httpAddr+"/")
+				}
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					t.Logf("connection failed: %v", err)
+					continue
+				}
+				atomic.AddInt64(&ok, 1)
+				if pid != "" {
+					mu.Lock()
+					pids[pid]++
+					mu.Unlock()
+				}
+			}
+		}(i)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	syscall.Kill(first, syscall.SIGUSR2)
+	second = waitPID(t, pidFile, first)
+	time.Sleep(500 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	t.Logf("%d ok, %d failed, responses by process: %v", ok, failed, pids)
+	if failed > 0 {
+		t.Errorf("%d connections failed during the upgrade", failed)
+	}
+	for _, pid := range []int{first, second} {
+		if pids[strconv.Itoa(pid)] == 0 {
+			t.Errorf("process %d served no connections", pid)
+		}
+	}
+}
+
+// freeAddr 先占一个端口再关闭，子进程随后在这个地址上监听
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// waitPID 等待PID文件中出现一个不等于old的pid
+func waitPID(t *testing.T, path string, old int) int {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if b, err := os.ReadFile(path); err == nil {
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil && pid != old {
+				return pid
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no new pid in %s", path)
+	return 0
+}
+
+// tcpEcho 经过网关的TCP代理发送一行数据，检查回显
+func tcpEcho(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != "ping\n" {
+		return fmt.Errorf("echo %q, want ping", line)
+	}
+	return nil
+}
+
+// httpGet 返回处理请求的网关进程pid
+func httpGet(client *http.Client, url string) (string, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if _, err := io.Copy(io.Discard, res.Body); err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", res.StatusCode)
+	}
+	return res.Header.Get(headerPID), nil
+}
@@ -0,0 +1,131 @@
+package waf
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// SQL注入和XSS的检测：先把值规范化（反复URL解码、HTML实体解码、小写、去掉SQL注释、合并空白），
+// 再匹配一组常见的攻击特征。这是启发式的检测，目标是挡住扫描器和常见的手工注入，不是完整的SQL解析器
+
+var sqliPatterns = compileAll(
+	//' or 1=1、" or "a"="a、') or ('x'='x
+	`['"`+"`"+`)]\s*(or|and|xor|\|\||&&)\s*['"(]?\s*[\w'"]+\s*['"]?\s*(=|<>|!=|<|>|like\b|is\b)`,
+	`['"]\s*(or|and)\s+(true|false|not\b|\d)`,
+	`\bunion\b(\s+(all|distinct))?\s+select\b`,
+	`;\s*(drop|delete|insert|update|alter|create|truncate|exec|shutdown)\b`,
+	`\b(sleep|benchmark|pg_sleep|waitfor\s+delay)\s*[('"]`,
+	`\b(information_schema|mysql\.user|sysobjects|pg_catalog|sqlite_master)\b`,
+	`\(\s*select\b.{1,100}\bfrom\b`,
+	`['"]\s*(--|#)`,
+	`\b(load_file|into\s+(out|dump)file)\b`,
+	`\b(extractvalue|updatexml)\s*\(`,
+	`\border\s+by\s+\d+\s*(--|#)`,
+)
+
+var xssPatterns = compileAll(
+	`<\s*script\b`,
+	`<\s*/\s*script\s*>`,
+	`\bjavascript\s*:`,
+	`\bvbscript\s*:`,
+	`<[^>]*\bon[a-z]+\s*=`,
+	`<\s*(iframe|frame|object|embed|applet|base|meta|svg|math|form|isindex)\b`,
+	`\bsrcdoc\s*=`,
+	`\bexpression\s*\(`,
+	`\bdocument\s*\.\s*(cookie|domain|write)`,
+	`\b(alert|prompt|confirm|eval)\s*[(`+"`"+`]`,
+	`data\s*:\s*text/html`,
+)
+
+func compileAll(patterns ...string) []*regexp.Regexp {
+	out := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		out[i] = regexp.MustCompile(`(?is)` + p)
+	}
+	return out
+}
+
+var sqlComment = regexp.MustCompile(`/\*.*?\*/`)
+
+// normalize 反复解码直到不再变化（最多3次），防止双重编码绕过
+func normalize(s string) string {
+	for i := 0; i < 3; i++ {
+		d := html.UnescapeString(urlDecode(s))
+		if d == s {
+			break
+		}
+		s = d
+	}
+	return strings.ToLower(s)
+}
+
+// urlDecode 宽松的URL解码：解码合法的%XX和+，不合法的%原样保留
+// url.QueryUnescape遇到一个错误的编码就整个失败，攻击者可以借此让检查看到的是未解码的原文
+func urlDecode(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]):
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// DetectSQLi 判断值中是否有SQL注入的特征
+func DetectSQLi(v string) bool {
+	if v == "" {
+		return false
+	}
+	s := normalize(v)
+	//union/**/select 这类用注释代替空白的写法
+	s = sqlComment.ReplaceAllString(s, " ")
+	s = whitespace.ReplaceAllString(s, " ")
+	for _, re := range sqliPatterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectXSS 判断值中是否有跨站脚本的特征
+func DetectXSS(v string) bool {
+	if v == "" {
+		return false
+	}
+	s := normalize(v)
+	//java\tscript: 这类在关键字中插入控制字符的写法，浏览器会忽略这些字符
+	s = strings.NewReplacer("\x00", "", "\t", "", "\n", "", "\r", "").Replace(s)
+	s = whitespace.ReplaceAllString(s, " ")
+	for _, re := range xssPatterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
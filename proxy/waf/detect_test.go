@@ -0,0 +1,77 @@
+package waf
+
+import "testing"
+
+func TestDetectSQLi(t *testing.T) {
+	attacks := []string{
+		`' or 1=1--`,
+		`admin'--`,
+		`" OR "a"="a`,
+		`') or ('x'='x`,
+		`1 UNION ALL SELECT username, password FROM users`,
+		`1 union/**/select null`,
+		`1; DROP TABLE users`,
+		`1 and sleep(5)`,
+		`x' AND extractvalue(1, concat(0x7e, version()))`,
+		`1 order by 3--`,
+		//双重URL编码的' or 1=1
+		`%2527%2520or%25201%253D1`,
+		//错误的%不影响后面的解码
+		`%zz%27%20or%201=1`,
+	}
+	for _, s := range attacks {
+		if !DetectSQLi(s) {
+			t.Errorf("DetectSQLi(%q) = false", s)
+		}
+	}
+	benign := []string{
+		``,
+		`{"id":1,"name":"O'Brien","tags":["a","b"],"active":true}`,
+		`{"query":"select","from":"2024-01-01","order":"desc"}`,
+		`It's a nice day, isn't it? Let's go out or stay in.`,
+		`I'd like to select a plan from the list and update my address`,
+		`Rock 'n' roll and the 80's`,
+		`Tom's and Jerry's`,
+		`100% + 50% = 150%`,
+		`C:\Program Files\app`,
+	}
+	for _, s := range benign {
+		if DetectSQLi(s) {
+			t.Errorf("DetectSQLi(%q) = true, false positive", s)
+		}
+	}
+}
+
+func TestDetectXSS(t *testing.T) {
+	attacks := []string{
+		`<script>alert(1)</script>`,
+		`<SCRIPT SRC=//evil.example/x.js>`,
+		`<img src=x onerror=alert(1)>`,
+		`<svg/onload=alert(1)>`,
+		`<a href="java	script:alert(1)">`,
+		`&lt;script&gt;alert(1)&lt;/script&gt;`,
+		`%253Cscript%253E`,
+		`<iframe srcdoc="<p>x">`,
+		`data:text/html;base64,PHNjcmlwdD4=`,
+		"eval`1`",
+	}
+	for _, s := range attacks {
+		if !DetectXSS(s) {
+			t.Errorf("DetectXSS(%q) = false", s)
+		}
+	}
+	benign := []string{
+		``,
+		`{"id":1,"html":false,"onload":true,"script":"deploy.sh"}`,
+		`It's 3 < 5 and 7 > 2, isn't it?`,
+		`I <3 cats`,
+		`Don't forget to confirm your email address`,
+		`The JavaScript guide's chapter on events`,
+		`https://example.com/docs?section=on-click`,
+	}
+	for _, s := range benign {
+		if DetectXSS(s) {
+			t.Errorf("DetectXSS(%q) = true, false positive", s)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package waf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gateway/proxy/clientip"
+)
+
+// DefaultMaxBodySize 默认检查的请求体大小，超出的部分不检查，但会原样转发
+const DefaultMaxBodySize = 64 << 10
+
+// TagsHeader tag动作命中的标签用逗号连接后放在这个请求头里转发给上游
+// 客户端自己带的同名请求头总是会被删掉，防止伪造
+const TagsHeader = "X-Waf-Tags"
+
+// Match 一条命中的规则
+type Match struct {
+	RuleID string
+	Action string
+	//Target 命中的位置，比如query:id、header:User-Agent、body
+	Target string
+	Score  int
+}
+
+// Verdict 一次检查的结果
+type Verdict struct {
+	//Blocked 为true时请求被拦截，RuleID是导致拦截的规则
+	//异常评分模式下是让总分达到阈值的那条规则
+	Blocked bool
+	RuleID  string
+	//Score 异常评分模式下的总分
+	Score   int
+	Matches []Match
+	Tags    []string
+}
+
+// ErrorPage 拦截时返回的页面
+type ErrorPage struct {
+	//Status 默认403
+	Status int
+	//ContentType 默认text/html; charset=utf-8
+	ContentType string
+	//Body 页面内容，其中的{{rule_id}}会替换成命中的规则ID
+	Body string
+}
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html><head><title>Request blocked</title></head>
+<body><h1>Request blocked</h1><p>Your request was blocked by the gateway firewall (rule {{rule_id}}).</p></body></html>
+`
+
+// Engine 按规则集检查请求
+type Engine struct {
+	//Sets 按名字索引的规则集
+	Sets map[string]*RuleSet
+	//MaxBodySize 检查的请求体大小，为0时使用DefaultMaxBodySize
+	MaxBodySize int64
+	ErrorPage   ErrorPage
+	//Logger 记录拦截和log动作，为nil时使用log包默认的Logger
+	Logger *log.Logger
+}
+
+// NewEngine 用LoadRules或ParseRules的结果创建检查引擎
+func NewEngine(sets map[string]*RuleSet) *Engine {
+	return &Engine{Sets: sets}
+}
+
+// Inspect 用规则集检查请求，需要检查请求体时会读出最多MaxBodySize字节，
+// 读过的部分和剩下的部分重新拼回r.Body，上游收到的请求体不变
+func (e *Engine) Inspect(set *RuleSet, r *http.Request) *Verdict {
+	req := &request{r: r, maxBody: e.MaxBodySize}
+	v := &Verdict{}
+	for i := range set.Rules {
+		rule := &set.Rules[i]
+		target, ok := req.match(rule)
+		if !ok {
+			continue
+		}
+		m := Match{RuleID: rule.ID, Action: rule.Action, Target: target}
+		switch rule.Action {
+		case ActionTag:
+			v.Tags = append(v.Tags, rule.Tag)
+		case ActionBlock:
+			if set.Mode == ModeScore {
+				m.Score = rule.Score
+				v.Score += rule.Score
+				if v.Score >= set.Threshold {
+					v.Blocked = true
+				}
+			} else {
+				v.Blocked = true
+			}
+		}
+		v.Matches = append(v.Matches, m)
+		if v.Blocked {
+			v.RuleID = rule.ID
+			break
+		}
+	}
+	return v
+}
+
+// Middleware 用规则集检查经过路由的请求，route只用于日志
+func (e *Engine) Middleware(route string, set *RuleSet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(TagsHeader)
+		v := e.Inspect(set, r)
+		for _, m := range v.Matches {
+			if m.Action == ActionLog {
+				e.logf("waf: route %q rule set %q rule %s matched %s %s from %s (target %s)",
+					route, set.Name, m.RuleID, r.Method, r.URL.Path, clientip.String(r), m.Target)
+			}
+		}
+		if v.Blocked {
+			m := v.Matches[len(v.Matches)-1]
+			score := ""
+			if set.Mode == ModeScore {
+				score = fmt.Sprintf(", score %d/%d", v.Score, set.Threshold)
+			}
+			e.logf("waf: route %q rule set %q blocked %s %s from %s: rule %s (target %s%s)",
+				route, set.Name, r.Method, r.URL.Path, clientip.String(r), v.RuleID, m.Target, score)
+			e.writeErrorPage(w, v.RuleID)
+			return
+		}
+		if len(v.Tags) > 0 {
+			r.Header.Set(TagsHeader, strings.Join(v.Tags, ","))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *Engine) writeErrorPage(w http.ResponseWriter, ruleID string) {
+	p := e.ErrorPage
+	if p.Status == 0 {
+		p.Status = http.StatusForbidden
+	}
+	if p.ContentType == "" {
+		p.ContentType = "text/html; charset=utf-8"
+	}
+	if p.Body == "" {
+		p.Body = defaultErrorPage
+	}
+	body := strings.ReplaceAll(p.Body, "{{rule_id}}", ruleID)
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(p.Status)
+	io.WriteString(w, body)
+}
+
+func (e *Engine) logf(format string, args ...interface{}) {
+	if e.Logger != nil {
+		e.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// request 一次检查中要用到的请求内容，查询参数、Cookie和请求体只在有规则用到时解析一次
+type request struct {
+	r       *http.Request
+	maxBody int64
+
+	query   url.Values
+	cookies []*http.Cookie
+	body    *string
+}
+
+// match 依次检查规则的每个位置，返回第一个命中的位置
+func (q *request) match(rule *Rule) (string, bool) {
+	for _, t := range rule.Targets {
+		name, arg, _ := strings.Cut(t, ":")
+		for _, v := range q.values(name, arg) {
+			if rule.match(v) {
+				return t, true
+			}
+		}
+		//negate的规则在值为空（比如没有这个请求头）时也要能命中
+		if rule.Negate && len(q.values(name, arg)) == 0 && rule.match("") {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func (q *request) values(name, arg string) []string {
+	switch name {
+	case "method":
+		return []string{q.r.Method}
+	case "path":
+		return []string{q.r.URL.Path}
+	case "query":
+		query := q.parseQuery()
+		if arg != "" {
+			return query[arg]
+		}
+		var vs []string
+		for k, list := range query {
+			vs = append(vs, k)
+			vs = append(vs, list...)
+		}
+		return vs
+	case "headers":
+		var vs []string
+		for _, list := range q.r.Header {
+			vs = append(vs, list...)
+		}
+		return vs
+	case "header":
+		return q.r.Header.Values(arg)
+	case "cookies", "cookie":
+		if q.cookies == nil {
+			q.cookies = q.r.Cookies()
+		}
+		var vs []string
+		for _, c := range q.cookies {
+			if arg == "" || c.Name == arg {
+				vs = append(vs, c.Value)
+			}
+		}
+		return vs
+	case "body":
+		if b := q.readBody(); b != "" {
+			return []string{b}
+		}
+	}
+	return nil
+}
+
+// parseQuery 解析查询参数，编码有错的查询串把原文也加进去检查，防止用错误的编码绕过
+func (q *request) parseQuery() url.Values {
+	if q.query == nil {
+		var err error
+		q.query, err = url.ParseQuery(q.r.URL.RawQuery)
+		if err != nil {
+			q.query.Add("", q.r.URL.RawQuery)
+		}
+	}
+	return q.query
+}
+
+// readBody 读出请求体的前maxBody字节用于检查，再和剩下的部分拼回去
+func (q *request) readBody() string {
+	if q.body != nil {
+		return *q.body
+	}
+	var s string
+	q.body = &s
+	r := q.r
+	if r.Body == nil || r.Body == http.NoBody {
+		return s
+	}
+	max := q.maxBody
+	if max <= 0 {
+		max = DefaultMaxBodySize
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, max))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), errReader{err}, r.Body), r.Body}
+	s = string(buf)
+	return s
+}
+
+// errReader 读请求体出错时把错误留给上游的转发去报告
+type errReader struct{ err error }
+
+func (e errReader) Read(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,142 @@
+package waf
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, data string) map[string]*RuleSet {
+	t.Helper()
+	sets, err := ParseRules([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sets
+}
+
+const testRules = `{"rule_sets": {
+	"strict": {"rules": [
+		{"id": "ua", "targets": ["header:User-Agent"], "operator": "contains", "value": "sqlmap", "transforms": ["lowercase"], "score": 3},
+		{"id": "sqli", "targets": ["query", "body"], "operator": "sqli", "score": 3},
+		{"id": "tag-admin", "targets": ["path"], "operator": "prefix", "value": "/admin", "action": "tag", "tag": "admin"}
+	]},
+	"scored": {"mode": "score", "threshold": 6, "rules": [
+		{"id": "ua", "targets": ["header:User-Agent"], "operator": "contains", "value": "sqlmap", "transforms": ["lowercase"], "score": 3},
+		{"id": "sqli", "targets": ["query", "body"], "operator": "sqli", "score": 3},
+		{"id": "log-all", "targets": ["method"], "operator": "equals", "value": "GET", "action": "log"}
+	]},
+	"methods": {"rules": [
+		{"id": "no-ua", "targets": ["header:User-Agent"], "operator": "regex", "value": ".", "negate": true},
+		{"id": "method", "targets": ["method"], "operator": "regex", "value": "^(GET|POST)$", "negate": true}
+	]}
+}}`
+
+// TestInspectModes block模式命中一条就拦截，score模式累加到阈值才拦截
+func TestInspectModes(t *testing.T) {
+	e := NewEngine(mustParse(t, testRules))
+	newReq := func(ua, query string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/admin/x?"+query, nil)
+		r.Header.Set("User-Agent", ua)
+		return r
+	}
+
+	v := e.Inspect(e.Sets["strict"], newReq("SQLMap/1.7", "id=1"))
+	if !v.Blocked || v.RuleID != "ua" || len(v.Matches) != 1 {
+		t.Errorf("block mode: %+v", v)
+	}
+	v = e.Inspect(e.Sets["strict"], newReq("curl", "id=1"))
+	if v.Blocked || len(v.Tags) != 1 || v.Tags[0] != "admin" {
+		t.Errorf("block mode, clean request: %+v", v)
+	}
+
+	//一条规则只有3分，不到阈值6
+	v = e.Inspect(e.Sets["scored"], newReq("SQLMap/1.7", "id=1"))
+	if v.Blocked || v.Score != 3 {
+		t.Errorf("score mode, one rule: %+v", v)
+	}
+	//第二条规则让总分到6，RuleID是让总分达到阈值的那条，后面的规则不再检查
+	v = e.Inspect(e.Sets["scored"], newReq("SQLMap/1.7", "id=1%27%20or%201=1--"))
+	if !v.Blocked || v.Score != 6 || v.RuleID != "sqli" || len(v.Matches) != 2 {
+		t.Errorf("score mode, threshold reached: %+v", v)
+	}
+	//log动作不计分也不拦截
+	v = e.Inspect(e.Sets["scored"], newReq("curl", "q=it%27s"))
+	if v.Blocked || v.Score != 0 || len(v.Matches) != 1 || v.Matches[0].Action != ActionLog {
+		t.Errorf("score mode, log only: %+v", v)
+	}
+}
+
+// TestInspectNegate negate的规则在请求没有这个位置时也能命中
+func TestInspectNegate(t *testing.T) {
+	e := NewEngine(mustParse(t, testRules))
+	set := e.Sets["methods"]
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Del("User-Agent")
+	if v := e.Inspect(set, r); !v.Blocked || v.RuleID != "no-ua" || v.Matches[0].Target != "header:User-Agent" {
+		t.Errorf("missing User-Agent: %+v", v)
+	}
+	r.Header.Set("User-Agent", "curl")
+	if v := e.Inspect(set, r); v.Blocked {
+		t.Errorf("GET with User-Agent: %+v", v)
+	}
+	r.Method = http.MethodDelete
+	if v := e.Inspect(set, r); !v.Blocked || v.RuleID != "method" {
+		t.Errorf("DELETE: %+v", v)
+	}
+}
+
+// TestInspectBody 只检查前MaxBodySize字节，上游收到完整的请求体
+func TestInspectBody(t *testing.T) {
+	e := NewEngine(mustParse(t, testRules))
+	e.MaxBodySize = 16
+	e.Logger = log.New(io.Discard, "", 0)
+	set := e.Sets["strict"]
+
+	body := `{"comment":"fine"}` + strings.Repeat("x", 100) + `' or 1=1--`
+	var got string
+	h := e.Middleware("test", set, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		got = string(b)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, the injection after MaxBodySize should not be inspected", w.Code)
+	}
+	if got != body {
+		t.Errorf("upstream body = %q, want %q", got, body)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`' or 1=1-- and more`))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "rule sqli") {
+		t.Errorf("injection in the first bytes: %d %q", w.Code, w.Body.String())
+	}
+}
+
+// TestMiddlewareTags 客户端伪造的标签头被删掉，命中的标签转发给上游
+func TestMiddlewareTags(t *testing.T) {
+	e := NewEngine(mustParse(t, testRules))
+	var tags []string
+	h := e.Middleware("test", e.Sets["strict"], http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tags = r.Header.Values(TagsHeader)
+	}))
+	for path, want := range map[string]string{"/admin/users": "admin", "/public": ""} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set(TagsHeader, "trusted")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if strings.Join(tags, ",") != want {
+			t.Errorf("%s: upstream saw tags %q, want %q", path, tags, want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package waf HTTP请求检查：转发之前按规则检查请求的方法、路径、查询参数、请求头、Cookie和请求体
+//
+// 规则集写在一个JSON文件里，每条路由引用其中一个规则集。规则集有两种模式：
+//   - block：命中动作为block的规则立即拦截
+//   - score：异常评分模式，block规则只累加分数，总分达到阈值才拦截，误报的代价更小
+//
+// log和tag动作在两种模式下都一样：log只记录日志，tag给请求打上标签转发给上游
+package waf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// 规则集的模式
+const (
+	ModeBlock = "block"
+	ModeScore = "score"
+)
+
+// 规则的动作
+const (
+	ActionBlock = "block"
+	ActionLog   = "log"
+	ActionTag   = "tag"
+)
+
+// Rule 一条规则
+type Rule struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	//Targets 检查的位置：method、path、query、query:名字、headers、header:名字、cookies、cookie:名字、body
+	Targets []string `json:"targets"`
+	//Operator contains、equals、prefix、regex、sqli、xss
+	Operator string `json:"operator"`
+	//Value contains、prefix的字符串，equals的字符串（可以为空），regex的正则表达式，sqli和xss不需要
+	Value string `json:"value,omitempty"`
+	//Negate 为true时不匹配才算命中，比如“method不是GET或POST”
+	Negate bool `json:"negate,omitempty"`
+	//Transforms 匹配之前对值的转换，按顺序执行：lowercase、urldecode、htmldecode、trim、compress_whitespace
+	Transforms []string `json:"transforms,omitempty"`
+	//Action block（默认）、log、tag
+	Action string `json:"action,omitempty"`
+	//Score 异常评分模式下命中时累加的分数，默认5
+	Score int `json:"score,omitempty"`
+	//Tag tag动作的标签，默认是规则ID
+	Tag string `json:"tag,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// RuleSet 一组规则
+type RuleSet struct {
+	//Name 规则集的名字，加载时按rule_sets中的键设置
+	Name string `json:"-"`
+	//Mode block（默认）或score
+	Mode string `json:"mode,omitempty"`
+	//Threshold 异常评分模式下拦截的分数，默认5
+	Threshold int    `json:"threshold,omitempty"`
+	Rules     []Rule `json:"rules"`
+}
+
+// RulesFile 规则文件的内容
+type RulesFile struct {
+	RuleSets map[string]*RuleSet `json:"rule_sets"`
+}
+
+// LoadRules 读取并编译规则文件
+func LoadRules(path string) (map[string]*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return sets, nil
+}
+
+// ParseRules 解析并编译规则，写错的字段名、未知的操作符和动作都会报错
+func ParseRules(data []byte) (map[string]*RuleSet, error) {
+	var f RulesFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	if len(f.RuleSets) == 0 {
+		return nil, errors.New("no rule_sets")
+	}
+	//按名字排序，错误信息的顺序每次都一样
+	names := make([]string, 0, len(f.RuleSets))
+	for name := range f.RuleSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		set := f.RuleSets[name]
+		if set == nil {
+			errs = append(errs, fmt.Errorf("rule set %q is empty", name))
+			continue
+		}
+		set.Name = name
+		if err := set.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("rule set %q: %w", name, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return f.RuleSets, nil
+}
+
+func (s *RuleSet) compile() error {
+	var errs []error
+	switch s.Mode {
+	case "":
+		s.Mode = ModeBlock
+	case ModeBlock, ModeScore:
+	default:
+		errs = append(errs, fmt.Errorf("unknown mode %q", s.Mode))
+	}
+	if s.Threshold <= 0 {
+		s.Threshold = 5
+	}
+	ids := make(map[string]bool)
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		if r.ID == "" {
+			errs = append(errs, fmt.Errorf("rules[%d]: id is required", i))
+		} else if ids[r.ID] {
+			errs = append(errs, fmt.Errorf("rules[%d]: duplicate id %q", i, r.ID))
+		}
+		ids[r.ID] = true
+		if err := r.compile(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %q: %w", r.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Rule) compile() error {
+	if len(r.Targets) == 0 {
+		return errors.New("no targets")
+	}
+	for _, t := range r.Targets {
+		name, arg, _ := strings.Cut(t, ":")
+		switch name {
+		case "method", "path", "headers", "cookies", "body":
+			if arg != "" {
+				return fmt.Errorf("target %q does not take a name", t)
+			}
+		case "query":
+			//query检查所有参数，query:名字只检查一个参数
+		case "header", "cookie":
+			if arg == "" {
+				return fmt.Errorf("target %q needs a name, like %s:Name", t, name)
+			}
+		default:
+			return fmt.Errorf("unknown target %q", t)
+		}
+	}
+	switch r.Operator {
+	case "equals":
+	case "contains", "prefix":
+		if r.Value == "" {
+			return fmt.Errorf("operator %s needs a value", r.Operator)
+		}
+	case "regex":
+		re, err := regexp.Compile(r.Value)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	case "sqli", "xss":
+	default:
+		return fmt.Errorf("unknown operator %q", r.Operator)
+	}
+	for _, t := range r.Transforms {
+		if _, ok := transforms[t]; !ok {
+			return fmt.Errorf("unknown transform %q", t)
+		}
+	}
+	switch r.Action {
+	case "":
+		r.Action = ActionBlock
+	case ActionBlock, ActionLog, ActionTag:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Score <= 0 {
+		r.Score = 5
+	}
+	if r.Tag == "" {
+		r.Tag = r.ID
+	}
+	return nil
+}
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// transforms 匹配前的转换，攻击者常用编码绕过简单的字符串匹配
+var transforms = map[string]func(string) string{
+	"lowercase":           strings.ToLower,
+	"urldecode":           urlDecode,
+	"htmldecode":          html.UnescapeString,
+	"trim":                strings.TrimSpace,
+	"compress_whitespace": func(s string) string { return whitespace.ReplaceAllString(s, " ") },
+}
+
+// match 对一个值执行转换和操作符
+func (r *Rule) match(v string) bool {
+	for _, t := range r.Transforms {
+		v = transforms[t](v)
+	}
+	var hit bool
+	switch r.Operator {
+	case "contains":
+		hit = strings.Contains(v, r.Value)
+	case "equals":
+		hit = v == r.Value
+	case "prefix":
+		hit = strings.HasPrefix(v, r.Value)
+	case "regex":
+		hit = r.re.MatchString(v)
+	case "sqli":
+		hit = DetectSQLi(v)
+	case "xss":
+		hit = DetectXSS(v)
+	}
+	return hit != r.Negate
+}